@@ -0,0 +1,108 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anacrolix/tagflag"
+	"github.com/dustin/go-humanize"
+
+	"testTorrent/crawler"
+	"testTorrent/index"
+	"testTorrent/metafetch"
+	"testTorrent/webapi"
+)
+
+func init() {
+	subcommands["search"] = search
+	openIndexSink = func(path string) (crawler.Sink, webapi.Index, error) {
+		ix, err := index.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &indexSink{
+			Sink: ix.NewSink(index.SinkConfig{Fetcher: metafetch.New(nil)}),
+			ix:   ix,
+		}, ix, nil
+	}
+}
+
+// Closes the Index along with the Sink.
+type indexSink struct {
+	*index.Sink
+	ix *index.Index
+}
+
+func (me *indexSink) Close() error {
+	err := me.Sink.Close()
+	if err1 := me.ix.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+const dateLayout = "2006-01-02"
+
+func parseDate(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(dateLayout, s, time.Local)
+	if err != nil {
+		log.Fatalf("bad date %q, expected YYYY-MM-DD", s)
+	}
+	return t
+}
+
+func search(args []string) {
+	var sf = struct {
+		Index   string        `help:"index database to search"`
+		MinSize tagflag.Bytes `help:"minimum total size"`
+		MaxSize tagflag.Bytes `help:"maximum total size"`
+		Ext     []string      `help:"only torrents containing a file with this extension, may be repeated"`
+		After   string        `help:"only torrents seen on or after this date, as YYYY-MM-DD"`
+		Before  string        `help:"only torrents seen before this date, as YYYY-MM-DD"`
+		Limit   int           `help:"maximum results"`
+		Offset  int           `help:"results to skip"`
+		tagflag.StartPos
+		Terms []string `arity:"*" help:"words that must appear in the name or file paths"`
+	}{
+		Index: "index.db",
+		Limit: 50,
+	}
+	tagflag.ParseArgs(&sf, args, tagflag.Program("spider search"))
+	ix, err := index.Open(sf.Index)
+	if err != nil {
+		log.Fatalf("error opening index: %s", err)
+	}
+	defer ix.Close()
+	q := index.Query{
+		Terms:      sf.Terms,
+		MinLength:  sf.MinSize.Int64(),
+		MaxLength:  sf.MaxSize.Int64(),
+		Extensions: sf.Ext,
+		SeenAfter:  parseDate(sf.After),
+		Limit:      sf.Limit,
+		Offset:     sf.Offset,
+	}
+	if sf.Before != "" {
+		q.SeenBefore = parseDate(sf.Before).Add(-time.Second)
+	}
+	ts, err := ix.Search(q)
+	if err != nil {
+		log.Fatalf("error searching: %s", err)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, t := range ts {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n",
+			t.InfoHash.HexString(), humanize.Bytes(uint64(t.Length)), t.Peers,
+			t.LastSeen.Format(dateLayout), t.Name)
+	}
+	tw.Flush()
+}
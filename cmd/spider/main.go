@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	_ "github.com/anacrolix/envpprof"
+	"github.com/anacrolix/tagflag"
+
+	"testTorrent/crawler"
+	"testTorrent/dht"
+	"testTorrent/metrics"
+	"testTorrent/torrent/iplist"
+	"testTorrent/webapi"
+)
+
+var flags = struct {
+	Addr        []string `help:"local UDP address to run a DHT server on, may be repeated"`
+	Out         string   `help:"file to append infohash sightings to as JSON lines, - for stdout"`
+	HttpAddr    string   `help:"serve the web UI and API, crawler status at /debug/spider, and Prometheus metrics at /metrics, on this address"`
+	Index       string   `help:"index database to record sightings and resolved metadata in"`
+	Identities  int      `help:"node IDs to run on each address, spread over the keyspace"`
+	Spoof       bool     `help:"reply to queries with node IDs close to their targets"`
+	MaxIDsPerIP int      `help:"block IPs that use more node IDs than this in a minute, 0 to allow any"`
+	NoBootstrap bool
+	Scrape      time.Duration `help:"scrape announced infohashes for swarm sizes at most this often, 0 to disable"`
+	Blocklist   []string      `help:"blocklist files in P2P, CIDR or eMule DAT format, optionally gzipped, reloaded when they change"`
+}{
+	Out: "infohashes.jsonl",
+}
+
+// Subcommands, selected by the first argument. Those needing cgo are only registered when it's
+// available.
+var subcommands = map[string]func(args []string){}
+
+// Returns a sink that indexes sightings and resolves their metadata, and the index for the API. Set
+// when cgo is available.
+var openIndexSink func(path string) (crawler.Sink, webapi.Index, error)
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+	tagflag.Parse(&flags)
+	var sink crawler.Sink
+	if flags.Out == "-" {
+		sink = crawler.NewJSONSink(os.Stdout)
+	} else {
+		var err error
+		sink, err = crawler.OpenJSONFile(flags.Out)
+		if err != nil {
+			log.Fatalf("error opening output: %s", err)
+		}
+	}
+	sinks := []crawler.Sink{sink}
+	var ix webapi.Index
+	if flags.Index != "" {
+		if openIndexSink == nil {
+			log.Fatal("indexing requires spider to be built with cgo")
+		}
+		var err error
+		sink, ix, err = openIndexSink(flags.Index)
+		if err != nil {
+			log.Fatalf("error opening index: %s", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	var configureServer func(*dht.ServerConfig)
+	if len(flags.Blocklist) != 0 {
+		var sources []iplist.Source
+		for _, path := range flags.Blocklist {
+			sources = append(sources, iplist.Source{Path: path})
+		}
+		blocklist, err := iplist.OpenBlocklist(sources...)
+		if err != nil {
+			log.Fatalf("error loading blocklists: %s", err)
+		}
+		if err := blocklist.Watch(); err != nil {
+			log.Fatalf("error watching blocklists: %s", err)
+		}
+		defer blocklist.Close()
+		configureServer = func(sc *dht.ServerConfig) {
+			sc.IPBlocklist = blocklist
+		}
+	}
+	cr, err := crawler.New(&crawler.Config{
+		Addrs:           flags.Addr,
+		ConfigureServer: configureServer,
+		Sinks:           sinks,
+		Identities:      flags.Identities,
+		SpoofNeighbors:  flags.Spoof,
+		InboundLimits:   &dht.InboundLimits{MaxIDs: flags.MaxIDsPerIP},
+		NoBootstrap:     flags.NoBootstrap,
+		ScrapeInterval:  flags.Scrape,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, s := range cr.Servers() {
+		log.Printf("dht server on %s, ID is %x", s.Addr(), s.ID())
+	}
+	if flags.HttpAddr != "" {
+		http.HandleFunc("/debug/spider", func(w http.ResponseWriter, r *http.Request) {
+			cr.WriteStatus(w)
+		})
+		exporter := metrics.New(metrics.Expvar())
+		for _, s := range cr.Servers() {
+			exporter.Register(metrics.DHTServer(s))
+		}
+		http.Handle("/metrics", exporter)
+		http.Handle("/", webapi.New(webapi.Config{Crawler: cr, Index: ix}))
+		go func() {
+			log.Printf("error serving http: %s", http.ListenAndServe(flags.HttpAddr, nil))
+		}()
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	<-ch
+	if err := cr.Close(); err != nil {
+		log.Printf("error closing crawler: %s", err)
+	}
+	st := cr.Stats()
+	log.Printf("recorded %d sightings of %d infohashes (%d dropped)", st.Sightings, st.InfoHashes, st.Dropped)
+}
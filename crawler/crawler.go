@@ -0,0 +1,395 @@
+// Package crawler runs DHT servers that harvest infohashes from the get_peers and announce_peer
+// queries they receive, and passes each sighting on to pluggable sinks.
+package crawler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo"
+
+	"testTorrent/dht"
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/metainfo"
+)
+
+// Config for a Crawler. The zero value is usable.
+type Config struct {
+	// Local UDP addresses to run DHT servers on. One dht.Server is started per address. Defaults to a
+	// single server on ":0".
+	Addrs []string
+	// Receive every sighting, in the order they're processed. Sinks are never called concurrently.
+	Sinks []Sink
+	// Called with each server's config before it's created, to tune it beyond the crawler's
+	// defaults. The crawler's hooks are installed afterwards, and chain to any set here.
+	ConfigureServer func(*dht.ServerConfig)
+	// Node IDs to run on each address. More than one runs a dht.Sybil, with IDs spread over the
+	// keyspace so the crawler hears from more of the DHT. Defaults to 1.
+	Identities int
+	// Reply to queries with IDs close to their targets, see dht.ServerConfig.SpoofNeighbors.
+	SpoofNeighbors bool
+	// Limits on the queries each server handles, as crawlers draw a lot of traffic, some of it
+	// abusive. Defaults to the dht.InboundLimits defaults, which don't block IPs for using several
+	// node IDs.
+	InboundLimits *dht.InboundLimits
+	// Don't bootstrap the servers. Nodes must then be added by other means.
+	NoBootstrap bool
+	// How often each server is bootstrapped again, which keeps our nodes in remote routing tables.
+	// Defaults to 5 minutes.
+	BootstrapInterval time.Duration
+	// Maximum number of infohash records kept in memory. The least recently seen are evicted first.
+	// Defaults to 1<<20.
+	MaxRecords int
+	// Number of sightings buffered between the DHT servers and the sinks. Sightings arriving while
+	// the buffer is full are dropped. Defaults to 1024.
+	QueueSize int
+	// If non-zero, announced infohashes are scraped per BEP 33 to estimate their swarm sizes, and
+	// scraped again when announced this long after. Estimates are kept in Records, and passed to
+	// Sinks that implement ScrapeSink.
+	ScrapeInterval time.Duration
+	// Scrapes run at once. Scrapes that come due while QueueSize others are waiting are skipped.
+	// Defaults to 4.
+	MaxScrapes int
+	// Defaults to log.Default.
+	Logger log.Logger
+}
+
+// Stats returned by Crawler.Stats.
+type Stats struct {
+	// Sightings passed to sinks.
+	Sightings int64
+	// Sightings dropped because the sinks couldn't keep up.
+	Dropped int64
+	// Errors returned by sinks.
+	SinkErrors int64
+	// Scrapes skipped because too many were waiting.
+	ScrapesDropped int64
+	// Distinct infohashes currently held in memory.
+	InfoHashes int
+}
+
+// Crawler harvests infohashes from one or more DHT servers.
+type Crawler struct {
+	config    Config
+	servers   []*dht.Server
+	sybils    []*dht.Sybil
+	sightings chan Sighting
+	toScrape  chan metainfo.Hash
+	scrapes   chan ScrapeResult
+	// Picks the server for the next scrape.
+	nextScrapeServer uint32
+
+	mu      sync.Mutex
+	records recordTable
+
+	stats struct {
+		sightings      int64
+		dropped        int64
+		sinkErrors     int64
+		scrapesDropped int64
+	}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// New starts a DHT server for each configured address, and begins recording the infohashes they
+// see.
+func New(c *Config) (_ *Crawler, err error) {
+	if c == nil {
+		c = &Config{}
+	}
+	cr := &Crawler{
+		config: *c,
+		closed: make(chan struct{}),
+	}
+	cr.config.setDefaults()
+	cr.records = newRecordTable(cr.config.MaxRecords)
+	cr.sightings = make(chan Sighting, cr.config.QueueSize)
+	cr.toScrape = make(chan metainfo.Hash, cr.config.QueueSize)
+	cr.scrapes = make(chan ScrapeResult)
+	defer func() {
+		if err != nil {
+			cr.closeServers()
+		}
+	}()
+	for _, addr := range cr.config.Addrs {
+		err = cr.startServers(addr)
+		if err != nil {
+			return nil, fmt.Errorf("starting server on %q: %w", addr, err)
+		}
+	}
+	cr.wg.Add(1)
+	go cr.writeSightings()
+	if cr.config.ScrapeInterval != 0 {
+		for i := 0; i < cr.config.MaxScrapes; i++ {
+			cr.wg.Add(1)
+			go cr.scraper()
+		}
+	}
+	if !cr.config.NoBootstrap {
+		for _, s := range cr.servers {
+			cr.wg.Add(1)
+			go cr.bootstrapper(s)
+		}
+	}
+	return cr, nil
+}
+
+func (c *Config) setDefaults() {
+	if len(c.Addrs) == 0 {
+		c.Addrs = []string{":0"}
+	}
+	if c.BootstrapInterval == 0 {
+		c.BootstrapInterval = 5 * time.Minute
+	}
+	if c.MaxRecords == 0 {
+		c.MaxRecords = 1 << 20
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = 1024
+	}
+	if c.MaxScrapes == 0 {
+		c.MaxScrapes = 4
+	}
+	if c.InboundLimits == nil {
+		c.InboundLimits = &dht.InboundLimits{}
+	}
+	if c.Logger.LoggerImpl == nil {
+		c.Logger = log.Default
+	}
+}
+
+// Starts the configured number of identities on addr.
+func (cr *Crawler) startServers(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	sc := cr.serverConfig(conn)
+	if cr.config.Identities > 1 {
+		sy, err := dht.NewSybil(&dht.SybilConfig{
+			Conns:      []net.PacketConn{conn},
+			Identities: cr.config.Identities,
+			Server:     *sc,
+		})
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		cr.sybils = append(cr.sybils, sy)
+		cr.servers = append(cr.servers, sy.Servers()...)
+		return nil
+	}
+	s, err := dht.NewServer(sc)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	cr.servers = append(cr.servers, s)
+	return nil
+}
+
+// Returns the config for servers on conn, with the crawler's hooks installed.
+func (cr *Crawler) serverConfig(conn net.PacketConn) *dht.ServerConfig {
+	sc := &dht.ServerConfig{
+		Conn:           conn,
+		NoSecurity:     true,
+		StartingNodes:  func() ([]dht.Addr, error) { return dht.GlobalBootstrapAddrs("udp") },
+		Logger:         cr.config.Logger.FilterLevel(log.Info),
+		SpoofNeighbors: cr.config.SpoofNeighbors,
+		InboundLimits:  cr.config.InboundLimits,
+	}
+	if cr.config.ConfigureServer != nil {
+		cr.config.ConfigureServer(sc)
+	}
+	via := conn.LocalAddr().String()
+	onQuery := sc.OnQuery
+	sc.OnQuery = func(m *krpc.Msg, source net.Addr) bool {
+		// This is called with the server locked, so don't do anything slow.
+		// Queries missing the info_hash aren't sightings of anything.
+		if m.Q == "get_peers" && m.A != nil && m.A.InfoHash != (krpc.ID{}) {
+			cr.sighted(Sighting{
+				InfoHash: metainfo.Hash(m.A.InfoHash),
+				Query:    QueryGetPeers,
+				Source:   nodeInfo(m.A.ID, source),
+				Via:      via,
+			})
+		}
+		if onQuery != nil {
+			return onQuery(m, source)
+		}
+		return true
+	}
+	onAnnounce := sc.OnAnnouncePeerNode
+	sc.OnAnnouncePeerNode = func(ih metainfo.Hash, source krpc.NodeInfo, port int, portOk bool) {
+		cr.sighted(Sighting{
+			InfoHash: ih,
+			Query:    QueryAnnouncePeer,
+			Source:   source,
+			Port:     port,
+			PortOk:   portOk,
+			Via:      via,
+		})
+		if onAnnounce != nil {
+			onAnnounce(ih, source, port, portOk)
+		}
+	}
+	return sc
+}
+
+func nodeInfo(id krpc.ID, addr net.Addr) (ret krpc.NodeInfo) {
+	ret.ID = id
+	ret.Addr.IP = missinggo.AddrIP(addr)
+	ret.Addr.Port = missinggo.AddrPort(addr)
+	return
+}
+
+// Queues a sighting for the sinks without blocking.
+func (cr *Crawler) sighted(s Sighting) {
+	s.Time = time.Now()
+	select {
+	case cr.sightings <- s:
+	default:
+		atomic.AddInt64(&cr.stats.dropped, 1)
+	}
+}
+
+func (cr *Crawler) writeSightings() {
+	defer cr.wg.Done()
+	for {
+		select {
+		case s := <-cr.sightings:
+			cr.mu.Lock()
+			r := cr.records.update(s)
+			if s.Query == QueryAnnouncePeer {
+				cr.maybeScrape(s.InfoHash, s.Time)
+			}
+			cr.mu.Unlock()
+			s.FirstSeen = r.FirstSeen
+			s.Count = r.GetPeers + r.AnnouncePeer
+			atomic.AddInt64(&cr.stats.sightings, 1)
+			for _, sink := range cr.config.Sinks {
+				if err := sink.Write(s); err != nil {
+					atomic.AddInt64(&cr.stats.sinkErrors, 1)
+					cr.config.Logger.WithDefaultLevel(log.Warning).Printf("error writing sighting to %v: %v", sink, err)
+				}
+			}
+		case res := <-cr.scrapes:
+			cr.mu.Lock()
+			cr.records.setScrape(res)
+			cr.mu.Unlock()
+			for _, sink := range cr.config.Sinks {
+				ss, ok := sink.(ScrapeSink)
+				if !ok {
+					continue
+				}
+				if err := ss.WriteScrape(res); err != nil {
+					atomic.AddInt64(&cr.stats.sinkErrors, 1)
+					cr.config.Logger.WithDefaultLevel(log.Warning).Printf("error writing scrape to %v: %v", sink, err)
+				}
+			}
+		case <-cr.closed:
+			return
+		}
+	}
+}
+
+func (cr *Crawler) bootstrapper(s *dht.Server) {
+	defer cr.wg.Done()
+	for {
+		stats, err := s.Bootstrap()
+		if err != nil {
+			cr.config.Logger.WithDefaultLevel(log.Warning).Printf("error bootstrapping %v: %v", s, err)
+		} else {
+			cr.config.Logger.WithDefaultLevel(log.Debug).Printf("bootstrapped %v: %v", s, stats)
+		}
+		select {
+		case <-time.After(cr.config.BootstrapInterval):
+		case <-cr.closed:
+			return
+		}
+	}
+}
+
+// Servers returns the DHT servers run by the crawler.
+func (cr *Crawler) Servers() []*dht.Server {
+	return cr.servers
+}
+
+// Record returns what's known about an infohash, if it's been seen and not evicted.
+func (cr *Crawler) Record(ih metainfo.Hash) (Record, bool) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.records.get(ih)
+}
+
+// Recent returns up to n records, most recently seen first.
+func (cr *Crawler) Recent(n int) []Record {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.records.recent(n)
+}
+
+// Stats returns statistics for the crawler.
+func (cr *Crawler) Stats() Stats {
+	cr.mu.Lock()
+	infoHashes := cr.records.len()
+	cr.mu.Unlock()
+	return Stats{
+		Sightings:      atomic.LoadInt64(&cr.stats.sightings),
+		Dropped:        atomic.LoadInt64(&cr.stats.dropped),
+		SinkErrors:     atomic.LoadInt64(&cr.stats.sinkErrors),
+		InfoHashes:     infoHashes,
+		ScrapesDropped: atomic.LoadInt64(&cr.stats.scrapesDropped),
+	}
+}
+
+// WriteStatus writes a human-readable description of the crawler and its servers.
+func (cr *Crawler) WriteStatus(w io.Writer) {
+	st := cr.Stats()
+	fmt.Fprintf(w, "Infohashes in memory: %d\n", st.InfoHashes)
+	fmt.Fprintf(w, "Sightings: %d (%d dropped, %d sink errors)\n", st.Sightings, st.Dropped, st.SinkErrors)
+	if cr.config.ScrapeInterval != 0 {
+		fmt.Fprintf(w, "Scrapes dropped: %d\n", st.ScrapesDropped)
+	}
+	fmt.Fprintln(w)
+	for _, s := range cr.servers {
+		s.WriteStatus(w)
+	}
+}
+
+func (cr *Crawler) closeServers() {
+	for _, s := range cr.servers {
+		s.Close()
+	}
+	for _, sy := range cr.sybils {
+		sy.Close()
+	}
+}
+
+// Close stops the servers, and then closes the sinks. Sightings still queued are discarded.
+func (cr *Crawler) Close() error {
+	var errs []error
+	cr.closeOnce.Do(func() {
+		cr.closeServers()
+		close(cr.closed)
+		cr.wg.Wait()
+		for _, sink := range cr.config.Sinks {
+			if err := sink.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	})
+	if len(errs) != 0 {
+		return errors.New(fmt.Sprint(errs))
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package crawler
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht"
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+	peer_store "testTorrent/dht/peer-store"
+	"testTorrent/torrent/metainfo"
+)
+
+func TestCrawlerRecordsQueries(t *testing.T) {
+	sightings := make(chan Sighting, 2)
+	cr, err := New(&Config{
+		Addrs:       []string{"127.0.0.1:0"},
+		NoBootstrap: true,
+		Sinks: []Sink{FuncSink(func(s Sighting) error {
+			sightings <- s
+			return nil
+		})},
+	})
+	require.NoError(t, err)
+	defer cr.Close()
+	client, err := dht.NewServer(&dht.ServerConfig{
+		Conn:       mustListen(t),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	crawlerAddr := dht.NewAddr(cr.Servers()[0].Addr())
+	// Not a sighting of the zero infohash.
+	client.Query(context.Background(), crawlerAddr, "get_peers", dht.QueryInput{})
+	ih := metainfo.NewHashFromHex("64a980abe6e448226bb930ba061592e44c3781a1")
+	res := client.GetPeers(context.Background(), crawlerAddr, int160.FromByteArray(ih), false, dht.QueryRateLimiting{})
+	require.NoError(t, res.Err)
+	require.NotNil(t, res.Reply.R.Token)
+	port := 1337
+	res = client.Query(context.Background(), crawlerAddr, "announce_peer", dht.QueryInput{
+		MsgArgs: krpc.MsgArgs{
+			InfoHash: krpc.ID(ih),
+			Port:     &port,
+			Token:    *res.Reply.R.Token,
+		},
+	})
+	require.NoError(t, res.Err)
+
+	gp := nextSighting(t, sightings)
+	assert.EqualValues(t, ih, gp.InfoHash)
+	assert.EqualValues(t, QueryGetPeers, gp.Query)
+	assert.EqualValues(t, client.ID(), gp.Source.ID)
+	assert.EqualValues(t, 1, gp.Count)
+	ap := nextSighting(t, sightings)
+	assert.EqualValues(t, QueryAnnouncePeer, ap.Query)
+	assert.EqualValues(t, client.ID(), ap.Source.ID)
+	assert.True(t, ap.PortOk)
+	assert.EqualValues(t, port, ap.Port)
+	assert.EqualValues(t, 2, ap.Count)
+	assert.Equal(t, gp.FirstSeen, ap.FirstSeen)
+
+	r, ok := cr.Record(ih)
+	require.True(t, ok)
+	assert.EqualValues(t, 1, r.GetPeers)
+	assert.EqualValues(t, 1, r.AnnouncePeer)
+	assert.EqualValues(t, port, r.LastPort)
+	assert.EqualValues(t, 1, cr.Stats().InfoHashes)
+}
+
+func TestCrawlerSybil(t *testing.T) {
+	sightings := make(chan Sighting, 1)
+	cr, err := New(&Config{
+		Addrs:       []string{"127.0.0.1:0"},
+		Identities:  4,
+		NoBootstrap: true,
+		Sinks: []Sink{FuncSink(func(s Sighting) error {
+			sightings <- s
+			return nil
+		})},
+	})
+	require.NoError(t, err)
+	defer cr.Close()
+	require.Len(t, cr.Servers(), 4)
+	client, err := dht.NewServer(&dht.ServerConfig{
+		Conn:       mustListen(t),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	answering := cr.Servers()[3]
+	ih := metainfo.Hash(answering.ID())
+	res := client.GetPeers(context.Background(), dht.NewAddr(answering.Addr()), int160.FromByteArray(ih), false, dht.QueryRateLimiting{})
+	require.NoError(t, res.Err)
+	assert.EqualValues(t, answering.ID(), res.Reply.R.ID)
+	s := nextSighting(t, sightings)
+	assert.EqualValues(t, ih, s.InfoHash)
+	assert.Equal(t, answering.Addr().String(), s.Via)
+}
+
+type scrapeSink struct {
+	FuncSink
+	scrapes chan ScrapeResult
+}
+
+func (me scrapeSink) WriteScrape(res ScrapeResult) error {
+	me.scrapes <- res
+	return nil
+}
+
+func TestCrawlerScrapes(t *testing.T) {
+	sink := scrapeSink{
+		FuncSink: func(Sighting) error { return nil },
+		scrapes:  make(chan ScrapeResult, 1),
+	}
+	cr, err := New(&Config{
+		Addrs:          []string{"127.0.0.1:0"},
+		NoBootstrap:    true,
+		ScrapeInterval: time.Hour,
+		Sinks:          []Sink{sink},
+	})
+	require.NoError(t, err)
+	defer cr.Close()
+	// A Node storing a swarm of 3 seeds and 5 other peers, which announces to the crawler so that
+	// the crawler knows to scrape it.
+	ih := metainfo.NewHashFromHex("64a980abe6e448226bb930ba061592e44c3781a1")
+	ps := &peer_store.InMemory{}
+	for i := 0; i < 8; i++ {
+		ps.AnnouncePeer(ih, krpc.NodeAddr{IP: net.IPv4(1, 2, 3, byte(i)).To4(), Port: 1}, i < 3)
+	}
+	node, err := dht.NewServer(&dht.ServerConfig{
+		Conn:       mustListen(t),
+		NoSecurity: true,
+		PeerStore:  ps,
+	})
+	require.NoError(t, err)
+	defer node.Close()
+	crawlerAddr := dht.NewAddr(cr.Servers()[0].Addr())
+	res := node.GetPeers(context.Background(), crawlerAddr, int160.FromByteArray(ih), false, dht.QueryRateLimiting{})
+	require.NoError(t, res.Err)
+	port := 1337
+	res = node.Query(context.Background(), crawlerAddr, "announce_peer", dht.QueryInput{
+		MsgArgs: krpc.MsgArgs{
+			InfoHash: krpc.ID(ih),
+			Port:     &port,
+			Token:    *res.Reply.R.Token,
+		},
+	})
+	require.NoError(t, res.Err)
+
+	var sr ScrapeResult
+	select {
+	case sr = <-sink.scrapes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for scrape")
+	}
+	assert.EqualValues(t, ih, sr.InfoHash)
+	assert.EqualValues(t, 1, sr.Responses)
+	assert.EqualValues(t, 3, sr.Seeds)
+	assert.EqualValues(t, 5, sr.Peers)
+	r, ok := cr.Record(ih)
+	require.True(t, ok)
+	assert.EqualValues(t, 3, r.Seeds)
+	assert.EqualValues(t, 5, r.Peers)
+	assert.False(t, r.LastScrape.IsZero())
+}
+
+func TestRecordTableEviction(t *testing.T) {
+	rt := newRecordTable(2)
+	hashes := []metainfo.Hash{{1}, {2}, {3}}
+	now := time.Now()
+	rt.update(Sighting{InfoHash: hashes[0], Query: QueryGetPeers, Time: now})
+	rt.update(Sighting{InfoHash: hashes[1], Query: QueryGetPeers, Time: now})
+	// Touch the first, so that the second is the least recently seen.
+	rt.update(Sighting{InfoHash: hashes[0], Query: QueryGetPeers, Time: now.Add(time.Second)})
+	rt.update(Sighting{InfoHash: hashes[2], Query: QueryGetPeers, Time: now})
+	assert.Equal(t, 2, rt.len())
+	_, ok := rt.get(hashes[1])
+	assert.False(t, ok)
+	r, ok := rt.get(hashes[0])
+	require.True(t, ok)
+	assert.EqualValues(t, 2, r.GetPeers)
+	assert.Equal(t, now, r.FirstSeen)
+	assert.Equal(t, now.Add(time.Second), r.LastSeen)
+	recent := rt.recent(3)
+	require.Len(t, recent, 2)
+	assert.Equal(t, hashes[2], recent[0].InfoHash)
+	assert.Equal(t, hashes[0], recent[1].InfoHash)
+}
+
+func nextSighting(t *testing.T, c <-chan Sighting) Sighting {
+	select {
+	case s := <-c:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sighting")
+		panic("unreachable")
+	}
+}
+
+func mustListen(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return pc
+}
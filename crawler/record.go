@@ -0,0 +1,137 @@
+package crawler
+
+import (
+	"container/list"
+	"time"
+
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/metainfo"
+)
+
+// Query types that infohashes are harvested from.
+const (
+	QueryGetPeers     = "get_peers"
+	QueryAnnouncePeer = "announce_peer"
+)
+
+// A Sighting is a single query received by one of the crawler's servers that referred to an
+// infohash.
+type Sighting struct {
+	InfoHash metainfo.Hash
+	// One of QueryGetPeers or QueryAnnouncePeer.
+	Query string
+	// The Node that sent the query.
+	Source krpc.NodeInfo
+	// The torrent port announced by the source. Only set for announce_peer.
+	Port   int
+	PortOk bool
+	Time   time.Time
+	// Local address of the server that received the query.
+	Via string
+	// When the crawler first saw the infohash, and how many sightings it's had including this one.
+	// These are only as good as the crawler's memory, see Config.MaxRecords.
+	FirstSeen time.Time
+	Count     int64
+}
+
+// Record aggregates the sightings of an infohash.
+type Record struct {
+	InfoHash  metainfo.Hash
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Counts of each query type seen.
+	GetPeers     int64
+	AnnouncePeer int64
+	// The most recent Node to query for the infohash.
+	LastSource krpc.NodeInfo
+	// The most recent announced torrent port, or zero if none has been.
+	LastPort int
+	// When a scrape was last started, see Config.ScrapeInterval.
+	LastScrape time.Time
+	// The swarm size estimated by the latest scrape with any responses.
+	Seeds int64
+	Peers int64
+}
+
+// Infohash records, with least recently seen eviction.
+type recordTable struct {
+	max   int
+	index map[metainfo.Hash]*list.Element
+	// Most recently seen at the front.
+	order *list.List
+}
+
+func newRecordTable(max int) recordTable {
+	return recordTable{
+		max:   max,
+		index: make(map[metainfo.Hash]*list.Element),
+		order: list.New(),
+	}
+}
+
+func (me *recordTable) len() int {
+	return me.order.Len()
+}
+
+func (me *recordTable) get(ih metainfo.Hash) (Record, bool) {
+	r := me.lookup(ih)
+	if r == nil {
+		return Record{}, false
+	}
+	return *r, true
+}
+
+// Returns the record for ih without affecting eviction, or nil.
+func (me *recordTable) lookup(ih metainfo.Hash) *Record {
+	e, ok := me.index[ih]
+	if !ok {
+		return nil
+	}
+	return e.Value.(*Record)
+}
+
+// Stores the estimates in the infohash's record, if it's still held.
+func (me *recordTable) setScrape(res ScrapeResult) {
+	if r := me.lookup(res.InfoHash); r != nil {
+		r.Seeds = res.Seeds
+		r.Peers = res.Peers
+	}
+}
+
+func (me *recordTable) update(s Sighting) Record {
+	e, ok := me.index[s.InfoHash]
+	if ok {
+		me.order.MoveToFront(e)
+	} else {
+		e = me.order.PushFront(&Record{
+			InfoHash:  s.InfoHash,
+			FirstSeen: s.Time,
+		})
+		me.index[s.InfoHash] = e
+		for me.order.Len() > me.max {
+			last := me.order.Back()
+			delete(me.index, last.Value.(*Record).InfoHash)
+			me.order.Remove(last)
+		}
+	}
+	r := e.Value.(*Record)
+	r.LastSeen = s.Time
+	r.LastSource = s.Source
+	switch s.Query {
+	case QueryGetPeers:
+		r.GetPeers++
+	case QueryAnnouncePeer:
+		r.AnnouncePeer++
+		if s.PortOk {
+			r.LastPort = s.Port
+		}
+	}
+	return *r
+}
+
+func (me *recordTable) recent(n int) (ret []Record) {
+	for e := me.order.Front(); e != nil && len(ret) < n; e = e.Next() {
+		ret = append(ret, *e.Value.(*Record))
+	}
+	return
+}
@@ -0,0 +1,144 @@
+package crawler
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"testTorrent/dht"
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/metainfo"
+)
+
+var errCrawlerClosed = errors.New("crawler closed")
+
+// How long a scrape collects responses for before it's abandoned.
+const scrapeTimeout = time.Minute
+
+// A ScrapeResult estimates the swarm of an infohash, from a BEP 33 scrape of the Nodes that store
+// its peers.
+type ScrapeResult struct {
+	InfoHash metainfo.Hash
+	// Estimated numbers of seeds, and of peers that aren't seeds, from the union of the bloom
+	// filters returned.
+	Seeds int64
+	Peers int64
+	// Nodes that returned bloom filters.
+	Responses int
+	Time      time.Time
+}
+
+// Sinks that implement ScrapeSink also receive the results of scrapes. As with Write, WriteScrape
+// is never called concurrently with the Sink's other methods.
+type ScrapeSink interface {
+	Sink
+	WriteScrape(ScrapeResult) error
+}
+
+// Queues a scrape of the infohash, if it's due. Called with cr.mu held.
+func (cr *Crawler) maybeScrape(ih metainfo.Hash, now time.Time) {
+	if cr.config.ScrapeInterval == 0 {
+		return
+	}
+	r := cr.records.lookup(ih)
+	if r == nil {
+		return
+	}
+	if !r.LastScrape.IsZero() && now.Sub(r.LastScrape) < cr.config.ScrapeInterval {
+		return
+	}
+	select {
+	case cr.toScrape <- r.InfoHash:
+		r.LastScrape = now
+	default:
+		atomic.AddInt64(&cr.stats.scrapesDropped, 1)
+	}
+}
+
+func (cr *Crawler) scraper() {
+	defer cr.wg.Done()
+	for {
+		select {
+		case ih := <-cr.toScrape:
+			// Spread scrapes over the servers.
+			i := atomic.AddUint32(&cr.nextScrapeServer, 1)
+			res, err := cr.scrape(cr.servers[int(i)%len(cr.servers)], ih)
+			if err == errCrawlerClosed {
+				return
+			}
+			if err != nil {
+				cr.config.Logger.WithDefaultLevel(log.Warning).Printf("error scraping %v: %v", ih, err)
+				continue
+			}
+			if res.Responses == 0 {
+				cr.config.Logger.WithDefaultLevel(log.Debug).Printf("no scrape responses for %v", ih)
+				continue
+			}
+			select {
+			case cr.scrapes <- res:
+			case <-cr.closed:
+				return
+			}
+		case <-cr.closed:
+			return
+		}
+	}
+}
+
+// Traverses toward the infohash with BEP 33 scrape get_peers queries, and estimates the swarm size
+// from the responses.
+func (cr *Crawler) scrape(s *dht.Server, ih metainfo.Hash) (res ScrapeResult, err error) {
+	a, err := s.Announce(ih, 0, false, dht.Scrape())
+	if err != nil {
+		return
+	}
+	defer a.Close()
+	res.InfoHash = ih
+	var seeds, peers krpc.ScrapeBloomFilter
+	timer := time.NewTimer(scrapeTimeout)
+	defer timer.Stop()
+	timeout := timer.C
+	for {
+		select {
+		case pv, ok := <-a.Peers:
+			if !ok {
+				res.Seeds = estimateCount(&seeds)
+				res.Peers = estimateCount(&peers)
+				res.Time = time.Now()
+				return
+			}
+			if pv.BFsd == nil || pv.BFpe == nil {
+				continue
+			}
+			res.Responses++
+			unionBloomFilter(&seeds, pv.BFsd)
+			unionBloomFilter(&peers, pv.BFpe)
+		case <-timeout:
+			// Peers is closed once the traversal stops, and the responses so far are used.
+			a.Close()
+			timeout = nil
+		case <-cr.closed:
+			err = errCrawlerClosed
+			return
+		}
+	}
+}
+
+// BEP 33 has the filters of several Nodes combined before estimating, so that peers known to more
+// than one aren't counted twice.
+func unionBloomFilter(dst, src *krpc.ScrapeBloomFilter) {
+	for i := range dst {
+		dst[i] |= src[i]
+	}
+}
+
+func estimateCount(bf *krpc.ScrapeBloomFilter) int64 {
+	// EstimateCount doesn't quite reach zero for an empty filter.
+	if *bf == (krpc.ScrapeBloomFilter{}) {
+		return 0
+	}
+	return int64(math.Round(bf.EstimateCount()))
+}
@@ -0,0 +1,120 @@
+package crawler
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Sink receives the sightings made by a Crawler.
+type Sink interface {
+	Write(Sighting) error
+	// Called once when the Crawler is closed.
+	Close() error
+}
+
+// FuncSink adapts a function to a Sink. Close does nothing.
+type FuncSink func(Sighting) error
+
+func (f FuncSink) Write(s Sighting) error {
+	return f(s)
+}
+
+func (f FuncSink) Close() error {
+	return nil
+}
+
+// JSONSink writes sightings as JSON objects, one per line.
+type JSONSink struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	// Flush after this many sightings. Buffered sightings are always flushed on Close.
+	FlushEvery int
+	pending    int
+}
+
+var _ Sink = (*JSONSink)(nil)
+
+// NewJSONSink writes to w. If w is also an io.Closer, it's closed with the sink.
+func NewJSONSink(w io.Writer) *JSONSink {
+	ret := &JSONSink{
+		w:          bufio.NewWriter(w),
+		FlushEvery: 1,
+	}
+	if c, ok := w.(io.Closer); ok {
+		ret.closer = c
+	}
+	return ret
+}
+
+// OpenJSONFile appends sightings to the named file, creating it if necessary.
+func OpenJSONFile(name string) (*JSONSink, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, err
+	}
+	ret := NewJSONSink(f)
+	ret.FlushEvery = 64
+	return ret, nil
+}
+
+type jsonSighting struct {
+	InfoHash  string    `json:"infohash"`
+	Query     string    `json:"query"`
+	NodeId    string    `json:"node_id"`
+	NodeAddr  string    `json:"node_addr"`
+	Port      int       `json:"port,omitempty"`
+	Time      time.Time `json:"time"`
+	Via       string    `json:"via"`
+	FirstSeen time.Time `json:"first_seen"`
+	Count     int64     `json:"count"`
+}
+
+func (me *JSONSink) Write(s Sighting) error {
+	js := jsonSighting{
+		InfoHash:  s.InfoHash.HexString(),
+		Query:     s.Query,
+		NodeId:    hex.EncodeToString(s.Source.ID[:]),
+		NodeAddr:  s.Source.Addr.String(),
+		Time:      s.Time,
+		Via:       s.Via,
+		FirstSeen: s.FirstSeen,
+		Count:     s.Count,
+	}
+	if s.PortOk {
+		js.Port = s.Port
+	}
+	b, err := json.Marshal(js)
+	if err != nil {
+		return err
+	}
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	b = append(b, '\n')
+	if _, err := me.w.Write(b); err != nil {
+		return err
+	}
+	me.pending++
+	if me.pending >= me.FlushEvery {
+		me.pending = 0
+		return me.w.Flush()
+	}
+	return nil
+}
+
+func (me *JSONSink) Close() error {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	err := me.w.Flush()
+	if me.closer != nil {
+		if closeErr := me.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
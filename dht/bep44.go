@@ -0,0 +1,389 @@
+package dht
+
+// BEP 44, get and put.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/anacrolix/stm"
+	"github.com/anacrolix/stm/stmutil"
+
+	"testTorrent/dht/bep44"
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+)
+
+var ErrItemNotFound = errors.New("item not found")
+
+// Returns the target of a put query's item. The item isn't checked.
+func putTarget(a *krpc.MsgArgs) krpc.ID {
+	if len(a.K) == 0 {
+		return bep44.ImmutableTarget(a.V)
+	}
+	var k [32]byte
+	copy(k[:], a.K)
+	return bep44.MutableTarget(k, a.Salt)
+}
+
+// Returns the item in a put query, or the error to reply with.
+func itemFromPut(a *krpc.MsgArgs) (i bep44.Item, kerr *krpc.Error) {
+	i.V = a.V
+	if len(a.V) == 0 {
+		return i, &krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: "missing value"}
+	}
+	if len(a.K) != 0 {
+		if len(a.K) != len(i.K) {
+			return i, &krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: "invalid key"}
+		}
+		if a.Seq == nil {
+			return i, &krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: "missing sequence number"}
+		}
+		if len(a.Sig) != len(i.Sig) {
+			return i, &krpc.Error{Code: krpc.ErrorCodeInvalidSignature, Msg: bep44.ErrInvalidSignature.Error()}
+		}
+		copy(i.K[:], a.K)
+		copy(i.Sig[:], a.Sig)
+		i.Salt = a.Salt
+		i.Seq = *a.Seq
+	}
+	switch err := i.Check(); err {
+	case nil:
+	case bep44.ErrValueTooBig:
+		return i, &krpc.Error{Code: krpc.ErrorCodeMessageValueFieldTooBig, Msg: err.Error()}
+	case bep44.ErrSaltTooBig:
+		return i, &krpc.Error{Code: krpc.ErrorCodeSaltFieldTooBig, Msg: err.Error()}
+	case bep44.ErrInvalidSignature:
+		return i, &krpc.Error{Code: krpc.ErrorCodeInvalidSignature, Msg: err.Error()}
+	default:
+		return i, &krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: err.Error()}
+	}
+	return i, nil
+}
+
+// Returns why a mutable item can't replace the stored one, if it can't.
+func replaceItemError(stored, i bep44.Item, cas *int64) *krpc.Error {
+	if cas != nil && *cas != stored.Seq {
+		return &krpc.Error{Code: krpc.ErrorCodeCasHashMismatched, Msg: "cas mismatch"}
+	}
+	if i.Seq < stored.Seq || i.Seq == stored.Seq && !bytes.Equal(i.V, stored.V) {
+		return &krpc.Error{Code: krpc.ErrorCodeSequenceNumberLessThanCurrent, Msg: "sequence number less than current"}
+	}
+	return nil
+}
+
+// Called with the Server locked.
+func (s *Server) handleGet(source Addr, m krpc.Msg) {
+	var r krpc.Return
+	if err := s.setReturnNodes(&r, m, source); err != nil {
+		s.sendError(source, m.T, *err)
+		return
+	}
+	token := s.createToken(source)
+	r.Token = &token
+	if is := s.config.ItemStore; is != nil {
+		if i, ok := is.Get(m.A.Target); ok {
+			expvars.Add("get queries answered with an item", 1)
+			if i.Mutable() {
+				r.K = i.K[:]
+				r.Seq = &i.Seq
+			}
+			if !i.Mutable() || m.A.Seq == nil || i.Seq > *m.A.Seq {
+				r.V = i.V
+				if i.Mutable() {
+					r.Sig = i.Sig[:]
+				}
+			}
+		}
+	}
+	s.reply(source, m, r)
+}
+
+// Called with the Server locked.
+func (s *Server) handlePut(source Addr, m krpc.Msg) {
+	args := m.A
+	if args == nil {
+		s.sendError(source, m.T, krpcErrMissingArguments)
+		return
+	}
+	if !s.validToken(args.Token, source) {
+		expvars.Add("received put with invalid token", 1)
+		s.sendError(source, m.T, krpc.Error{Code: krpc.ErrorCodeProtocolError, Msg: "invalid token"})
+		return
+	}
+	is := s.config.ItemStore
+	if is == nil {
+		s.sendError(source, m.T, krpc.Error{Code: krpc.ErrorCodeGenericError, Msg: "not storing items"})
+		return
+	}
+	i, kerr := itemFromPut(args)
+	if kerr != nil {
+		expvars.Add("received invalid put", 1)
+		s.sendError(source, m.T, *kerr)
+		return
+	}
+	if stored, ok := is.Get(i.Target()); ok && i.Mutable() {
+		if kerr := replaceItemError(stored, i, args.Cas); kerr != nil {
+			s.sendError(source, m.T, *kerr)
+			return
+		}
+	}
+	if err := is.Put(i); err != nil {
+		s.sendError(source, m.T, krpc.Error{Code: krpc.ErrorCodeServerError, Msg: err.Error()})
+		return
+	}
+	expvars.Add("received put with valid token", 1)
+	s.reply(source, m, krpc.Return{})
+}
+
+// Sends a get query for target to addr. If seq isn't nil, the value is only wanted if the stored
+// sequence number is greater.
+func (s *Server) getItem(ctx context.Context, addr Addr, target int160.T, seq *int64, rl QueryRateLimiting) (ret QueryResult) {
+	ret = s.Query(ctx, addr, "get", QueryInput{
+		MsgArgs: krpc.MsgArgs{
+			Target: target.AsByteArray(),
+			Seq:    seq,
+			Want:   []krpc.Want{krpc.WantNodes, krpc.WantNodes6},
+		},
+		RateLimiting: rl,
+	})
+	s.mu.Lock()
+	s.addResponseNodes(ret.Reply)
+	s.mu.Unlock()
+	return
+}
+
+// Sends a put query for the item to addr, with a token from an earlier get. If cas isn't nil, the
+// put only succeeds if the stored item has that sequence number.
+func (s *Server) putItem(ctx context.Context, addr Addr, i bep44.Item, token string, cas *int64, rl QueryRateLimiting) (ret QueryResult) {
+	args := krpc.MsgArgs{
+		V:     i.V,
+		Token: token,
+	}
+	if i.Mutable() {
+		args.K = i.K[:]
+		args.Salt = i.Salt
+		args.Seq = &i.Seq
+		args.Sig = i.Sig[:]
+		args.Cas = cas
+	}
+	ret = s.Query(ctx, addr, "put", QueryInput{MsgArgs: args, RateLimiting: rl})
+	if ret.Err != nil {
+		return
+	}
+	if e := ret.Reply.Error(); e != nil {
+		ret.Err = *e
+	}
+	return
+}
+
+// A traversal with get queries toward an item's target. It keeps the item with the highest sequence
+// number found, and the closest nodes that gave a token to put to, like the peers to announce to in
+// an Announce.
+type itemTraversal struct {
+	server    *Server
+	target    int160.T
+	salt      []byte
+	seq       *int64
+	traversal traversal
+	// The closest nodes that gave us a token.
+	closest *stm.Var
+	// The best item found. Set to a *bep44.Item.
+	item *stm.Var
+}
+
+func (s *Server) newItemTraversal(target krpc.ID, salt []byte, seq *int64) (*itemTraversal, error) {
+	t := int160.FromByteArray(target)
+	traversal, err := s.newTraversal(t)
+	if err != nil {
+		return nil, err
+	}
+	it := &itemTraversal{
+		server:    s,
+		target:    t,
+		salt:      salt,
+		seq:       seq,
+		traversal: traversal,
+		closest:   stm.NewVar(newPendingAnnouncePeers(t)),
+		item:      stm.NewVar((*bep44.Item)(nil)),
+	}
+	it.traversal.query = it.get
+	it.traversal.stopTraversal = it.stopTraversal
+	return it, nil
+}
+
+func (it *itemTraversal) run(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	it.traversal.doneVar, _ = stmutil.ContextDoneVar(ctx)
+	it.traversal.run()
+}
+
+func (it *itemTraversal) stats() TraversalStats {
+	return TraversalStats{
+		NumAddrsTried: atomic.LoadInt64(&it.traversal.stats.NumAddrsTried),
+		NumResponses:  atomic.LoadInt64(&it.traversal.stats.NumResponses),
+	}
+}
+
+func (it *itemTraversal) get(addr Addr) QueryResult {
+	res := it.server.getItem(context.TODO(), addr, it.target, it.seq, QueryRateLimiting{
+		// This is paid for in earlier in a call to Server.beginQuery.
+		NotFirst: true,
+	})
+	r := res.Reply.R
+	if r == nil {
+		return res
+	}
+	if i, ok := it.returnItem(r); ok {
+		stm.AtomicModify(it.item, func(best *bep44.Item) *bep44.Item {
+			if best == nil || i.Seq > best.Seq {
+				return &i
+			}
+			return best
+		})
+	}
+	if r.Token == nil {
+		return res
+	}
+	if !it.server.config.NoSecurity && !NodeIdSecure(r.ID, addr.IP()) {
+		return res
+	}
+	id := int160.FromByteArray(r.ID)
+	x := pendingAnnouncePeer{token: *r.Token}
+	x.Addr = addr.KRPC()
+	x.Id = &id
+	stm.AtomicModify(it.closest, func(v pendingAnnouncePeers) pendingAnnouncePeers {
+		return v.Push(x)
+	})
+	return res
+}
+
+// Returns the item in a get response, if there's one that belongs at the target.
+func (it *itemTraversal) returnItem(r *krpc.Return) (i bep44.Item, ok bool) {
+	if len(r.V) == 0 {
+		return
+	}
+	i.V = r.V
+	if len(r.K) != 0 {
+		if len(r.K) != len(i.K) || len(r.Sig) != len(i.Sig) || r.Seq == nil {
+			return
+		}
+		copy(i.K[:], r.K)
+		copy(i.Sig[:], r.Sig)
+		i.Salt = it.salt
+		i.Seq = *r.Seq
+	}
+	if i.Target() != it.target.AsByteArray() || i.Check() != nil {
+		expvars.Add("get responses with invalid item", 1)
+		return
+	}
+	return i, true
+}
+
+// Immutable items can't get any better once found. Otherwise we stop once we've heard from the
+// closest nodes.
+func (it *itemTraversal) stopTraversal(tx *stm.Tx, next addrMaybeId) bool {
+	if i := tx.Get(it.item).(*bep44.Item); i != nil && !i.Mutable() {
+		return true
+	}
+	pending := tx.Get(it.closest).(pendingAnnouncePeers)
+	if pending.Len() < pending.k {
+		return false
+	}
+	farthest, ok := pending.Farthest()
+	return ok && farthest.closerThan(next, it.target)
+}
+
+// GetResult is returned by Server.Get.
+type GetResult struct {
+	Item bep44.Item
+	TraversalStats
+}
+
+// Get traverses the DHT toward target with get queries, and returns the item stored there. For a
+// mutable item, salt must be what it was put with, and the one with the highest sequence number
+// found is returned. If seq isn't nil, only a newer item is wanted. Returns ErrItemNotFound if
+// there's no valid item.
+func (s *Server) Get(ctx context.Context, target krpc.ID, salt []byte, seq *int64) (ret GetResult, err error) {
+	it, err := s.newItemTraversal(target, salt, seq)
+	if err != nil {
+		return
+	}
+	it.traversal.reason = "dht get"
+	it.run(ctx)
+	ret.TraversalStats = it.stats()
+	i := stm.AtomicGet(it.item).(*bep44.Item)
+	if i == nil {
+		err = ctx.Err()
+		if err == nil {
+			err = ErrItemNotFound
+		}
+		return
+	}
+	ret.Item = *i
+	return
+}
+
+// PutResult is returned by Server.Put.
+type PutResult struct {
+	// Nodes that stored the item.
+	Stored []krpc.NodeAddr
+	// Why the other closest nodes didn't, such as a stale sequence number.
+	Errors []error
+	TraversalStats
+}
+
+// Put traverses the DHT toward the item's target with get queries, and puts the item to the
+// closest nodes, like Announce does with announce_peer. If cas isn't nil, mutable items are only
+// replaced where the stored sequence number matches it. Returns an error if no node stored the
+// item.
+func (s *Server) Put(ctx context.Context, i bep44.Item, cas *int64) (ret PutResult, err error) {
+	if err = i.Check(); err != nil {
+		return
+	}
+	it, err := s.newItemTraversal(i.Target(), i.Salt, nil)
+	if err != nil {
+		return
+	}
+	it.traversal.reason = "dht put get"
+	it.run(ctx)
+	ret.TraversalStats = it.stats()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	closest := stm.AtomicGet(it.closest).(pendingAnnouncePeers)
+	closest.Range(func(x interface{}) {
+		p := x.(pendingAnnouncePeer)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := s.putItem(ctx, NewAddr(p.Addr.UDP()), i, p.token, cas, QueryRateLimiting{})
+			mu.Lock()
+			defer mu.Unlock()
+			if res.Err != nil {
+				ret.Errors = append(ret.Errors, fmt.Errorf("putting to %v: %w", p.Addr, res.Err))
+				return
+			}
+			ret.Stored = append(ret.Stored, p.Addr)
+		}()
+	})
+	wg.Wait()
+	if len(ret.Stored) != 0 {
+		return
+	}
+	if len(ret.Errors) != 0 {
+		err = ret.Errors[0]
+	} else {
+		err = errors.New("no nodes to put to")
+	}
+	return
+}
@@ -0,0 +1,120 @@
+// Package bep44 implements the items of BEP 44, arbitrary data stored in the DHT, and a store for
+// the items a Server is given.
+package bep44
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/bencode"
+)
+
+const (
+	// The longest bencoded value an item can have.
+	MaxValueLen = 1000
+	// The longest salt a mutable item can have.
+	MaxSaltLen = 64
+)
+
+var (
+	ErrValueTooBig      = errors.New("value too big")
+	ErrSaltTooBig       = errors.New("salt too big")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// Item is a value stored in the DHT. Immutable items are found by the hash of their value. Mutable
+// items are found by the hash of their public key and salt, and carry a sequence number and a
+// signature by the key, so only the key's owner can update them.
+type Item struct {
+	// The bencoded value.
+	V []byte
+	// The rest are only set for mutable items.
+	K    [32]byte
+	Salt []byte
+	Seq  int64
+	Sig  [64]byte
+}
+
+// NewImmutable returns an item with the bencoding of v.
+func NewImmutable(v interface{}) (i Item, err error) {
+	i.V, err = bencode.Marshal(v)
+	if err != nil {
+		return
+	}
+	err = i.Check()
+	return
+}
+
+// NewMutable returns an item with the bencoding of v, signed by key.
+func NewMutable(v interface{}, seq int64, salt []byte, key ed25519.PrivateKey) (i Item, err error) {
+	i.V, err = bencode.Marshal(v)
+	if err != nil {
+		return
+	}
+	copy(i.K[:], key.Public().(ed25519.PublicKey))
+	i.Salt = salt
+	i.Seq = seq
+	i.Sign(key)
+	err = i.Check()
+	return
+}
+
+// Mutable returns whether the item has a public key.
+func (i *Item) Mutable() bool {
+	return i.K != [32]byte{}
+}
+
+// Target returns the ID the item is stored under.
+func (i *Item) Target() krpc.ID {
+	if i.Mutable() {
+		return MutableTarget(i.K, i.Salt)
+	}
+	return ImmutableTarget(i.V)
+}
+
+// Sign sets the signature of a mutable item, after its value or sequence number changes.
+func (i *Item) Sign(key ed25519.PrivateKey) {
+	copy(i.Sig[:], ed25519.Sign(key, signedBytes(i.Salt, i.V, i.Seq)))
+}
+
+// Check returns an error if the item is too big, or a mutable item's signature doesn't match.
+func (i *Item) Check() error {
+	if len(i.V) > MaxValueLen {
+		return ErrValueTooBig
+	}
+	if !i.Mutable() {
+		return nil
+	}
+	if len(i.Salt) > MaxSaltLen {
+		return ErrSaltTooBig
+	}
+	if !ed25519.Verify(i.K[:], signedBytes(i.Salt, i.V, i.Seq), i.Sig[:]) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// The target of an immutable item is the SHA-1 of its bencoded value.
+func ImmutableTarget(v []byte) krpc.ID {
+	return sha1.Sum(v)
+}
+
+// The target of a mutable item is the SHA-1 of its public key and salt.
+func MutableTarget(k [32]byte, salt []byte) krpc.ID {
+	return sha1.Sum(append(k[:], salt...))
+}
+
+// What's signed for a mutable item: the bencoded dict it would be without the braces, and
+// without the salt if it's empty.
+func signedBytes(salt, v []byte, seq int64) []byte {
+	var b []byte
+	if len(salt) != 0 {
+		b = append(b, fmt.Sprintf("4:salt%d:", len(salt))...)
+		b = append(b, salt...)
+	}
+	b = append(b, fmt.Sprintf("3:seqi%de1:v", seq)...)
+	return append(b, v...)
+}
@@ -0,0 +1,76 @@
+package bep44
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"testTorrent/dht/krpc"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// The test vectors from BEP 44.
+func TestVectors(t *testing.T) {
+	c := qt.New(t)
+	i := Item{V: []byte("12:Hello World!")}
+	c.Check(i.Target().String(), qt.Equals, "e5f96f6f38320f0f33959cb4d3d656452117aadb")
+	c.Check(i.Check(), qt.IsNil)
+
+	i.Seq = 1
+	copy(i.K[:], mustHex("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548"))
+	copy(i.Sig[:], mustHex("305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01"))
+	c.Check(i.Target().String(), qt.Equals, "4a533d47ec9c7d95b1ad75f576cffc641853b750")
+	c.Check(i.Check(), qt.IsNil)
+
+	i.Salt = []byte("foobar")
+	copy(i.Sig[:], mustHex("6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17ddf9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08"))
+	c.Check(i.Target().String(), qt.Equals, "411eba73b6f087ca51a3795d9c8c938d365e32c1")
+	c.Check(i.Check(), qt.IsNil)
+	i.Seq = 2
+	c.Check(i.Check(), qt.Equals, ErrInvalidSignature)
+}
+
+func TestNewMutable(t *testing.T) {
+	c := qt.New(t)
+	_, key, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.IsNil)
+	i, err := NewMutable(map[string]int{"a": 1}, 3, []byte("salt"), key)
+	c.Assert(err, qt.IsNil)
+	c.Check(i.Mutable(), qt.IsTrue)
+	c.Check(string(i.V), qt.Equals, "d1:ai1ee")
+	_, err = NewMutable(make([]byte, MaxValueLen), 1, nil, key)
+	c.Check(err, qt.Equals, ErrValueTooBig)
+	_, err = NewMutable(1, 1, make([]byte, MaxSaltLen+1), key)
+	c.Check(err, qt.Equals, ErrSaltTooBig)
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	c := qt.New(t)
+	m := Memory{Expiry: time.Millisecond, MaxItems: 1}
+	i, err := NewImmutable("a")
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Put(i), qt.IsNil)
+	got, ok := m.Get(i.Target())
+	c.Check(ok, qt.IsTrue)
+	c.Check(got.V, qt.DeepEquals, i.V)
+	j, err := NewImmutable("b")
+	c.Assert(err, qt.IsNil)
+	c.Check(m.Put(j), qt.Equals, ErrStoreFull)
+	time.Sleep(2 * time.Millisecond)
+	_, ok = m.Get(i.Target())
+	c.Check(ok, qt.IsFalse)
+	c.Check(m.Put(j), qt.IsNil)
+	c.Check(m.Len(), qt.Equals, 1)
+	_, ok = m.Get(krpc.ID{})
+	c.Check(ok, qt.IsFalse)
+}
@@ -0,0 +1,94 @@
+package bep44
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"testTorrent/dht/krpc"
+)
+
+// How long items are kept by default. BEP 44 suggests at least 2 hours, and putters are expected
+// to put their items again before then.
+const DefaultExpiry = 2 * time.Hour
+
+var ErrStoreFull = errors.New("store full")
+
+// Store holds the items put to a Server. Items are checked before they're stored.
+type Store interface {
+	Get(target krpc.ID) (Item, bool)
+	// Put adds or replaces the item under its target.
+	Put(Item) error
+}
+
+// Memory is a Store that forgets items that haven't been put again within the Expiry.
+type Memory struct {
+	// Defaults to DefaultExpiry.
+	Expiry time.Duration
+	// If non-zero, puts of new items fail with ErrStoreFull while this many are stored.
+	MaxItems int
+
+	mu       sync.Mutex
+	items    map[krpc.ID]memoryItem
+	pruneLen int
+}
+
+type memoryItem struct {
+	Item
+	put time.Time
+}
+
+var _ Store = (*Memory)(nil)
+
+func (me *Memory) expiry() time.Duration {
+	if me.Expiry > 0 {
+		return me.Expiry
+	}
+	return DefaultExpiry
+}
+
+func (me *Memory) Get(target krpc.ID) (Item, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	mi, ok := me.items[target]
+	if !ok || time.Since(mi.put) >= me.expiry() {
+		return Item{}, false
+	}
+	return mi.Item, true
+}
+
+func (me *Memory) Put(i Item) error {
+	target := i.Target()
+	now := time.Now()
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.items == nil {
+		me.items = make(map[krpc.ID]memoryItem)
+	}
+	if _, ok := me.items[target]; !ok {
+		if len(me.items) >= me.pruneLen || me.MaxItems > 0 && len(me.items) >= me.MaxItems {
+			me.prune(now)
+		}
+		if me.MaxItems > 0 && len(me.items) >= me.MaxItems {
+			return ErrStoreFull
+		}
+	}
+	me.items[target] = memoryItem{i, now}
+	return nil
+}
+
+func (me *Memory) prune(now time.Time) {
+	for k, v := range me.items {
+		if now.Sub(v.put) >= me.expiry() {
+			delete(me.items, k)
+		}
+	}
+	me.pruneLen = 2*len(me.items) + 1024
+}
+
+// Len returns the number of items stored, including any that have expired but not been dropped.
+func (me *Memory) Len() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	return len(me.items)
+}
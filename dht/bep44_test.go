@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/stm/rate"
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/bep44"
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/bencode"
+)
+
+func errorCode(err error) int {
+	var e krpc.Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return 0
+}
+
+func TestGetPut(t *testing.T) {
+	c := qt.New(t)
+	var store bep44.Memory
+	storing, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+		ItemStore:  &store,
+	})
+	require.NoError(t, err)
+	defer storing.Close()
+	addr := NewAddr(storing.Addr())
+	client, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+		StartingNodes: func() ([]Addr, error) {
+			return []Addr{addr}, nil
+		},
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	// The shared default limiter drops replies once the many queries here exhaust it.
+	storing.sendLimit = rate.NewLimiter(rate.Inf, 0)
+	client.sendLimit = rate.NewLimiter(rate.Inf, 0)
+	ctx := context.Background()
+
+	imm, err := bep44.NewImmutable("crawl summary")
+	c.Assert(err, qt.IsNil)
+	res, err := client.Put(ctx, imm, nil)
+	c.Assert(err, qt.IsNil)
+	c.Check(res.Stored, qt.HasLen, 1)
+	got, err := client.Get(ctx, imm.Target(), nil, nil)
+	c.Assert(err, qt.IsNil)
+	c.Check(got.Item, qt.DeepEquals, imm)
+
+	_, key, err := ed25519.GenerateKey(nil)
+	c.Assert(err, qt.IsNil)
+	salt := []byte("feed")
+	mut, err := bep44.NewMutable("first", 1, salt, key)
+	c.Assert(err, qt.IsNil)
+	_, err = client.Put(ctx, mut, nil)
+	c.Assert(err, qt.IsNil)
+	mut2, err := bep44.NewMutable("second", 2, salt, key)
+	c.Assert(err, qt.IsNil)
+	cas := int64(2)
+	_, err = client.Put(ctx, mut2, &cas)
+	c.Check(errorCode(err), qt.Equals, krpc.ErrorCodeCasHashMismatched)
+	cas = 1
+	_, err = client.Put(ctx, mut2, &cas)
+	c.Assert(err, qt.IsNil)
+	_, err = client.Put(ctx, mut, nil)
+	c.Check(errorCode(err), qt.Equals, krpc.ErrorCodeSequenceNumberLessThanCurrent)
+	got, err = client.Get(ctx, mut.Target(), salt, nil)
+	c.Assert(err, qt.IsNil)
+	c.Check(got.Item, qt.DeepEquals, mut2)
+	// Nothing newer than what we have.
+	seq := int64(2)
+	_, err = client.Get(ctx, mut.Target(), salt, &seq)
+	c.Check(err, qt.Equals, ErrItemNotFound)
+	// The wrong salt doesn't verify.
+	_, err = client.Get(ctx, mut.Target(), nil, nil)
+	c.Check(err, qt.Equals, ErrItemNotFound)
+	_, err = client.Get(ctx, krpc.ID{1}, nil, nil)
+	c.Check(err, qt.Equals, ErrItemNotFound)
+
+	// Items that don't check out are refused.
+	gr := client.getItem(ctx, addr, int160.FromByteArray(mut.Target()), nil, QueryRateLimiting{})
+	c.Assert(gr.Err, qt.IsNil)
+	token := *gr.Reply.R.Token
+	bad := mut2
+	bad.Seq = 3
+	pr := client.putItem(ctx, addr, bad, token, nil, QueryRateLimiting{})
+	c.Check(errorCode(pr.Err), qt.Equals, krpc.ErrorCodeInvalidSignature)
+	pr = client.putItem(ctx, addr, mut2, "bad token", nil, QueryRateLimiting{})
+	c.Check(errorCode(pr.Err), qt.Equals, krpc.ErrorCodeProtocolError)
+	big, err := bencode.Marshal(strings.Repeat("a", bep44.MaxValueLen))
+	c.Assert(err, qt.IsNil)
+	pr = client.Query(ctx, addr, "put", QueryInput{MsgArgs: krpc.MsgArgs{V: big, Token: token}})
+	c.Assert(pr.Err, qt.IsNil)
+	c.Check(pr.Reply.E.Code, qt.Equals, krpc.ErrorCodeMessageValueFieldTooBig)
+	c.Check(store.Len(), qt.Equals, 2)
+}
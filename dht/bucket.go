@@ -1,9 +1,19 @@
 package dht
 
-import "testTorrent/dht/int160"
+import (
+	"time"
+
+	"testTorrent/dht/int160"
+)
 
 type bucket struct {
 	nodes map[*Node]struct{}
+	// Nodes seen while the bucket was full, least recently seen first. They take the place of Nodes
+	// that go bad.
+	replacements []*Node
+	// When a Node was added to or dropped from the bucket, or responded to us. Buckets that don't
+	// change for a while are refreshed, per BEP 5.
+	lastChanged time.Time
 }
 
 func (b *bucket) Len() int {
@@ -37,3 +47,56 @@ func (b *bucket) GetNode(addr Addr, id int160.T) *Node {
 	}
 	return nil
 }
+
+// The Node with the least recent lastSeen that passes filter.
+func (b *bucket) leastRecentlySeen(filter func(*Node) bool) (ret *Node) {
+	for n := range b.nodes {
+		if filter(n) && (ret == nil || n.lastSeen().Before(ret.lastSeen())) {
+			ret = n
+		}
+	}
+	return
+}
+
+func (b *bucket) getReplacement(addr Addr, id int160.T) *Node {
+	for _, n := range b.replacements {
+		if n.hasAddrAndID(addr, id) {
+			return n
+		}
+	}
+	return nil
+}
+
+func (b *bucket) removeReplacement(addr Addr, id int160.T) {
+	for i, n := range b.replacements {
+		if n.hasAddrAndID(addr, id) {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			return
+		}
+	}
+}
+
+// Moves the Node to the most recently seen end of the replacements, dropping the least recently
+// seen if there are more than k.
+func (b *bucket) addReplacement(n *Node, k int) {
+	b.removeReplacement(n.Addr, n.Id)
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > k {
+		b.replacements = append(b.replacements[:0], b.replacements[len(b.replacements)-k:]...)
+	}
+}
+
+// Removes and returns the most recently seen replacement that passes filter. Replacements that
+// don't pass are discarded.
+func (b *bucket) popReplacement(filter func(*Node) bool) *Node {
+	for len(b.replacements) != 0 {
+		last := len(b.replacements) - 1
+		n := b.replacements[last]
+		b.replacements[last] = nil
+		b.replacements = b.replacements[:last]
+		if filter(n) {
+			return n
+		}
+	}
+	return nil
+}
@@ -12,12 +12,16 @@ import (
 	"github.com/anacrolix/tagflag"
 
 	"testTorrent/dht"
+	node_store "testTorrent/dht/node-store"
+	"testTorrent/webapi"
 )
 
 var (
 	flags = struct {
 		TableFile   string `help:"name of file for storing node info"`
+		NodeDb      string `help:"bolt database recording every node interacted with"`
 		Addr        string `help:"local UDP address"`
+		HttpAddr    string `help:"serve the web UI and API, and the default mux with server status at /debug/dht, on this address"`
 		NoBootstrap bool
 	}{
 		Addr: ":0",
@@ -43,16 +47,31 @@ func main() {
 		log.Fatal(err)
 	}
 	defer conn.Close()
-	s, err = dht.NewServer(&dht.ServerConfig{
+	cfg := dht.ServerConfig{
 		Conn:          conn,
 		StartingNodes: func() ([]dht.Addr, error) { return dht.GlobalBootstrapAddrs("udp") },
-	})
+	}
+	if flags.NodeDb != "" {
+		ns, err := node_store.OpenBolt(flags.NodeDb)
+		if err != nil {
+			log.Fatalf("error opening node db: %s", err)
+		}
+		defer ns.Close()
+		cfg.NodeStore = ns
+	}
+	s, err = dht.NewServer(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	http.HandleFunc("/debug/dht", func(w http.ResponseWriter, r *http.Request) {
 		s.WriteStatus(w)
 	})
+	if flags.HttpAddr != "" {
+		http.Handle("/", webapi.New(webapi.Config{Servers: []*dht.Server{s}}))
+		go func() {
+			log.Printf("error serving http: %s", http.ListenAndServe(flags.HttpAddr, nil))
+		}()
+	}
 	if flags.TableFile != "" {
 		err = loadTable()
 		if err != nil {
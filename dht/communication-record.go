@@ -0,0 +1,476 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"testTorrent/dht/krpc"
+)
+
+// HourCounts are the interactions with a Node within one hour. Counts saturate rather than wrap.
+type HourCounts struct {
+	// Queries we sent to the Node.
+	Sent uint16
+	// Responses the Node sent to our queries.
+	Replies uint16
+	// Queries the Node sent to us.
+	Received uint16
+}
+
+const hourCountsLen = 6
+
+func (me HourCounts) IsZero() bool {
+	return me == HourCounts{}
+}
+
+func saturatingAdd(a, b uint16) uint16 {
+	if a > math.MaxUint16-b {
+		return math.MaxUint16
+	}
+	return a + b
+}
+
+func (me HourCounts) add(other HourCounts) HourCounts {
+	return HourCounts{
+		Sent:     saturatingAdd(me.Sent, other.Sent),
+		Replies:  saturatingAdd(me.Replies, other.Replies),
+		Received: saturatingAdd(me.Received, other.Received),
+	}
+}
+
+// Consecutive hours with identical counts.
+type communicationRun struct {
+	start int64 // Hours since the Unix epoch.
+	hours int64
+	HourCounts
+}
+
+func (r communicationRun) end() int64 {
+	return r.start + r.hours
+}
+
+// CommunicationRecord counts our interactions with a Node, bucketed by the hour. Each hour holds
+// the number of queries we sent, the replies we got to them, and the queries the Node sent us.
+// Consecutive hours with identical counts, including idle hours, are run-length compressed, so
+// long-lived Nodes cost little more than drive-by ones. The zero value is an empty record.
+type CommunicationRecord struct {
+	// Contiguous, ordered, and with no two adjacent runs having the same counts.
+	runs []communicationRun
+}
+
+// HourlyCounts are the counts for the hour beginning at Hour.
+type HourlyCounts struct {
+	Hour time.Time
+	HourCounts
+}
+
+func unixHour(t time.Time) int64 {
+	return t.Unix() / 3600
+}
+
+func hourTime(h int64) time.Time {
+	return time.Unix(h*3600, 0)
+}
+
+func (cr *CommunicationRecord) addSent(t time.Time) {
+	cr.add(unixHour(t), HourCounts{Sent: 1})
+}
+
+func (cr *CommunicationRecord) addReply(t time.Time) {
+	cr.add(unixHour(t), HourCounts{Replies: 1})
+}
+
+func (cr *CommunicationRecord) addReceived(t time.Time) {
+	cr.add(unixHour(t), HourCounts{Received: 1})
+}
+
+// Adds delta to the given hour, extending the record as necessary.
+func (cr *CommunicationRecord) add(hour int64, delta HourCounts) {
+	n := len(cr.runs)
+	if n == 0 {
+		cr.runs = append(cr.runs, communicationRun{start: hour, hours: 1, HourCounts: delta})
+		return
+	}
+	// The common cases are the current hour, or a new one.
+	last := &cr.runs[n-1]
+	switch {
+	case hour >= last.end():
+		// Fill any idle hours since the last interaction.
+		cr.runs = appendRun(cr.runs, communicationRun{start: last.end(), hours: hour - last.end()})
+		cr.runs = appendRun(cr.runs, communicationRun{start: hour, hours: 1, HourCounts: delta})
+	case hour == last.end()-1:
+		counts := last.HourCounts.add(delta)
+		last.hours--
+		if last.hours == 0 {
+			cr.runs = cr.runs[:n-1]
+		}
+		cr.runs = appendRun(cr.runs, communicationRun{start: hour, hours: 1, HourCounts: counts})
+	default:
+		cr.merge([]communicationRun{{start: hour, hours: 1, HourCounts: delta}})
+	}
+}
+
+// Merge adds the counts from other into the record, hour by hour.
+func (cr *CommunicationRecord) Merge(other CommunicationRecord) {
+	cr.merge(other.runs)
+}
+
+func (cr *CommunicationRecord) merge(other []communicationRun) {
+	if len(other) == 0 {
+		return
+	}
+	if len(cr.runs) == 0 {
+		cr.runs = append([]communicationRun(nil), other...)
+		return
+	}
+	start := cr.runs[0].start
+	if other[0].start < start {
+		start = other[0].start
+	}
+	var ret []communicationRun
+	// Both sides are contiguous, so outside their spans there's an implied run of zero counts.
+	// Returns the counts at hour h, and the hour they next change.
+	countsAt := func(runs []communicationRun, i *int, h int64) (HourCounts, int64) {
+		for *i < len(runs) && runs[*i].end() <= h {
+			*i++
+		}
+		if *i == len(runs) {
+			return HourCounts{}, math.MaxInt64
+		}
+		r := runs[*i]
+		if h < r.start {
+			return HourCounts{}, r.start
+		}
+		return r.HourCounts, r.end()
+	}
+	var ai, bi int
+	end := cr.runs[len(cr.runs)-1].end()
+	if e := other[len(other)-1].end(); e > end {
+		end = e
+	}
+	for h := start; h < end; {
+		ac, aEnd := countsAt(cr.runs, &ai, h)
+		bc, bEnd := countsAt(other, &bi, h)
+		next := aEnd
+		if bEnd < next {
+			next = bEnd
+		}
+		if next > end {
+			next = end
+		}
+		ret = appendRun(ret, communicationRun{start: h, hours: next - h, HourCounts: ac.add(bc)})
+		h = next
+	}
+	cr.runs = ret
+}
+
+// Appends a run, coalescing it with the last if they have the same counts.
+func appendRun(runs []communicationRun, r communicationRun) []communicationRun {
+	if r.hours <= 0 {
+		return runs
+	}
+	if n := len(runs); n != 0 && runs[n-1].HourCounts == r.HourCounts && runs[n-1].end() == r.start {
+		runs[n-1].hours += r.hours
+		return runs
+	}
+	return append(runs, r)
+}
+
+// Returns the hours of each run within [fromHour, toHour).
+func (cr CommunicationRecord) eachHourIn(fromHour, toHour int64, f func(h int64, c HourCounts)) {
+	for _, r := range cr.runs {
+		s, e := r.start, r.end()
+		if s < fromHour {
+			s = fromHour
+		}
+		if e > toHour {
+			e = toHour
+		}
+		for ; s < e; s++ {
+			f(s, r.HourCounts)
+		}
+	}
+}
+
+// Hours returns the counts for each hour overlapping [from, to). Hours outside the record are
+// omitted, but idle hours within it are included.
+func (cr CommunicationRecord) Hours(from, to time.Time) (ret []HourlyCounts) {
+	cr.eachHourIn(unixHour(from), unixHour(to.Add(time.Hour-1)), func(h int64, c HourCounts) {
+		ret = append(ret, HourlyCounts{hourTime(h), c})
+	})
+	return
+}
+
+// Total sums the counts for the hours overlapping [from, to).
+func (cr CommunicationRecord) Total(from, to time.Time) (ret HourCounts) {
+	cr.eachHourIn(unixHour(from), unixHour(to.Add(time.Hour-1)), func(_ int64, c HourCounts) {
+		ret = ret.add(c)
+	})
+	return
+}
+
+// Span returns the first and last hours in the record. ok is false if the record is empty.
+func (cr CommunicationRecord) Span() (first, last time.Time, ok bool) {
+	if len(cr.runs) == 0 {
+		return
+	}
+	return hourTime(cr.runs[0].start), hourTime(cr.runs[len(cr.runs)-1].end() - 1), true
+}
+
+// ActiveHours returns how many hours had any interaction at all.
+func (cr CommunicationRecord) ActiveHours() (ret int64) {
+	for _, r := range cr.runs {
+		if !r.IsZero() {
+			ret += r.hours
+		}
+	}
+	return
+}
+
+// ReplyRate returns the fraction of our queries that the Node replied to. It's 0 if we've never
+// queried it.
+func (cr CommunicationRecord) ReplyRate() float64 {
+	var sent, replies int64
+	for _, r := range cr.runs {
+		sent += int64(r.Sent) * r.hours
+		replies += int64(r.Replies) * r.hours
+	}
+	if sent == 0 {
+		return 0
+	}
+	if replies > sent {
+		return 1
+	}
+	return float64(replies) / float64(sent)
+}
+
+func (cr CommunicationRecord) String() string {
+	first, last, ok := cr.Span()
+	if !ok {
+		return "no communication"
+	}
+	t := cr.Total(first, last.Add(time.Hour))
+	return fmt.Sprintf("%d sent, %d replies, %d received over %d active hours since %v",
+		t.Sent, t.Replies, t.Received, cr.ActiveHours(), first)
+}
+
+// MarshalBinary encodes the record as the first hour (4 bytes, hours since the Unix epoch), followed
+// by each run as a uvarint hour count and the 6 bytes of counts for those hours.
+func (cr CommunicationRecord) MarshalBinary() ([]byte, error) {
+	if len(cr.runs) == 0 {
+		return nil, nil
+	}
+	if cr.runs[0].start < 0 || cr.runs[0].start > math.MaxUint32 {
+		return nil, fmt.Errorf("start hour %v out of range", cr.runs[0].start)
+	}
+	b := make([]byte, 4, 4+len(cr.runs)*(hourCountsLen+1))
+	binary.BigEndian.PutUint32(b, uint32(cr.runs[0].start))
+	var buf [binary.MaxVarintLen64 + hourCountsLen]byte
+	for _, r := range cr.runs {
+		n := binary.PutUvarint(buf[:], uint64(r.hours))
+		binary.BigEndian.PutUint16(buf[n:], r.Sent)
+		binary.BigEndian.PutUint16(buf[n+2:], r.Replies)
+		binary.BigEndian.PutUint16(buf[n+4:], r.Received)
+		b = append(b, buf[:n+hourCountsLen]...)
+	}
+	return b, nil
+}
+
+func (cr *CommunicationRecord) UnmarshalBinary(b []byte) error {
+	cr.runs = nil
+	if len(b) == 0 {
+		return nil
+	}
+	if len(b) < 4 {
+		return errors.New("communication record too short")
+	}
+	h := int64(binary.BigEndian.Uint32(b))
+	b = b[4:]
+	for len(b) != 0 {
+		hours, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad run length")
+		}
+		b = b[n:]
+		if len(b) < hourCountsLen {
+			return errors.New("truncated run counts")
+		}
+		if hours == 0 || hours > math.MaxUint32 {
+			return fmt.Errorf("run length %v out of range", hours)
+		}
+		r := communicationRun{
+			start: h,
+			hours: int64(hours),
+			HourCounts: HourCounts{
+				Sent:     binary.BigEndian.Uint16(b),
+				Replies:  binary.BigEndian.Uint16(b[2:]),
+				Received: binary.BigEndian.Uint16(b[4:]),
+			},
+		}
+		b = b[hourCountsLen:]
+		cr.runs = appendRun(cr.runs, r)
+		h = r.end()
+	}
+	return nil
+}
+
+// NodeCommunication pairs a Node with its communication record.
+type NodeCommunication struct {
+	krpc.NodeInfo
+	CommunicationRecord
+}
+
+// How long communication records are kept after the last interaction, and how many a Server keeps
+// at most. The oldest go first once there are too many.
+var (
+	communicationRetention  = 7 * 24 * time.Hour
+	maxCommunicationRecords = 1 << 16
+)
+
+type communicationKey struct {
+	addr string
+	// Zero for queries sent to an address before any Node there identified itself.
+	id krpc.ID
+}
+
+type communicationEntry struct {
+	addr Addr
+	CommunicationRecord
+}
+
+// The communication records of a Server, by Node address and ID. They're kept apart from the
+// routing table, so that they survive Nodes being evicted and coming back, and cover Nodes that
+// never made it in. Guarded by the Server's mutex.
+type communicationRecords struct {
+	entries map[communicationKey]*communicationEntry
+	// The ID last seen from each address, that queries sent there are counted against.
+	ids      map[string]krpc.ID
+	pruneLen int
+}
+
+func (me *communicationRecords) sent(addr Addr, t time.Time) {
+	me.entry(addr, me.ids[addr.String()], t).addSent(t)
+}
+
+func (me *communicationRecords) replied(addr Addr, id *krpc.ID, t time.Time) {
+	me.entry(addr, me.identify(addr, id), t).addReply(t)
+}
+
+func (me *communicationRecords) received(addr Addr, id *krpc.ID, t time.Time) {
+	me.entry(addr, me.identify(addr, id), t).addReceived(t)
+}
+
+// Notes the ID a message from addr came with, and returns the ID to count it against. Queries sent
+// to addr before any Node there identified itself are attributed to the first that does.
+func (me *communicationRecords) identify(addr Addr, id *krpc.ID) krpc.ID {
+	a := addr.String()
+	if id == nil || *id == (krpc.ID{}) {
+		return me.ids[a]
+	}
+	if me.ids == nil {
+		me.ids = make(map[string]krpc.ID)
+	}
+	me.ids[a] = *id
+	pendingKey := communicationKey{a, krpc.ID{}}
+	if pending, ok := me.entries[pendingKey]; ok {
+		delete(me.entries, pendingKey)
+		if e, ok := me.entries[communicationKey{a, *id}]; ok {
+			e.Merge(pending.CommunicationRecord)
+		} else {
+			me.entries[communicationKey{a, *id}] = pending
+		}
+	}
+	return *id
+}
+
+func (me *communicationRecords) entry(addr Addr, id krpc.ID, now time.Time) *communicationEntry {
+	key := communicationKey{addr.String(), id}
+	if e, ok := me.entries[key]; ok {
+		return e
+	}
+	if me.entries == nil {
+		me.entries = make(map[communicationKey]*communicationEntry)
+	}
+	if len(me.entries) >= me.pruneLen || len(me.entries) >= maxCommunicationRecords {
+		me.prune(now)
+		me.pruneLen = 2*len(me.entries) + 1024
+	}
+	e := &communicationEntry{addr: addr}
+	me.entries[key] = e
+	return e
+}
+
+// Drops records that have expired, then the least recently active until there's room for more.
+func (me *communicationRecords) prune(now time.Time) {
+	expired := unixHour(now.Add(-communicationRetention))
+	var byLastHour []communicationKey
+	for k, e := range me.entries {
+		if e.lastHour() < expired {
+			delete(me.entries, k)
+		} else {
+			byLastHour = append(byLastHour, k)
+		}
+	}
+	if excess := len(me.entries) - maxCommunicationRecords*3/4; excess > 0 {
+		sort.Slice(byLastHour, func(i, j int) bool {
+			return me.entries[byLastHour[i]].lastHour() < me.entries[byLastHour[j]].lastHour()
+		})
+		for _, k := range byLastHour[:excess] {
+			delete(me.entries, k)
+		}
+	}
+	addrs := make(map[string]struct{}, len(me.entries))
+	for k := range me.entries {
+		addrs[k.addr] = struct{}{}
+	}
+	for a := range me.ids {
+		if _, ok := addrs[a]; !ok {
+			delete(me.ids, a)
+		}
+	}
+}
+
+// The last hour in the record, or math.MinInt64 if it's empty.
+func (cr CommunicationRecord) lastHour() int64 {
+	if len(cr.runs) == 0 {
+		return math.MinInt64
+	}
+	return cr.runs[len(cr.runs)-1].end() - 1
+}
+
+// CommunicationRecords returns a copy of the communication record of every Node we've interacted
+// with in the last week or so, whether or not it's in the routing table. Queries to addresses whose
+// Nodes haven't yet identified themselves are left out.
+func (s *Server) CommunicationRecords() (ret []NodeCommunication) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k, e := range s.communication.entries {
+		if k.id == (krpc.ID{}) {
+			continue
+		}
+		ret = append(ret, NodeCommunication{
+			krpc.NodeInfo{ID: k.id, Addr: e.addr.KRPC()},
+			e.CommunicationRecord.clone(),
+		})
+	}
+	return
+}
+
+// NodeCommunicationRecord returns a copy of the communication record of a Node.
+func (s *Server) NodeCommunicationRecord(ni krpc.NodeInfo) (_ CommunicationRecord, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.communication.entries[communicationKey{NewAddr(ni.Addr.UDP()).String(), ni.ID}]
+	if !ok {
+		return
+	}
+	return e.CommunicationRecord.clone(), true
+}
+
+func (cr CommunicationRecord) clone() CommunicationRecord {
+	return CommunicationRecord{append([]communicationRun(nil), cr.runs...)}
+}
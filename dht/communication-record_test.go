@@ -0,0 +1,151 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/krpc"
+)
+
+func TestCommunicationRecordCompression(t *testing.T) {
+	c := qt.New(t)
+	start := time.Date(2021, 9, 1, 15, 0, 0, 0, time.UTC)
+	var cr CommunicationRecord
+	cr.addSent(start)
+	cr.addReply(start.Add(time.Minute))
+	// Two idle hours, then three hours with the same interactions.
+	for i := 3; i < 6; i++ {
+		cr.addReceived(start.Add(time.Duration(i) * time.Hour))
+	}
+	require.Equal(t, []communicationRun{
+		{start: unixHour(start), hours: 1, HourCounts: HourCounts{Sent: 1, Replies: 1}},
+		{start: unixHour(start) + 1, hours: 2},
+		{start: unixHour(start) + 3, hours: 3, HourCounts: HourCounts{Received: 1}},
+	}, cr.runs)
+	b, err := cr.MarshalBinary()
+	c.Assert(err, qt.IsNil)
+	c.Assert(b, qt.HasLen, 4+3*(1+hourCountsLen))
+	var decoded CommunicationRecord
+	c.Assert(decoded.UnmarshalBinary(b), qt.IsNil)
+	require.Equal(t, cr.runs, decoded.runs)
+
+	first, last, ok := cr.Span()
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(first.Equal(start), qt.IsTrue)
+	c.Assert(last.Equal(start.Add(5*time.Hour)), qt.IsTrue)
+	c.Assert(cr.ActiveHours(), qt.Equals, int64(4))
+	c.Assert(cr.ReplyRate(), qt.Equals, 1.0)
+	c.Assert(cr.Total(start.Add(time.Hour), start.Add(5*time.Hour)), qt.Equals, HourCounts{Received: 2})
+	hours := cr.Hours(start.Add(2*time.Hour), start.Add(4*time.Hour))
+	c.Assert(hours, qt.HasLen, 2)
+	c.Assert(hours[0].HourCounts.IsZero(), qt.IsTrue)
+	c.Assert(hours[1].Hour.Equal(start.Add(3*time.Hour)), qt.IsTrue)
+	c.Assert(hours[1].Received, qt.Equals, uint16(1))
+}
+
+func TestCommunicationRecordAddOutOfOrder(t *testing.T) {
+	start := time.Date(2021, 9, 1, 15, 0, 0, 0, time.UTC)
+	var cr CommunicationRecord
+	for i := 0; i < 4; i++ {
+		cr.addSent(start.Add(time.Duration(i) * time.Hour))
+	}
+	cr.addSent(start.Add(time.Hour))
+	cr.addSent(start.Add(-time.Hour))
+	require.Equal(t, []communicationRun{
+		{start: unixHour(start) - 1, hours: 2, HourCounts: HourCounts{Sent: 1}},
+		{start: unixHour(start) + 1, hours: 1, HourCounts: HourCounts{Sent: 2}},
+		{start: unixHour(start) + 2, hours: 2, HourCounts: HourCounts{Sent: 1}},
+	}, cr.runs)
+}
+
+func TestCommunicationRecordMerge(t *testing.T) {
+	c := qt.New(t)
+	start := time.Date(2021, 9, 1, 15, 0, 0, 0, time.UTC)
+	var a, b CommunicationRecord
+	a.addSent(start)
+	a.addSent(start.Add(time.Hour))
+	b.addSent(start.Add(time.Hour))
+	b.addReceived(start.Add(4 * time.Hour))
+	a.Merge(b)
+	require.Equal(t, []communicationRun{
+		{start: unixHour(start), hours: 1, HourCounts: HourCounts{Sent: 1}},
+		{start: unixHour(start) + 1, hours: 1, HourCounts: HourCounts{Sent: 2}},
+		{start: unixHour(start) + 2, hours: 2},
+		{start: unixHour(start) + 4, hours: 1, HourCounts: HourCounts{Received: 1}},
+	}, a.runs)
+	// Merging doesn't alias the other record.
+	b.addReceived(start.Add(4 * time.Hour))
+	c.Assert(a.Total(start, start.Add(5*time.Hour)).Received, qt.Equals, uint16(1))
+}
+
+func TestCommunicationRecordSaturates(t *testing.T) {
+	cr := CommunicationRecord{runs: []communicationRun{{hours: 1, HourCounts: HourCounts{Sent: 0xffff}}}}
+	cr.addSent(time.Unix(0, 0))
+	qt.Assert(t, cr.runs[0].Sent, qt.Equals, uint16(0xffff))
+}
+
+func TestServerCommunicationRecords(t *testing.T) {
+	s0, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer s0.Close()
+	s1, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer s1.Close()
+	// The first ping adds s1 to s0's table from the reply, and s0 to s1's from the query.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, s0.Ping(s1.Addr().(*net.UDPAddr)).Err)
+	}
+	now := time.Now()
+	cr, ok := s0.NodeCommunicationRecord(krpc.NodeInfo{ID: s1.ID(), Addr: NewAddr(s1.Addr()).KRPC()})
+	require.True(t, ok)
+	// The query sent before s1 identified itself counts too.
+	qt.Assert(t, cr.Total(now.Add(-time.Hour), now.Add(time.Hour)), qt.Equals, HourCounts{Sent: 2, Replies: 2})
+	ncs := s1.CommunicationRecords()
+	require.Len(t, ncs, 1)
+	qt.Assert(t, ncs[0].ID, qt.Equals, s0.ID())
+	qt.Assert(t, ncs[0].Total(now.Add(-time.Hour), now.Add(time.Hour)), qt.Equals, HourCounts{Received: 2})
+
+	// Records outlive the Node in the routing table.
+	s1.mu.Lock()
+	s1.Table.forNodes(func(n *Node) bool {
+		s1.Table.dropNode(n)
+		return true
+	})
+	s1.mu.Unlock()
+	cr, ok = s1.NodeCommunicationRecord(ncs[0].NodeInfo)
+	require.True(t, ok)
+	qt.Assert(t, cr.Total(now.Add(-time.Hour), now.Add(time.Hour)), qt.Equals, HourCounts{Received: 2})
+}
+
+func TestCommunicationRecordsPrune(t *testing.T) {
+	c := qt.New(t)
+	defer func(max int) { maxCommunicationRecords = max }(maxCommunicationRecords)
+	maxCommunicationRecords = 8
+	now := time.Date(2021, 9, 1, 15, 0, 0, 0, time.UTC)
+	var crs communicationRecords
+	addr := func(i int) Addr {
+		return NewAddr(&net.UDPAddr{IP: net.IPv4(10, 0, 0, byte(i)), Port: 6881})
+	}
+	// Expired, then successively more recent.
+	crs.received(addr(0), &krpc.ID{1}, now.Add(-communicationRetention-time.Hour))
+	for i := 1; i < 10; i++ {
+		crs.received(addr(i), &krpc.ID{1}, now.Add(time.Duration(i)*time.Hour))
+	}
+	c.Assert(len(crs.entries) <= maxCommunicationRecords, qt.IsTrue)
+	_, ok := crs.entries[communicationKey{addr(0).String(), krpc.ID{1}}]
+	c.Check(ok, qt.IsFalse)
+	_, ok = crs.entries[communicationKey{addr(9).String(), krpc.ID{1}}]
+	c.Check(ok, qt.IsTrue)
+	_, ok = crs.ids[addr(0).String()]
+	c.Check(ok, qt.IsFalse)
+}
@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/rs/dnscache"
+	"testTorrent/dht/bep44"
+	node_store "testTorrent/dht/node-store"
 	peer_store "testTorrent/dht/peer-store"
 
 	"github.com/anacrolix/log"
@@ -49,6 +51,9 @@ type ServerConfig struct {
 	// Initial IP blocklist to use. Applied before serving and bootstrapping
 	// begins.
 	IPBlocklist iplist.Ranger
+	// Limits on the queries handled from each source. Abusive sources are blocked for a while, see
+	// Server.BlockedIPs. If nil, queries aren't limited.
+	InboundLimits *InboundLimits
 	// Used to secure the server's ID. Defaults to the Conn's LocalAddr(). Set to the IP that remote
 	// nodes will see, as that IP is what they'll use to validate our ID.
 	PublicIP net.IP
@@ -57,11 +62,28 @@ type ServerConfig struct {
 	OnQuery func(query *krpc.Msg, source net.Addr) (propagate bool)
 	// Called when a peer successfully announces to us.
 	OnAnnouncePeer func(infoHash metainfo.Hash, ip net.IP, port int, portOk bool)
+	// Like OnAnnouncePeer, but also passes the ID and address of the announcing Node.
+	OnAnnouncePeerNode func(infoHash metainfo.Hash, source krpc.NodeInfo, port int, portOk bool)
 	// How long to wait before resending queries that haven't received a response. Defaults to a
 	// random value between 4.5 and 5.5s.
 	QueryResendDelay func() time.Duration
 	// TODO: Expose Peers, to return NodeInfo for received get_peers queries.
 	PeerStore peer_store.Interface
+	// Records every Node we interact with. If set, it's used for starting nodes before falling back
+	// to StartingNodes.
+	NodeStore node_store.Interface
+	// BEP 51. How long a sample of the PeerStore is given out to sample_infohashes queries, and so
+	// how long queriers are told to wait before asking again. Defaults to
+	// DefaultSampleInfohashesInterval.
+	SampleInfohashesInterval time.Duration
+	// BEP 44. Holds items put to us, and answers get queries for them. If nil, get queries are
+	// answered with nodes only, and put queries are refused.
+	ItemStore bep44.Store
+	// Reply to queries with an ID that shares most of its prefix with the query's target, or with
+	// the querier's ID if there's no target, instead of our own. Queriers then take us for one of
+	// the Nodes closest to what they're looking for, add us to their routing tables, and announce
+	// to us. The IDs used aren't BEP 42 secure. See Server.SpoofedIDs.
+	SpoofNeighbors bool
 
 	ConnectionTracking *conntrack.Instance
 
@@ -85,6 +107,10 @@ type ServerStats struct {
 	// Nodes that have been blocked.
 	BadNodes                 uint
 	OutboundQueriesAttempted int64
+	// Queries dropped by the InboundLimits.
+	InboundQueriesDropped int64
+	// IPs currently blocked by Server.BlockIP or the InboundLimits.
+	BlockedIPs int
 }
 
 func jitterDuration(average time.Duration, plusMinus time.Duration) time.Duration {
@@ -108,6 +134,8 @@ func init() {
 	go dnsResolverRefresher()
 }
 
+// GlobalBootstrapAddrs resolves the well-known bootstrap nodes. network "udp4" or "udp6" keeps only
+// the addresses of that family.
 func GlobalBootstrapAddrs(network string) (addrs []Addr, err error) {
 	for _, s := range []string{
 		"router.utorrent.com:6881",
@@ -127,6 +155,9 @@ func GlobalBootstrapAddrs(network string) (addrs []Addr, err error) {
 			continue
 		}
 		for _, a := range hostAddrs {
+			if ip := net.ParseIP(a); ip != nil && (network == "udp4" && ip.To4() == nil || network == "udp6" && ip.To4() != nil) {
+				continue
+			}
 			ua, err := net.ResolveUDPAddr("udp", net.JoinHostPort(a, port))
 			if err != nil {
 				log.Printf("error resolving %q: %v", a, err)
@@ -1,6 +1,7 @@
 package dht
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -12,6 +13,7 @@ import (
 	_ "github.com/anacrolix/envpprof"
 	"github.com/anacrolix/missinggo/inproc"
 	"github.com/anacrolix/sync"
+	qt "github.com/frankban/quicktest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"testTorrent/torrent/bencode"
@@ -20,6 +22,7 @@ import (
 
 	"testTorrent/dht/int160"
 	"testTorrent/dht/krpc"
+	peer_store "testTorrent/dht/peer-store"
 )
 
 func TestSetNilBigInt(t *testing.T) {
@@ -348,3 +351,54 @@ func (me *bootstrapRacePacketConn) WriteTo(b []byte, addr net.Addr) (int, error)
 	}
 	return len(b), nil
 }
+
+func TestGetPeersValues(t *testing.T) {
+	c := qt.New(t)
+	ps := &peer_store.InMemory{}
+	ih := peer_store.InfoHash{1}
+	for i := 0; i < 2*maxGetPeersValues; i++ {
+		ps.AnnouncePeer(ih, krpc.NodeAddr{IP: net.IPv4(1, 2, byte(i>>8), byte(i)).To4(), Port: 1}, i%2 == 0)
+	}
+	s, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+		PeerStore:  ps,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	client, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	getPeers := func(noSeed, scrape int) *krpc.Return {
+		res := client.Query(context.Background(), NewAddr(s.Addr()), "get_peers", QueryInput{
+			MsgArgs: krpc.MsgArgs{
+				InfoHash: krpc.ID(ih),
+				NoSeed:   noSeed,
+				Scrape:   scrape,
+			},
+			RateLimiting: QueryRateLimiting{NotAny: true},
+		})
+		c.Assert(res.Err, qt.IsNil)
+		return res.Reply.R
+	}
+	r := getPeers(0, 0)
+	c.Check(r.Values, qt.HasLen, maxGetPeersValues)
+	c.Check(r.BFsd, qt.IsNil)
+	c.Check(r.BFpe, qt.IsNil)
+	noSeeds := getPeers(1, 0).Values
+	c.Check(noSeeds, qt.HasLen, maxGetPeersValues)
+	for _, na := range noSeeds {
+		// Seeds were announced with even last octets.
+		c.Check(na.IP[3]%2, qt.Equals, byte(1))
+	}
+	r = getPeers(0, 1)
+	seeds, peers := ps.Scrape(ih)
+	c.Assert(r.BFsd, qt.Not(qt.IsNil))
+	c.Assert(r.BFpe, qt.Not(qt.IsNil))
+	c.Check(*r.BFsd, qt.Equals, seeds)
+	c.Check(*r.BFpe, qt.Equals, peers)
+	c.Check(r.BFsd.EstimateCount() > maxGetPeersValues*0.9, qt.IsTrue)
+}
@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"errors"
+	"net"
+
+	"github.com/anacrolix/sync"
+)
+
+// DualStackConfig configures NewDualStack.
+type DualStackConfig struct {
+	// The IPv4 and IPv6 sockets. Both are required. The IPv6 socket shouldn't accept IPv4-mapped
+	// addresses, or IPv4 Nodes will reach both tables.
+	Conn4, Conn6 net.PacketConn
+	// Template for both Servers. Conn is set per family. If StartingNodes is nil, each family
+	// starts from the global bootstrap nodes of that family.
+	Server ServerConfig
+}
+
+// A DualStack runs an IPv4 and an IPv6 Server per BEP 32, each with its own routing table, so the
+// families don't crowd each other out of buckets. Nodes of the other family learned by either
+// Server, say through nodes6 in a response over IPv4, go to the other Server's table, and replies
+// fill nodes and nodes6 from the table of the matching family. The Servers share a lock so they can
+// reach into each other's tables.
+type DualStack struct {
+	v4, v6 *Server
+}
+
+// DualStackStats are the ServerStats of each family.
+type DualStackStats struct {
+	IPv4 ServerStats
+	IPv6 ServerStats
+}
+
+// NewDualStack starts both Servers, and serves their sockets.
+func NewDualStack(c *DualStackConfig) (*DualStack, error) {
+	if c.Conn4 == nil || c.Conn6 == nil {
+		return nil, errors.New("both conns required")
+	}
+	mu := new(sync.RWMutex)
+	newFamily := func(conn net.PacketConn, network string) (*Server, error) {
+		sc := c.Server
+		sc.Conn = conn
+		if sc.StartingNodes == nil {
+			sc.StartingNodes = func() ([]Addr, error) { return GlobalBootstrapAddrs(network) }
+		}
+		return newServerWithMutex(&sc, mu)
+	}
+	v4, err := newFamily(c.Conn4, "udp4")
+	if err != nil {
+		return nil, err
+	}
+	v6, err := newFamily(c.Conn6, "udp6")
+	if err != nil {
+		v4.Close()
+		return nil, err
+	}
+	mu.Lock()
+	v4.otherFamily = v6
+	v6.otherFamily = v4
+	v6.ipv6 = true
+	mu.Unlock()
+	go v4.serveUntilClosed()
+	go v6.serveUntilClosed()
+	return &DualStack{v4: v4, v6: v6}, nil
+}
+
+// IPv4 returns the Server for the IPv4 socket.
+func (ds *DualStack) IPv4() *Server {
+	return ds.v4
+}
+
+// IPv6 returns the Server for the IPv6 socket.
+func (ds *DualStack) IPv6() *Server {
+	return ds.v6
+}
+
+// Bootstrap populates both tables at the same time. Each family bootstraps from its own Nodes, so
+// one failing doesn't hold up the other. err is the first error, if any.
+func (ds *DualStack) Bootstrap() (v4, v6 TraversalStats, err error) {
+	var err6 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v6, err6 = ds.v6.Bootstrap()
+	}()
+	v4, err = ds.v4.Bootstrap()
+	wg.Wait()
+	if err == nil {
+		err = err6
+	}
+	return
+}
+
+// Stats returns the statistics of each family.
+func (ds *DualStack) Stats() DualStackStats {
+	return DualStackStats{
+		IPv4: ds.v4.Stats(),
+		IPv6: ds.v6.Stats(),
+	}
+}
+
+// Close closes both Servers and their sockets.
+func (ds *DualStack) Close() {
+	ds.v4.Close()
+	ds.v6.Close()
+}
@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/stm/rate"
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/krpc"
+)
+
+func TestDualStack(t *testing.T) {
+	c := qt.New(t)
+	conn6, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	id := RandomNodeID()
+	ds, err := NewDualStack(&DualStackConfig{
+		Conn4:  mustListen("127.0.0.1:0"),
+		Conn6:  conn6,
+		Server: ServerConfig{NodeId: id, NoSecurity: true},
+	})
+	require.NoError(t, err)
+	defer ds.Close()
+	ds.IPv4().sendLimit = rate.NewLimiter(rate.Inf, 0)
+	ds.IPv6().sendLimit = rate.NewLimiter(rate.Inf, 0)
+
+	// Nodes go to the table of their family, whichever Server learns of them.
+	node4 := krpc.NodeInfo{ID: RandomNodeID(), Addr: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 1}}
+	node6 := krpc.NodeInfo{ID: RandomNodeID(), Addr: krpc.NodeAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}}
+	ds.IPv6().mu.Lock()
+	for _, ni := range []krpc.NodeInfo{node4, node6} {
+		c.Assert(ds.IPv6().updateNode(NewAddr(ni.Addr.UDP()), (*krpc.ID)(&ni.ID), true, func(n *Node) {
+			n.lastGotResponse = time.Now()
+		}), qt.IsNil)
+	}
+	ds.IPv6().mu.Unlock()
+	stats := ds.Stats()
+	c.Check(stats.IPv4.Nodes, qt.Equals, 1)
+	c.Check(stats.IPv6.Nodes, qt.Equals, 1)
+	c.Check(ds.IPv4().Nodes()[0].ID, qt.Equals, node4.ID)
+	c.Check(ds.IPv6().Nodes()[0].ID, qt.Equals, node6.ID)
+
+	// Each family's Nodes come from its own table, whichever socket is asked.
+	for _, tc := range []struct {
+		s      *Server
+		listen string
+	}{
+		{ds.IPv4(), "127.0.0.1:0"},
+		{ds.IPv6(), "[::1]:0"},
+	} {
+		client, err := NewServer(&ServerConfig{
+			Conn:       mustListen(tc.listen),
+			NoSecurity: true,
+		})
+		require.NoError(t, err)
+		defer client.Close()
+		res := client.Query(context.Background(), NewAddr(tc.s.Addr()), "find_node", QueryInput{
+			MsgArgs: krpc.MsgArgs{
+				// Targeting the shared ID searches every bucket of both tables.
+				Target: id,
+				Want:   []krpc.Want{krpc.WantNodes, krpc.WantNodes6},
+			},
+			RateLimiting: QueryRateLimiting{NotAny: true},
+		})
+		c.Assert(res.Err, qt.IsNil)
+		c.Assert(res.Reply.R.Nodes, qt.HasLen, 1)
+		c.Check(res.Reply.R.Nodes[0].ID, qt.Equals, node4.ID)
+		c.Assert(res.Reply.R.Nodes6, qt.HasLen, 1)
+		c.Check(res.Reply.R.Nodes6[0].ID, qt.Equals, node6.ID)
+	}
+
+	// Traversals over one socket leave the other family alone.
+	c.Check(ds.IPv4().shouldContact(node6.Addr, nil), qt.IsFalse)
+	c.Check(ds.IPv6().shouldContact(node6.Addr, nil), qt.IsTrue)
+}
@@ -0,0 +1,311 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+	"golang.org/x/time/rate"
+
+	"testTorrent/dht/krpc"
+)
+
+// InboundLimits bound the queries a Server handles from each source, and have sources that flood it
+// or rotate node IDs blocked for a while. Zero fields take the defaults.
+type InboundLimits struct {
+	// Sustained queries per second handled from one IP, and the burst allowed. Default to 10 and 50.
+	PerIP      rate.Limit
+	PerIPBurst int
+	// Likewise for each /24 of IPv4 or /48 of IPv6, so that a host can't spread its queries over
+	// neighbouring addresses. Default to 50 and 250.
+	PerSubnet      rate.Limit
+	PerSubnetBurst int
+	// The period the following are counted over. Defaults to a minute.
+	Window time.Duration
+	// An IP is blocked once, in one Window, it has more than MaxDropped queries dropped by the rate
+	// limits, or sends more than MaxGetPeers get_peers or MaxAnnouncePeer announce_peer queries.
+	// Default to 100, 300 and 100.
+	MaxDropped      int
+	MaxGetPeers     int
+	MaxAnnouncePeer int
+	// If set, an IP is also blocked once it uses more than MaxIDs node IDs in one Window. Hosts
+	// behind a NAT, and clients running several IDs, share an IP, so this is off by default.
+	MaxIDs int
+	// How long offending IPs are blocked. Defaults to an hour.
+	BlockFor time.Duration
+}
+
+func (l InboundLimits) withDefaults() InboundLimits {
+	if l.PerIP == 0 {
+		l.PerIP = 10
+	}
+	if l.PerIPBurst == 0 {
+		l.PerIPBurst = 50
+	}
+	if l.PerSubnet == 0 {
+		l.PerSubnet = 50
+	}
+	if l.PerSubnetBurst == 0 {
+		l.PerSubnetBurst = 250
+	}
+	if l.Window == 0 {
+		l.Window = time.Minute
+	}
+	if l.MaxDropped == 0 {
+		l.MaxDropped = 100
+	}
+	if l.MaxGetPeers == 0 {
+		l.MaxGetPeers = 300
+	}
+	if l.MaxAnnouncePeer == 0 {
+		l.MaxAnnouncePeer = 100
+	}
+	if l.BlockFor == 0 {
+		l.BlockFor = time.Hour
+	}
+	return l
+}
+
+// Tracks the queries from each source. State for sources that have been quiet for a Window is
+// forgotten.
+type inboundLimiter struct {
+	limits InboundLimits
+
+	mu              sync.Mutex
+	sources         map[string]*inboundSource
+	sourcesPruneLen int
+	subnets         map[string]*inboundSubnet
+	subnetsPruneLen int
+}
+
+type inboundSource struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	// Counts for the current window.
+	windowStart  time.Time
+	dropped      int
+	getPeers     int
+	announcePeer int
+	ids          map[krpc.ID]struct{}
+}
+
+type inboundSubnet struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newInboundLimiter(limits InboundLimits) *inboundLimiter {
+	return &inboundLimiter{
+		limits:  limits.withDefaults(),
+		sources: make(map[string]*inboundSource),
+		subnets: make(map[string]*inboundSubnet),
+	}
+}
+
+// The network that an IP's queries are also limited as part of.
+func ipSubnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Counts a query from ip. allowed is whether it's within the rate limits. If the source should be
+// blocked, reason says why, and its state is dropped.
+func (me *inboundLimiter) allow(ip net.IP, m krpc.Msg, now time.Time) (allowed bool, reason string) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	key := ip.String()
+	src := me.source(key, now)
+	subnet := me.subnet(ipSubnet(ip), now)
+	if now.Sub(src.windowStart) >= me.limits.Window {
+		src.windowStart = now
+		src.dropped = 0
+		src.getPeers = 0
+		src.announcePeer = 0
+		src.ids = nil
+	}
+	switch m.Q {
+	case "get_peers":
+		src.getPeers++
+	case "announce_peer":
+		src.announcePeer++
+	}
+	if id := m.SenderID(); id != nil && me.limits.MaxIDs > 0 {
+		if src.ids == nil {
+			src.ids = make(map[krpc.ID]struct{})
+		}
+		src.ids[*id] = struct{}{}
+	}
+	allowed = src.limiter.AllowN(now, 1) && subnet.limiter.AllowN(now, 1)
+	if !allowed {
+		src.dropped++
+	}
+	switch {
+	case src.dropped > me.limits.MaxDropped:
+		reason = "exceeded rate limits"
+	case src.getPeers > me.limits.MaxGetPeers:
+		reason = "get_peers flood"
+	case src.announcePeer > me.limits.MaxAnnouncePeer:
+		reason = "announce_peer flood"
+	case me.limits.MaxIDs > 0 && len(src.ids) > me.limits.MaxIDs:
+		reason = "rotating node IDs"
+	default:
+		return
+	}
+	delete(me.sources, key)
+	return false, reason
+}
+
+func (me *inboundLimiter) source(key string, now time.Time) *inboundSource {
+	src, ok := me.sources[key]
+	if !ok {
+		if len(me.sources) >= me.sourcesPruneLen {
+			for k, v := range me.sources {
+				if now.Sub(v.lastSeen) >= me.limits.Window {
+					delete(me.sources, k)
+				}
+			}
+			me.sourcesPruneLen = 2*len(me.sources) + 1024
+		}
+		src = &inboundSource{
+			limiter:     rate.NewLimiter(me.limits.PerIP, me.limits.PerIPBurst),
+			windowStart: now,
+		}
+		me.sources[key] = src
+	}
+	src.lastSeen = now
+	return src
+}
+
+func (me *inboundLimiter) subnet(key string, now time.Time) *inboundSubnet {
+	sn, ok := me.subnets[key]
+	if !ok {
+		if len(me.subnets) >= me.subnetsPruneLen {
+			for k, v := range me.subnets {
+				if now.Sub(v.lastSeen) >= me.limits.Window {
+					delete(me.subnets, k)
+				}
+			}
+			me.subnetsPruneLen = 2*len(me.subnets) + 1024
+		}
+		sn = &inboundSubnet{
+			limiter: rate.NewLimiter(me.limits.PerSubnet, me.limits.PerSubnetBurst),
+		}
+		me.subnets[key] = sn
+	}
+	sn.lastSeen = now
+	return sn
+}
+
+// A BlockedIP is an IP blocked for a while, on top of the Server's IP blocklist.
+type BlockedIP struct {
+	IP     net.IP
+	Until  time.Time
+	Reason string
+}
+
+// IPs blocked until a time. It has its own lock, as it's consulted from places that don't hold the
+// Server's.
+type dynamicBlocklist struct {
+	mu       sync.Mutex
+	ips      map[string]BlockedIP
+	pruneLen int
+}
+
+func (me *dynamicBlocklist) block(b BlockedIP, now time.Time) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if me.ips == nil {
+		me.ips = make(map[string]BlockedIP)
+	}
+	if len(me.ips) >= me.pruneLen {
+		me.prune(now)
+		me.pruneLen = 2*len(me.ips) + 1024
+	}
+	me.ips[b.IP.String()] = b
+}
+
+// Called with mu held.
+func (me *dynamicBlocklist) prune(now time.Time) {
+	for k, b := range me.ips {
+		if !now.Before(b.Until) {
+			delete(me.ips, k)
+		}
+	}
+}
+
+func (me *dynamicBlocklist) lookup(ip net.IP, now time.Time) (b BlockedIP, ok bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	if len(me.ips) == 0 {
+		return
+	}
+	b, ok = me.ips[ip.String()]
+	if ok && !now.Before(b.Until) {
+		delete(me.ips, ip.String())
+		ok = false
+	}
+	return
+}
+
+func (me *dynamicBlocklist) all(now time.Time) (ret []BlockedIP) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.prune(now)
+	for _, b := range me.ips {
+		ret = append(ret, b)
+	}
+	return
+}
+
+// BlockIP drops packets to and from ip until the time given, in addition to the IP blocklist.
+// Nodes at ip are removed from the Table.
+func (s *Server) BlockIP(ip net.IP, until time.Time, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blockIP(ip, until, reason)
+}
+
+// Called with s.mu held.
+func (s *Server) blockIP(ip net.IP, until time.Time, reason string) {
+	s.dynamicBlocks.block(BlockedIP{IP: ip, Until: until, Reason: reason}, time.Now())
+	var drop []*Node
+	s.Table.forNodes(func(n *Node) bool {
+		if n.Addr.IP().Equal(ip) {
+			drop = append(drop, n)
+		}
+		return true
+	})
+	for _, n := range drop {
+		s.Table.dropNode(n)
+	}
+}
+
+// BlockedIPs returns the IPs blocked by BlockIP or the InboundLimits that haven't yet been
+// unblocked.
+func (s *Server) BlockedIPs() []BlockedIP {
+	return s.dynamicBlocks.all(time.Now())
+}
+
+// Applies the InboundLimits to a query, blocking the source if it's abusive. Returns whether the
+// query should be handled. Called with s.mu held.
+func (s *Server) allowQuery(addr Addr, m krpc.Msg) bool {
+	if s.inbound == nil {
+		return true
+	}
+	now := time.Now()
+	allowed, reason := s.inbound.allow(addr.IP(), m, now)
+	if !allowed {
+		s.stats.InboundQueriesDropped++
+		expvars.Add("inbound queries dropped by rate limits", 1)
+	}
+	if reason != "" {
+		blockFor := s.inbound.limits.BlockFor
+		s.logger().WithDefaultLevel(log.Info).Printf("blocking %v for %v: %v", addr.IP(), blockFor, reason)
+		expvars.Add("ips blocked by inbound limits", 1)
+		s.blockIP(addr.IP(), now.Add(blockFor), reason)
+	}
+	return allowed
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/krpc"
+)
+
+func TestInboundLimiter(t *testing.T) {
+	c := qt.New(t)
+	l := newInboundLimiter(InboundLimits{
+		PerIP:       1,
+		PerIPBurst:  2,
+		MaxDropped:  2,
+		MaxGetPeers: 4,
+		MaxIDs:      2,
+	})
+	now := time.Unix(1630000000, 0)
+	query := func(ip string, q string, id byte) (bool, string) {
+		return l.allow(net.ParseIP(ip), krpc.Msg{Y: "q", Q: q, A: &krpc.MsgArgs{ID: krpc.ID{id}}}, now)
+	}
+	check := func(allowed bool, reason string, wantAllowed bool, wantReason string) {
+		c.Helper()
+		c.Check(allowed, qt.Equals, wantAllowed)
+		c.Check(reason, qt.Equals, wantReason)
+	}
+
+	allowed, reason := query("1.2.3.4", "ping", 1)
+	check(allowed, reason, true, "")
+	allowed, reason = query("1.2.3.4", "ping", 1)
+	check(allowed, reason, true, "")
+	allowed, reason = query("1.2.3.4", "ping", 1)
+	check(allowed, reason, false, "")
+	// The burst is per IP.
+	allowed, reason = query("1.2.3.5", "ping", 1)
+	check(allowed, reason, true, "")
+	allowed, reason = query("1.2.3.4", "ping", 1)
+	check(allowed, reason, false, "")
+	allowed, reason = query("1.2.3.4", "ping", 1)
+	check(allowed, reason, false, "exceeded rate limits")
+
+	// A fresh window, for a fresh source.
+	now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		allowed, reason = query("1.2.3.6", "get_peers", 1)
+		check(allowed, reason, true, "")
+	}
+	now = now.Add(time.Second)
+	allowed, reason = query("1.2.3.6", "get_peers", 1)
+	check(allowed, reason, false, "get_peers flood")
+
+	now = now.Add(time.Second)
+	allowed, reason = query("1.2.3.7", "ping", 1)
+	check(allowed, reason, true, "")
+	now = now.Add(time.Second)
+	allowed, reason = query("1.2.3.7", "ping", 2)
+	check(allowed, reason, true, "")
+	now = now.Add(time.Second)
+	allowed, reason = query("1.2.3.7", "ping", 3)
+	check(allowed, reason, false, "rotating node IDs")
+
+	// Node IDs aren't limited by default.
+	l = newInboundLimiter(InboundLimits{})
+	for i := 0; i < 20; i++ {
+		now = now.Add(time.Second)
+		allowed, reason = query("1.2.3.8", "ping", byte(i))
+		check(allowed, reason, true, "")
+	}
+}
+
+func TestInboundLimiterSubnet(t *testing.T) {
+	c := qt.New(t)
+	l := newInboundLimiter(InboundLimits{
+		PerSubnet:      1,
+		PerSubnetBurst: 2,
+	})
+	now := time.Unix(1630000000, 0)
+	allowed := func(ip string) bool {
+		ok, _ := l.allow(net.ParseIP(ip), krpc.Msg{Y: "q", Q: "ping"}, now)
+		return ok
+	}
+	c.Check(allowed("1.2.3.4"), qt.IsTrue)
+	c.Check(allowed("1.2.3.5"), qt.IsTrue)
+	c.Check(allowed("1.2.3.6"), qt.IsFalse)
+	c.Check(allowed("1.2.4.6"), qt.IsTrue)
+	c.Check(allowed("2001:db8:1::1"), qt.IsTrue)
+	c.Check(allowed("2001:db8:1:2::1"), qt.IsTrue)
+	c.Check(allowed("2001:db8:1:3::1"), qt.IsFalse)
+}
+
+func TestServerBlocksAbusiveSources(t *testing.T) {
+	c := qt.New(t)
+	s, err := NewServer(&ServerConfig{
+		Conn:          mustListen("127.0.0.1:0"),
+		NoSecurity:    true,
+		InboundLimits: &InboundLimits{MaxIDs: 1},
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	client, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	res := client.Ping(s.Addr().(*net.UDPAddr))
+	c.Assert(res.Err, qt.IsNil)
+	c.Check(s.Stats().Nodes, qt.Equals, 1)
+	// The same IP with another node ID.
+	other, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+		// Don't wait the whole resend delay for the reply that won't come.
+		QueryResendDelay: func() time.Duration { return time.Millisecond },
+	})
+	require.NoError(t, err)
+	defer other.Close()
+	res = other.Ping(s.Addr().(*net.UDPAddr))
+	c.Check(res.Err, qt.Not(qt.IsNil))
+
+	// The ping can give up before s has handled its last attempt.
+	var blocked []BlockedIP
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		blocked = s.BlockedIPs()
+		if len(blocked) != 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	c.Assert(blocked, qt.HasLen, 1)
+	c.Check(blocked[0].IP.Equal(net.IPv4(127, 0, 0, 1)), qt.IsTrue)
+	c.Check(blocked[0].Reason, qt.Equals, "rotating node IDs")
+	st := s.Stats()
+	c.Check(st.BlockedIPs, qt.Equals, 1)
+	// Nodes at the IP are dropped, and no longer contacted.
+	c.Check(st.Nodes, qt.Equals, 0)
+	res = s.Ping(client.Addr().(*net.UDPAddr))
+	c.Check(res.Err, qt.ErrorMatches, ".*blocked until.*rotating node IDs")
+}
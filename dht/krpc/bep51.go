@@ -0,0 +1,47 @@
+package krpc
+
+import (
+	"fmt"
+
+	"testTorrent/torrent/bencode"
+)
+
+// BEP 51. Infohashes packed end to end, as returned in the "samples" field of sample_infohashes
+// responses.
+type CompactInfohashes []ID
+
+func (CompactInfohashes) ElemSize() int { return 20 }
+
+func (me CompactInfohashes) MarshalBinary() ([]byte, error) {
+	ret := make([]byte, 0, len(me)*me.ElemSize())
+	for _, ih := range me {
+		ret = append(ret, ih[:]...)
+	}
+	return ret, nil
+}
+
+func (me CompactInfohashes) MarshalBencode() ([]byte, error) {
+	return bencodeBytesResult(me.MarshalBinary())
+}
+
+func (me *CompactInfohashes) UnmarshalBinary(b []byte) error {
+	if len(b)%me.ElemSize() != 0 {
+		return fmt.Errorf("%d trailing bytes", len(b)%me.ElemSize())
+	}
+	*me = make(CompactInfohashes, 0, len(b)/me.ElemSize())
+	for ; len(b) != 0; b = b[me.ElemSize():] {
+		var ih ID
+		copy(ih[:], b)
+		*me = append(*me, ih)
+	}
+	return nil
+}
+
+func (me *CompactInfohashes) UnmarshalBencode(b []byte) error {
+	return unmarshalBencodedBinary(me, b)
+}
+
+var _ interface {
+	bencode.Marshaler
+	bencode.Unmarshaler
+} = (*CompactInfohashes)(nil)
@@ -2,6 +2,8 @@ package krpc
 
 import (
 	"fmt"
+
+	"testTorrent/torrent/bencode"
 )
 
 // Msg represents messages that nodes in the network send to each other as specified by the protocol.
@@ -17,7 +19,7 @@ import (
 // may be correlated with multiple queries to the same node. The transaction ID should be encoded as a short string of binary numbers, typically 2 characters are enough as they cover 2^16 outstanding queries. The other key contained in every KRPC message is "y" with a single character value describing the type of message. The value of the "y" key is one of "q" for query, "r" for response, or "e" for error.
 // 3 message types:  QUERY, RESPONSE, ERROR
 type Msg struct {
-	Q        string   `bencode:"q,omitempty"` // Query method (one of 4: "ping", "find_node", "get_peers", "announce_peer")
+	Q        string   `bencode:"q,omitempty"` // Query method ("ping", "find_node", "get_peers", "announce_peer", "sample_infohashes" from BEP 51, or "get" and "put" from BEP 44)
 	A        *MsgArgs `bencode:"a,omitempty"` // named arguments sent with a query
 	T        string   `bencode:"t"`           // required: transaction ID
 	Y        string   `bencode:"y"`           // required: type of the message: q for QUERY, r for RESPONSE, e for ERROR
@@ -37,6 +39,15 @@ type MsgArgs struct {
 	Want        []Want `bencode:"want,omitempty"`         // Contains strings like "n4" and "n6" from BEP 32.
 	NoSeed      int    `bencode:"noseed,omitempty"`       // BEP 33
 	Scrape      int    `bencode:"scrape,omitempty"`       // BEP 33
+	Seed        int    `bencode:"seed,omitempty"`         // BEP 33. The announcing peer is a seed.
+
+	// BEP 44 (get and put)
+	V    bencode.Bytes `bencode:"v,omitempty"`    // Bencoded value to put
+	Seq  *int64        `bencode:"seq,omitempty"`  // Sequence number of a mutable item. A get only wants the value if it's newer.
+	Cas  *int64        `bencode:"cas,omitempty"`  // A put only succeeds if this is the stored sequence number
+	K    []byte        `bencode:"k,omitempty"`    // ed25519 public key of a mutable item
+	Salt []byte        `bencode:"salt,omitempty"` // Distinguishes mutable items under the same key
+	Sig  []byte        `bencode:"sig,omitempty"`  // ed25519 signature of a mutable item
 }
 
 type Want string
@@ -57,6 +68,20 @@ type Return struct {
 	// BEP 33 (scrapes)
 	BFsd *ScrapeBloomFilter `bencode:"BFsd,omitempty"`
 	BFpe *ScrapeBloomFilter `bencode:"BFpe,omitempty"`
+
+	// BEP 51 (sample_infohashes)
+	Interval *int64 `bencode:"interval,omitempty"` // Seconds the querier should wait before querying again
+	Num      *int64 `bencode:"num,omitempty"`      // Number of infohashes the queried node has stored
+	// Nodes supporting the extension always include samples, even when empty, so they can be told
+	// apart from nodes that answer unknown queries having a target like find_node.
+	Samples *CompactInfohashes `bencode:"samples,omitempty"`
+
+	// BEP 44 (get). The stored item, if any. V is left out if the querier already has its sequence
+	// number.
+	V   bencode.Bytes `bencode:"v,omitempty"`
+	K   []byte        `bencode:"k,omitempty"`
+	Sig []byte        `bencode:"sig,omitempty"`
+	Seq *int64        `bencode:"seq,omitempty"`
 }
 
 func (r Return) ForAllNodes(f func(NodeInfo)) {
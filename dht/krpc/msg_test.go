@@ -140,3 +140,44 @@ func TestEmptyScrapeBloomFilterEstimatedCount(t *testing.T) {
 	var f ScrapeBloomFilter
 	assert.EqualValues(t, 0, math.Floor(f.EstimateCount()))
 }
+
+func TestMarshalUnmarshalSampleInfohashes(t *testing.T) {
+	interval, num := int64(21600), int64(2)
+	samples := CompactInfohashes{IdFromString(strings.Repeat("a", 20)), IdFromString(strings.Repeat("b", 20))}
+	testMarshalUnmarshalMsg(t, Msg{
+		Y: "r",
+		T: "\x03",
+		R: &Return{
+			Interval: &interval,
+			Num:      &num,
+			Samples:  &samples,
+		},
+	}, "d1:rd2:id20:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x008:intervali21600e3:numi2e7:samples40:"+
+		strings.Repeat("a", 20)+strings.Repeat("b", 20)+"e1:t1:\x031:y1:re")
+	// Supporting nodes send empty samples.
+	empty := CompactInfohashes{}
+	testMarshalUnmarshalMsg(t, Msg{
+		Y: "r",
+		T: "\x03",
+		R: &Return{Samples: &empty},
+	}, "d1:rd2:id20:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x007:samples0:e1:t1:\x031:y1:re")
+	var ihs CompactInfohashes
+	assert.Error(t, ihs.UnmarshalBinary(make([]byte, 21)))
+}
+
+func TestMarshalUnmarshalPut(t *testing.T) {
+	seq := int64(4)
+	testMarshalUnmarshalMsg(t, Msg{
+		Y: "q",
+		Q: "put",
+		T: "\x04",
+		A: &MsgArgs{
+			V:     []byte("5:hello"),
+			Seq:   &seq,
+			K:     []byte(strings.Repeat("k", 32)),
+			Token: "t",
+			Sig:   []byte(strings.Repeat("s", 64)),
+		},
+	}, "d1:ad2:id20:\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x001:k32:"+
+		strings.Repeat("k", 32)+"3:seqi4e3:sig64:"+strings.Repeat("s", 64)+"5:token1:t1:v5:helloe1:q3:put1:t1:\x041:y1:qe")
+}
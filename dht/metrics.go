@@ -0,0 +1,167 @@
+package dht
+
+import (
+	"time"
+)
+
+// Upper bounds of the QueryLatency histogram buckets.
+var QueryLatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// LatencyHistogram counts durations into the QueryLatencyBuckets.
+type LatencyHistogram struct {
+	// Counts[i] is the number of durations no greater than QueryLatencyBuckets[i], and not in an
+	// earlier bucket. The last count is of those greater than every bound.
+	Counts []int64
+	Sum    time.Duration
+	Count  int64
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Counts = make([]int64, len(QueryLatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(QueryLatencyBuckets) && d > QueryLatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += d
+	h.Count++
+}
+
+func (h LatencyHistogram) copy() LatencyHistogram {
+	h.Counts = append([]int64(nil), h.Counts...)
+	return h
+}
+
+// ServerMetrics are counts of a Server's traffic, broken down for monitoring. Query methods other
+// than those the Server handles are counted as "other", and error codes outside 200 to 299 as 0,
+// so that remote Nodes can't add labels without bound.
+type ServerMetrics struct {
+	// By query method.
+	QueriesReceived map[string]int64
+	QueriesSent     map[string]int64
+	// By KRPC error code.
+	ErrorsReceived map[int]int64
+	ErrorsSent     map[int]int64
+	// The number of Nodes in each Table bucket that has any, by bucket index.
+	BucketNodes map[int]int
+	// Round trip times of queries that got a reply, by query method.
+	QueryLatency map[string]LatencyHistogram
+}
+
+// The counters behind ServerMetrics. Guarded by the Server's mutex.
+type serverMetrics struct {
+	queriesReceived map[string]int64
+	queriesSent     map[string]int64
+	errorsReceived  map[int]int64
+	errorsSent      map[int]int64
+	queryLatency    map[string]*LatencyHistogram
+}
+
+func metricsQueryMethod(q string) string {
+	switch q {
+	case "ping", "find_node", "get_peers", "announce_peer", "sample_infohashes", "get", "put":
+		return q
+	default:
+		return "other"
+	}
+}
+
+func metricsErrorCode(code int) int {
+	if code < 200 || code > 299 {
+		return 0
+	}
+	return code
+}
+
+func (me *serverMetrics) queryReceived(q string) {
+	if me.queriesReceived == nil {
+		me.queriesReceived = make(map[string]int64)
+	}
+	me.queriesReceived[metricsQueryMethod(q)]++
+}
+
+func (me *serverMetrics) querySent(q string) {
+	if me.queriesSent == nil {
+		me.queriesSent = make(map[string]int64)
+	}
+	me.queriesSent[metricsQueryMethod(q)]++
+}
+
+func (me *serverMetrics) errorReceived(code int) {
+	if me.errorsReceived == nil {
+		me.errorsReceived = make(map[int]int64)
+	}
+	me.errorsReceived[metricsErrorCode(code)]++
+}
+
+func (me *serverMetrics) errorSent(code int) {
+	if me.errorsSent == nil {
+		me.errorsSent = make(map[int]int64)
+	}
+	me.errorsSent[metricsErrorCode(code)]++
+}
+
+func (me *serverMetrics) replyReceived(q string, latency time.Duration) {
+	if me.queryLatency == nil {
+		me.queryLatency = make(map[string]*LatencyHistogram)
+	}
+	q = metricsQueryMethod(q)
+	h, ok := me.queryLatency[q]
+	if !ok {
+		h = new(LatencyHistogram)
+		me.queryLatency[q] = h
+	}
+	h.observe(latency)
+}
+
+func copyCounts(m map[string]int64) map[string]int64 {
+	ret := make(map[string]int64, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+func copyCodeCounts(m map[int]int64) map[int]int64 {
+	ret := make(map[int]int64, len(m))
+	for k, v := range m {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Metrics returns a snapshot of the Server's ServerMetrics.
+func (s *Server) Metrics() ServerMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := ServerMetrics{
+		QueriesReceived: copyCounts(s.metrics.queriesReceived),
+		QueriesSent:     copyCounts(s.metrics.queriesSent),
+		ErrorsReceived:  copyCodeCounts(s.metrics.errorsReceived),
+		ErrorsSent:      copyCodeCounts(s.metrics.errorsSent),
+		BucketNodes:     make(map[int]int),
+		QueryLatency:    make(map[string]LatencyHistogram, len(s.metrics.queryLatency)),
+	}
+	for i := range s.Table.buckets {
+		if n := s.Table.buckets[i].Len(); n != 0 {
+			ret.BucketNodes[i] = n
+		}
+	}
+	for q, h := range s.metrics.queryLatency {
+		ret.QueryLatency[q] = h.copy()
+	}
+	return ret
+}
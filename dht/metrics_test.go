@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerMetrics(t *testing.T) {
+	c := qt.New(t)
+	s, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	client, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+
+	res := client.Ping(s.Addr().(*net.UDPAddr))
+	c.Assert(res.Err, qt.IsNil)
+	res = client.Query(context.Background(), NewAddr(s.Addr()), "bogus", QueryInput{})
+	c.Assert(res.Err, qt.IsNil)
+	c.Assert(res.Reply.E, qt.Not(qt.IsNil))
+
+	sm := s.Metrics()
+	c.Check(sm.QueriesReceived, qt.DeepEquals, map[string]int64{"ping": 1, "other": 1})
+	c.Check(sm.ErrorsSent, qt.DeepEquals, map[int]int64{res.Reply.E.Code: 1})
+	c.Check(sm.BucketNodes, qt.HasLen, 1)
+
+	cm := client.Metrics()
+	c.Check(cm.QueriesSent, qt.DeepEquals, map[string]int64{"ping": 1, "other": 1})
+	c.Check(cm.ErrorsReceived, qt.DeepEquals, map[int]int64{res.Reply.E.Code: 1})
+	h := cm.QueryLatency["ping"]
+	c.Check(h.Count, qt.Equals, int64(1))
+	c.Check(h.Counts, qt.HasLen, len(QueryLatencyBuckets)+1)
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	c := qt.New(t)
+	var h LatencyHistogram
+	h.observe(time.Millisecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(11 * time.Millisecond)
+	h.observe(time.Minute)
+	c.Check(h.Counts[0], qt.Equals, int64(2))
+	c.Check(h.Counts[1], qt.Equals, int64(1))
+	c.Check(h.Counts[len(QueryLatencyBuckets)], qt.Equals, int64(1))
+	c.Check(h.Count, qt.Equals, int64(4))
+	c.Check(h.Sum, qt.Equals, time.Minute+22*time.Millisecond)
+}
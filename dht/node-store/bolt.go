@@ -0,0 +1,430 @@
+package node_store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/multiless"
+	"go.etcd.io/bbolt"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/bencode"
+)
+
+var (
+	nodesBucketKey = []byte("nodes")
+	// Keys are the day a Node last responded, then its ID, for finding the Best without reading
+	// every Node. Values are empty.
+	respondedBucketKey = []byte("responded")
+)
+
+// Bolt is a Node store in a bbolt database. Updates are buffered in memory and written in batches.
+type Bolt struct {
+	db *bbolt.DB
+
+	mu      sync.Mutex
+	pending map[krpc.ID]*pendingUpdates
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	flushDone chan struct{}
+}
+
+var _ Interface = (*Bolt)(nil)
+
+// How often buffered updates are written out by OpenBolt stores.
+const DefaultFlushInterval = 10 * time.Second
+
+// OpenBolt opens or creates a bbolt database file for storing Nodes.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		nodes, err := tx.CreateBucketIfNotExists(nodesBucketKey)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(respondedBucketKey) != nil {
+			return nil
+		}
+		// Databases from before the index was kept.
+		responded, err := tx.CreateBucket(respondedBucketKey)
+		if err != nil {
+			return err
+		}
+		return nodes.ForEach(func(k, v []byte) error {
+			r, err := unmarshalRecord(k, v)
+			if err != nil {
+				return err
+			}
+			if r.LastResponse.IsZero() {
+				return nil
+			}
+			return responded.Put(respondedKey(r.LastResponse, r.ID), nil)
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ret := &Bolt{
+		db:        db,
+		pending:   make(map[krpc.ID]*pendingUpdates),
+		closed:    make(chan struct{}),
+		flushDone: make(chan struct{}),
+	}
+	go ret.flusher(DefaultFlushInterval)
+	return ret, nil
+}
+
+func (me *Bolt) flusher(interval time.Duration) {
+	defer close(me.flushDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			me.Flush()
+		case <-me.closed:
+			return
+		}
+	}
+}
+
+// Updates to a Node not yet written out, applied to an empty Record.
+type pendingUpdates struct {
+	Record
+	// Whether any of the updates set ReadOnly.
+	readOnlySet bool
+}
+
+func (me *pendingUpdates) apply(u Update) {
+	me.Record.apply(u)
+	if u.Event != EventQuerySent {
+		me.readOnlySet = true
+	}
+}
+
+// Applies later updates on top of these.
+func (me *pendingUpdates) merge(later *pendingUpdates) {
+	me.Record.merge(later)
+	me.readOnlySet = me.readOnlySet || later.readOnlySet
+}
+
+// Applies the updates that d was made from, as though they came after those already applied.
+func (r *Record) merge(d *pendingUpdates) {
+	if r.FirstSeen.IsZero() || (!d.FirstSeen.IsZero() && d.FirstSeen.Before(r.FirstSeen)) {
+		r.FirstSeen = d.FirstSeen
+	}
+	if d.LastSeen.After(r.LastSeen) {
+		r.LastSeen = d.LastSeen
+	}
+	if d.LastResponse.After(r.LastResponse) {
+		r.LastResponse = d.LastResponse
+	}
+	for i := len(d.Addrs) - 1; i >= 0; i-- {
+		r.addAddr(d.Addrs[i])
+	}
+	r.QueriesSent += d.QueriesSent
+	r.Responses += d.Responses
+	r.QueriesReceived += d.QueriesReceived
+	if d.readOnlySet {
+		r.ReadOnly = d.ReadOnly
+	}
+	r.Secure = d.Secure
+}
+
+func (me *Bolt) Update(u Update) {
+	if u.Time.IsZero() {
+		u.Time = time.Now()
+	}
+	me.mu.Lock()
+	p, ok := me.pending[u.ID]
+	if !ok {
+		p = new(pendingUpdates)
+		me.pending[u.ID] = p
+	}
+	p.apply(u)
+	me.mu.Unlock()
+}
+
+// Flush writes buffered updates to the database. If that fails, they're kept for the next Flush.
+func (me *Bolt) Flush() error {
+	me.mu.Lock()
+	pending := me.pending
+	me.pending = make(map[krpc.ID]*pendingUpdates, len(pending))
+	me.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := me.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(nodesBucketKey)
+		responded := tx.Bucket(respondedBucketKey)
+		for id, p := range pending {
+			r, _, err := getRecord(b, id)
+			if err != nil {
+				return err
+			}
+			r.ID = id
+			lastResponse := r.LastResponse
+			r.merge(p)
+			v, err := marshalRecord(r)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(id[:], v); err != nil {
+				return err
+			}
+			if r.LastResponse.Equal(lastResponse) {
+				continue
+			}
+			if !lastResponse.IsZero() {
+				if err := responded.Delete(respondedKey(lastResponse, id)); err != nil {
+					return err
+				}
+			}
+			if err := responded.Put(respondedKey(r.LastResponse, id), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		me.mu.Lock()
+		for id, p := range pending {
+			if later, ok := me.pending[id]; ok {
+				p.merge(later)
+			}
+			me.pending[id] = p
+		}
+		me.mu.Unlock()
+	}
+	return err
+}
+
+func (me *Bolt) Get(id krpc.ID) (r Record, ok bool, err error) {
+	if err = me.Flush(); err != nil {
+		return
+	}
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		r, ok, err = getRecord(tx.Bucket(nodesBucketKey), id)
+		return err
+	})
+	return
+}
+
+// Len returns the number of Nodes stored.
+func (me *Bolt) Len() (n int, err error) {
+	if err = me.Flush(); err != nil {
+		return
+	}
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		n = tx.Bucket(nodesBucketKey).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+// Each Node that's responded to us is scored by the day it last did so, and then how reliably it
+// responds. Read-only Nodes are excluded. Only the Nodes that responded on the most recent days are
+// read, whole days at a time until there are enough.
+func (me *Bolt) Best(n int) (ret []Record, err error) {
+	if err = me.Flush(); err != nil {
+		return
+	}
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		nodes := tx.Bucket(nodesBucketKey)
+		c := tx.Bucket(respondedBucketKey).Cursor()
+		day := int64(-1)
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			kDay, id := parseRespondedKey(k)
+			if kDay != day {
+				if len(ret) >= n {
+					break
+				}
+				day = kDay
+			}
+			r, ok, err := getRecord(nodes, id)
+			if err != nil {
+				return err
+			}
+			if !ok || r.ReadOnly || r.Responses == 0 {
+				continue
+			}
+			ret = append(ret, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		l, r := ret[i], ret[j]
+		return multiless.New().Int64(
+			r.LastResponse.Unix()/86400, l.LastResponse.Unix()/86400,
+		).Bool(
+			r.Secure, l.Secure,
+		).Float64(
+			r.ResponseRate(), l.ResponseRate(),
+		).Int64(
+			r.Responses, l.Responses,
+		).Less()
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return
+}
+
+func respondedKey(lastResponse time.Time, id krpc.ID) []byte {
+	k := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(lastResponse.Unix()/86400))
+	copy(k[8:], id[:])
+	return k
+}
+
+func parseRespondedKey(k []byte) (day int64, id krpc.ID) {
+	day = int64(binary.BigEndian.Uint64(k))
+	copy(id[:], k[8:])
+	return
+}
+
+// IDs sharing a longer prefix with the target are always closer than those that don't, and are
+// contiguous in the key order. So the range of keys sharing a prefix with the target is widened
+// until it contains enough Nodes, and then those are sorted by distance.
+func (me *Bolt) Closest(target int160.T, n int) (ret []Record, err error) {
+	if err = me.Flush(); err != nil {
+		return
+	}
+	err = me.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(nodesBucketKey).Cursor()
+		for prefixLen := 160; prefixLen >= 0; prefixLen-- {
+			lo, hi := prefixRange(target, prefixLen)
+			ret = ret[:0]
+			for k, v := c.Seek(lo[:]); k != nil && bytes.Compare(k, hi[:]) <= 0; k, v = c.Next() {
+				r, err := unmarshalRecord(k, v)
+				if err != nil {
+					return err
+				}
+				ret = append(ret, r)
+			}
+			if len(ret) >= n {
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return int160.Distance(int160.FromByteArray(ret[i].ID), target).Cmp(
+			int160.Distance(int160.FromByteArray(ret[j].ID), target)) < 0
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return
+}
+
+// Returns the lowest and highest IDs sharing the first prefixLen bits with the target.
+func prefixRange(target int160.T, prefixLen int) (lo, hi [20]byte) {
+	lo = target.AsByteArray()
+	hi = lo
+	for i := prefixLen; i < 160; i++ {
+		mask := byte(0x80) >> (i % 8)
+		lo[i/8] &^= mask
+		hi[i/8] |= mask
+	}
+	return
+}
+
+// Close flushes any buffered updates and closes the database.
+func (me *Bolt) Close() (err error) {
+	me.closeOnce.Do(func() {
+		close(me.closed)
+		<-me.flushDone
+		err = me.Flush()
+		if closeErr := me.db.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return
+}
+
+type boltValue struct {
+	Addrs           []krpc.NodeAddr `bencode:"addrs"`
+	FirstSeen       int64           `bencode:"first"`
+	LastSeen        int64           `bencode:"last"`
+	LastResponse    int64           `bencode:"last_response,omitempty"`
+	QueriesSent     int64           `bencode:"sent,omitempty"`
+	Responses       int64           `bencode:"responses,omitempty"`
+	QueriesReceived int64           `bencode:"received,omitempty"`
+	ReadOnly        bool            `bencode:"ro,omitempty"`
+	Secure          bool            `bencode:"secure,omitempty"`
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+	return time.Unix(unix, 0)
+}
+
+func marshalRecord(r Record) ([]byte, error) {
+	return bencode.Marshal(boltValue{
+		Addrs:           r.Addrs,
+		FirstSeen:       unixOrZero(r.FirstSeen),
+		LastSeen:        unixOrZero(r.LastSeen),
+		LastResponse:    unixOrZero(r.LastResponse),
+		QueriesSent:     r.QueriesSent,
+		Responses:       r.Responses,
+		QueriesReceived: r.QueriesReceived,
+		ReadOnly:        r.ReadOnly,
+		Secure:          r.Secure,
+	})
+}
+
+func unmarshalRecord(k, v []byte) (r Record, err error) {
+	var bv boltValue
+	err = bencode.Unmarshal(v, &bv)
+	if err != nil {
+		return
+	}
+	copy(r.ID[:], k)
+	r.Addrs = bv.Addrs
+	r.FirstSeen = timeOrZero(bv.FirstSeen)
+	r.LastSeen = timeOrZero(bv.LastSeen)
+	r.LastResponse = timeOrZero(bv.LastResponse)
+	r.QueriesSent = bv.QueriesSent
+	r.Responses = bv.Responses
+	r.QueriesReceived = bv.QueriesReceived
+	r.ReadOnly = bv.ReadOnly
+	r.Secure = bv.Secure
+	return
+}
+
+func getRecord(b *bbolt.Bucket, id krpc.ID) (r Record, ok bool, err error) {
+	v := b.Get(id[:])
+	if v == nil {
+		return
+	}
+	r, err = unmarshalRecord(id[:], v)
+	ok = err == nil
+	return
+}
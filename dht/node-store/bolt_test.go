@@ -0,0 +1,178 @@
+package node_store
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.etcd.io/bbolt"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+)
+
+func openTestBolt(c *qt.C) *Bolt {
+	b, err := OpenBolt(filepath.Join(c.TempDir(), "nodes.db"))
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { b.Close() })
+	return b
+}
+
+func nodeInfo(id byte, port int) krpc.NodeInfo {
+	return krpc.NodeInfo{
+		ID:   krpc.ID{id},
+		Addr: krpc.NodeAddr{IP: net.IPv4(1, 2, 3, id), Port: port},
+	}
+}
+
+func TestBoltUpdateAndReopen(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.TempDir(), "nodes.db")
+	b, err := OpenBolt(path)
+	c.Assert(err, qt.IsNil)
+	now := time.Unix(1630000000, 0)
+	ni := nodeInfo(1, 6881)
+	b.Update(Update{NodeInfo: ni, Event: EventQuerySent, Time: now})
+	b.Update(Update{NodeInfo: ni, Event: EventResponded, Time: now.Add(time.Second), Secure: true})
+	moved := ni
+	moved.Addr.Port = 6882
+	b.Update(Update{NodeInfo: moved, Event: EventQueried, Time: now.Add(2 * time.Second), ReadOnly: true})
+	c.Assert(b.Close(), qt.IsNil)
+
+	b, err = OpenBolt(path)
+	c.Assert(err, qt.IsNil)
+	defer b.Close()
+	r, ok, err := b.Get(ni.ID)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(r.FirstSeen.Equal(now), qt.IsTrue)
+	c.Assert(r.LastSeen.Equal(now.Add(2*time.Second)), qt.IsTrue)
+	c.Assert(r.LastResponse.Equal(now.Add(time.Second)), qt.IsTrue)
+	c.Assert(r.QueriesSent, qt.Equals, int64(1))
+	c.Assert(r.Responses, qt.Equals, int64(1))
+	c.Assert(r.QueriesReceived, qt.Equals, int64(1))
+	c.Assert(r.ResponseRate(), qt.Equals, 1.0)
+	c.Assert(r.ReadOnly, qt.IsTrue)
+	// Secure is as of the last update, which came from a different address.
+	c.Assert(r.Secure, qt.IsFalse)
+	c.Assert(r.Addrs, qt.HasLen, 2)
+	c.Assert(r.NodeInfo().Addr.Port, qt.Equals, 6882)
+	_, ok, err = b.Get(krpc.ID{2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+}
+
+func TestBoltBest(t *testing.T) {
+	c := qt.New(t)
+	b := openTestBolt(c)
+	now := time.Now()
+	respond := func(id byte, sent, responses int, at time.Time) {
+		for i := 0; i < sent; i++ {
+			b.Update(Update{NodeInfo: nodeInfo(id, 1), Event: EventQuerySent, Time: at})
+		}
+		for i := 0; i < responses; i++ {
+			b.Update(Update{NodeInfo: nodeInfo(id, 1), Event: EventResponded, Time: at})
+		}
+	}
+	respond(1, 4, 1, now)
+	respond(2, 4, 4, now)
+	respond(3, 1, 1, now.Add(-48*time.Hour))
+	// Never responded.
+	respond(4, 4, 0, now)
+	// Read-only.
+	b.Update(Update{NodeInfo: nodeInfo(5, 1), Event: EventResponded, Time: now, ReadOnly: true})
+	best, err := b.Best(10)
+	c.Assert(err, qt.IsNil)
+	var ids []byte
+	for _, r := range best {
+		ids = append(ids, r.ID[0])
+	}
+	c.Assert(ids, qt.DeepEquals, []byte{2, 1, 3})
+	best, err = b.Best(1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(best, qt.HasLen, 1)
+	// Responding again moves a Node to the later day.
+	respond(3, 1, 1, now)
+	best, err = b.Best(10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(best, qt.HasLen, 3)
+	c.Assert(best[2].ID[0], qt.Equals, byte(1))
+}
+
+func TestBoltBestIndexRebuilt(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.TempDir(), "nodes.db")
+	b, err := OpenBolt(path)
+	c.Assert(err, qt.IsNil)
+	now := time.Now()
+	b.Update(Update{NodeInfo: nodeInfo(1, 1), Event: EventResponded, Time: now.Add(-48 * time.Hour)})
+	b.Update(Update{NodeInfo: nodeInfo(2, 1), Event: EventResponded, Time: now})
+	b.Update(Update{NodeInfo: nodeInfo(3, 1), Event: EventQueried, Time: now})
+	c.Assert(b.Close(), qt.IsNil)
+	// As written before the index was kept.
+	db, err := bbolt.Open(path, 0600, nil)
+	c.Assert(err, qt.IsNil)
+	c.Assert(db.Update(func(tx *bbolt.Tx) error {
+		return tx.DeleteBucket(respondedBucketKey)
+	}), qt.IsNil)
+	c.Assert(db.Close(), qt.IsNil)
+
+	b, err = OpenBolt(path)
+	c.Assert(err, qt.IsNil)
+	defer b.Close()
+	best, err := b.Best(10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(best, qt.HasLen, 2)
+	c.Assert(best[0].ID[0], qt.Equals, byte(2))
+	c.Assert(best[1].ID[0], qt.Equals, byte(1))
+}
+
+func TestBoltFlushFailureKeepsUpdates(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.TempDir(), "nodes.db")
+	b, err := OpenBolt(path)
+	c.Assert(err, qt.IsNil)
+	defer b.Close()
+	now := time.Unix(1630000000, 0)
+	ni := nodeInfo(1, 6881)
+	b.Update(Update{NodeInfo: ni, Event: EventQuerySent, Time: now})
+	b.Update(Update{NodeInfo: ni, Event: EventResponded, Time: now.Add(time.Second)})
+	c.Assert(b.db.Close(), qt.IsNil)
+	c.Assert(b.Flush(), qt.Not(qt.IsNil))
+	b.Update(Update{NodeInfo: ni, Event: EventQueried, Time: now.Add(2 * time.Second), ReadOnly: true})
+	b.db, err = bbolt.Open(path, 0600, nil)
+	c.Assert(err, qt.IsNil)
+	r, ok, err := b.Get(ni.ID)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Check(r.QueriesSent, qt.Equals, int64(1))
+	c.Check(r.Responses, qt.Equals, int64(1))
+	c.Check(r.QueriesReceived, qt.Equals, int64(1))
+	c.Check(r.FirstSeen.Equal(now), qt.IsTrue)
+	c.Check(r.LastResponse.Equal(now.Add(time.Second)), qt.IsTrue)
+	c.Check(r.ReadOnly, qt.IsTrue)
+}
+
+func TestBoltClosest(t *testing.T) {
+	c := qt.New(t)
+	b := openTestBolt(c)
+	for _, id := range []byte{0x00, 0x10, 0x11, 0x80, 0xff} {
+		b.Update(Update{NodeInfo: nodeInfo(id, 1), Event: EventQueried})
+	}
+	n, err := b.Len()
+	c.Assert(err, qt.IsNil)
+	c.Assert(n, qt.Equals, 5)
+	closest, err := b.Closest(int160.FromByteArray(krpc.ID{0x12}), 3)
+	c.Assert(err, qt.IsNil)
+	var ids []byte
+	for _, r := range closest {
+		ids = append(ids, r.ID[0])
+	}
+	c.Assert(ids, qt.DeepEquals, []byte{0x10, 0x11, 0x00})
+	closest, err = b.Closest(int160.FromByteArray(krpc.ID{0xfe}), 10)
+	c.Assert(err, qt.IsNil)
+	c.Assert(closest, qt.HasLen, 5)
+	c.Assert(closest[0].ID[0], qt.Equals, byte(0xff))
+}
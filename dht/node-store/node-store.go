@@ -0,0 +1,123 @@
+package node_store
+
+import (
+	"time"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+)
+
+// Interface is a store of every Node a DHT server has interacted with.
+type Interface interface {
+	// Records an interaction with a Node. This is called while handling packets, so
+	// implementations shouldn't block on IO.
+	Update(Update)
+	// Returns the record for a Node ID.
+	Get(krpc.ID) (_ Record, ok bool, _ error)
+	// Returns up to n Nodes most likely to respond, for bootstrapping a routing table.
+	Best(n int) ([]Record, error)
+	// Returns up to n Nodes closest to the target ID, nearest first.
+	Closest(target int160.T, n int) ([]Record, error)
+}
+
+type Event int
+
+const (
+	// The Node sent us a query.
+	EventQueried Event = iota
+	// We sent the Node a query.
+	EventQuerySent
+	// The Node responded to one of our queries.
+	EventResponded
+)
+
+// Update describes a single interaction with a Node.
+type Update struct {
+	krpc.NodeInfo
+	Event Event
+	Time  time.Time
+	// BEP 43. The Node claims it doesn't respond to queries.
+	ReadOnly bool
+	// BEP 42. The Node's ID is valid for its IP.
+	Secure bool
+}
+
+// Maximum distinct addresses kept for a Node.
+const maxAddrs = 4
+
+// Record is everything known about a Node.
+type Record struct {
+	ID krpc.ID
+	// Most recently used first.
+	Addrs           []krpc.NodeAddr
+	FirstSeen       time.Time
+	LastSeen        time.Time
+	LastResponse    time.Time
+	QueriesSent     int64
+	Responses       int64
+	QueriesReceived int64
+	// BEP 43, as of the Node's last message.
+	ReadOnly bool
+	// BEP 42, as of the Node's last message.
+	Secure bool
+}
+
+// Fraction of our queries that the Node responded to, or 0 if we've never queried it.
+func (r Record) ResponseRate() float64 {
+	if r.QueriesSent == 0 {
+		return 0
+	}
+	if r.Responses > r.QueriesSent {
+		return 1
+	}
+	return float64(r.Responses) / float64(r.QueriesSent)
+}
+
+func (r Record) NodeInfo() (ret krpc.NodeInfo) {
+	ret.ID = r.ID
+	if len(r.Addrs) != 0 {
+		ret.Addr = r.Addrs[0]
+	}
+	return
+}
+
+func (r *Record) apply(u Update) {
+	if r.FirstSeen.IsZero() || u.Time.Before(r.FirstSeen) {
+		r.FirstSeen = u.Time
+	}
+	if u.Time.After(r.LastSeen) {
+		r.LastSeen = u.Time
+	}
+	r.addAddr(u.Addr)
+	switch u.Event {
+	case EventQueried:
+		r.QueriesReceived++
+		r.ReadOnly = u.ReadOnly
+	case EventQuerySent:
+		r.QueriesSent++
+	case EventResponded:
+		r.Responses++
+		r.ReadOnly = u.ReadOnly
+		if u.Time.After(r.LastResponse) {
+			r.LastResponse = u.Time
+		}
+	}
+	r.Secure = u.Secure
+}
+
+func (r *Record) addAddr(na krpc.NodeAddr) {
+	if ip4 := na.IP.To4(); ip4 != nil {
+		na.IP = ip4
+	}
+	for i, a := range r.Addrs {
+		if a.IP.Equal(na.IP) && a.Port == na.Port {
+			copy(r.Addrs[1:i+1], r.Addrs[:i])
+			r.Addrs[0] = na
+			return
+		}
+	}
+	r.Addrs = append([]krpc.NodeAddr{na}, r.Addrs...)
+	if len(r.Addrs) > maxAddrs {
+		r.Addrs = r.Addrs[:maxAddrs]
+	}
+}
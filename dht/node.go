@@ -28,6 +28,14 @@ func (s *Server) IsQuestionable(n *Node) bool {
 	return !s.IsGood(n) && !s.nodeIsBad(n)
 }
 
+// The last time we heard from the Node, whether it was a query or a response.
+func (n *Node) lastSeen() time.Time {
+	if n.lastGotQuery.After(n.lastGotResponse) {
+		return n.lastGotQuery
+	}
+	return n.lastGotResponse
+}
+
 func (n *Node) hasAddrAndID(addr Addr, id int160.T) bool {
 	return id == n.Id && n.Addr.String() == addr.String()
 }
@@ -0,0 +1,227 @@
+package peer_store
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"testTorrent/dht/krpc"
+)
+
+var peersBucketKey = []byte("peers")
+
+// Bolt is an InMemory store that's saved to a bbolt database, so announces survive restarts. Reads
+// are served from memory, and changes are written out in batches.
+type Bolt struct {
+	InMemory
+	db *bbolt.DB
+
+	pendingMu sync.Mutex
+	// Values to put by key, nil for deletes.
+	pending map[string][]byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	flushDone chan struct{}
+}
+
+var _ Store = (*Bolt)(nil)
+
+// How often buffered changes are written out by OpenBolt stores.
+const DefaultFlushInterval = 10 * time.Second
+
+// OpenBolt opens or creates a bbolt database file for storing peers, and loads the announces that
+// haven't expired.
+func OpenBolt(path string, limits Limits) (*Bolt, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret := &Bolt{
+		InMemory:  InMemory{Limits: limits},
+		db:        db,
+		pending:   make(map[string][]byte),
+		closed:    make(chan struct{}),
+		flushDone: make(chan struct{}),
+	}
+	ret.onRemove = func(ih InfoHash, nat NodeAndTime) {
+		ret.queue(ih, nat, false)
+	}
+	if err := ret.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	go ret.flusher(DefaultFlushInterval)
+	return ret, nil
+}
+
+type boltEntry struct {
+	ih InfoHash
+	NodeAndTime
+}
+
+// Reads the stored announces into memory, deleting those that have expired.
+func (me *Bolt) load() error {
+	var entries []boltEntry
+	err := me.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(peersBucketKey)
+		if err != nil {
+			return err
+		}
+		cutoff := me.timeNow().Add(-me.ttl())
+		var expired [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			e, err := unmarshalBoltEntry(k, v)
+			if err != nil {
+				return err
+			}
+			if e.Time.After(cutoff) {
+				entries = append(entries, e)
+			} else {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	for _, e := range entries {
+		// Anything beyond the limits is queued for deletion.
+		me.add(e.ih, e.NodeAndTime)
+	}
+	return nil
+}
+
+func (me *Bolt) AddPeer(ih InfoHash, na krpc.NodeAddr) {
+	me.AnnouncePeer(ih, na, false)
+}
+
+func (me *Bolt) AnnouncePeer(ih InfoHash, na krpc.NodeAddr, seed bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	nat := NodeAndTime{na, me.timeNow(), seed}
+	me.add(ih, nat)
+	me.queue(ih, nat, true)
+}
+
+// Buffers a change for the next Flush. Called with mu held, so the order of changes to a peer is
+// kept.
+func (me *Bolt) queue(ih InfoHash, nat NodeAndTime, put bool) {
+	k := boltKey(ih, nat.NodeAddr)
+	var v []byte
+	if put {
+		v = marshalBoltValue(nat)
+	}
+	me.pendingMu.Lock()
+	me.pending[k] = v
+	me.pendingMu.Unlock()
+}
+
+func (me *Bolt) flusher(interval time.Duration) {
+	defer close(me.flushDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Expired peers are only dropped when the store is used, so do it here too.
+			me.Len()
+			me.Flush()
+		case <-me.closed:
+			return
+		}
+	}
+}
+
+// Flush writes buffered changes to the database.
+func (me *Bolt) Flush() error {
+	me.pendingMu.Lock()
+	pending := me.pending
+	me.pending = make(map[string][]byte, len(pending))
+	me.pendingMu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	return me.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(peersBucketKey)
+		for k, v := range pending {
+			var err error
+			if v == nil {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Close writes out buffered changes and closes the database.
+func (me *Bolt) Close() (err error) {
+	me.closeOnce.Do(func() {
+		close(me.closed)
+		<-me.flushDone
+		err = me.Flush()
+		if closeErr := me.db.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return
+}
+
+// The infohash then the peer key, so an infohash's peers are together.
+func boltKey(ih InfoHash, na krpc.NodeAddr) string {
+	return string(ih[:]) + peerKey(na)
+}
+
+// The announce time in Unix nanoseconds, then the seed flag.
+func marshalBoltValue(nat NodeAndTime) []byte {
+	var b [9]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(nat.Time.UnixNano()))
+	if nat.Seed {
+		b[8] = 1
+	}
+	return b[:]
+}
+
+func unmarshalBoltEntry(k, v []byte) (e boltEntry, err error) {
+	if len(k) != len(e.ih)+18 || len(v) != 9 {
+		err = errors.New("bad peer record")
+		return
+	}
+	copy(e.ih[:], k)
+	k = k[len(e.ih):]
+	ip := net.IP(append([]byte(nil), k[:16]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	e.NodeAddr = krpc.NodeAddr{IP: ip, Port: int(binary.BigEndian.Uint16(k[16:]))}
+	e.Time = time.Unix(0, int64(binary.BigEndian.Uint64(v[:8])))
+	e.Seed = v[8] != 0
+	return
+}
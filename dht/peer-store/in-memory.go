@@ -2,8 +2,11 @@ package peer_store
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -14,38 +17,126 @@ import (
 	"testTorrent/dht/krpc"
 )
 
+// InMemory keeps announced peers in memory. Peers are keyed by IP and port. Announces expire after
+// the TTL, and the least recently announced peers are dropped to stay within the other Limits. The
+// zero value is ready to use.
 type InMemory struct {
 	// This is used for sorting infohashes by distance in WriteDebug.
 	RootId int160.T
-	mu     sync.RWMutex
-	index  map[InfoHash]indexValue
+	Limits
+
+	mu    sync.Mutex
+	index map[InfoHash]indexValue
+	// Every peer, least recently announced first.
+	byTime list.List
+	// Bloom filters for scrapes, built on demand and dropped when an infohash's peers change.
+	scrapes map[InfoHash]*scrape
+	// Called with mu held for each peer dropped by expiry or the limits.
+	onRemove func(InfoHash, NodeAndTime)
+	// Overridden in tests.
+	now func() time.Time
 }
 
 // A uniqueness key for entries to the entry details
-type indexValue = map[string]NodeAndTime
+type indexValue = map[string]*list.Element
+
+type scrape struct {
+	seeds, peers krpc.ScrapeBloomFilter
+}
+
+type entry struct {
+	ih  InfoHash
+	key string
+	NodeAndTime
+}
 
 var _ interface {
 	debug_writer.Interface
+	InfoHashSampler
+	Store
 } = (*InMemory)(nil)
 
+func (me *InMemory) timeNow() time.Time {
+	if me.now != nil {
+		return me.now()
+	}
+	return time.Now()
+}
+
+// IP and port, with IPv4 addresses in one form.
+func peerKey(na krpc.NodeAddr) string {
+	var b [18]byte
+	copy(b[:16], na.IP.To16())
+	binary.BigEndian.PutUint16(b[16:], uint16(na.Port))
+	return string(b[:])
+}
+
 func (me *InMemory) GetPeers(ih InfoHash) (ret []krpc.NodeAddr) {
-	me.mu.RLock()
-	defer me.mu.RUnlock()
-	for b := range me.index[ih] {
-		var r krpc.NodeAddr
-		err := r.UnmarshalBinary([]byte(b))
-		if err != nil {
-			panic(err)
+	return me.GetPeersFiltered(ih, GetPeersOpts{})
+}
+
+func (me *InMemory) GetPeersFiltered(ih InfoHash, opts GetPeersOpts) (ret []krpc.NodeAddr) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.expire()
+	for _, e := range me.index[ih] {
+		nat := e.Value.(*entry).NodeAndTime
+		if opts.match(nat.NodeAddr, nat.Seed) {
+			ret = append(ret, nat.NodeAddr)
 		}
-		ret = append(ret, r)
+	}
+	if opts.Limit > 0 && len(ret) > opts.Limit {
+		rand.Shuffle(len(ret), func(i, j int) { ret[i], ret[j] = ret[j], ret[i] })
+		ret = ret[:opts.Limit]
 	}
 	return
 }
 
+func (me *InMemory) Scrape(ih InfoHash) (seeds, peers krpc.ScrapeBloomFilter) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.expire()
+	nodes := me.index[ih]
+	if len(nodes) == 0 {
+		return
+	}
+	sc, ok := me.scrapes[ih]
+	if !ok {
+		sc = new(scrape)
+		for _, e := range nodes {
+			nat := e.Value.(*entry).NodeAndTime
+			ip := nat.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			if nat.Seed {
+				sc.seeds.AddIp(ip)
+			} else {
+				sc.peers.AddIp(ip)
+			}
+		}
+		if me.scrapes == nil {
+			me.scrapes = make(map[InfoHash]*scrape)
+		}
+		me.scrapes[ih] = sc
+	}
+	return sc.seeds, sc.peers
+}
+
 func (me *InMemory) AddPeer(ih InfoHash, na krpc.NodeAddr) {
-	key := string(na.IP)
+	me.AnnouncePeer(ih, na, false)
+}
+
+func (me *InMemory) AnnouncePeer(ih InfoHash, na krpc.NodeAddr, seed bool) {
 	me.mu.Lock()
 	defer me.mu.Unlock()
+	me.add(ih, NodeAndTime{na, me.timeNow(), seed})
+}
+
+// Adds or refreshes a peer, and then applies the limits. Times must not go backwards, so that byTime
+// stays in order. Called with mu held.
+func (me *InMemory) add(ih InfoHash, nat NodeAndTime) {
+	me.expire()
 	if me.index == nil {
 		me.index = make(map[InfoHash]indexValue)
 	}
@@ -54,21 +145,94 @@ func (me *InMemory) AddPeer(ih InfoHash, na krpc.NodeAddr) {
 		nodes = make(indexValue)
 		me.index[ih] = nodes
 	}
-	nodes[key] = NodeAndTime{na, time.Now()}
+	key := peerKey(nat.NodeAddr)
+	if e, ok := nodes[key]; ok {
+		en := e.Value.(*entry)
+		if en.Seed != nat.Seed {
+			delete(me.scrapes, ih)
+		}
+		en.NodeAndTime = nat
+		me.byTime.MoveToBack(e)
+		return
+	}
+	nodes[key] = me.byTime.PushBack(&entry{ih, key, nat})
+	delete(me.scrapes, ih)
+	if len(nodes) > me.maxPerInfoHash() {
+		var oldest *list.Element
+		for _, e := range nodes {
+			if oldest == nil || e.Value.(*entry).Time.Before(oldest.Value.(*entry).Time) {
+				oldest = e
+			}
+		}
+		me.remove(oldest)
+	}
+	for me.byTime.Len() > me.maxPeers() {
+		me.remove(me.byTime.Front())
+	}
+}
+
+func (me *InMemory) remove(e *list.Element) {
+	en := me.byTime.Remove(e).(*entry)
+	nodes := me.index[en.ih]
+	delete(nodes, en.key)
+	delete(me.scrapes, en.ih)
+	if len(nodes) == 0 {
+		delete(me.index, en.ih)
+	}
+	if me.onRemove != nil {
+		me.onRemove(en.ih, en.NodeAndTime)
+	}
+}
+
+// Drops announces older than the TTL. Called with mu held.
+func (me *InMemory) expire() {
+	cutoff := me.timeNow().Add(-me.ttl())
+	for e := me.byTime.Front(); e != nil && !e.Value.(*entry).Time.After(cutoff); e = me.byTime.Front() {
+		me.remove(e)
+	}
+}
+
+// Len returns the number of peers stored, over all infohashes.
+func (me *InMemory) Len() int {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.expire()
+	return me.byTime.Len()
+}
+
+func (me *InMemory) SampleInfoHashes(n int) (sample []InfoHash, total int) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.expire()
+	total = len(me.index)
+	// Reservoir sampling, as map iteration order isn't uniformly random.
+	i := 0
+	for ih := range me.index {
+		if i < n {
+			sample = append(sample, ih)
+		} else if j := rand.Intn(i + 1); j < n {
+			sample[j] = ih
+		}
+		i++
+	}
+	return
 }
 
 type NodeAndTime struct {
 	krpc.NodeAddr
 	time.Time
+	// Announced as a seed, per BEP 33.
+	Seed bool
 }
 
 func (me *InMemory) GetAll() (ret map[InfoHash][]NodeAndTime) {
-	me.mu.RLock()
-	defer me.mu.RUnlock()
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	me.expire()
 	ret = make(map[InfoHash][]NodeAndTime, len(me.index))
 	for ih, nodes := range me.index {
-		for _, v := range nodes {
-			ret[ih] = append(ret[ih], v)
+		for _, e := range nodes {
+			ret[ih] = append(ret[ih], e.Value.(*entry).NodeAndTime)
 		}
 	}
 	return
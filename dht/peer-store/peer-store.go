@@ -1,6 +1,8 @@
 package peer_store
 
 import (
+	"time"
+
 	"testTorrent/dht/krpc"
 	"testTorrent/torrent/metainfo"
 )
@@ -11,3 +13,83 @@ type Interface interface {
 	AddPeer(InfoHash, krpc.NodeAddr)
 	GetPeers(InfoHash) []krpc.NodeAddr
 }
+
+// Implemented by peer stores that can answer BEP 51 sample_infohashes queries.
+type InfoHashSampler interface {
+	// Returns up to n randomly chosen infohashes, and the total number stored.
+	SampleInfoHashes(n int) (sample []InfoHash, total int)
+}
+
+// Store is a peer store that knows which peers are seeds, and can bound what it returns. The DHT
+// server uses it in place of Interface when the PeerStore implements it.
+type Store interface {
+	Interface
+	// Like AddPeer, with BEP 33's seed flag from announce_peer.
+	AnnouncePeer(ih InfoHash, na krpc.NodeAddr, seed bool)
+	// Returns up to opts.Limit peers for the infohash, chosen at random if more pass opts.
+	GetPeersFiltered(InfoHash, GetPeersOpts) []krpc.NodeAddr
+	// Returns BEP 33 bloom filters of the IPs of the seeds and the other peers for the infohash.
+	Scrape(InfoHash) (seeds, peers krpc.ScrapeBloomFilter)
+}
+
+// GetPeersOpts selects the peers returned by Store.GetPeersFiltered.
+type GetPeersOpts struct {
+	// Address families to return, as from a get_peers want (BEP 32). If neither is set, both are
+	// returned.
+	IPv4, IPv6 bool
+	// Leave out seeds, per BEP 33's noseed.
+	NoSeed bool
+	// The most peers to return. 0 means no limit.
+	Limit int
+}
+
+func (opts GetPeersOpts) match(na krpc.NodeAddr, seed bool) bool {
+	if opts.NoSeed && seed {
+		return false
+	}
+	if !opts.IPv4 && !opts.IPv6 {
+		return true
+	}
+	if na.IP.To4() != nil {
+		return opts.IPv4
+	}
+	return opts.IPv6
+}
+
+const (
+	// Peers re-announce about every 30 minutes per BEP 5, so anything older is likely gone.
+	DefaultPeerTTL             = 30 * time.Minute
+	DefaultMaxPeersPerInfoHash = 1000
+	DefaultMaxPeers            = 1 << 20
+)
+
+// Limits bound a peer store. Zero fields take the defaults.
+type Limits struct {
+	// How long an announce is kept. Defaults to DefaultPeerTTL.
+	TTL time.Duration
+	// The most peers kept for one infohash. Defaults to DefaultMaxPeersPerInfoHash.
+	MaxPerInfoHash int
+	// The most peers kept in all, which bounds memory use. Defaults to DefaultMaxPeers.
+	MaxPeers int
+}
+
+func (l Limits) ttl() time.Duration {
+	if l.TTL == 0 {
+		return DefaultPeerTTL
+	}
+	return l.TTL
+}
+
+func (l Limits) maxPerInfoHash() int {
+	if l.MaxPerInfoHash == 0 {
+		return DefaultMaxPeersPerInfoHash
+	}
+	return l.MaxPerInfoHash
+}
+
+func (l Limits) maxPeers() int {
+	if l.MaxPeers == 0 {
+		return DefaultMaxPeers
+	}
+	return l.MaxPeers
+}
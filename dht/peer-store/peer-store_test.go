@@ -0,0 +1,171 @@
+package peer_store
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"testTorrent/dht/krpc"
+)
+
+func peer(i int) krpc.NodeAddr {
+	return krpc.NodeAddr{IP: net.IPv4(1, 2, 3, byte(i)).To4(), Port: 1000 + i}
+}
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (me *fakeClock) now() time.Time {
+	return me.t
+}
+
+func (me *fakeClock) advance(d time.Duration) {
+	me.t = me.t.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{time.Unix(1630000000, 0)}
+}
+
+// Peers as strings, for comparing regardless of order.
+func peerSet(nas []krpc.NodeAddr) map[string]bool {
+	ret := make(map[string]bool, len(nas))
+	for _, na := range nas {
+		ret[na.String()] = true
+	}
+	return ret
+}
+
+func TestInMemoryExpiry(t *testing.T) {
+	c := qt.New(t)
+	clock := newFakeClock()
+	me := &InMemory{now: clock.now}
+	ih := InfoHash{1}
+	samePort := krpc.NodeAddr{IP: peer(1).IP, Port: 1}
+	me.AddPeer(ih, peer(1))
+	me.AddPeer(ih, samePort)
+	clock.advance(DefaultPeerTTL / 2)
+	me.AddPeer(ih, peer(2))
+	// Peers on the same IP are kept apart by port.
+	c.Assert(me.GetPeers(ih), qt.HasLen, 3)
+	// Announcing again keeps the peer for another TTL.
+	me.AddPeer(ih, peer(1))
+	clock.advance(DefaultPeerTTL / 2)
+	c.Check(peerSet(me.GetPeers(ih)), qt.DeepEquals, peerSet([]krpc.NodeAddr{peer(1), peer(2)}))
+	clock.advance(DefaultPeerTTL / 2)
+	c.Check(me.GetPeers(ih), qt.HasLen, 0)
+	c.Check(me.Len(), qt.Equals, 0)
+	_, total := me.SampleInfoHashes(1)
+	c.Check(total, qt.Equals, 0)
+}
+
+func TestInMemoryLimits(t *testing.T) {
+	c := qt.New(t)
+	clock := newFakeClock()
+	me := &InMemory{
+		Limits: Limits{MaxPerInfoHash: 2, MaxPeers: 3},
+		now:    clock.now,
+	}
+	add := func(ih InfoHash, i int) {
+		clock.advance(time.Second)
+		me.AddPeer(ih, peer(i))
+	}
+	add(InfoHash{1}, 1)
+	add(InfoHash{1}, 2)
+	add(InfoHash{1}, 3)
+	c.Check(peerSet(me.GetPeers(InfoHash{1})), qt.DeepEquals, peerSet([]krpc.NodeAddr{peer(2), peer(3)}))
+	add(InfoHash{2}, 4)
+	add(InfoHash{2}, 5)
+	c.Check(me.Len(), qt.Equals, 3)
+	c.Check(me.GetPeers(InfoHash{1}), qt.DeepEquals, []krpc.NodeAddr{peer(3)})
+}
+
+func TestInMemoryGetPeersFiltered(t *testing.T) {
+	c := qt.New(t)
+	me := &InMemory{}
+	ih := InfoHash{1}
+	for i := 0; i < 5; i++ {
+		me.AnnouncePeer(ih, peer(i), i == 0)
+	}
+	peer6 := krpc.NodeAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}
+	me.AnnouncePeer(ih, peer6, false)
+	c.Check(me.GetPeersFiltered(ih, GetPeersOpts{IPv6: true}), qt.DeepEquals, []krpc.NodeAddr{peer6})
+	c.Check(me.GetPeersFiltered(ih, GetPeersOpts{IPv4: true}), qt.HasLen, 5)
+	c.Check(me.GetPeersFiltered(ih, GetPeersOpts{IPv4: true, NoSeed: true}), qt.HasLen, 4)
+	c.Check(me.GetPeersFiltered(ih, GetPeersOpts{Limit: 2}), qt.HasLen, 2)
+	c.Check(me.GetPeersFiltered(ih, GetPeersOpts{}), qt.HasLen, 6)
+}
+
+func TestInMemoryScrape(t *testing.T) {
+	c := qt.New(t)
+	clock := newFakeClock()
+	me := &InMemory{now: clock.now}
+	ih := InfoHash{1}
+	// Filters of the IPs of the given peers.
+	filter := func(is ...int) (ret krpc.ScrapeBloomFilter) {
+		for _, i := range is {
+			ret.AddIp(peer(i).IP)
+		}
+		return
+	}
+	scrape := func(wantSeeds, wantPeers krpc.ScrapeBloomFilter) {
+		c.Helper()
+		seeds, peers := me.Scrape(ih)
+		c.Check(seeds, qt.Equals, wantSeeds)
+		c.Check(peers, qt.Equals, wantPeers)
+	}
+	scrape(filter(), filter())
+	for i := 0; i < 3; i++ {
+		me.AnnouncePeer(ih, peer(i), i == 0)
+	}
+	scrape(filter(0), filter(1, 2))
+	// Completing the download moves a peer to the seeds.
+	clock.advance(time.Minute)
+	me.AnnouncePeer(ih, peer(1), true)
+	scrape(filter(0, 1), filter(2))
+	clock.advance(DefaultPeerTTL - time.Second)
+	scrape(filter(1), filter())
+}
+
+func TestBoltReopen(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(c.TempDir(), "peers.db")
+	reopen := func(limits Limits) *Bolt {
+		b, err := OpenBolt(path, limits)
+		c.Assert(err, qt.IsNil)
+		return b
+	}
+	b := reopen(Limits{})
+	ih := InfoHash{1}
+	b.AnnouncePeer(ih, peer(1), true)
+	// So peer 2 is the more recent on reloading.
+	time.Sleep(time.Millisecond)
+	b.AnnouncePeer(ih, peer(2), false)
+	b.AnnouncePeer(InfoHash{2}, peer(3), false)
+	c.Assert(b.Close(), qt.IsNil)
+
+	b = reopen(Limits{})
+	c.Check(peerSet(b.GetPeers(ih)), qt.DeepEquals, peerSet([]krpc.NodeAddr{peer(1), peer(2)}))
+	c.Check(b.GetPeersFiltered(ih, GetPeersOpts{NoSeed: true}), qt.DeepEquals, []krpc.NodeAddr{peer(2)})
+	c.Assert(b.Close(), qt.IsNil)
+
+	// Peers beyond the limits when loading are deleted, keeping the most recent.
+	b = reopen(Limits{MaxPerInfoHash: 1})
+	c.Check(b.GetPeers(ih), qt.DeepEquals, []krpc.NodeAddr{peer(2)})
+	c.Assert(b.Close(), qt.IsNil)
+	b = reopen(Limits{})
+	c.Check(b.Len(), qt.Equals, 2)
+	c.Assert(b.Close(), qt.IsNil)
+
+	// As are expired peers.
+	b = reopen(Limits{TTL: time.Nanosecond})
+	c.Check(b.Len(), qt.Equals, 0)
+	c.Assert(b.Close(), qt.IsNil)
+	b = reopen(Limits{})
+	defer b.Close()
+	c.Check(b.Len(), qt.Equals, 0)
+}
@@ -0,0 +1,325 @@
+package dht
+
+// BEP 51, sample_infohashes.
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/stm"
+	"github.com/anacrolix/stm/stmutil"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+	peer_store "testTorrent/dht/peer-store"
+)
+
+// The longest interval BEP 51 permits, and libtorrent's default.
+const DefaultSampleInfohashesInterval = 6 * time.Hour
+
+// Keeps sample_infohashes responses within a typical UDP payload, alongside the closest nodes.
+const maxSampleInfohashes = 20
+
+// How long to wait before querying a Node again that doesn't support sample_infohashes.
+const sampleInfohashesUnsupportedInterval = time.Hour
+
+// How long an empty sample is given out for, so that a Server whose PeerStore is still filling, as
+// after a start, doesn't advertise nothing for a whole interval.
+const emptySampleInfohashesInterval = time.Minute
+
+// The sample we give out to sample_infohashes queriers until it expires.
+type infohashSample struct {
+	infohashes krpc.CompactInfohashes
+	num        int64
+	expires    time.Time
+}
+
+func (s *Server) sampleInfohashesInterval() time.Duration {
+	if i := s.config.SampleInfohashesInterval; i > 0 {
+		return i
+	}
+	return DefaultSampleInfohashesInterval
+}
+
+// Returns the current sample, taking a new one from the PeerStore if it has expired. Called with the
+// Server locked.
+func (s *Server) currentInfohashSample(now time.Time) infohashSample {
+	if now.Before(s.infohashSample.expires) {
+		return s.infohashSample
+	}
+	sample := infohashSample{
+		infohashes: krpc.CompactInfohashes{},
+	}
+	if ps, ok := s.config.PeerStore.(peer_store.InfoHashSampler); ok {
+		ihs, total := ps.SampleInfoHashes(maxSampleInfohashes)
+		for _, ih := range ihs {
+			sample.infohashes = append(sample.infohashes, krpc.ID(ih))
+		}
+		sample.num = int64(total)
+	}
+	interval := s.sampleInfohashesInterval()
+	if len(sample.infohashes) == 0 && interval > emptySampleInfohashesInterval {
+		interval = emptySampleInfohashesInterval
+	}
+	sample.expires = now.Add(interval)
+	s.infohashSample = sample
+	return sample
+}
+
+// Answers from a sample of the PeerStore that's only refreshed once per interval, so repeated
+// queries within the interval get nothing new. Called with the Server locked.
+func (s *Server) handleSampleInfohashes(source Addr, m krpc.Msg) {
+	if m.A == nil {
+		s.sendError(source, m.T, krpcErrMissingArguments)
+		return
+	}
+	now := time.Now()
+	sample := s.currentInfohashSample(now)
+	interval := int64((sample.expires.Sub(now) + time.Second - 1) / time.Second)
+	r := krpc.Return{
+		Interval: &interval,
+		Num:      &sample.num,
+		Samples:  &sample.infohashes,
+	}
+	s.setReturnNodes(&r, m, source)
+	s.reply(source, m, r)
+}
+
+// Sends a sample_infohashes query to addr. target determines the nodes returned with the sample, which
+// are added to the routing table. The sample is in Reply.R.Samples, which is nil if the Node doesn't
+// support BEP 51. Addresses queried this way aren't queried again by SampleInfohashesWalks until the
+// interval the Node returns has passed.
+func (s *Server) SampleInfohashes(ctx context.Context, addr Addr, target int160.T) QueryResult {
+	return s.sampleInfohashes(ctx, addr, target, QueryRateLimiting{})
+}
+
+func (s *Server) sampleInfohashes(ctx context.Context, addr Addr, target int160.T, rl QueryRateLimiting) (ret QueryResult) {
+	ret = s.Query(ctx, addr, "sample_infohashes", QueryInput{
+		MsgArgs: krpc.MsgArgs{
+			Target: target.AsByteArray(),
+			Want:   []krpc.Want{krpc.WantNodes, krpc.WantNodes6},
+		},
+		RateLimiting: rl,
+	})
+	if e := ret.Reply.Error(); ret.Err == nil && e != nil {
+		ret.Err = e
+	}
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := ret.Reply
+	s.addResponseNodes(m)
+	switch {
+	case ret.Err != nil && m.E == nil:
+		// No response, so we don't know anything about the Node.
+	case m.R == nil || m.R.Samples == nil:
+		expvars.Add("sample_infohashes responses without samples", 1)
+		s.setNextInfohashSample(addr.KRPC(), now.Add(sampleInfohashesUnsupportedInterval))
+	default:
+		expvars.Add("sample_infohashes responses with samples", 1)
+		expvars.Add("sampled infohashes", int64(len(*m.R.Samples)))
+		s.setNextInfohashSample(addr.KRPC(), now.Add(sampleInterval(m.R)))
+	}
+	return
+}
+
+func sampleInterval(r *krpc.Return) time.Duration {
+	if r.Interval == nil || *r.Interval < 0 {
+		return 0
+	}
+	if i := time.Duration(*r.Interval) * time.Second; i < DefaultSampleInfohashesInterval {
+		return i
+	}
+	return DefaultSampleInfohashesInterval
+}
+
+// Records the earliest time addr should be sampled again. Called with the Server locked.
+func (s *Server) setNextInfohashSample(addr krpc.NodeAddr, next time.Time) {
+	if s.nextInfohashSample == nil {
+		s.nextInfohashSample = make(map[string]time.Time)
+	}
+	now := time.Now()
+	if len(s.nextInfohashSample) >= s.nextInfohashSamplePruneLen {
+		for k, t := range s.nextInfohashSample {
+			if !now.Before(t) {
+				delete(s.nextInfohashSample, k)
+			}
+		}
+		s.nextInfohashSamplePruneLen = 2*len(s.nextInfohashSample) + 1024
+	}
+	if next.After(now) {
+		s.nextInfohashSample[addr.String()] = next
+	}
+}
+
+func (s *Server) infohashSampleDue(addr krpc.NodeAddr) bool {
+	s.mu.RLock()
+	next, ok := s.nextInfohashSample[addr.String()]
+	s.mu.RUnlock()
+	return !ok || !time.Now().Before(next)
+}
+
+// InfohashSamples are the infohashes sampled from a single Node.
+type InfohashSamples struct {
+	Source     krpc.NodeInfo
+	Infohashes krpc.CompactInfohashes
+	// How many infohashes the Node claims to store.
+	Num int64
+	// How long the Node asked us to wait before sampling it again.
+	Interval time.Duration
+}
+
+// Maintains state for an ongoing walk of the keyspace with sample_infohashes queries. A walk is
+// started by calling Server.SampleInfohashesWalk.
+type SampleInfohashesWalk struct {
+	// Samples from each Node that responded. Closed when the walk completes or is closed.
+	Samples chan InfohashSamples
+
+	numContacted int64 // Accessed with atomic.
+
+	server        *Server
+	prefixBits    uint
+	regionReplies int
+	// Queries that might still send on Samples.
+	querying sync.WaitGroup
+
+	done   <-chan struct{}
+	cancel func()
+}
+
+var errSampleNotDue = errors.New("node's sample interval hasn't passed")
+
+// The keyspace is walked in 2^defaultSampleWalkPrefixBits regions.
+const defaultSampleWalkPrefixBits = 4
+
+// Divides the keyspace into 2^prefixBits regions (16 if prefixBits is 0), and traverses toward a
+// random target in each in turn with sample_infohashes queries, until enough Nodes in the region have
+// responded. Nodes aren't queried again until the interval they last returned has passed, including
+// across walks.
+func (s *Server) SampleInfohashesWalk(prefixBits uint) (*SampleInfohashesWalk, error) {
+	if prefixBits == 0 {
+		prefixBits = defaultSampleWalkPrefixBits
+	}
+	if prefixBits > 16 {
+		prefixBits = 16
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &SampleInfohashesWalk{
+		Samples:       make(chan InfohashSamples),
+		server:        s,
+		prefixBits:    prefixBits,
+		regionReplies: 2 * s.Table.k,
+		done:          ctx.Done(),
+		cancel:        cancel,
+	}
+	// Fail early if there's nowhere to start.
+	first, err := w.regionTraversal(ctx, 0)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go w.run(ctx, first)
+	return w, nil
+}
+
+// Returns the number of distinct remote addresses the walk has queried.
+func (w *SampleInfohashesWalk) NumContacted() int64 {
+	return atomic.LoadInt64(&w.numContacted)
+}
+
+// Stops the walk. Samples is closed once any queries in flight are done.
+func (w *SampleInfohashesWalk) Close() {
+	w.cancel()
+}
+
+func (w *SampleInfohashesWalk) run(ctx context.Context, t traversal) {
+	defer func() {
+		w.querying.Wait()
+		close(w.Samples)
+	}()
+	for region := 0; ; {
+		t.run()
+		region++
+		if region == 1<<w.prefixBits {
+			return
+		}
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+		var err error
+		t, err = w.regionTraversal(ctx, region)
+		if err != nil {
+			w.server.logger().WithDefaultLevel(log.Warning).Printf("error sampling infohashes: %v", err)
+			return
+		}
+	}
+}
+
+// Returns a random target with the region's prefix.
+func (w *SampleInfohashesWalk) regionTarget(region int) int160.T {
+	var b [20]byte
+	rand.Read(b[:])
+	prefix := uint32(region) << (32 - w.prefixBits)
+	mask := ^uint32(0) << (32 - w.prefixBits)
+	for i := 0; i < 4; i++ {
+		shift := 24 - 8*i
+		b[i] = b[i]&^byte(mask>>shift) | byte(prefix>>shift)
+	}
+	return int160.FromByteArray(b)
+}
+
+func (w *SampleInfohashesWalk) regionTraversal(ctx context.Context, region int) (t traversal, err error) {
+	s := w.server
+	target := w.regionTarget(region)
+	t, err = s.newTraversal(target)
+	if err != nil {
+		return
+	}
+	t.reason = "dht sample_infohashes"
+	t.doneVar, _ = stmutil.ContextDoneVar(ctx)
+	t.shouldContact = func(addr krpc.NodeAddr, tx *stm.Tx) bool {
+		return s.shouldContact(addr, tx) && s.infohashSampleDue(addr)
+	}
+	numReplies := stm.NewBuiltinEqVar(0)
+	t.stopTraversal = func(tx *stm.Tx, _ addrMaybeId) bool {
+		return tx.Get(numReplies).(int) >= w.regionReplies
+	}
+	t.query = func(addr Addr) QueryResult {
+		// Starting nodes are pended before shouldContact is replaced.
+		if !s.infohashSampleDue(addr.KRPC()) {
+			return QueryResult{Err: errSampleNotDue}
+		}
+		w.querying.Add(1)
+		defer w.querying.Done()
+		atomic.AddInt64(&w.numContacted, 1)
+		res := s.sampleInfohashes(ctx, addr, target, QueryRateLimiting{NotFirst: true})
+		r := res.Reply.R
+		if res.Err != nil || r == nil || r.Samples == nil {
+			return res
+		}
+		stm.Atomically(stm.VoidOperation(func(tx *stm.Tx) {
+			tx.Set(numReplies, tx.Get(numReplies).(int)+1)
+		}))
+		samples := InfohashSamples{
+			Source:     krpc.NodeInfo{ID: r.ID, Addr: addr.KRPC()},
+			Infohashes: *r.Samples,
+			Interval:   sampleInterval(r),
+		}
+		if r.Num != nil {
+			samples.Num = *r.Num
+		}
+		select {
+		case w.Samples <- samples:
+		case <-w.done:
+		}
+		return res
+	}
+	return
+}
@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+	peer_store "testTorrent/dht/peer-store"
+)
+
+func newSampleInfohashesServers(t *testing.T, ihs ...peer_store.InfoHash) (serving, sampling *Server) {
+	ps := &peer_store.InMemory{}
+	for i, ih := range ihs {
+		ps.AddPeer(ih, krpc.NodeAddr{IP: []byte{1, 2, 3, byte(i)}, Port: 1})
+	}
+	serving, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+		PeerStore:  ps,
+	})
+	require.NoError(t, err)
+	t.Cleanup(serving.Close)
+	sampling, err = NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(sampling.Close)
+	return
+}
+
+func TestSampleInfohashes(t *testing.T) {
+	c := qt.New(t)
+	ihs := []peer_store.InfoHash{{1}, {2}, {3}}
+	serving, sampling := newSampleInfohashesServers(t, ihs...)
+	addr := NewAddr(serving.Addr())
+	res := sampling.SampleInfohashes(context.Background(), addr, int160.T{})
+	c.Assert(res.Err, qt.IsNil)
+	r := res.Reply.R
+	c.Assert(r.Samples, qt.Not(qt.IsNil))
+	c.Assert(*r.Samples, qt.HasLen, 3)
+	c.Assert(*r.Num, qt.Equals, int64(3))
+	c.Assert(*r.Interval, qt.Equals, int64(DefaultSampleInfohashesInterval/time.Second))
+	c.Assert(sampling.infohashSampleDue(addr.KRPC()), qt.IsFalse)
+	// The sample doesn't change within the interval.
+	serving.PeerStore().AddPeer(peer_store.InfoHash{4}, krpc.NodeAddr{IP: []byte{1, 2, 3, 4}, Port: 1})
+	res = sampling.SampleInfohashes(context.Background(), addr, int160.T{})
+	c.Assert(res.Err, qt.IsNil)
+	c.Assert(*res.Reply.R.Samples, qt.HasLen, 3)
+	c.Assert(*res.Reply.R.Num, qt.Equals, int64(3))
+}
+
+func TestSampleInfohashesNoPeerStore(t *testing.T) {
+	c := qt.New(t)
+	_, sampling := newSampleInfohashesServers(t)
+	other, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	c.Assert(err, qt.IsNil)
+	defer other.Close()
+	res := sampling.SampleInfohashes(context.Background(), NewAddr(other.Addr()), int160.T{})
+	c.Assert(res.Err, qt.IsNil)
+	// Supporting nodes include samples even when they have none.
+	c.Assert(res.Reply.R.Samples, qt.Not(qt.IsNil))
+	c.Assert(*res.Reply.R.Samples, qt.HasLen, 0)
+}
+
+func TestSampleInfohashesEmptyNotCached(t *testing.T) {
+	c := qt.New(t)
+	serving, _ := newSampleInfohashesServers(t)
+	now := time.Now()
+	serving.mu.Lock()
+	defer serving.mu.Unlock()
+	sample := serving.currentInfohashSample(now)
+	c.Assert(sample.infohashes, qt.HasLen, 0)
+	c.Check(sample.expires, qt.Equals, now.Add(emptySampleInfohashesInterval))
+	serving.PeerStore().AddPeer(peer_store.InfoHash{1}, krpc.NodeAddr{IP: []byte{1, 2, 3, 4}, Port: 1})
+	now = now.Add(emptySampleInfohashesInterval)
+	sample = serving.currentInfohashSample(now)
+	c.Check(sample.infohashes, qt.HasLen, 1)
+	c.Check(sample.expires, qt.Equals, now.Add(DefaultSampleInfohashesInterval))
+}
+
+func TestSampleInfohashesWalk(t *testing.T) {
+	c := qt.New(t)
+	serving, sampling := newSampleInfohashesServers(t, peer_store.InfoHash{1}, peer_store.InfoHash{2})
+	c.Assert(sampling.AddNode(krpc.NodeInfo{ID: serving.ID(), Addr: NewAddr(serving.Addr()).KRPC()}), qt.IsNil)
+	w, err := sampling.SampleInfohashesWalk(1)
+	c.Assert(err, qt.IsNil)
+	var got []InfohashSamples
+	for s := range w.Samples {
+		got = append(got, s)
+	}
+	c.Assert(got, qt.HasLen, 1)
+	c.Assert(got[0].Source.ID, qt.Equals, serving.ID())
+	c.Assert(got[0].Infohashes, qt.HasLen, 2)
+	c.Assert(got[0].Num, qt.Equals, int64(2))
+	c.Assert(got[0].Interval, qt.Equals, DefaultSampleInfohashesInterval)
+	c.Assert(w.NumContacted(), qt.Equals, int64(1))
+	// The serving node's interval hasn't passed, so it's not sampled again.
+	w, err = sampling.SampleInfohashesWalk(1)
+	c.Assert(err, qt.IsNil)
+	for range w.Samples {
+		t.Fatal("got samples from node within its interval")
+	}
+	c.Assert(w.NumContacted(), qt.Equals, int64(0))
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/anacrolix/sync"
 	"github.com/pkg/errors"
 	"testTorrent/dht/int160"
+	node_store "testTorrent/dht/node-store"
 	peer_store "testTorrent/dht/peer-store"
 	"testTorrent/torrent/bencode"
 	"testTorrent/torrent/iplist"
@@ -41,16 +42,41 @@ type Server struct {
 	socket      net.PacketConn
 	resendDelay func() time.Duration
 
-	mu           sync.RWMutex
+	// Shared by the Servers of a DualStack.
+	mu           *sync.RWMutex
 	transactions map[transactionKey]*Transaction
 	nextT        uint64 // unique "t" field for outbound queries
-	Table        table
-	closed       missinggo.Event
-	ipBlockList  iplist.Ranger
-	tokenServer  tokenServer // Manages tokens we issue to our queriers.
-	config       ServerConfig
-	stats        ServerStats
-	sendLimit    sendLimiter
+	// Prepended to transaction IDs, so a Sybil can tell which of its Servers a response is for.
+	transactionIDPrefix string
+	Table               table
+	closed              missinggo.Event
+	ipBlockList         iplist.Ranger
+	// Blocks with expiry, on top of ipBlockList.
+	dynamicBlocks dynamicBlocklist
+	// Set if ServerConfig.InboundLimits is.
+	inbound     *inboundLimiter
+	tokenServer tokenServer // Manages tokens we issue to our queriers.
+	config      ServerConfig
+	stats       ServerStats
+	metrics     serverMetrics
+	sendLimit   sendLimiter
+	// Hourly interactions with Nodes, in the Table or not.
+	communication communicationRecords
+
+	// BEP 51. The sample we give out, and when we can next sample other Nodes by address.
+	infohashSample             infohashSample
+	nextInfohashSample         map[string]time.Time
+	nextInfohashSamplePruneLen int
+
+	// IDs we've replied with when spoofing neighbors.
+	spoofedIDs         map[krpc.ID]*SpoofedID
+	spoofedIDsPruneLen int
+
+	// The Server for the other address family in a DualStack. Nodes of that family are added to
+	// its Table instead, and it provides the Nodes for that family in replies.
+	otherFamily *Server
+	// Whether this is the IPv6 Server of a DualStack.
+	ipv6 bool
 }
 
 type sendLimiter interface {
@@ -85,6 +111,10 @@ func (s *Server) WriteStatus(w io.Writer) {
 	defer s.mu.Unlock()
 	fmt.Fprintf(w, "Nodes in Table: %d good, %d total\n", s.numGoodNodes(), s.numNodes())
 	fmt.Fprintf(w, "Ongoing transactions: %d\n", len(s.transactions))
+	if s.inbound != nil {
+		fmt.Fprintf(w, "Inbound queries dropped: %d\n", s.stats.InboundQueriesDropped)
+	}
+	fmt.Fprintf(w, "Blocked IPs: %d\n", len(s.dynamicBlocks.all(time.Now())))
 	fmt.Fprintf(w, "Server Node ID: %x\n", s.id.Bytes())
 	fmt.Fprintln(w)
 	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
@@ -130,6 +160,47 @@ func (s *Server) WriteStatus(w io.Writer) {
 	fmt.Fprintln(w)
 }
 
+// NodeStatus describes a Node in the routing table, as listed by WriteStatus.
+type NodeStatus struct {
+	krpc.NodeInfo
+	// Index of the bucket holding the Node.
+	Bucket              int
+	LastGotQuery        time.Time
+	LastGotResponse     time.Time
+	NumReceivesFrom     int
+	ConsecutiveFailures int
+	Good                bool
+	Questionable        bool
+	Bad                 bool
+	Secure              bool
+	ReadOnly            bool
+}
+
+// NodeStatuses returns the status of every Node in the routing table, ordered by bucket.
+func (s *Server) NodeStatuses() (ret []NodeStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, b := range s.Table.buckets {
+		b.EachNode(func(n *Node) bool {
+			ret = append(ret, NodeStatus{
+				NodeInfo:            n.NodeInfo(),
+				Bucket:              i,
+				LastGotQuery:        n.lastGotQuery,
+				LastGotResponse:     n.lastGotResponse,
+				NumReceivesFrom:     n.numReceivesFrom,
+				ConsecutiveFailures: n.consecutiveFailures,
+				Good:                s.IsGood(n),
+				Questionable:        s.IsQuestionable(n),
+				Bad:                 s.nodeIsBad(n),
+				Secure:              n.IsSecure(),
+				ReadOnly:            n.readOnly,
+			})
+			return true
+		})
+	}
+	return
+}
+
 func (s *Server) numNodes() (num int) {
 	s.Table.forNodes(func(n *Node) bool {
 		num++
@@ -146,6 +217,7 @@ func (s *Server) Stats() ServerStats {
 	ss.GoodNodes = s.numGoodNodes()
 	ss.Nodes = s.numNodes()
 	ss.OutstandingTransactions = len(s.transactions)
+	ss.BlockedIPs = len(s.dynamicBlocks.all(time.Now()))
 	return ss
 }
 
@@ -177,6 +249,20 @@ func (c *ServerConfig) InitNodeId() {
 
 // NewServer initializes a new DHT Node server.
 func NewServer(c *ServerConfig) (s *Server, err error) {
+	s, err = newServer(c)
+	if err != nil {
+		return
+	}
+	go s.serveUntilClosed()
+	return
+}
+
+// Initializes a Server that doesn't read from its Conn. Packets must be passed to it by the caller.
+func newServer(c *ServerConfig) (s *Server, err error) {
+	return newServerWithMutex(c, new(sync.RWMutex))
+}
+
+func newServerWithMutex(c *ServerConfig, mu *sync.RWMutex) (s *Server, err error) {
 	if c == nil {
 		c = NewDefaultServerConfig()
 	}
@@ -193,6 +279,7 @@ func NewServer(c *ServerConfig) (s *Server, err error) {
 	c.Logger = c.Logger.WithDefaultLevel(log.Debug)
 
 	s = &Server{
+		mu:          mu,
 		config:      *c,
 		ipBlockList: c.IPBlocklist,
 		tokenServer: tokenServer{
@@ -209,16 +296,23 @@ func NewServer(c *ServerConfig) (s *Server, err error) {
 	if s.config.ConnectionTracking == nil {
 		s.config.ConnectionTracking = conntrack.NewInstance()
 	}
+	if c.InboundLimits != nil {
+		s.inbound = newInboundLimiter(*c.InboundLimits)
+	}
 	rand.Read(s.tokenServer.secret)
 	s.socket = c.Conn
 	s.id = int160.FromByteArray(c.NodeId)
 	s.Table.rootID = s.id
+	// Buckets are filled by bootstrapping, and only need refreshing if they go quiet after that.
+	for i := range s.Table.buckets {
+		s.Table.buckets[i].lastChanged = time.Now()
+	}
 	s.resendDelay = s.config.QueryResendDelay
 	if s.resendDelay == nil {
 		s.resendDelay = defaultQueryResendDelay
 	}
 	go s.questionableNodePinger()
-	go s.serveUntilClosed()
+	go s.bucketRefresher()
 	return
 }
 
@@ -251,14 +345,20 @@ func (s *Server) IPBlocklist() iplist.Ranger {
 }
 
 func (s *Server) processPacket(b []byte, addr Addr) {
+	if d, ok := decodePacket(b); ok {
+		s.processMsg(d, addr)
+	}
+}
+
+// Decodes a received packet as a KRPC message. ok is false if it isn't one.
+func decodePacket(b []byte) (d krpc.Msg, ok bool) {
 	if len(b) < 2 || b[0] != 'd' {
 		// KRPC messages are bencoded dicts.
 		readNotKRPCDict.Add(1)
 		return
 	}
-	var d krpc.Msg
 	err := bencode.Unmarshal(b, &d)
-	if _, ok := err.(bencode.ErrUnusedTrailingBytes); ok {
+	if _, trailing := err.(bencode.ErrUnusedTrailingBytes); trailing {
 		// log.Printf("%s: received message packet with %d trailing bytes: %q", s, _err.NumUnusedBytes, b[len(b)-_err.NumUnusedBytes:])
 		expvars.Add("processed packets with trailing bytes", 1)
 	} else if err != nil {
@@ -284,6 +384,10 @@ func (s *Server) processPacket(b []byte, addr Addr) {
 		}()
 		return
 	}
+	return d, true
+}
+
+func (s *Server) processMsg(d krpc.Msg, addr Addr) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.closed.IsSet() {
@@ -292,6 +396,9 @@ func (s *Server) processPacket(b []byte, addr Addr) {
 	if d.Y == "q" {
 		expvars.Add("received queries", 1)
 		s.logger().Printf("received query %q from %v", d.Q, addr)
+		if !s.allowQuery(addr, d) {
+			return
+		}
 		s.handleQuery(addr, d)
 		return
 	}
@@ -312,14 +419,35 @@ func (s *Server) processPacket(b []byte, addr Addr) {
 		n.readOnly = d.ReadOnly
 		n.numReceivesFrom++
 	})
+	s.communication.replied(addr, d.SenderID(), time.Now())
+	if id := d.SenderID(); id != nil {
+		if n := s.Table.getNode(addr, int160.FromByteArray(*id)); n != nil {
+			s.Table.bucketForID(n.Id).lastChanged = n.lastGotResponse
+		}
+	}
+	s.storeNodeEvent(addr, d.SenderID(), node_store.EventResponded, d.ReadOnly)
 	// Ensure we don't provide more than one response to a transaction.
 	s.deleteTransaction(tk)
 }
 
 func (s *Server) serve() error {
+	return readPackets(s.socket, func(b []byte, addr net.Addr) {
+		s.mu.Lock()
+		blocked := s.ipBlocked(missinggo.AddrIP(addr))
+		s.mu.Unlock()
+		if blocked {
+			readBlocked.Add(1)
+			return
+		}
+		s.processPacket(b, NewAddr(addr))
+	})
+}
+
+// Reads packets from conn until it returns an error, passing on those that could be from a Node.
+func readPackets(conn net.PacketConn, f func(b []byte, addr net.Addr)) error {
 	var b [0x10000]byte
 	for {
-		n, addr, err := s.socket.ReadFrom(b[:])
+		n, addr, err := conn.ReadFrom(b[:])
 		if err != nil {
 			return err
 		}
@@ -332,18 +460,14 @@ func (s *Server) serve() error {
 			readZeroPort.Add(1)
 			continue
 		}
-		s.mu.Lock()
-		blocked := s.ipBlocked(missinggo.AddrIP(addr))
-		s.mu.Unlock()
-		if blocked {
-			readBlocked.Add(1)
-			continue
-		}
-		s.processPacket(b[:n], NewAddr(addr))
+		f(b[:n], addr)
 	}
 }
 
 func (s *Server) ipBlocked(ip net.IP) (blocked bool) {
+	if _, blocked = s.dynamicBlocks.lookup(ip, time.Now()); blocked {
+		return
+	}
 	if s.ipBlockList == nil {
 		return
 	}
@@ -385,6 +509,19 @@ func shouldReturnNodes6(queryWants []krpc.Want, querySource net.IP) bool {
 	return querySource.To4() == nil
 }
 
+// The Server whose Table holds Nodes of the given family. Without a DualStack, there's only the one
+// Table.
+func (s *Server) familyServer(ipv6 bool) *Server {
+	if s.otherFamily != nil && s.otherFamily.ipv6 == ipv6 {
+		return s.otherFamily
+	}
+	return s
+}
+
+func isIPv6(ip net.IP) bool {
+	return ip.To4() == nil
+}
+
 func (s *Server) makeReturnNodes(target int160.T, filter func(krpc.NodeAddr) bool) []krpc.NodeInfo {
 	return s.closestGoodNodeInfos(8, target, filter)
 }
@@ -425,16 +562,42 @@ func filterPeers(querySourceIp net.IP, queryWants []krpc.Want, allPeers []krpc.N
 	return
 }
 
+// The most peers returned in the values of a get_peers reply, which keeps it to a few packets' worth
+// however many peers are stored.
+const maxGetPeersValues = 100
+
+// Peers for the values of a get_peers reply. A peer_store.Store does the filtering and limiting
+// itself, which saves copying every peer of a popular infohash.
+func (s *Server) peerValues(ps peer_store.Interface, source Addr, args *krpc.MsgArgs) (values []krpc.NodeAddr) {
+	ih := peer_store.InfoHash(args.InfoHash)
+	if fs, ok := ps.(peer_store.Store); ok {
+		values = fs.GetPeersFiltered(ih, peer_store.GetPeersOpts{
+			IPv4:   shouldReturnNodes(args.Want, source.IP()),
+			IPv6:   shouldReturnNodes6(args.Want, source.IP()),
+			NoSeed: args.NoSeed != 0,
+			Limit:  maxGetPeersValues,
+		})
+	} else {
+		values = ps.GetPeers(ih)
+	}
+	values = filterPeers(source.IP(), args.Want, values)
+	if len(values) > maxGetPeersValues {
+		values = values[:maxGetPeersValues]
+	}
+	return
+}
+
 func (s *Server) setReturnNodes(r *krpc.Return, queryMsg krpc.Msg, querySource Addr) *krpc.Error {
 	if queryMsg.A == nil {
 		return &krpcErrMissingArguments
 	}
-	target := int160.FromByteArray(queryMsg.A.InfoHash)
+	t, _ := queryTarget(queryMsg)
+	target := int160.FromByteArray(t)
 	if shouldReturnNodes(queryMsg.A.Want, querySource.IP()) {
-		r.Nodes = s.makeReturnNodes(target, func(na krpc.NodeAddr) bool { return na.IP.To4() != nil })
+		r.Nodes = s.familyServer(false).makeReturnNodes(target, func(na krpc.NodeAddr) bool { return na.IP.To4() != nil })
 	}
 	if shouldReturnNodes6(queryMsg.A.Want, querySource.IP()) {
-		r.Nodes6 = s.makeReturnNodes(target, func(krpc.NodeAddr) bool { return true })
+		r.Nodes6 = s.familyServer(true).makeReturnNodes(target, func(krpc.NodeAddr) bool { return true })
 	}
 	return nil
 }
@@ -452,11 +615,17 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 			}
 		}
 	}()
+	s.metrics.queryReceived(m.Q)
 	s.updateNode(source, m.SenderID(), true, func(n *Node) {
 		n.lastGotQuery = time.Now()
 		n.readOnly = m.ReadOnly
 		n.numReceivesFrom++
 	})
+	s.communication.received(source, m.SenderID(), time.Now())
+	s.storeNodeEvent(source, m.SenderID(), node_store.EventQueried, m.ReadOnly)
+	if s.config.SpoofNeighbors {
+		s.attributeQuery(m, false)
+	}
 	if s.config.OnQuery != nil {
 		propagate := s.config.OnQuery(&m, source.Raw())
 		if !propagate {
@@ -471,7 +640,7 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 	args := m.A
 	switch m.Q {
 	case "ping":
-		s.reply(source, m.T, krpc.Return{})
+		s.reply(source, m, krpc.Return{})
 	case "get_peers":
 		// Check for the naked m.A.Want deref below.
 		if m.A == nil {
@@ -480,8 +649,12 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 		}
 		var r krpc.Return
 		if ps := s.config.PeerStore; ps != nil {
-			r.Values = filterPeers(source.IP(), m.A.Want, ps.GetPeers(peer_store.InfoHash(args.InfoHash)))
-
+			r.Values = s.peerValues(ps, source, args)
+			if sc, ok := ps.(peer_store.Store); ok && args.Scrape != 0 {
+				seeds, peers := sc.Scrape(peer_store.InfoHash(args.InfoHash))
+				r.BFsd = &seeds
+				r.BFpe = &peers
+			}
 		}
 		if len(r.Values) == 0 {
 			if err := s.setReturnNodes(&r, m, source); err != nil {
@@ -495,14 +668,14 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 			t := s.createToken(source)
 			return &t
 		}()
-		s.reply(source, m.T, r)
+		s.reply(source, m, r)
 	case "find_node":
 		var r krpc.Return
 		if err := s.setReturnNodes(&r, m, source); err != nil {
 			s.sendError(source, m.T, *err)
 			break
 		}
-		s.reply(source, m.T, r)
+		s.reply(source, m, r)
 	case "announce_peer":
 		readAnnouncePeer.Add(1)
 
@@ -511,6 +684,9 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 			return
 		}
 		expvars.Add("received announce_peer with valid token", 1)
+		if s.config.SpoofNeighbors {
+			s.attributeQuery(m, true)
+		}
 
 		var port int
 		portOk := false
@@ -530,14 +706,23 @@ func (s *Server) handleQuery(source Addr, m krpc.Msg) {
 		if h := s.config.OnAnnouncePeer; h != nil {
 			go h(metainfo.Hash(args.InfoHash), source.IP(), port, portOk)
 		}
-		if ps := s.config.PeerStore; ps != nil {
-			go ps.AddPeer(
-				peer_store.InfoHash(args.InfoHash),
-				krpc.NodeAddr{source.IP(), port},
-			)
+		if h := s.config.OnAnnouncePeerNode; h != nil {
+			go h(metainfo.Hash(args.InfoHash), krpc.NodeInfo{ID: args.ID, Addr: source.KRPC()}, port, portOk)
+		}
+		peer := krpc.NodeAddr{IP: source.IP(), Port: port}
+		if ps, ok := s.config.PeerStore.(peer_store.Store); ok {
+			go ps.AnnouncePeer(peer_store.InfoHash(args.InfoHash), peer, args.Seed != 0)
+		} else if ps := s.config.PeerStore; ps != nil {
+			go ps.AddPeer(peer_store.InfoHash(args.InfoHash), peer)
 		}
 
-		s.reply(source, m.T, krpc.Return{})
+		s.reply(source, m, krpc.Return{})
+	case "sample_infohashes":
+		s.handleSampleInfohashes(source, m)
+	case "get":
+		s.handleGet(source, m)
+	case "put":
+		s.handlePut(source, m)
 	default:
 		s.sendError(source, m.T, krpc.ErrorMethodUnknown)
 	}
@@ -553,6 +738,7 @@ func (s *Server) sendError(addr Addr, t string, e krpc.Error) {
 	if err != nil {
 		panic(err)
 	}
+	s.metrics.errorSent(e.Code)
 	s.logger().Printf("sending error to %q: %v", addr, e)
 	_, err = s.writeToNode(context.Background(), b, addr, false, true)
 	if err != nil {
@@ -560,10 +746,10 @@ func (s *Server) sendError(addr Addr, t string, e krpc.Error) {
 	}
 }
 
-func (s *Server) reply(addr Addr, t string, r krpc.Return) {
-	r.ID = s.id.AsByteArray()
+func (s *Server) reply(addr Addr, query krpc.Msg, r krpc.Return) {
+	r.ID = s.replyID(query)
 	m := krpc.Msg{
-		T:  t,
+		T:  query.T,
 		Y:  "r",
 		R:  &r,
 		IP: addr.KRPC(),
@@ -592,6 +778,9 @@ func (s *Server) addNode(n *Node) error {
 			}
 			return b.Len() >= s.Table.k
 		}) {
+			// It takes the place of the first Node found to be bad. questionableNodePinger checks
+			// the Nodes in buckets with replacements first.
+			b.addReplacement(n, s.Table.k)
 			return errors.New("no room in bucket")
 		}
 	}
@@ -606,6 +795,9 @@ func (s *Server) updateNode(addr Addr, id *krpc.ID, tryAdd bool, update func(*No
 	if id == nil {
 		return errors.New("id is nil")
 	}
+	if s.otherFamily != nil && isIPv6(addr.IP()) != s.ipv6 {
+		return s.otherFamily.updateNode(addr, id, tryAdd, update)
+	}
 	int160Id := int160.FromByteArray(*id)
 	n := s.Table.getNode(addr, int160Id)
 	missing := n == nil
@@ -616,10 +808,13 @@ func (s *Server) updateNode(addr Addr, id *krpc.ID, tryAdd bool, update func(*No
 		if int160Id == s.id {
 			return errors.New("can't store own id in routing Table")
 		}
-		n = &Node{nodeKey: nodeKey{
-			Id:   int160Id,
-			Addr: addr,
-		}}
+		n = s.Table.getReplacement(addr, int160Id)
+		if n == nil {
+			n = &Node{nodeKey: nodeKey{
+				Id:   int160Id,
+				Addr: addr,
+			}}
+		}
 	}
 	update(n)
 	if !missing {
@@ -658,6 +853,10 @@ func (s *Server) writeToNode(ctx context.Context, b []byte, node Addr, wait, rat
 			return
 		}
 	}
+	if b, ok := s.dynamicBlocks.lookup(node.IP(), time.Now()); ok {
+		err = fmt.Errorf("write to %v blocked until %v: %v", node, b.Until, b.Reason)
+		return
+	}
 	//s.config.Logger.WithValues(log.Debug).Printf("writing to %s: %q", Node.String(), b)
 	if rate {
 		if wait {
@@ -695,7 +894,7 @@ func (s *Server) nextTransactionID() string {
 	var b [binary.MaxVarintLen64]byte
 	n := binary.PutUvarint(b[:], s.nextT)
 	s.nextT++
-	return string(b[:n])
+	return s.transactionIDPrefix + string(b[:n])
 }
 
 func (s *Server) deleteTransaction(k transactionKey) {
@@ -806,11 +1005,12 @@ type QueryInput struct {
 // made this way are not interpreted by the Server. More specific methods like FindNode and GetPeers
 // may make use of the response internally before passing it back to the caller.
 func (s *Server) Query(ctx context.Context, addr Addr, q string, input QueryInput) (ret QueryResult) {
-	defer func(started time.Time) {
+	started := time.Now()
+	defer func() {
 		s.logger().WithDefaultLevel(log.Debug).WithValues(q).Printf(
 			"Query(%v) returned after %v (err=%v, reply.Y=%v, reply.E=%v, writes=%v)",
 			q, time.Since(started), ret.Err, ret.Reply.Y, ret.Reply.E, ret.writes)
-	}(time.Now())
+	}()
 	replyChan := make(chan krpc.Msg, 1)
 	t := &Transaction{
 		onResponse: func(m krpc.Msg) {
@@ -823,8 +1023,14 @@ func (s *Server) Query(ctx context.Context, addr Addr, q string, input QueryInpu
 	s.mu.Lock()
 	tid := s.nextTransactionID()
 	s.stats.OutboundQueriesAttempted++
+	s.metrics.querySent(q)
 	tk.T = tid
 	s.addTransaction(tk, t)
+	s.communication.sent(addr, time.Now())
+	for _, n := range s.Table.addrNodes(addr) {
+		id := n.Id.AsByteArray()
+		s.storeNodeEvent(addr, (*krpc.ID)(&id), node_store.EventQuerySent, n.readOnly)
+	}
 	s.mu.Unlock()
 	// Receives a non-nil error from the sender, and closes when the sender completes.
 	sendErr := make(chan error, 1)
@@ -855,6 +1061,12 @@ func (s *Server) Query(ctx context.Context, addr Addr, q string, input QueryInpu
 	<-sendErr
 	s.mu.Lock()
 	s.deleteTransaction(tk)
+	if ret.Err == nil {
+		s.metrics.replyReceived(q, time.Since(started))
+		if e := ret.Reply.E; e != nil {
+			s.metrics.errorReceived(e.Code)
+		}
+	}
 	if ret.Err != nil {
 		for _, n := range s.Table.addrNodes(addr) {
 			// TODO: What kind of failures? Failures to respond at all, or error responses, or
@@ -1048,6 +1260,19 @@ func (s *Server) traversalStartingNodes() (nodes []addrMaybeId, err error) {
 	if len(nodes) > 0 {
 		return
 	}
+	if ns := s.config.NodeStore; ns != nil {
+		rs, bestErr := ns.Best(160 * s.Table.k)
+		if bestErr != nil {
+			s.logger().WithValues(log.Warning).Printf("error getting starting nodes from node store: %v", bestErr)
+		}
+		for _, r := range rs {
+			id := int160.FromByteArray(r.ID)
+			nodes = append(nodes, addrMaybeId{r.NodeInfo().Addr, &id})
+		}
+		if len(nodes) > 0 {
+			return
+		}
+	}
 	if s.config.StartingNodes != nil {
 		// There seems to be floods on this call on occasion, which may cause a barrage of DNS
 		// resolution attempts. This would require that we're unable to get replies because we can't
@@ -1083,6 +1308,42 @@ func (s *Server) AddNodesFromFile(fileName string) (added int, err error) {
 	return
 }
 
+// Adds up to n of the best Nodes from the NodeStore directly to the Node Table.
+func (s *Server) AddNodesFromStore(n int) (added int, err error) {
+	if s.config.NodeStore == nil {
+		err = errors.New("no node store")
+		return
+	}
+	rs, err := s.config.NodeStore.Best(n)
+	if err != nil {
+		return
+	}
+	for _, r := range rs {
+		if s.AddNode(r.NodeInfo()) == nil {
+			added++
+		}
+	}
+	return
+}
+
+// Passes an interaction with a Node to the NodeStore, if there is one.
+func (s *Server) storeNodeEvent(addr Addr, id *krpc.ID, e node_store.Event, readOnly bool) {
+	ns := s.config.NodeStore
+	if ns == nil || id == nil {
+		return
+	}
+	if int160.FromByteArray(*id) == s.id {
+		return
+	}
+	ns.Update(node_store.Update{
+		NodeInfo: krpc.NodeInfo{ID: *id, Addr: addr.KRPC()},
+		Event:    e,
+		Time:     time.Now(),
+		ReadOnly: readOnly,
+		Secure:   NodeIdSecure(*id, addr.IP()),
+	})
+}
+
 func (s *Server) logger() log.Logger {
 	return s.config.Logger
 }
@@ -1092,6 +1353,17 @@ func (s *Server) PeerStore() peer_store.Interface {
 }
 
 func (s *Server) getQuestionableNode() (ret *Node) {
+	// Nodes that have replacements waiting come first, least recently seen first, as these are the
+	// ones we'd evict.
+	for i := range s.Table.buckets {
+		b := &s.Table.buckets[i]
+		if len(b.replacements) == 0 {
+			continue
+		}
+		if ret = b.leastRecentlySeen(s.IsQuestionable); ret != nil {
+			return
+		}
+	}
 	s.Table.forNodes(func(n *Node) bool {
 		if s.IsQuestionable(n) {
 			ret = n
@@ -1130,12 +1402,17 @@ tryPing:
 				goto tryPing
 			}
 			logger.Printf("questionable Node %v failed to respond: %v", target, res.Err)
+			s.mu.Lock()
+			if n := s.Table.getNode(target.Addr, target.Id); n != nil && s.nodeIsBad(n) {
+				s.replaceBadNode(n)
+			}
+			s.mu.Unlock()
 		} else {
 			s.mu.RUnlock()
 		}
 		select {
 		case <-time.After(time.Second):
-		case <-s.closed.LockedChan(&s.mu):
+		case <-s.closed.LockedChan(s.mu):
 		}
 	}
 }
@@ -1161,6 +1438,10 @@ func (a *Server) shouldContact(addr krpc.NodeAddr, tx *stm.Tx) bool {
 	if a.ipBlocked(addr.IP) {
 		return false
 	}
+	if a.otherFamily != nil && isIPv6(addr.IP) != a.ipv6 {
+		// The other Server of the DualStack covers these.
+		return false
+	}
 	return true
 }
 
@@ -1177,6 +1458,62 @@ func validNodeAddr(addr net.Addr) bool {
 	return true
 }
 
-//func (s *Server) refreshBucket(bucketIndex int) {
-//	targetId := s.Table.randomIdForBucket(bucketIndex)
-//}
+// Swaps a bad Node for the most recently seen replacement in its bucket that isn't bad. The bad
+// Node stays if there isn't one, until addNode needs the room.
+func (s *Server) replaceBadNode(n *Node) {
+	b := s.Table.bucketForID(n.Id)
+	r := b.popReplacement(func(r *Node) bool { return !s.nodeIsBad(r) })
+	if r == nil {
+		return
+	}
+	s.Table.dropNode(n)
+	if err := s.Table.addNode(r); err != nil {
+		panic(fmt.Sprintf("expected to add replacement Node: %s", err))
+	}
+	expvars.Add("replaced bad nodes", 1)
+}
+
+// Buckets that haven't changed in this long are refreshed, per BEP 5.
+const bucketRefreshInterval = 15 * time.Minute
+
+func (s *Server) bucketRefresher() {
+	for {
+		select {
+		case <-time.After(time.Minute):
+		case <-s.closed.LockedChan(s.mu):
+			return
+		}
+		s.refreshBuckets()
+	}
+}
+
+// Sends a find_node for a random ID in each stale bucket to the closest good Node we know of. The
+// Nodes in the response are added to the table.
+func (s *Server) refreshBuckets() {
+	type refresh struct {
+		addr   Addr
+		target int160.T
+	}
+	var refreshes []refresh
+	s.mu.Lock()
+	now := time.Now()
+	for i := 0; i <= s.Table.deepestBucket(); i++ {
+		b := &s.Table.buckets[i]
+		if now.Sub(b.lastChanged) < bucketRefreshInterval {
+			continue
+		}
+		target := s.Table.randomIdForBucket(i)
+		closest := s.Table.closestNodes(1, target, s.IsGood)
+		if len(closest) == 0 {
+			continue
+		}
+		// Don't try again until the next interval, whether or not it finds anything.
+		b.lastChanged = now
+		refreshes = append(refreshes, refresh{closest[0].Addr, target})
+	}
+	s.mu.Unlock()
+	for _, r := range refreshes {
+		expvars.Add("bucket refreshes", 1)
+		s.FindNode(r.addr, r.target, QueryRateLimiting{})
+	}
+}
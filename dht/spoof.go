@@ -0,0 +1,158 @@
+package dht
+
+import (
+	"sort"
+	"time"
+
+	"testTorrent/dht/krpc"
+)
+
+// Bytes of the target kept in a spoofed ID. The rest are from our own ID, so each target always
+// gets the same ID.
+const spoofedIDPrefixLen = 15
+
+// Spoofed IDs unused for this long are forgotten.
+const spoofedIDExpiry = time.Hour
+
+// The most spoofed IDs a Server remembers. The least recently used go first once there are too
+// many, as queriers choose the targets.
+var maxSpoofedIDs = 1 << 16
+
+// SpoofedID is an ID we've replied with instead of our own. See ServerConfig.SpoofNeighbors.
+type SpoofedID struct {
+	ID krpc.ID
+	// What the ID was derived from: a query's target, or the querier's ID if it had none.
+	Target    krpc.ID
+	FirstUsed time.Time
+	LastUsed  time.Time
+	// Replies sent using the ID.
+	Replies int64
+	// Queries received after the ID was first used that derive it again, so the querier likely
+	// found us under it. Announces counts those that were announce_peer with a valid token.
+	Queries   int64
+	Announces int64
+}
+
+// Returns the target of a query, for the queries that have one.
+func queryTarget(m krpc.Msg) (target krpc.ID, ok bool) {
+	if m.A == nil {
+		return
+	}
+	switch m.Q {
+	case "get_peers", "announce_peer":
+		return m.A.InfoHash, true
+	case "find_node", "sample_infohashes", "get":
+		return m.A.Target, true
+	case "put":
+		return putTarget(m.A), true
+	}
+	return
+}
+
+// Returns what a spoofed ID for a query would be derived from.
+func spoofTarget(m krpc.Msg) krpc.ID {
+	if target, ok := queryTarget(m); ok {
+		return target
+	}
+	return m.A.ID
+}
+
+func (s *Server) spoofedID(target krpc.ID) (id krpc.ID) {
+	id = s.id.AsByteArray()
+	copy(id[:spoofedIDPrefixLen], target[:spoofedIDPrefixLen])
+	return
+}
+
+// Returns the ID to reply to a query with, recording its use if it's spoofed. Called with the
+// Server locked.
+func (s *Server) replyID(query krpc.Msg) krpc.ID {
+	if !s.config.SpoofNeighbors || query.A == nil {
+		return s.id.AsByteArray()
+	}
+	target := spoofTarget(query)
+	id := s.spoofedID(target)
+	now := time.Now()
+	if s.spoofedIDs == nil {
+		s.spoofedIDs = make(map[krpc.ID]*SpoofedID)
+	}
+	sid, ok := s.spoofedIDs[id]
+	if !ok {
+		if len(s.spoofedIDs) >= s.spoofedIDsPruneLen || len(s.spoofedIDs) >= maxSpoofedIDs {
+			s.pruneSpoofedIDs(now)
+			s.spoofedIDsPruneLen = 2*len(s.spoofedIDs) + 1024
+		}
+		sid = &SpoofedID{ID: id, Target: target, FirstUsed: now}
+		s.spoofedIDs[id] = sid
+	}
+	sid.LastUsed = now
+	sid.Replies++
+	return id
+}
+
+// Drops expired spoofed IDs, then the least recently used until there's room for more. Called with
+// the Server locked.
+func (s *Server) pruneSpoofedIDs(now time.Time) {
+	var byLastUsed []*SpoofedID
+	for k, v := range s.spoofedIDs {
+		if now.Sub(v.LastUsed) >= spoofedIDExpiry {
+			delete(s.spoofedIDs, k)
+		} else {
+			byLastUsed = append(byLastUsed, v)
+		}
+	}
+	if excess := len(s.spoofedIDs) - maxSpoofedIDs*3/4; excess > 0 {
+		sort.Slice(byLastUsed, func(i, j int) bool {
+			return byLastUsed[i].LastUsed.Before(byLastUsed[j].LastUsed)
+		})
+		for _, v := range byLastUsed[:excess] {
+			delete(s.spoofedIDs, v.ID)
+		}
+	}
+}
+
+// Attributes a received query to the spoofed ID it would be answered with, if that's been used
+// already. Called with the Server locked.
+func (s *Server) attributeQuery(m krpc.Msg, announce bool) {
+	if m.A == nil {
+		return
+	}
+	sid, ok := s.spoofedIDs[s.spoofedID(spoofTarget(m))]
+	if !ok {
+		return
+	}
+	if announce {
+		sid.Announces++
+	} else {
+		sid.Queries++
+	}
+}
+
+// SpoofedIDs returns the spoofed IDs in use, most recently used first.
+func (s *Server) SpoofedIDs() (ret []SpoofedID) {
+	s.mu.RLock()
+	for _, sid := range s.spoofedIDs {
+		ret = append(ret, *sid)
+	}
+	s.mu.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].LastUsed.After(ret[j].LastUsed)
+	})
+	return
+}
+
+// SpoofedID returns what's known about a spoofed ID, for attributing traffic that refers to it.
+func (s *Server) SpoofedID(id krpc.ID) (_ SpoofedID, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sid, ok := s.spoofedIDs[id]
+	if !ok {
+		return
+	}
+	return *sid, true
+}
+
+// SpoofedIDFor returns the spoofed ID that's been given to queries for target, such as the
+// infohash of an announce_peer.
+func (s *Server) SpoofedIDFor(target krpc.ID) (SpoofedID, bool) {
+	return s.SpoofedID(s.spoofedID(target))
+}
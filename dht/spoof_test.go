@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+)
+
+func TestSpoofNeighbors(t *testing.T) {
+	c := qt.New(t)
+	spoofing, err := NewServer(&ServerConfig{
+		Conn:           mustListen("127.0.0.1:0"),
+		NoSecurity:     true,
+		SpoofNeighbors: true,
+	})
+	require.NoError(t, err)
+	defer spoofing.Close()
+	client, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	addr := NewAddr(spoofing.Addr())
+	own := spoofing.ID()
+	checkSpoofed := func(id, target krpc.ID) {
+		c.Helper()
+		c.Check(id[:spoofedIDPrefixLen], qt.DeepEquals, target[:spoofedIDPrefixLen])
+		c.Check(id[spoofedIDPrefixLen:], qt.DeepEquals, own[spoofedIDPrefixLen:])
+	}
+
+	target := krpc.ID{1, 2, 3}
+	res := client.FindNode(addr, int160.FromByteArray(target), QueryRateLimiting{})
+	c.Assert(res.Err, qt.IsNil)
+	checkSpoofed(res.Reply.R.ID, target)
+
+	ih := krpc.ID{4, 5, 6}
+	res = client.GetPeers(context.Background(), addr, int160.FromByteArray(ih), false, QueryRateLimiting{})
+	c.Assert(res.Err, qt.IsNil)
+	checkSpoofed(res.Reply.R.ID, ih)
+	port := 1
+	res = client.Query(context.Background(), addr, "announce_peer", QueryInput{
+		MsgArgs: krpc.MsgArgs{InfoHash: ih, Port: &port, Token: *res.Reply.R.Token},
+	})
+	c.Assert(res.Err, qt.IsNil)
+	checkSpoofed(res.Reply.R.ID, ih)
+	res = client.GetPeers(context.Background(), addr, int160.FromByteArray(ih), false, QueryRateLimiting{})
+	c.Assert(res.Err, qt.IsNil)
+
+	res = client.Ping(spoofing.Addr().(*net.UDPAddr))
+	c.Assert(res.Err, qt.IsNil)
+	checkSpoofed(res.Reply.R.ID, client.ID())
+
+	sid, ok := spoofing.SpoofedIDFor(ih)
+	c.Assert(ok, qt.IsTrue)
+	c.Check(sid.Target, qt.Equals, ih)
+	c.Check(sid.Replies, qt.Equals, int64(3))
+	// The announce_peer and the second get_peers came after the ID was given out.
+	c.Check(sid.Queries, qt.Equals, int64(2))
+	c.Check(sid.Announces, qt.Equals, int64(1))
+	c.Check(spoofing.SpoofedIDs(), qt.HasLen, 3)
+	_, ok = spoofing.SpoofedID(krpc.ID(own))
+	c.Check(ok, qt.IsFalse)
+}
+
+func TestSpoofedIDsCapped(t *testing.T) {
+	c := qt.New(t)
+	defer func(max int) { maxSpoofedIDs = max }(maxSpoofedIDs)
+	maxSpoofedIDs = 8
+	s, err := NewServer(&ServerConfig{
+		Conn:           mustListen("127.0.0.1:0"),
+		NoSecurity:     true,
+		SpoofNeighbors: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < 100; i++ {
+		s.replyID(krpc.Msg{Q: "find_node", A: &krpc.MsgArgs{Target: krpc.ID{byte(i)}}})
+		c.Assert(len(s.spoofedIDs) <= maxSpoofedIDs, qt.IsTrue)
+	}
+	_, ok := s.spoofedIDs[s.spoofedID(krpc.ID{99})]
+	c.Check(ok, qt.IsTrue)
+}
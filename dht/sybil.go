@@ -0,0 +1,210 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo"
+
+	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
+)
+
+// SybilConfig configures NewSybil.
+type SybilConfig struct {
+	// Sockets shared by the identities, which are assigned to them in turn. At least one is
+	// required.
+	Conns []net.PacketConn
+	// Number of Node IDs to run. Defaults to 16.
+	Identities int
+	// Template for each identity's Server. Conn and NodeId are set per identity, everything else,
+	// including hooks and stores, is shared.
+	Server ServerConfig
+}
+
+// A Sybil runs many Servers on a few sockets, with Node IDs spread over the keyspace. A single
+// Server only hears from Nodes looking for things near its ID, so spreading identities out sees far
+// more of the DHT's traffic. Each identity has its own routing table and token secret.
+//
+// Responses are passed to the identity that sent the query, which is encoded in the transaction
+// ID. Queries are answered by whichever identity on the receiving socket is closest to the query's
+// target, or to the querier for queries without one. An announce_peer then reaches the identity
+// that issued its token in reply to get_peers.
+type Sybil struct {
+	servers []*Server
+	sockets []*sybilSocket
+	logger  log.Logger
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+type sybilSocket struct {
+	net.PacketConn
+	servers []*Server
+}
+
+// NewSybil starts the identities, and serves the sockets. Closing the Sybil closes the sockets, but
+// they're left open if there's an error.
+func NewSybil(c *SybilConfig) (*Sybil, error) {
+	if len(c.Conns) == 0 {
+		return nil, errors.New("no conns")
+	}
+	n := c.Identities
+	if n <= 0 {
+		n = 16
+	}
+	var secureIP net.IP
+	if !c.Server.NoSecurity {
+		secureIP = c.Server.PublicIP
+	}
+	sy := &Sybil{logger: c.Server.Logger, closed: make(chan struct{})}
+	if sy.logger.LoggerImpl == nil {
+		sy.logger = log.Default
+	}
+	for _, conn := range c.Conns {
+		sy.sockets = append(sy.sockets, &sybilSocket{PacketConn: conn})
+	}
+	for i := 0; i < n; i++ {
+		sock := sy.sockets[i%len(sy.sockets)]
+		sc := c.Server
+		sc.Conn = sybilConn{sock.PacketConn}
+		sc.NodeId = sybilNodeID(i, n, secureIP)
+		s, err := newServer(&sc)
+		if err != nil {
+			sy.closeServers()
+			return nil, err
+		}
+		s.mu.Lock()
+		s.transactionIDPrefix = sybilTransactionIDPrefix(i)
+		s.mu.Unlock()
+		sy.servers = append(sy.servers, s)
+		sock.servers = append(sock.servers, s)
+	}
+	for _, sock := range sy.sockets {
+		sy.wg.Add(1)
+		go sy.serve(sock)
+	}
+	return sy, nil
+}
+
+// Returns the Node ID for identity i of n. The leading bits place it evenly over the keyspace. If
+// it's secured to ip, BEP 42 fixes the first 21 bits to one of 8 values, so the identities are
+// divided between those, and spread evenly within each.
+func sybilNodeID(i, n int, ip net.IP) (id [20]byte) {
+	id = RandomNodeID()
+	spread := func(b []byte, i, n int) {
+		// The identity's slot, and a random position within it.
+		binary.BigEndian.PutUint32(b, uint32((uint64(i)<<32+uint64(rand.Uint32()))/uint64(n)))
+	}
+	if ip == nil {
+		spread(id[:], i, n)
+		return
+	}
+	id[19] = id[19]&^7 | byte(i%8)
+	spread(id[3:], i/8, (n+7)/8)
+	SecureNodeId(&id, ip)
+	return
+}
+
+func sybilTransactionIDPrefix(i int) string {
+	var b [binary.MaxVarintLen64]byte
+	return string(b[:binary.PutUvarint(b[:], uint64(i))])
+}
+
+// Servers returns the identities.
+func (sy *Sybil) Servers() []*Server {
+	return sy.servers
+}
+
+func (sy *Sybil) serve(sock *sybilSocket) {
+	defer sy.wg.Done()
+	err := readPackets(sock.PacketConn, func(b []byte, addr net.Addr) {
+		d, ok := decodePacket(b)
+		if !ok {
+			return
+		}
+		s := sy.route(sock, d)
+		if s == nil {
+			expvars.Add("sybil responses for unknown identity", 1)
+			return
+		}
+		s.mu.Lock()
+		blocked := s.ipBlocked(missinggo.AddrIP(addr))
+		s.mu.Unlock()
+		if blocked {
+			readBlocked.Add(1)
+			return
+		}
+		s.processMsg(d, NewAddr(addr))
+	})
+	select {
+	case <-sy.closed:
+	default:
+		sy.logger.WithDefaultLevel(log.Error).Printf("error reading from %v: %v", sock.LocalAddr(), err)
+	}
+}
+
+// Returns the identity that should handle a message received on sock.
+func (sy *Sybil) route(sock *sybilSocket, d krpc.Msg) *Server {
+	if d.Y != "q" {
+		i, n := binary.Uvarint([]byte(d.T))
+		if n <= 0 || i >= uint64(len(sy.servers)) {
+			return nil
+		}
+		return sy.servers[i]
+	}
+	if d.A == nil {
+		return sock.servers[0]
+	}
+	target, ok := queryTarget(d)
+	if !ok {
+		target = d.A.ID
+	}
+	t := int160.FromByteArray(target)
+	closest := sock.servers[0]
+	closestDistance := int160.Distance(closest.id, t)
+	for _, s := range sock.servers[1:] {
+		if dist := int160.Distance(s.id, t); dist.Cmp(closestDistance) < 0 {
+			closest, closestDistance = s, dist
+		}
+	}
+	return closest
+}
+
+func (sy *Sybil) closeServers() {
+	for _, s := range sy.servers {
+		s.Close()
+	}
+}
+
+// Close stops the identities, and closes the sockets.
+func (sy *Sybil) Close() {
+	sy.closeOnce.Do(func() {
+		close(sy.closed)
+		sy.closeServers()
+		for _, sock := range sy.sockets {
+			sock.Close()
+		}
+	})
+	sy.wg.Wait()
+}
+
+// An identity's view of a shared socket. The Sybil reads from the socket, and closing the Server
+// leaves it open.
+type sybilConn struct {
+	net.PacketConn
+}
+
+func (sybilConn) ReadFrom([]byte) (int, net.Addr, error) {
+	return 0, nil, errors.New("sybil identities don't read")
+}
+
+func (sybilConn) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/metainfo"
+)
+
+func TestSybilNodeIDs(t *testing.T) {
+	c := qt.New(t)
+	for i := 0; i < 8; i++ {
+		id := sybilNodeID(i, 8, nil)
+		c.Check(int(id[0])/32, qt.Equals, i)
+	}
+	ip := net.ParseIP("1.2.3.4")
+	for i := 0; i < 16; i++ {
+		id := sybilNodeID(i, 16, ip)
+		c.Check(NodeIdSecure(id, ip), qt.IsTrue)
+		c.Check(int(id[19]&7), qt.Equals, i%8)
+		c.Check(int(id[3])/128, qt.Equals, i/8)
+	}
+}
+
+func TestSybil(t *testing.T) {
+	c := qt.New(t)
+	announced := make(chan metainfo.Hash, 1)
+	sy, err := NewSybil(&SybilConfig{
+		Conns:      []net.PacketConn{mustListen("127.0.0.1:0")},
+		Identities: 4,
+		Server: ServerConfig{
+			NoSecurity: true,
+			OnAnnouncePeer: func(ih metainfo.Hash, _ net.IP, _ int, _ bool) {
+				announced <- ih
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer sy.Close()
+	c.Assert(sy.Servers(), qt.HasLen, 4)
+	client, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer client.Close()
+	addr := NewAddr(sy.Servers()[0].Addr())
+
+	// Queries are answered by the identity nearest the target.
+	for _, s := range sy.Servers() {
+		res := client.FindNode(addr, s.id, QueryRateLimiting{})
+		c.Assert(res.Err, qt.IsNil)
+		c.Check(res.Reply.R.ID, qt.Equals, krpc.ID(s.ID()))
+	}
+	target := sy.Servers()[2].id
+	res := client.GetPeers(context.Background(), addr, target, false, QueryRateLimiting{})
+	c.Assert(res.Err, qt.IsNil)
+	c.Assert(res.Reply.R.Token, qt.Not(qt.IsNil))
+	port := 1
+	res = client.Query(context.Background(), addr, "announce_peer", QueryInput{
+		MsgArgs: krpc.MsgArgs{
+			InfoHash: target.AsByteArray(),
+			Port:     &port,
+			Token:    *res.Reply.R.Token,
+		},
+	})
+	c.Assert(res.Err, qt.IsNil)
+	c.Assert(<-announced, qt.Equals, metainfo.Hash(target.AsByteArray()))
+
+	// Responses go to the identity that sent the query.
+	for _, s := range sy.Servers() {
+		res := s.Ping(client.Addr().(*net.UDPAddr))
+		c.Assert(res.Err, qt.IsNil)
+		c.Check(res.Reply.R.ID, qt.Equals, krpc.ID(client.ID()))
+	}
+	c.Check(sy.Servers()[3].NumNodes(), qt.Equals, 1)
+}
@@ -3,6 +3,7 @@ package dht
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"testTorrent/dht/int160"
 )
@@ -46,6 +47,7 @@ func (tbl *table) dropNode(n *Node) {
 		panic("expected Node in bucket")
 	}
 	delete(b.nodes, n)
+	b.lastChanged = time.Now()
 }
 
 func (tbl *table) bucketForID(id int160.T) *bucket {
@@ -85,6 +87,25 @@ func (tbl *table) getNode(addr Addr, id int160.T) *Node {
 	return tbl.buckets[tbl.bucketIndex(id)].GetNode(addr, id)
 }
 
+// Returns a Node waiting in the replacements of its bucket.
+func (tbl *table) getReplacement(addr Addr, id int160.T) *Node {
+	if id == tbl.rootID {
+		return nil
+	}
+	return tbl.buckets[tbl.bucketIndex(id)].getReplacement(addr, id)
+}
+
+// Index of the bucket nearest the root ID that has Nodes, or -1 if the table is empty. Nearer
+// buckets cover so little of the ID space that refreshing them is unlikely to find anything.
+func (tbl *table) deepestBucket() int {
+	for i := len(tbl.buckets) - 1; i >= 0; i-- {
+		if tbl.buckets[i].Len() != 0 {
+			return i
+		}
+	}
+	return -1
+}
+
 func (tbl *table) closestNodes(k int, target int160.T, filter func(*Node) bool) (ret []*Node) {
 	for bi := func() int {
 		if target == tbl.rootID {
@@ -118,6 +139,8 @@ func (tbl *table) addNode(n *Node) error {
 		return errors.New("bucket is full")
 	}
 	b.AddNode(n, tbl.k)
+	b.removeReplacement(n.Addr, n.Id)
+	b.lastChanged = time.Now()
 	if tbl.addrs == nil {
 		tbl.addrs = make(map[string]map[int160.T]struct{}, 160*tbl.k)
 	}
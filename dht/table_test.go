@@ -3,10 +3,14 @@ package dht
 import (
 	"net"
 	"testing"
+	"time"
 
+	"github.com/anacrolix/stm/rate"
 	qt "github.com/frankban/quicktest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"testTorrent/dht/int160"
+	"testTorrent/dht/krpc"
 )
 
 func TestTable(t *testing.T) {
@@ -61,3 +65,116 @@ func TestRandomIdInBucket(t *testing.T) {
 		qt.Assert(t, tbl.bucketIndex(id), qt.Equals, i)
 	}
 }
+
+func TestReplacementCache(t *testing.T) {
+	c := qt.New(t)
+	s, err := newServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	// Keeps questionableNodePinger out of the way.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k := s.Table.k
+	var nodes []*Node
+	for i := 0; i < k+2; i++ {
+		randomId := s.Table.randomIdForBucket(0)
+		id := krpc.ID(randomId.AsByteArray())
+		addr := NewAddr(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000 + i})
+		err := s.updateNode(addr, &id, true, func(n *Node) {
+			n.lastGotResponse = time.Now()
+			nodes = append(nodes, n)
+		})
+		if i < k {
+			c.Assert(err, qt.IsNil)
+		} else {
+			c.Assert(err, qt.Not(qt.IsNil))
+		}
+	}
+	b := &s.Table.buckets[0]
+	c.Assert(b.Len(), qt.Equals, k)
+	c.Assert(b.replacements, qt.HasLen, 2)
+	c.Assert(b.replacements[0], qt.Equals, nodes[k])
+	c.Assert(b.replacements[1], qt.Equals, nodes[k+1])
+
+	// Seeing a replacement again makes it the most recently seen.
+	first := nodes[k]
+	id := krpc.ID(first.Id.AsByteArray())
+	c.Assert(s.updateNode(first.Addr, &id, true, func(*Node) {}), qt.Not(qt.IsNil))
+	c.Assert(b.replacements, qt.HasLen, 2)
+	c.Assert(b.replacements[0], qt.Equals, nodes[k+1])
+	c.Assert(b.replacements[1], qt.Equals, first)
+
+	// Questionable Nodes in buckets with replacements are pinged first, least recently seen first.
+	nodes[3].lastGotResponse = time.Now().Add(-time.Hour)
+	nodes[5].lastGotResponse = time.Now().Add(-2 * time.Hour)
+	c.Check(s.getQuestionableNode(), qt.Equals, nodes[5])
+
+	nodes[5].consecutiveFailures = 3
+	s.replaceBadNode(nodes[5])
+	c.Check(b.GetNode(nodes[5].Addr, nodes[5].Id), qt.IsNil)
+	c.Check(b.GetNode(first.Addr, first.Id), qt.Equals, first)
+	c.Assert(b.replacements, qt.HasLen, 1)
+	c.Check(b.replacements[0], qt.Equals, nodes[k+1])
+
+	// Bad replacements are discarded rather than put in the table.
+	nodes[k+1].consecutiveFailures = 3
+	nodes[3].consecutiveFailures = 3
+	s.replaceBadNode(nodes[3])
+	c.Check(b.GetNode(nodes[3].Addr, nodes[3].Id), qt.Equals, nodes[3])
+	c.Check(b.replacements, qt.HasLen, 0)
+}
+
+func TestRefreshBuckets(t *testing.T) {
+	c := qt.New(t)
+	targets := make(chan krpc.ID, 1)
+	remote, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+		OnQuery: func(m *krpc.Msg, _ net.Addr) bool {
+			if m.Q == "find_node" {
+				targets <- m.A.Target
+			}
+			return true
+		},
+	})
+	require.NoError(t, err)
+	defer remote.Close()
+	s, err := NewServer(&ServerConfig{
+		Conn:       mustListen("127.0.0.1:0"),
+		NoSecurity: true,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	s.sendLimit = rate.NewLimiter(rate.Inf, 0)
+
+	remoteId := krpc.ID(remote.ID())
+	s.mu.Lock()
+	c.Assert(s.updateNode(NewAddr(remote.Addr()), &remoteId, true, func(n *Node) {
+		n.lastGotResponse = time.Now()
+	}), qt.IsNil)
+	bi := s.Table.bucketIndex(remote.id)
+	// Only the stale bucket is refreshed.
+	s.Table.buckets[bi].lastChanged = time.Now().Add(-bucketRefreshInterval)
+	s.mu.Unlock()
+
+	s.refreshBuckets()
+	select {
+	case target := <-targets:
+		s.mu.Lock()
+		c.Check(s.Table.bucketIndex(int160.FromByteArray(target)), qt.Equals, bi)
+		c.Check(time.Since(s.Table.buckets[bi].lastChanged) < time.Minute, qt.IsTrue)
+		s.mu.Unlock()
+	default:
+		t.Fatal("no find_node for the stale bucket")
+	}
+
+	s.refreshBuckets()
+	select {
+	case <-targets:
+		t.Fatal("refreshed a fresh bucket")
+	default:
+	}
+}
@@ -0,0 +1,3 @@
+// Package index stores resolved torrent metainfo in SQLite, with full-text search over torrent names
+// and file paths using FTS5. It requires cgo.
+package index
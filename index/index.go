@@ -0,0 +1,262 @@
+//go:build cgo
+// +build cgo
+
+package index
+
+import (
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+
+	"testTorrent/torrent/metainfo"
+)
+
+type conn = *sqlite.Conn
+
+const schema = `
+	create table if not exists torrent (
+		infohash blob primary key,
+		-- The following are null until the metadata is resolved.
+		name text,
+		length integer,
+		num_files integer,
+		resolved integer,
+		-- Unix seconds.
+		first_seen integer not null,
+		last_seen integer not null,
+		announces integer not null default 0,
+		peers integer not null default 0
+	);
+	create index if not exists torrent_last_seen on torrent(last_seen);
+
+	create table if not exists file (
+		-- The torrent's rowid.
+		torrent integer not null,
+		path text not null,
+		length integer not null,
+		-- Lowercased, without the dot. Empty if there's no extension.
+		ext text not null
+	);
+	create index if not exists file_torrent on file(torrent);
+	create index if not exists file_ext on file(ext, torrent);
+
+	-- Row IDs match the torrent table.
+	create virtual table if not exists torrent_fts using fts5(name, files);
+`
+
+// Index is a store of torrents seen by the crawler. Its methods are safe for concurrent use.
+type Index struct {
+	pool *sqlitex.Pool
+}
+
+// Open opens or creates an index database file.
+func Open(path string) (*Index, error) {
+	pool, err := sqlitex.Open(path, 0, 4)
+	if err != nil {
+		return nil, err
+	}
+	ix := &Index{pool: pool}
+	err = ix.withConn(func(c conn) error {
+		return sqlitex.ExecScript(c, schema)
+	})
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+func (ix *Index) Close() error {
+	return ix.pool.Close()
+}
+
+func (ix *Index) withConn(f func(conn) error) error {
+	c := ix.pool.Get(context.TODO())
+	if c == nil {
+		return errors.New("index closed")
+	}
+	defer ix.pool.Put(c)
+	return f(c)
+}
+
+// Record notes a sighting of an infohash at t. announce is set if the sighting was an
+// announce_peer.
+func (ix *Index) Record(ih metainfo.Hash, t time.Time, announce bool) error {
+	var b Batch
+	b.Record(ih, t, announce)
+	return ix.WriteBatch(&b)
+}
+
+// SetPeers raises the estimated number of peers for an infohash. Estimates never go down.
+func (ix *Index) SetPeers(ih metainfo.Hash, peers int64) error {
+	var b Batch
+	b.SetPeers(ih, peers)
+	return ix.WriteBatch(&b)
+}
+
+// A Batch collects sightings and peer estimates to write to an Index in one transaction. The zero
+// value is an empty batch.
+type Batch struct {
+	seen  map[metainfo.Hash]*batchSeen
+	peers map[metainfo.Hash]int64
+	n     int
+}
+
+type batchSeen struct {
+	first, last time.Time
+	announces   int64
+}
+
+// Record adds a sighting, as for Index.Record.
+func (b *Batch) Record(ih metainfo.Hash, t time.Time, announce bool) {
+	b.n++
+	if b.seen == nil {
+		b.seen = make(map[metainfo.Hash]*batchSeen)
+	}
+	s, ok := b.seen[ih]
+	if !ok {
+		s = &batchSeen{first: t, last: t}
+		b.seen[ih] = s
+	}
+	if t.Before(s.first) {
+		s.first = t
+	}
+	if t.After(s.last) {
+		s.last = t
+	}
+	if announce {
+		s.announces++
+	}
+}
+
+// SetPeers adds a peer estimate, as for Index.SetPeers.
+func (b *Batch) SetPeers(ih metainfo.Hash, peers int64) {
+	b.n++
+	if b.peers == nil {
+		b.peers = make(map[metainfo.Hash]int64)
+	}
+	if cur, ok := b.peers[ih]; !ok || peers > cur {
+		b.peers[ih] = peers
+	}
+}
+
+// Len returns the number of sightings and estimates added.
+func (b *Batch) Len() int {
+	return b.n
+}
+
+// WriteBatch applies a Batch in one transaction. Sightings are applied before estimates, so the
+// estimates apply to infohashes first seen in the same batch.
+func (ix *Index) WriteBatch(b *Batch) error {
+	return ix.withConn(func(c conn) (err error) {
+		defer sqlitex.Save(c)(&err)
+		for ih, s := range b.seen {
+			err = sqlitex.Exec(c, `
+				insert into torrent (infohash, first_seen, last_seen, announces) values (?1, ?2, ?3, ?4)
+				on conflict (infohash) do update set
+					first_seen=min(first_seen, ?2),
+					last_seen=max(last_seen, ?3),
+					announces=announces+?4`,
+				nil, ih[:], s.first.Unix(), s.last.Unix(), s.announces)
+			if err != nil {
+				return
+			}
+		}
+		for ih, peers := range b.peers {
+			err = sqlitex.Exec(c, `update torrent set peers=max(peers, ?) where infohash=?`, nil, peers, ih[:])
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// AddInfo stores the resolved metainfo for an infohash, replacing any already stored. The infohash
+// is recorded as seen at t if it wasn't already known.
+func (ix *Index) AddInfo(ih metainfo.Hash, info *metainfo.Info, t time.Time) error {
+	files := info.UpvertedFiles()
+	return ix.withConn(func(c conn) (err error) {
+		defer sqlitex.Save(c)(&err)
+		err = sqlitex.Exec(c, `
+			insert into torrent (infohash, first_seen, last_seen) values (?1, ?2, ?2)
+			on conflict (infohash) do nothing`,
+			nil, ih[:], t.Unix())
+		if err != nil {
+			return
+		}
+		var rowid int64
+		err = sqlitex.Exec(c, `select rowid from torrent where infohash=?`, func(stmt *sqlite.Stmt) error {
+			rowid = stmt.ColumnInt64(0)
+			return nil
+		}, ih[:])
+		if err != nil {
+			return
+		}
+		err = sqlitex.Exec(c, `update torrent set name=?, length=?, num_files=?, resolved=? where rowid=?`,
+			nil, info.Name, info.TotalLength(), len(files), time.Now().Unix(), rowid)
+		if err != nil {
+			return
+		}
+		err = sqlitex.Exec(c, `delete from file where torrent=?`, nil, rowid)
+		if err != nil {
+			return
+		}
+		paths := make([]string, 0, len(files))
+		for _, fi := range files {
+			p := fi.DisplayPath(info)
+			paths = append(paths, p)
+			err = sqlitex.Exec(c, `insert into file (torrent, path, length, ext) values (?, ?, ?, ?)`,
+				nil, rowid, p, fi.Length, fileExt(p))
+			if err != nil {
+				return
+			}
+		}
+		err = sqlitex.Exec(c, `delete from torrent_fts where rowid=?`, nil, rowid)
+		if err != nil {
+			return
+		}
+		return sqlitex.Exec(c, `insert into torrent_fts (rowid, name, files) values (?, ?, ?)`,
+			nil, rowid, info.Name, strings.Join(paths, "\n"))
+	})
+}
+
+// HasInfo returns whether the metainfo for an infohash has been stored.
+func (ix *Index) HasInfo(ih metainfo.Hash) (ok bool, err error) {
+	err = ix.withConn(func(c conn) error {
+		return sqlitex.Exec(c, `select 1 from torrent where infohash=? and resolved is not null`,
+			func(*sqlite.Stmt) error {
+				ok = true
+				return nil
+			}, ih[:])
+	})
+	return
+}
+
+// Returns the lowercased extension of a file path. Things after the last dot that don't look like an
+// extension, like in "Ubuntu 21.04", are ignored.
+func fileExt(p string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+	if len(ext) > 10 {
+		return ""
+	}
+	hasLetter := false
+	for _, r := range ext {
+		switch {
+		case r >= 'a' && r <= 'z':
+			hasLetter = true
+		case r >= '0' && r <= '9':
+		default:
+			return ""
+		}
+	}
+	if !hasLetter {
+		return ""
+	}
+	return ext
+}
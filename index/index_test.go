@@ -0,0 +1,204 @@
+//go:build cgo
+// +build cgo
+
+package index
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"testTorrent/crawler"
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/metainfo"
+)
+
+func openTestIndex(c *qt.C) *Index {
+	ix, err := Open(filepath.Join(c.TempDir(), "index.db"))
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { ix.Close() })
+	return ix
+}
+
+func searchHashes(c *qt.C, ix *Index, q Query) (ret []metainfo.Hash) {
+	ts, err := ix.Search(q)
+	c.Assert(err, qt.IsNil)
+	for _, t := range ts {
+		ret = append(ret, t.InfoHash)
+	}
+	return
+}
+
+func TestIndex(t *testing.T) {
+	c := qt.New(t)
+	ix := openTestIndex(c)
+	day := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	ubuntu := metainfo.Hash{1}
+	album := metainfo.Hash{2}
+	unresolved := metainfo.Hash{3}
+	c.Assert(ix.Record(ubuntu, day, false), qt.IsNil)
+	c.Assert(ix.Record(ubuntu, day.Add(-time.Hour), true), qt.IsNil)
+	c.Assert(ix.Record(ubuntu, day.Add(time.Hour), true), qt.IsNil)
+	c.Assert(ix.SetPeers(ubuntu, 5), qt.IsNil)
+	c.Assert(ix.SetPeers(ubuntu, 3), qt.IsNil)
+	c.Assert(ix.AddInfo(ubuntu, &metainfo.Info{
+		Name:   "ubuntu-21.04-desktop-amd64.iso",
+		Length: 3 << 30,
+	}, day), qt.IsNil)
+	c.Assert(ix.AddInfo(album, &metainfo.Info{
+		Name: "Some Album (2021)",
+		Files: []metainfo.FileInfo{
+			{Path: []string{"01 - Intro.FLAC"}, Length: 20 << 20},
+			{Path: []string{"cover.jpg"}, Length: 1 << 20},
+		},
+	}, day.Add(48*time.Hour)), qt.IsNil)
+	c.Assert(ix.Record(unresolved, day, true), qt.IsNil)
+
+	total, resolved, err := ix.Count()
+	c.Assert(err, qt.IsNil)
+	c.Assert(total, qt.Equals, int64(3))
+	c.Assert(resolved, qt.Equals, int64(2))
+	ok, err := ix.HasInfo(unresolved)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+
+	tor, ok, err := ix.Get(ubuntu)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(tor.Name, qt.Equals, "ubuntu-21.04-desktop-amd64.iso")
+	c.Assert(tor.Length, qt.Equals, int64(3<<30))
+	c.Assert(tor.NumFiles, qt.Equals, 1)
+	c.Assert(tor.FirstSeen.Equal(day.Add(-time.Hour)), qt.IsTrue)
+	c.Assert(tor.LastSeen.Equal(day.Add(time.Hour)), qt.IsTrue)
+	c.Assert(tor.Announces, qt.Equals, int64(2))
+	c.Assert(tor.Peers, qt.Equals, int64(5))
+	c.Assert(tor.Resolved.IsZero(), qt.IsFalse)
+	c.Assert(tor.Files, qt.DeepEquals, []File{{Path: "ubuntu-21.04-desktop-amd64.iso", Length: 3 << 30}})
+	tor, ok, err = ix.Get(unresolved)
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(tor.Resolved.IsZero(), qt.IsTrue)
+	_, ok, err = ix.Get(metainfo.Hash{4})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+
+	// Most recently seen first without terms, and unresolved infohashes are excluded.
+	c.Assert(searchHashes(c, ix, Query{}), qt.DeepEquals, []metainfo.Hash{album, ubuntu})
+	c.Assert(searchHashes(c, ix, Query{Terms: []string{"ubuntu desktop"}}), qt.DeepEquals, []metainfo.Hash{ubuntu})
+	// File paths are searched too.
+	c.Assert(searchHashes(c, ix, Query{Terms: []string{"intro"}}), qt.DeepEquals, []metainfo.Hash{album})
+	// Query syntax is taken literally.
+	c.Assert(searchHashes(c, ix, Query{Terms: []string{`ubuntu OR "album`}}), qt.HasLen, 0)
+	c.Assert(searchHashes(c, ix, Query{Extensions: []string{".flac"}}), qt.DeepEquals, []metainfo.Hash{album})
+	c.Assert(searchHashes(c, ix, Query{Extensions: []string{"iso", "mkv"}}), qt.DeepEquals, []metainfo.Hash{ubuntu})
+	c.Assert(searchHashes(c, ix, Query{MinLength: 1 << 30}), qt.DeepEquals, []metainfo.Hash{ubuntu})
+	c.Assert(searchHashes(c, ix, Query{MaxLength: 1 << 30}), qt.DeepEquals, []metainfo.Hash{album})
+	c.Assert(searchHashes(c, ix, Query{SeenAfter: day.Add(24 * time.Hour)}), qt.DeepEquals, []metainfo.Hash{album})
+	c.Assert(searchHashes(c, ix, Query{SeenBefore: day}), qt.DeepEquals, []metainfo.Hash{ubuntu})
+	c.Assert(searchHashes(c, ix, Query{Limit: 1, Offset: 1}), qt.DeepEquals, []metainfo.Hash{ubuntu})
+
+	// Replacing the info replaces the searchable text and files.
+	c.Assert(ix.AddInfo(album, &metainfo.Info{Name: "Renamed", Length: 1}, day), qt.IsNil)
+	c.Assert(searchHashes(c, ix, Query{Terms: []string{"intro"}}), qt.HasLen, 0)
+	c.Assert(searchHashes(c, ix, Query{Terms: []string{"renamed"}}), qt.DeepEquals, []metainfo.Hash{album})
+	tor, _, err = ix.Get(album)
+	c.Assert(err, qt.IsNil)
+	c.Assert(tor.Files, qt.HasLen, 1)
+	c.Assert(tor.FirstSeen.Equal(day.Add(48*time.Hour)), qt.IsTrue)
+}
+
+func TestFileExt(t *testing.T) {
+	c := qt.New(t)
+	for p, ext := range map[string]string{
+		"a/b.MKV":         "mkv",
+		"archive.7z":      "7z",
+		"Ubuntu 21.04":    "",
+		"no extension":    "",
+		"file.with space": "",
+		"x.part001":       "part001",
+	} {
+		c.Check(fileExt(p), qt.Equals, ext, qt.Commentf("%q", p))
+	}
+}
+
+func TestSinkWithoutFetcher(t *testing.T) {
+	c := qt.New(t)
+	ix := openTestIndex(c)
+	s := ix.NewSink(SinkConfig{MaxTracked: 1})
+	now := time.Unix(1630000000, 0)
+	announce := func(ih metainfo.Hash, ip byte, port int) {
+		c.Assert(s.Write(crawler.Sighting{
+			InfoHash: ih,
+			Query:    crawler.QueryAnnouncePeer,
+			Source:   krpc.NodeInfo{Addr: krpc.NodeAddr{IP: []byte{1, 2, 3, ip}, Port: 1}},
+			Port:     port,
+			PortOk:   true,
+			Time:     now,
+		}), qt.IsNil)
+	}
+	announce(metainfo.Hash{1}, 1, 10)
+	announce(metainfo.Hash{1}, 1, 10)
+	announce(metainfo.Hash{1}, 2, 10)
+	c.Assert(s.Write(crawler.Sighting{InfoHash: metainfo.Hash{1}, Query: crawler.QueryGetPeers, Time: now}), qt.IsNil)
+	// Evicts the first infohash's peers, so they're counted afresh, but the estimate doesn't go down.
+	announce(metainfo.Hash{2}, 1, 10)
+	announce(metainfo.Hash{1}, 3, 10)
+	c.Assert(s.Close(), qt.IsNil)
+	tor, ok, err := ix.Get(metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(tor.Announces, qt.Equals, int64(4))
+	c.Assert(tor.Peers, qt.Equals, int64(2))
+	// Scrapes raise the estimate too.
+	c.Assert(s.WriteScrape(crawler.ScrapeResult{InfoHash: metainfo.Hash{1}, Seeds: 3, Peers: 4}), qt.IsNil)
+	c.Assert(s.Flush(), qt.IsNil)
+	tor, _, err = ix.Get(metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(tor.Peers, qt.Equals, int64(7))
+}
+
+func TestSinkBatchesWrites(t *testing.T) {
+	c := qt.New(t)
+	ix := openTestIndex(c)
+	s := ix.NewSink(SinkConfig{FlushEvery: 3, FlushInterval: time.Hour})
+	now := time.Unix(1630000000, 0)
+	write := func(ih metainfo.Hash, t time.Time) {
+		c.Assert(s.Write(crawler.Sighting{InfoHash: ih, Query: crawler.QueryGetPeers, Time: t}), qt.IsNil)
+	}
+	write(metainfo.Hash{1}, now.Add(time.Minute))
+	write(metainfo.Hash{1}, now)
+	_, ok, err := ix.Get(metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsFalse)
+	c.Assert(s.WriteScrape(crawler.ScrapeResult{InfoHash: metainfo.Hash{1}, Seeds: 1, Peers: 2}), qt.IsNil)
+	tor, ok, err := ix.Get(metainfo.Hash{1})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(tor.FirstSeen.Unix(), qt.Equals, now.Unix())
+	c.Assert(tor.LastSeen.Unix(), qt.Equals, now.Add(time.Minute).Unix())
+	c.Assert(tor.Peers, qt.Equals, int64(3))
+	// Close writes what's pending.
+	write(metainfo.Hash{2}, now)
+	c.Assert(s.Close(), qt.IsNil)
+	_, ok, err = ix.Get(metainfo.Hash{2})
+	c.Assert(err, qt.IsNil)
+	c.Assert(ok, qt.IsTrue)
+}
+
+func TestSinkFlushInterval(t *testing.T) {
+	c := qt.New(t)
+	ix := openTestIndex(c)
+	s := ix.NewSink(SinkConfig{FlushInterval: time.Millisecond})
+	defer s.Close()
+	c.Assert(s.Write(crawler.Sighting{InfoHash: metainfo.Hash{1}, Query: crawler.QueryGetPeers, Time: time.Now()}), qt.IsNil)
+	for {
+		_, ok, err := ix.Get(metainfo.Hash{1})
+		c.Assert(err, qt.IsNil)
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
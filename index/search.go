@@ -0,0 +1,135 @@
+//go:build cgo
+// +build cgo
+
+package index
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+
+	"testTorrent/torrent/metainfo"
+)
+
+// Returns the FTS5 match expression for terms. Each term is quoted, so any syntax in it is literal.
+func matchExpr(terms []string) string {
+	var quoted []string
+	for _, t := range terms {
+		for _, f := range strings.Fields(t) {
+			quoted = append(quoted, `"`+strings.ReplaceAll(f, `"`, `""`)+`"`)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Search returns the torrents matching q, best match first, or most recently seen first if there are
+// no terms.
+func (ix *Index) Search(q Query) (ret []Torrent, err error) {
+	var (
+		from  = "torrent t"
+		where = []string{"t.resolved is not null"}
+		args  []interface{}
+		order = "t.last_seen desc"
+	)
+	if match := matchExpr(q.Terms); match != "" {
+		from = "torrent_fts f join torrent t on t.rowid=f.rowid"
+		where = append(where, "f.torrent_fts match ?")
+		args = append(args, match)
+		order = "f.rank"
+	}
+	if q.MinLength > 0 {
+		where = append(where, "t.length >= ?")
+		args = append(args, q.MinLength)
+	}
+	if q.MaxLength > 0 {
+		where = append(where, "t.length <= ?")
+		args = append(args, q.MaxLength)
+	}
+	if len(q.Extensions) != 0 {
+		var placeholders []string
+		for _, ext := range q.Extensions {
+			placeholders = append(placeholders, "?")
+			args = append(args, strings.ToLower(strings.TrimPrefix(ext, ".")))
+		}
+		where = append(where, fmt.Sprintf(
+			"exists (select 1 from file where file.torrent=t.rowid and file.ext in (%s))",
+			strings.Join(placeholders, ", ")))
+	}
+	if !q.SeenAfter.IsZero() {
+		where = append(where, "t.last_seen >= ?")
+		args = append(args, q.SeenAfter.Unix())
+	}
+	if !q.SeenBefore.IsZero() {
+		where = append(where, "t.first_seen <= ?")
+		args = append(args, q.SeenBefore.Unix())
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = 50
+	}
+	args = append(args, limit, q.Offset)
+	query := fmt.Sprintf("select %s from %s where %s order by %s limit ? offset ?",
+		torrentColumns, from, strings.Join(where, " and "), order)
+	err = ix.withConn(func(c conn) error {
+		return sqlitex.Exec(c, query, func(stmt *sqlite.Stmt) error {
+			ret = append(ret, scanTorrent(stmt))
+			return nil
+		}, args...)
+	})
+	return
+}
+
+// Get returns the torrent for an infohash, including its files if it's resolved.
+func (ix *Index) Get(ih metainfo.Hash) (t Torrent, ok bool, err error) {
+	err = ix.withConn(func(c conn) error {
+		var rowid int64
+		err := sqlitex.Exec(c, "select "+torrentColumns+", t.rowid from torrent t where infohash=?",
+			func(stmt *sqlite.Stmt) error {
+				t = scanTorrent(stmt)
+				rowid = stmt.ColumnInt64(9)
+				ok = true
+				return nil
+			}, ih[:])
+		if err != nil || !ok {
+			return err
+		}
+		return sqlitex.Exec(c, "select path, length from file where torrent=? order by rowid",
+			func(stmt *sqlite.Stmt) error {
+				t.Files = append(t.Files, File{Path: stmt.ColumnText(0), Length: stmt.ColumnInt64(1)})
+				return nil
+			}, rowid)
+	})
+	return
+}
+
+// Count returns the number of infohashes, and how many of those have been resolved.
+func (ix *Index) Count() (total, resolved int64, err error) {
+	err = ix.withConn(func(c conn) error {
+		return sqlitex.Exec(c, "select count(*), count(resolved) from torrent", func(stmt *sqlite.Stmt) error {
+			total = stmt.ColumnInt64(0)
+			resolved = stmt.ColumnInt64(1)
+			return nil
+		})
+	})
+	return
+}
+
+const torrentColumns = "t.infohash, t.name, t.length, t.num_files, t.resolved, t.first_seen, t.last_seen, t.announces, t.peers"
+
+func scanTorrent(stmt *sqlite.Stmt) (t Torrent) {
+	stmt.ColumnBytes(0, t.InfoHash[:])
+	t.Name = stmt.ColumnText(1)
+	t.Length = stmt.ColumnInt64(2)
+	t.NumFiles = stmt.ColumnInt(3)
+	if stmt.ColumnType(4) != sqlite.SQLITE_NULL {
+		t.Resolved = time.Unix(stmt.ColumnInt64(4), 0)
+	}
+	t.FirstSeen = time.Unix(stmt.ColumnInt64(5), 0)
+	t.LastSeen = time.Unix(stmt.ColumnInt64(6), 0)
+	t.Announces = stmt.ColumnInt64(7)
+	t.Peers = stmt.ColumnInt64(8)
+	return
+}
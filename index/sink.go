@@ -0,0 +1,217 @@
+//go:build cgo
+// +build cgo
+
+package index
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"testTorrent/crawler"
+	"testTorrent/dht/krpc"
+	"testTorrent/metafetch"
+	"testTorrent/torrent/metainfo"
+)
+
+type SinkConfig struct {
+	// Resolves the metadata of announced infohashes. If nil, only sightings are indexed.
+	Fetcher *metafetch.Fetcher
+	// Infohashes whose announcing peers are remembered, for estimating swarm sizes and fetching
+	// metadata. The least recently announced are forgotten first. Defaults to 100000.
+	MaxTracked int
+	// Distinct peers remembered for each infohash. Peer estimates don't go higher. Defaults to 256.
+	MaxPeers int
+	// Sightings and peer estimates are written to the Index in one transaction once FlushEvery are
+	// pending, or FlushInterval after the first of them. Default to 1000 and a second.
+	FlushEvery    int
+	FlushInterval time.Duration
+	Logger        log.Logger
+}
+
+// Sink indexes a crawler's sightings, and resolves the metadata of announced infohashes from the
+// announcing peers.
+type Sink struct {
+	ix     *Index
+	config SinkConfig
+
+	mu sync.Mutex
+	// Values are *tracked, most recently announced at the front.
+	order   *list.List
+	tracked map[metainfo.Hash]*list.Element
+
+	// Guards the pending batch, and serializes writing batches to the Index.
+	batchMu    sync.Mutex
+	batch      *Batch
+	flushTimer *time.Timer
+
+	ctx     context.Context
+	cancel  func()
+	fetches sync.WaitGroup
+}
+
+var _ crawler.ScrapeSink = (*Sink)(nil)
+
+type tracked struct {
+	ih       metainfo.Hash
+	peers    map[string]krpc.NodeAddr
+	fetching bool
+	resolved bool
+}
+
+// NewSink returns a crawler.Sink that writes to the Index. Closing it doesn't close the Index.
+func (ix *Index) NewSink(cfg SinkConfig) *Sink {
+	if cfg.MaxTracked <= 0 {
+		cfg.MaxTracked = 100000
+	}
+	if cfg.MaxPeers <= 0 {
+		cfg.MaxPeers = 256
+	}
+	if cfg.FlushEvery <= 0 {
+		cfg.FlushEvery = 1000
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Logger.LoggerImpl == nil {
+		cfg.Logger = log.Default
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Sink{
+		ix:      ix,
+		config:  cfg,
+		order:   list.New(),
+		tracked: make(map[metainfo.Hash]*list.Element),
+		batch:   new(Batch),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (s *Sink) Write(sg crawler.Sighting) error {
+	announce := sg.Query == crawler.QueryAnnouncePeer
+	numPeers := -1
+	var (
+		t     *tracked
+		fetch bool
+		peers []krpc.NodeAddr
+	)
+	if announce && sg.PortOk && sg.Port != 0 {
+		peer := krpc.NodeAddr{IP: sg.Source.Addr.IP, Port: sg.Port}
+		s.mu.Lock()
+		t = s.track(sg.InfoHash)
+		if _, ok := t.peers[peer.String()]; !ok && len(t.peers) < s.config.MaxPeers {
+			t.peers[peer.String()] = peer
+			numPeers = len(t.peers)
+		}
+		// Failed fetches are only retried once there's another peer to try.
+		fetch = s.config.Fetcher != nil && numPeers >= 0 && !t.fetching && !t.resolved
+		if fetch {
+			t.fetching = true
+			for _, p := range t.peers {
+				peers = append(peers, p)
+			}
+		}
+		s.mu.Unlock()
+	}
+	err := s.batched(func(b *Batch) {
+		b.Record(sg.InfoHash, sg.Time, announce)
+		if numPeers >= 0 {
+			b.SetPeers(sg.InfoHash, int64(numPeers))
+		}
+	})
+	if fetch {
+		s.fetches.Add(1)
+		go s.fetch(t, peers)
+	}
+	return err
+}
+
+// WriteScrape raises the infohash's swarm size estimate to the scraped seeds and peers.
+func (s *Sink) WriteScrape(res crawler.ScrapeResult) error {
+	return s.batched(func(b *Batch) {
+		b.SetPeers(res.InfoHash, res.Seeds+res.Peers)
+	})
+}
+
+// Adds to the pending batch, writing it to the Index if it's full.
+func (s *Sink) batched(f func(*Batch)) error {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	f(s.batch)
+	if s.batch.Len() >= s.config.FlushEvery {
+		return s.flushLocked()
+	}
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(s.config.FlushInterval, func() {
+			if err := s.Flush(); err != nil {
+				s.config.Logger.WithDefaultLevel(log.Warning).Printf("flushing index sink: %v", err)
+			}
+		})
+	}
+	return nil
+}
+
+// Flush writes pending sightings and peer estimates to the Index.
+func (s *Sink) Flush() error {
+	s.batchMu.Lock()
+	defer s.batchMu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *Sink) flushLocked() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	if s.batch.Len() == 0 {
+		return nil
+	}
+	b := s.batch
+	s.batch = new(Batch)
+	return s.ix.WriteBatch(b)
+}
+
+// Returns the tracking for ih, making it the most recent. Called with the Sink locked.
+func (s *Sink) track(ih metainfo.Hash) *tracked {
+	if e, ok := s.tracked[ih]; ok {
+		s.order.MoveToFront(e)
+		return e.Value.(*tracked)
+	}
+	t := &tracked{ih: ih, peers: make(map[string]krpc.NodeAddr)}
+	s.tracked[ih] = s.order.PushFront(t)
+	for s.order.Len() > s.config.MaxTracked {
+		delete(s.tracked, s.order.Remove(s.order.Back()).(*tracked).ih)
+	}
+	return t
+}
+
+func (s *Sink) fetch(t *tracked, peers []krpc.NodeAddr) {
+	defer s.fetches.Done()
+	resolved, err := s.ix.HasInfo(t.ih)
+	if err == nil && !resolved {
+		var res metafetch.Result
+		res, err = s.config.Fetcher.Fetch(s.ctx, t.ih, peers)
+		if err == nil {
+			err = s.ix.AddInfo(t.ih, &res.Info, time.Now())
+		}
+		resolved = err == nil
+	}
+	if err != nil {
+		s.config.Logger.WithDefaultLevel(log.Debug).Printf("resolving %v: %v", t.ih, err)
+	}
+	s.mu.Lock()
+	t.fetching = false
+	t.resolved = resolved
+	s.mu.Unlock()
+}
+
+// Close waits for metadata fetches in progress to be abandoned, and flushes pending writes.
+func (s *Sink) Close() error {
+	s.cancel()
+	s.fetches.Wait()
+	return s.Flush()
+}
@@ -0,0 +1,47 @@
+package index
+
+import (
+	"time"
+
+	"testTorrent/torrent/metainfo"
+)
+
+// Torrent is an indexed infohash. Resolved is zero, and the metainfo fields empty, until the metadata
+// has been stored.
+type Torrent struct {
+	InfoHash  metainfo.Hash
+	Name      string
+	Length    int64
+	NumFiles  int
+	Resolved  time.Time
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// announce_peer sightings.
+	Announces int64
+	// Estimated swarm size.
+	Peers int64
+	// Only populated by Get.
+	Files []File
+}
+
+type File struct {
+	// Slash separated, or the torrent name for single file torrents.
+	Path   string
+	Length int64
+}
+
+// Query selects resolved torrents. Zero fields don't filter.
+type Query struct {
+	// Words that must all appear in the torrent name or file paths. Words are matched as FTS5 tokens,
+	// with no query syntax.
+	Terms []string
+	// Bounds on the total length, inclusive.
+	MinLength, MaxLength int64
+	// The torrent must have a file with one of these extensions, without the dot.
+	Extensions []string
+	// The torrent must have been seen within this time range.
+	SeenAfter, SeenBefore time.Time
+	// Defaults to 50.
+	Limit  int
+	Offset int
+}
@@ -5,12 +5,10 @@ import (
 	"github.com/pkg/errors"
 	"net"
 	"testTorrent/dht"
-	"testTorrent/dht/int160"
 	"testTorrent/timeWheel"
 	"testTorrent/torrent"
 	"testTorrent/torrent/metainfo"
 	"testTorrent/torrent/tracker"
-	"time"
 )
 
 func main() {
@@ -99,35 +97,3 @@ func TrackerGetPeers() {
 	}
 	fmt.Printf("%+v\n", response)
 }
-
-/*
-记录所有请求过来的node节点数据
-对get_peer的请求记录种子信息，后续对外请求
-定期储存种子信息
-*/
-type CommunicationRecord struct {
-	// 时间段 一个小时 记录一个小时中有多少次请求交互 其中有我主动发送的数量，他主动发送的数量
-	// 数据格式 每个小时站6个字节，前2个字节 我主动发送的数量 然后他回复的数量，他发送的数量
-	// 如果连续多个小时交互数据都相同就压缩
-}
-type nodeInfo struct {
-	nodeData            dht.Node
-	ReceivedTime        int64
-	communicationRecord CommunicationRecord
-}
-
-var nodeMap map[int160.T]nodeInfo
-
-func addNewNode(node dht.Node) {
-	a, ok := nodeMap[node.Id]
-	if !ok {
-		a = nodeInfo{
-			nodeData:     node,
-			ReceivedTime: time.Now().Unix(),
-		}
-	}
-	a.communicationRecord.add()
-}
-func (cr *CommunicationRecord) add() {
-
-}
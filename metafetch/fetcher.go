@@ -0,0 +1,215 @@
+// Package metafetch resolves infohashes to their info dictionaries by fetching them directly from
+// peers over the ut_metadata extension (BEP 9), without the storage, piece state and connection
+// management of a torrent.Client.
+package metafetch
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/bencode"
+	"testTorrent/torrent/metainfo"
+)
+
+type Config struct {
+	// Sent in handshakes. Random if zero.
+	PeerID [20]byte
+	// Sent in the extended handshake.
+	ClientVersion string
+	// Infohashes fetched at once. Further calls to Fetch wait their turn. Defaults to 256.
+	MaxConcurrentFetches int
+	// Peers tried at once for each infohash. Defaults to 4.
+	PeersPerFetch int
+	// Deadline for fetching each infohash, across all its peers. Defaults to 30s.
+	FetchTimeout time.Duration
+	// Deadline for getting the metadata from a single peer, including dialing. Defaults to 10s.
+	PeerTimeout time.Duration
+	// Defaults to 5s.
+	DialTimeout time.Duration
+	// Larger metadata is refused. Defaults to 10 MiB.
+	MaxMetadataSize int
+	// Defaults to a net.Dialer.
+	Dial   func(ctx context.Context, network, addr string) (net.Conn, error)
+	Logger log.Logger
+}
+
+func (c *Config) setDefaults() {
+	if c.PeerID == [20]byte{} {
+		copy(c.PeerID[:], "-MF0001-")
+		rand.Read(c.PeerID[8:])
+	}
+	if c.MaxConcurrentFetches <= 0 {
+		c.MaxConcurrentFetches = 256
+	}
+	if c.PeersPerFetch <= 0 {
+		c.PeersPerFetch = 4
+	}
+	if c.FetchTimeout <= 0 {
+		c.FetchTimeout = 30 * time.Second
+	}
+	if c.PeerTimeout <= 0 {
+		c.PeerTimeout = 10 * time.Second
+	}
+	if c.DialTimeout <= 0 {
+		c.DialTimeout = 5 * time.Second
+	}
+	if c.MaxMetadataSize <= 0 {
+		c.MaxMetadataSize = 10 << 20
+	}
+	if c.Dial == nil {
+		c.Dial = (&net.Dialer{}).DialContext
+	}
+	if c.Logger.LoggerImpl == nil {
+		c.Logger = log.Default.FilterLevel(log.Info)
+	}
+	c.Logger = c.Logger.WithDefaultLevel(log.Debug)
+}
+
+// Stats are cumulative counts for a Fetcher. Fields are accessed with atomic.
+type Stats struct {
+	Fetches        int64
+	FetchesOk      int64
+	PeersTried     int64
+	PeerErrors     int64
+	MetadataBytes  int64
+	FetchesPending int64
+}
+
+// Fetcher resolves infohashes to info dictionaries. Its methods are safe for concurrent use.
+type Fetcher struct {
+	config  Config
+	fetches chan struct{}
+	stats   Stats
+}
+
+func New(cfg *Config) *Fetcher {
+	f := &Fetcher{}
+	if cfg != nil {
+		f.config = *cfg
+	}
+	f.config.setDefaults()
+	f.fetches = make(chan struct{}, f.config.MaxConcurrentFetches)
+	return f
+}
+
+// Result is a verified info dictionary.
+type Result struct {
+	InfoHash metainfo.Hash
+	Info     metainfo.Info
+	// The bencoded info dictionary, as received.
+	InfoBytes []byte
+	// The peer it was fetched from.
+	Peer krpc.NodeAddr
+}
+
+// ErrNoPeers is returned by Fetch when no peers were given.
+var ErrNoPeers = errors.New("no peers")
+
+// Fetch gets the info dictionary for ih from the first of peers to provide one that hashes to ih.
+// Config.PeersPerFetch peers are tried at a time, until one succeeds or all have failed, ctx is done,
+// or Config.FetchTimeout passes. The error from the last peer tried is returned if none succeed.
+func (f *Fetcher) Fetch(ctx context.Context, ih metainfo.Hash, peers []krpc.NodeAddr) (ret Result, err error) {
+	if len(peers) == 0 {
+		err = ErrNoPeers
+		return
+	}
+	atomic.AddInt64(&f.stats.FetchesPending, 1)
+	select {
+	case f.fetches <- struct{}{}:
+		atomic.AddInt64(&f.stats.FetchesPending, -1)
+	case <-ctx.Done():
+		atomic.AddInt64(&f.stats.FetchesPending, -1)
+		err = ctx.Err()
+		return
+	}
+	defer func() { <-f.fetches }()
+	atomic.AddInt64(&f.stats.Fetches, 1)
+	ctx, cancel := context.WithTimeout(ctx, f.config.FetchTimeout)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		found   bool
+		lastErr error
+		wg      sync.WaitGroup
+	)
+	next := make(chan krpc.NodeAddr)
+	for i := 0; i < f.config.PeersPerFetch && i < len(peers); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range next {
+				atomic.AddInt64(&f.stats.PeersTried, 1)
+				b, peerErr := f.fetchFromPeer(ctx, p.String(), ih)
+				if peerErr == nil {
+					var info metainfo.Info
+					peerErr = bencode.Unmarshal(b, &info)
+					if peerErr == nil {
+						mu.Lock()
+						if !found {
+							found = true
+							ret = Result{InfoHash: ih, Info: info, InfoBytes: b, Peer: p}
+						}
+						mu.Unlock()
+						cancel()
+						continue
+					}
+					peerErr = fmt.Errorf("unmarshalling info: %w", peerErr)
+				}
+				mu.Lock()
+				// Peers interrupted by another's success didn't fail.
+				if !found {
+					atomic.AddInt64(&f.stats.PeerErrors, 1)
+					f.config.Logger.Printf("fetching metadata for %v from %v: %v", ih, p, peerErr)
+					lastErr = fmt.Errorf("peer %v: %w", p, peerErr)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, p := range peers {
+		select {
+		case next <- p:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if found {
+		atomic.AddInt64(&f.stats.FetchesOk, 1)
+		atomic.AddInt64(&f.stats.MetadataBytes, int64(len(ret.InfoBytes)))
+		return
+	}
+	switch {
+	case ctx.Err() == nil:
+		err = lastErr
+	case lastErr == nil:
+		err = ctx.Err()
+	default:
+		err = fmt.Errorf("%w (last error: %v)", ctx.Err(), lastErr)
+	}
+	return
+}
+
+// Stats returns a snapshot of the Fetcher's counters.
+func (f *Fetcher) Stats() Stats {
+	return Stats{
+		Fetches:        atomic.LoadInt64(&f.stats.Fetches),
+		FetchesOk:      atomic.LoadInt64(&f.stats.FetchesOk),
+		PeersTried:     atomic.LoadInt64(&f.stats.PeersTried),
+		PeerErrors:     atomic.LoadInt64(&f.stats.PeerErrors),
+		MetadataBytes:  atomic.LoadInt64(&f.stats.MetadataBytes),
+		FetchesPending: atomic.LoadInt64(&f.stats.FetchesPending),
+	}
+}
@@ -0,0 +1,223 @@
+package metafetch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"testTorrent/dht/krpc"
+	"testTorrent/torrent/bencode"
+	"testTorrent/torrent/metainfo"
+	pp "testTorrent/torrent/peer_protocol"
+)
+
+// Serves metadata over ut_metadata. If reject is set, requests are rejected instead.
+type testSeeder struct {
+	infoBytes []byte
+	// The infohash to handshake with. Defaults to the hash of infoBytes.
+	ih     metainfo.Hash
+	reject bool
+	// Don't complete the handshake.
+	stall bool
+}
+
+func (ts testSeeder) serve(c *qt.C) krpc.NodeAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { l.Close() })
+	if ts.ih == (metainfo.Hash{}) {
+		ts.ih = sha1.Sum(ts.infoBytes)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				ts.handleConn(conn)
+			}()
+		}
+	}()
+	tcpAddr := l.Addr().(*net.TCPAddr)
+	return krpc.NodeAddr{IP: tcpAddr.IP, Port: tcpAddr.Port}
+}
+
+func (ts testSeeder) handleConn(conn net.Conn) {
+	if ts.stall {
+		io.Copy(ioutil.Discard, conn)
+		return
+	}
+	_, err := pp.Handshake(conn, &ts.ih, [20]byte{}, pp.NewPeerExtensionBytes(pp.ExtensionBitExtended))
+	if err != nil {
+		return
+	}
+	const ourExtensionId = 3
+	conn.Write(pp.Message{
+		Type:       pp.Extended,
+		ExtendedID: pp.HandshakeExtendedID,
+		ExtendedPayload: bencode.MustMarshal(pp.ExtendedHandshakeMessage{
+			M:            map[pp.ExtensionName]pp.ExtensionNumber{pp.ExtensionNameMetadata: ourExtensionId},
+			MetadataSize: len(ts.infoBytes),
+		}),
+	}.MustMarshalBinary())
+	d := pp.Decoder{R: bufio.NewReader(conn), MaxLength: 1 << 20}
+	var peerExtensionId pp.ExtensionNumber
+	for {
+		var msg pp.Message
+		if d.Decode(&msg) != nil {
+			return
+		}
+		if msg.Type != pp.Extended {
+			continue
+		}
+		switch msg.ExtendedID {
+		case pp.HandshakeExtendedID:
+			var ehs pp.ExtendedHandshakeMessage
+			if bencode.Unmarshal(msg.ExtendedPayload, &ehs) != nil {
+				return
+			}
+			peerExtensionId = ehs.M[pp.ExtensionNameMetadata]
+		case ourExtensionId:
+			var req pp.ExtendedMetadataRequestMsg
+			if bencode.Unmarshal(msg.ExtendedPayload, &req) != nil {
+				return
+			}
+			resp := pp.ExtendedMetadataRequestMsg{
+				Piece:     req.Piece,
+				TotalSize: len(ts.infoBytes),
+				Type:      pp.DataMetadataExtensionMsgType,
+			}
+			var data []byte
+			if ts.reject {
+				resp.Type = pp.RejectMetadataExtensionMsgType
+			} else {
+				data = ts.infoBytes[req.Piece*metadataPieceLen:][:resp.PieceSize()]
+			}
+			conn.Write(pp.Message{
+				Type:            pp.Extended,
+				ExtendedID:      peerExtensionId,
+				ExtendedPayload: append(bencode.MustMarshal(resp), data...),
+			}.MustMarshalBinary())
+		}
+	}
+}
+
+// Returns the bencoded info for a torrent with enough files to need several metadata pieces.
+func testInfoBytes(c *qt.C) []byte {
+	info := metainfo.Info{
+		Name:        "test",
+		PieceLength: 1 << 18,
+		Pieces:      make([]byte, 20),
+	}
+	for i := 0; i < 1000; i++ {
+		info.Files = append(info.Files, metainfo.FileInfo{
+			Length: 1,
+			Path:   []string{"dir", strings.Repeat("x", 20) + string(rune('a'+i%26))},
+		})
+	}
+	b, err := bencode.Marshal(info)
+	c.Assert(err, qt.IsNil)
+	c.Assert(len(b) > 2*metadataPieceLen, qt.IsTrue)
+	return b
+}
+
+func TestFetch(t *testing.T) {
+	c := qt.New(t)
+	infoBytes := testInfoBytes(c)
+	ih := metainfo.Hash(sha1.Sum(infoBytes))
+	good := testSeeder{infoBytes: infoBytes}.serve(c)
+	f := New(&Config{PeersPerFetch: 1})
+	res, err := f.Fetch(context.Background(), ih, []krpc.NodeAddr{good})
+	c.Assert(err, qt.IsNil)
+	c.Assert(res.InfoBytes, qt.DeepEquals, infoBytes)
+	c.Assert(res.Info.Name, qt.Equals, "test")
+	c.Assert(res.Info.UpvertedFiles(), qt.HasLen, 1000)
+	c.Assert(res.Peer, qt.DeepEquals, good)
+	c.Assert(f.Stats(), qt.Equals, Stats{
+		Fetches:       1,
+		FetchesOk:     1,
+		PeersTried:    1,
+		MetadataBytes: int64(len(infoBytes)),
+	})
+}
+
+func TestFetchRetriesPeers(t *testing.T) {
+	c := qt.New(t)
+	infoBytes := testInfoBytes(c)
+	ih := metainfo.Hash(sha1.Sum(infoBytes))
+	peers := []krpc.NodeAddr{
+		// Serves the wrong metadata.
+		testSeeder{infoBytes: []byte("de"), ih: ih}.serve(c),
+		testSeeder{infoBytes: infoBytes, reject: true}.serve(c),
+		// Nothing listening.
+		{IP: net.IPv4(127, 0, 0, 1), Port: 1},
+		testSeeder{infoBytes: infoBytes}.serve(c),
+	}
+	f := New(&Config{PeersPerFetch: 1})
+	res, err := f.Fetch(context.Background(), ih, peers)
+	c.Assert(err, qt.IsNil)
+	c.Assert(res.Peer, qt.DeepEquals, peers[3])
+	c.Assert(f.Stats().PeerErrors, qt.Equals, int64(3))
+}
+
+func TestFetchAllPeersFail(t *testing.T) {
+	c := qt.New(t)
+	infoBytes := testInfoBytes(c)
+	ih := metainfo.Hash(sha1.Sum(infoBytes))
+	f := New(nil)
+	_, err := f.Fetch(context.Background(), ih, []krpc.NodeAddr{
+		testSeeder{infoBytes: infoBytes, reject: true}.serve(c),
+	})
+	c.Assert(errors.Is(err, errRejected), qt.IsTrue)
+	_, err = f.Fetch(context.Background(), ih, nil)
+	c.Assert(err, qt.Equals, ErrNoPeers)
+}
+
+func TestFetchTimeout(t *testing.T) {
+	c := qt.New(t)
+	f := New(&Config{FetchTimeout: 100 * time.Millisecond})
+	started := time.Now()
+	_, err := f.Fetch(context.Background(), metainfo.Hash{1}, []krpc.NodeAddr{
+		testSeeder{stall: true}.serve(c),
+	})
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+	c.Assert(time.Since(started) < 5*time.Second, qt.IsTrue)
+}
+
+func TestFetchConcurrencyLimit(t *testing.T) {
+	c := qt.New(t)
+	infoBytes := testInfoBytes(c)
+	ih := metainfo.Hash(sha1.Sum(infoBytes))
+	good := testSeeder{infoBytes: infoBytes}.serve(c)
+	f := New(&Config{MaxConcurrentFetches: 1})
+	// Hold the only fetch slot.
+	f.fetches <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := f.Fetch(ctx, ih, []krpc.NodeAddr{good})
+	c.Assert(err, qt.Equals, context.DeadlineExceeded)
+	<-f.fetches
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := f.Fetch(context.Background(), ih, []krpc.NodeAddr{good})
+			c.Check(err, qt.IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(f.Stats().FetchesOk, qt.Equals, int64(4))
+}
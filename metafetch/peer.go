@@ -0,0 +1,165 @@
+package metafetch
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"testTorrent/torrent/bencode"
+	"testTorrent/torrent/metainfo"
+	pp "testTorrent/torrent/peer_protocol"
+)
+
+const (
+	metadataPieceLen = 1 << 14
+	// The extension number we ask peers to use for ut_metadata messages to us.
+	localMetadataExtensionId pp.ExtensionNumber = 1
+)
+
+var errRejected = errors.New("peer rejected metadata request")
+
+// Fetches the info dictionary bytes for ih from a single peer. The bytes are verified against ih.
+func (f *Fetcher) fetchFromPeer(ctx context.Context, addr string, ih metainfo.Hash) (_ []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, f.config.PeerTimeout)
+	defer cancel()
+	dialCtx, cancelDial := context.WithTimeout(ctx, f.config.DialTimeout)
+	conn, err := f.config.Dial(dialCtx, "tcp", addr)
+	cancelDial()
+	if err != nil {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+	defer conn.Close()
+	// Unblock any IO when the context is done.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	return f.converse(conn, ih)
+}
+
+func (f *Fetcher) converse(conn net.Conn, ih metainfo.Hash) ([]byte, error) {
+	hs, err := pp.Handshake(conn, &ih, f.config.PeerID, pp.NewPeerExtensionBytes(pp.ExtensionBitExtended))
+	if err != nil {
+		return nil, fmt.Errorf("handshaking: %w", err)
+	}
+	if hs.Hash != ih {
+		return nil, fmt.Errorf("peer handshook for %v", hs.Hash)
+	}
+	if !hs.SupportsExtended() {
+		return nil, errors.New("peer doesn't support the extension protocol")
+	}
+	err = writeMessage(conn, pp.Message{
+		Type:       pp.Extended,
+		ExtendedID: pp.HandshakeExtendedID,
+		ExtendedPayload: bencode.MustMarshal(pp.ExtendedHandshakeMessage{
+			M: map[pp.ExtensionName]pp.ExtensionNumber{
+				pp.ExtensionNameMetadata: localMetadataExtensionId,
+			},
+			V: f.config.ClientVersion,
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+	d := pp.Decoder{
+		R:         bufio.NewReader(conn),
+		MaxLength: 256 * 1024,
+		Pool: &sync.Pool{New: func() interface{} {
+			b := make([]byte, metadataPieceLen)
+			return &b
+		}},
+	}
+	var (
+		peerExtensionId pp.ExtensionNumber
+		metadata        []byte
+		havePieces      []bool
+		numPieces       int
+	)
+	for {
+		var msg pp.Message
+		if err := d.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("reading message: %w", err)
+		}
+		if msg.Keepalive || msg.Type != pp.Extended {
+			continue
+		}
+		switch msg.ExtendedID {
+		case pp.HandshakeExtendedID:
+			if metadata != nil {
+				continue
+			}
+			var ehs pp.ExtendedHandshakeMessage
+			if err := bencode.Unmarshal(msg.ExtendedPayload, &ehs); err != nil {
+				return nil, fmt.Errorf("unmarshalling extended handshake: %w", err)
+			}
+			var ok bool
+			peerExtensionId, ok = ehs.M[pp.ExtensionNameMetadata]
+			if !ok || peerExtensionId == pp.ExtensionDeleteNumber {
+				return nil, errors.New("peer doesn't support ut_metadata")
+			}
+			if ehs.MetadataSize <= 0 || ehs.MetadataSize > f.config.MaxMetadataSize {
+				return nil, fmt.Errorf("bad metadata size %d", ehs.MetadataSize)
+			}
+			metadata = make([]byte, ehs.MetadataSize)
+			havePieces = make([]bool, (ehs.MetadataSize+metadataPieceLen-1)/metadataPieceLen)
+			for i := range havePieces {
+				if err := writeMessage(conn, pp.MetadataExtensionRequestMsg(peerExtensionId, i)); err != nil {
+					return nil, err
+				}
+			}
+		case localMetadataExtensionId:
+			if metadata == nil {
+				return nil, errors.New("got metadata message before extended handshake")
+			}
+			var m pp.ExtendedMetadataRequestMsg
+			err := bencode.Unmarshal(msg.ExtendedPayload, &m)
+			if _, ok := err.(bencode.ErrUnusedTrailingBytes); !ok && err != nil {
+				return nil, fmt.Errorf("unmarshalling metadata message: %w", err)
+			}
+			switch m.Type {
+			case pp.RejectMetadataExtensionMsgType:
+				return nil, errRejected
+			case pp.DataMetadataExtensionMsgType:
+			default:
+				continue
+			}
+			if m.Piece < 0 || m.Piece >= len(havePieces) || m.TotalSize != len(metadata) {
+				return nil, fmt.Errorf("unexpected metadata piece %d of total size %d", m.Piece, m.TotalSize)
+			}
+			begin := len(msg.ExtendedPayload) - m.PieceSize()
+			if begin < 0 || begin >= len(msg.ExtendedPayload) {
+				return nil, fmt.Errorf("data has bad offset in payload: %d", begin)
+			}
+			copy(metadata[m.Piece*metadataPieceLen:], msg.ExtendedPayload[begin:])
+			if !havePieces[m.Piece] {
+				havePieces[m.Piece] = true
+				numPieces++
+			}
+			if numPieces < len(havePieces) {
+				continue
+			}
+			if metainfo.Hash(sha1.Sum(metadata)) != ih {
+				return nil, errors.New("metadata hash mismatch")
+			}
+			return metadata, nil
+		}
+	}
+}
+
+func writeMessage(conn net.Conn, msg pp.Message) error {
+	_, err := conn.Write(msg.MustMarshalBinary())
+	if err != nil {
+		err = fmt.Errorf("writing message: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+
+	"testTorrent/dht"
+	"testTorrent/timeWheel"
+	"testTorrent/torrent"
+)
+
+// DHTServer collects a Server's ServerStats and ServerMetrics, labelled by the Server's address and
+// node ID, as several identities can share an address.
+func DHTServer(s *dht.Server) Collector {
+	return CollectorFunc(func(m *Metrics) {
+		server := s.Addr().String()
+		id := fmt.Sprintf("%x", s.ID())
+		sm := s.Metrics()
+		for method, n := range sm.QueriesReceived {
+			m.Counter("dht_queries_received_total", "Queries received, by method.", float64(n),
+				"server", server, "id", id, "method", method)
+		}
+		for method, n := range sm.QueriesSent {
+			m.Counter("dht_queries_sent_total", "Queries sent, by method.", float64(n),
+				"server", server, "id", id, "method", method)
+		}
+		for code, n := range sm.ErrorsReceived {
+			m.Counter("dht_errors_received_total", "KRPC errors received, by code.", float64(n),
+				"server", server, "id", id, "code", strconv.Itoa(code))
+		}
+		for code, n := range sm.ErrorsSent {
+			m.Counter("dht_errors_sent_total", "KRPC errors sent, by code.", float64(n),
+				"server", server, "id", id, "code", strconv.Itoa(code))
+		}
+		for bucket, n := range sm.BucketNodes {
+			m.Gauge("dht_table_nodes", "Nodes in the routing table, by bucket.", float64(n),
+				"server", server, "id", id, "bucket", strconv.Itoa(bucket))
+		}
+		bounds := make([]float64, 0, len(dht.QueryLatencyBuckets))
+		for _, d := range dht.QueryLatencyBuckets {
+			bounds = append(bounds, d.Seconds())
+		}
+		for method, h := range sm.QueryLatency {
+			m.Histogram("dht_query_duration_seconds", "Time for queries to get a reply, by method.",
+				bounds, h.Counts, h.Sum.Seconds(), "server", server, "id", id, "method", method)
+		}
+		st := s.Stats()
+		m.Gauge("dht_nodes", "Nodes in the routing table.", float64(st.Nodes), "server", server, "id", id)
+		m.Gauge("dht_good_nodes", "Nodes in the routing table that are good.",
+			float64(st.GoodNodes), "server", server, "id", id)
+		m.Gauge("dht_bad_nodes", "Nodes that have been blocked.", float64(st.BadNodes), "server", server, "id", id)
+		m.Gauge("dht_outstanding_transactions", "Queries awaiting a reply.",
+			float64(st.OutstandingTransactions), "server", server, "id", id)
+		m.Counter("dht_outbound_queries_attempted_total", "Queries attempted.",
+			float64(st.OutboundQueriesAttempted), "server", server, "id", id)
+		m.Counter("dht_successful_outbound_announce_peer_queries_total",
+			"announce_peer queries that succeeded.",
+			float64(st.SuccessfulOutboundAnnouncePeerQueries), "server", server, "id", id)
+		m.Counter("dht_inbound_queries_dropped_total", "Queries dropped by the inbound limits.",
+			float64(st.InboundQueriesDropped), "server", server, "id", id)
+		m.Gauge("dht_blocked_ips", "IPs blocked for a while.", float64(st.BlockedIPs), "server", server, "id", id)
+	})
+}
+
+// TorrentClient collects the bytes transferred and peers of each of a Client's Torrents, labelled by
+// infohash and name.
+func TorrentClient(cl *torrent.Client) Collector {
+	return CollectorFunc(func(m *Metrics) {
+		for _, t := range cl.Torrents() {
+			ls := []string{"infohash", t.InfoHash().HexString(), "name", t.Name()}
+			st := t.Stats()
+			m.Counter("torrent_bytes_read_total", "Bytes read from peers.",
+				float64(st.BytesRead.Int64()), ls...)
+			m.Counter("torrent_bytes_written_total", "Bytes written to peers.",
+				float64(st.BytesWritten.Int64()), ls...)
+			m.Counter("torrent_data_bytes_read_total", "Bytes of piece data read from peers.",
+				float64(st.BytesReadData.Int64()), ls...)
+			m.Counter("torrent_data_bytes_written_total", "Bytes of piece data written to peers.",
+				float64(st.BytesWrittenData.Int64()), ls...)
+			m.Counter("torrent_useful_data_bytes_read_total",
+				"Bytes of piece data read from peers that were wanted.",
+				float64(st.BytesReadUsefulData.Int64()), ls...)
+			m.Gauge("torrent_bytes_completed", "Bytes of the torrent's data completed.",
+				float64(t.BytesCompleted()), ls...)
+			for _, p := range []struct {
+				state string
+				n     int
+			}{
+				{"total", st.TotalPeers},
+				{"pending", st.PendingPeers},
+				{"active", st.ActivePeers},
+				{"half_open", st.HalfOpenPeers},
+				{"seeder", st.ConnectedSeeders},
+			} {
+				m.Gauge("torrent_peers", "Peers, by state.", float64(p.n), append(ls, "state", p.state)...)
+			}
+		}
+	})
+}
+
+// TimeWheel collects the statistics of every TimeWheel.
+func TimeWheel() Collector {
+	return CollectorFunc(func(m *Metrics) {
+		tm := timeWheel.ReadMetrics()
+		for roulette, n := range tm.Pending {
+			m.Gauge("timewheel_pending_tasks", "Tasks waiting to expire, by roulette.",
+				float64(n), "roulette", roulette)
+		}
+		for event, n := range tm.Counters {
+			m.Counter("timewheel_events_total", "Task events, such as fired, runs and failures.",
+				float64(n), "event", event)
+		}
+		bounds := make([]float64, 0, len(tm.LateBy))
+		counts := make([]int64, 0, len(tm.LateBy))
+		for _, b := range tm.LateBy {
+			if b.Max != 0 {
+				bounds = append(bounds, b.Max.Seconds())
+			}
+			counts = append(counts, b.Count)
+		}
+		m.Histogram("timewheel_late_seconds", "How late tasks ran.", bounds, counts, tm.LateBySum.Seconds())
+	})
+}
+
+// Expvar collects the published expvar Ints and Floats, and the Ints and Floats in published Maps,
+// which have their keys in a "key" label. Names are prefixed with "expvar_". Their values are
+// untyped, as expvar doesn't say whether they're counters.
+func Expvar() Collector {
+	return CollectorFunc(func(m *Metrics) {
+		expvar.Do(func(kv expvar.KeyValue) {
+			name := "expvar_" + SanitizeName(kv.Key)
+			switch v := kv.Value.(type) {
+			case *expvar.Int:
+				m.Untyped(name, "", float64(v.Value()))
+			case *expvar.Float:
+				m.Untyped(name, "", v.Value())
+			case *expvar.Map:
+				v.Do(func(kv expvar.KeyValue) {
+					switch v := kv.Value.(type) {
+					case *expvar.Int:
+						m.Untyped(name, "", float64(v.Value()), "key", kv.Key)
+					case *expvar.Float:
+						m.Untyped(name, "", v.Value(), "key", kv.Key)
+					}
+				})
+			}
+		})
+	})
+}
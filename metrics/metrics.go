@@ -0,0 +1,229 @@
+// Package metrics serves the statistics of DHT servers, torrent clients and the time wheel at
+// /metrics in the Prometheus text exposition format, so they can be scraped without going through
+// expvar's JSON.
+//
+// An Exporter gathers its Collectors' samples afresh for each scrape:
+//
+//	http.Handle("/metrics", metrics.New(metrics.DHTServer(s), metrics.TimeWheel(), metrics.Expvar()))
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A Collector adds samples for a scrape.
+type Collector interface {
+	Collect(*Metrics)
+}
+
+// CollectorFunc adapts a function to a Collector.
+type CollectorFunc func(*Metrics)
+
+func (f CollectorFunc) Collect(m *Metrics) {
+	f(m)
+}
+
+// Metrics are the samples of a scrape, grouped into families by metric name. Labels are given as
+// name, value pairs.
+type Metrics struct {
+	families map[string]*family
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     string
+	samples []sample
+}
+
+type sample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+// Counter adds a sample of a counter. Names should end in _total.
+func (m *Metrics) Counter(name, help string, value float64, labels ...string) {
+	m.add("counter", name, help, sample{name, formatLabels(labels), value})
+}
+
+// Gauge adds a sample of a gauge.
+func (m *Metrics) Gauge(name, help string, value float64, labels ...string) {
+	m.add("gauge", name, help, sample{name, formatLabels(labels), value})
+}
+
+// Untyped adds a sample of a metric that could be a counter or a gauge.
+func (m *Metrics) Untyped(name, help string, value float64, labels ...string) {
+	m.add("untyped", name, help, sample{name, formatLabels(labels), value})
+}
+
+// Histogram adds a histogram. counts[i] is the number of observations no greater than bounds[i],
+// and not in an earlier bucket. There's one more count than bounds, for the observations greater
+// than every bound.
+func (m *Metrics) Histogram(
+	name, help string, bounds []float64, counts []int64, sum float64, labels ...string,
+) {
+	if len(counts) != len(bounds)+1 {
+		panic(fmt.Sprintf("%d counts for %d bounds", len(counts), len(bounds)))
+	}
+	var cum int64
+	for i, c := range counts {
+		cum += c
+		le := math.Inf(1)
+		if i < len(bounds) {
+			le = bounds[i]
+		}
+		bl := append(labels[:len(labels):len(labels)], "le", formatValue(le))
+		m.add("histogram", name, help, sample{name + "_bucket", formatLabels(bl), float64(cum)})
+	}
+	ls := formatLabels(labels)
+	m.add("histogram", name, help, sample{name + "_sum", ls, sum})
+	m.add("histogram", name, help, sample{name + "_count", ls, float64(cum)})
+}
+
+// Samples for a name are kept in the first family added under it.
+func (m *Metrics) add(typ, name, help string, s sample) {
+	if m.families == nil {
+		m.families = make(map[string]*family)
+	}
+	f, ok := m.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ}
+		m.families[name] = f
+	} else if f.typ != typ {
+		return
+	}
+	f.samples = append(f.samples, s)
+}
+
+// WriteTo writes the families in the text exposition format, sorted by name.
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	names := make([]string, 0, len(m.families))
+	for name := range m.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, name := range names {
+		f := m.families[name]
+		if f.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", name, helpEscaper.Replace(f.help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintf(bw, "%s%s %s\n", s.name, s.labels, formatValue(s.value))
+		}
+	}
+	err = bw.Flush()
+	return cw.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (n int, err error) {
+	n, err = cw.w.Write(b)
+	cw.n += int64(n)
+	return
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatLabels(labels []string) string {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("odd number of label names and values: %q", labels))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := 0; i < len(labels); i += 2 {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// SanitizeName replaces the characters that aren't allowed in metric names with underscores.
+func SanitizeName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+		case c >= '0' && c <= '9' && i != 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// Exporter serves the samples of its Collectors.
+type Exporter struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+var _ http.Handler = (*Exporter)(nil)
+
+func New(cs ...Collector) *Exporter {
+	return &Exporter{collectors: cs}
+}
+
+// Register adds Collectors to those scraped.
+func (e *Exporter) Register(cs ...Collector) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.collectors = append(e.collectors, cs...)
+}
+
+// Collect gathers the samples of every Collector.
+func (e *Exporter) Collect() *Metrics {
+	e.mu.Lock()
+	cs := append([]Collector(nil), e.collectors...)
+	e.mu.Unlock()
+	m := new(Metrics)
+	for _, c := range cs {
+		c.Collect(m)
+	}
+	return m
+}
+
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	e.Collect().WriteTo(w)
+}
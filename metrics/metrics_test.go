@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"testTorrent/dht"
+	"testTorrent/torrent"
+)
+
+func TestWriteTo(t *testing.T) {
+	c := qt.New(t)
+	var m Metrics
+	m.Gauge("b", "A gauge.", 2, "l", "x\"y\\z\n")
+	m.Counter("a_total", "A counter.\nSecond line.", 1)
+	m.Histogram("c_seconds", "", []float64{0.1, 1}, []int64{1, 0, 2}, 5.5, "method", "ping")
+	// Samples of another type under the name are dropped.
+	m.Counter("b", "", 3)
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	c.Assert(err, qt.IsNil)
+	c.Check(n, qt.Equals, int64(buf.Len()))
+	c.Check(buf.String(), qt.Equals, `# HELP a_total A counter.\nSecond line.
+# TYPE a_total counter
+a_total 1
+# HELP b A gauge.
+# TYPE b gauge
+b{l="x\"y\\z\n"} 2
+# TYPE c_seconds histogram
+c_seconds_bucket{method="ping",le="0.1"} 1
+c_seconds_bucket{method="ping",le="1"} 1
+c_seconds_bucket{method="ping",le="+Inf"} 3
+c_seconds_sum{method="ping"} 5.5
+c_seconds_count{method="ping"} 3
+`)
+}
+
+// More than bufio buffers at once.
+func TestWriteToCount(t *testing.T) {
+	c := qt.New(t)
+	var m Metrics
+	for i := 0; i < 1000; i++ {
+		m.Gauge("g", "", float64(i), "i", strconv.Itoa(i))
+	}
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf.Len() > 4096, qt.IsTrue)
+	c.Check(n, qt.Equals, int64(buf.Len()))
+}
+
+func TestSanitizeName(t *testing.T) {
+	c := qt.New(t)
+	c.Check(SanitizeName("dhtReadBlocked"), qt.Equals, "dhtReadBlocked")
+	c.Check(SanitizeName("0 peers/s"), qt.Equals, "__peers_s")
+}
+
+var testExpvarMap = expvar.NewMap("metricsTestMap")
+
+func TestExporter(t *testing.T) {
+	c := qt.New(t)
+	testExpvarMap.Add("a key", 2)
+	newServer := func() *dht.Server {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		c.Assert(err, qt.IsNil)
+		s, err := dht.NewServer(&dht.ServerConfig{Conn: conn, NoSecurity: true})
+		c.Assert(err, qt.IsNil)
+		c.Cleanup(s.Close)
+		return s
+	}
+	s := newServer()
+	client := newServer()
+	c.Assert(client.Ping(s.Addr().(*net.UDPAddr)).Err, qt.IsNil)
+
+	e := New(DHTServer(s))
+	e.Register(DHTServer(client), TimeWheel(), Expvar())
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	c.Check(w.Header().Get("Content-Type"), qt.Matches, "text/plain; version=0.0.4.*")
+	body := w.Body.String()
+	for _, want := range []string{
+		`dht_queries_received_total{server="` + s.Addr().String() + `",id="` + fmt.Sprintf("%x", s.ID()) + `",method="ping"} 1`,
+		`dht_queries_sent_total{server="` + client.Addr().String() + `",id="` + fmt.Sprintf("%x", client.ID()) + `",method="ping"} 1`,
+		`dht_table_nodes{server="` + s.Addr().String() + `",id="` + fmt.Sprintf("%x", s.ID()) + `",bucket="`,
+		`dht_query_duration_seconds_count{server="` + client.Addr().String() + `",id="` + fmt.Sprintf("%x", client.ID()) + `",method="ping"} 1`,
+		"# TYPE timewheel_late_seconds histogram\n",
+		`expvar_metricsTestMap{key="a key"} 2`,
+		"# TYPE expvar_dhtReadBlocked untyped\n",
+	} {
+		c.Check(strings.Contains(body, want), qt.IsTrue, qt.Commentf("missing %q", want))
+	}
+}
+
+func TestTorrentClient(t *testing.T) {
+	c := qt.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	c.Assert(err, qt.IsNil)
+	defer cl.Close()
+	tt, err := cl.AddMagnet("magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=test")
+	c.Assert(err, qt.IsNil)
+	tt.AddPeers([]torrent.PeerInfo{{Addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}}})
+
+	var m Metrics
+	TorrentClient(cl).Collect(&m)
+	var buf bytes.Buffer
+	m.WriteTo(&buf)
+	body := buf.String()
+	ls := `infohash="0123456789abcdef0123456789abcdef01234567",name="test"`
+	for _, want := range []string{
+		"torrent_bytes_read_total{" + ls + "} 0",
+		"torrent_peers{" + ls + `,state="total"} 1`,
+	} {
+		c.Check(strings.Contains(body, want), qt.IsTrue, qt.Commentf("missing %q in\n%s", want, body))
+	}
+}
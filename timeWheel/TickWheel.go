@@ -0,0 +1,246 @@
+package timeWheel
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// TickWheelConfig 分层时间轮配置
+type TickWheelConfig struct {
+	Tick  time.Duration // 最小刻度，默认 1 毫秒
+	Slots []int64       // 每层轮盘的槽数，从最底层开始，默认 256, 64, 64, 64
+	Clock Clock         // 时间来源，默认是系统时间
+}
+
+// TickWheel 按固定刻度转动的分层时间轮
+/*
+和 TimeWheel 按年月日时分秒分层不同，这里每层的刻度由 Tick 和下层的槽数决定：
+最底层每个槽是一个 Tick，上一层每个槽是下层转一圈的时间，依次类推。
+默认配置下最底层是 256 毫秒一圈，四层一共约 18.6 小时，更远的定时器先放在 overflow 中，
+最上层转完一圈时再重新分配。
+上层的槽被指针指到时，槽中的定时器按剩余时间重新分配到下层，最底层的槽被指到时，槽中的定时器全部到期。
+用法和 time.AfterFunc 一样：
+	tw := NewTickWheel(&TickWheelConfig{Tick: 10 * time.Millisecond})
+	go tw.Start()
+	t := tw.AfterFunc(5*time.Second, resend)
+	t.Stop()
+*/
+type TickWheel struct {
+	tick     time.Duration
+	levels   []*tickLevel
+	overflow *list.List // 超出最上层范围的定时器
+	now      int64      // 指针已经走过的刻度数
+	start    time.Time  // 第 0 个刻度的时间
+	clock    Clock
+
+	mu       sync.Mutex
+	runing   bool
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+type tickLevel struct {
+	span  int64        // 每个槽代表的刻度数
+	slots []*list.List // 时间轮槽
+}
+
+// 这一层一圈的刻度数
+func (l *tickLevel) cycle() int64 {
+	return l.span * int64(len(l.slots))
+}
+
+// Timer TickWheel 中的定时器
+type Timer struct {
+	w    *TickWheel
+	at   int64  // 到期的刻度
+	f    func() // 到期后在新的 goroutine 中调用
+	slot *list.List
+	elem *list.Element
+}
+
+// NewTickWheel 创建分层时间轮，需要调用 Start 才会开始转动
+func NewTickWheel(config *TickWheelConfig) *TickWheel {
+	tw := &TickWheel{
+		tick:     config.Tick,
+		overflow: list.New(),
+		clock:    config.Clock,
+		stopped:  make(chan struct{}),
+	}
+	if tw.clock == nil {
+		tw.clock = realClock{}
+	}
+	tw.start = tw.clock.Now()
+	if tw.tick <= 0 {
+		tw.tick = time.Millisecond
+	}
+	slots := config.Slots
+	if len(slots) == 0 {
+		slots = []int64{256, 64, 64, 64}
+	}
+	span := int64(1)
+	for _, n := range slots {
+		if n <= 0 {
+			panic("槽数必须大于0")
+		}
+		tw.levels = append(tw.levels, &tickLevel{
+			span:  span,
+			slots: make([]*list.List, n),
+		})
+		span *= n
+	}
+	return tw
+}
+
+// Start 开始转动，直到调用 Stop
+func (tw *TickWheel) Start() {
+	tw.mu.Lock()
+	if tw.runing {
+		tw.mu.Unlock()
+		return
+	}
+	tw.runing = true
+	tw.mu.Unlock()
+	ticker := tw.clock.NewTicker(tw.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			// ticker 会丢掉来不及处理的刻度，所以按实际经过的时间追上
+			tw.mu.Lock()
+			expired := tw.advance(int64(tw.clock.Now().Sub(tw.start) / tw.tick))
+			tw.mu.Unlock()
+			for _, t := range expired {
+				go t.f()
+			}
+		case <-tw.stopped:
+			return
+		}
+	}
+}
+
+// Stop 停止转动，未到期的定时器不会再执行
+func (tw *TickWheel) Stop() {
+	tw.stopOnce.Do(func() {
+		close(tw.stopped)
+	})
+}
+
+// AfterFunc 在 d 之后调用 f，和 time.AfterFunc 一样，精度是一个 Tick，不会提前调用
+func (tw *TickWheel) AfterFunc(d time.Duration, f func()) *Timer {
+	t := &Timer{w: tw, f: f}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	t.at = tw.expireAt(d)
+	tw.add(t)
+	return t
+}
+
+// Len 未到期的定时器数量
+func (tw *TickWheel) Len() (n int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	for _, l := range tw.levels {
+		for _, s := range l.slots {
+			if s != nil {
+				n += s.Len()
+			}
+		}
+	}
+	return n + tw.overflow.Len()
+}
+
+// Stop 取消定时器，如果定时器已经到期或已取消返回 false
+func (t *Timer) Stop() bool {
+	t.w.mu.Lock()
+	defer t.w.mu.Unlock()
+	return t.w.remove(t)
+}
+
+// Reset 改为从现在起 d 之后到期，返回定时器之前是否还未到期
+func (t *Timer) Reset(d time.Duration) bool {
+	t.w.mu.Lock()
+	defer t.w.mu.Unlock()
+	active := t.w.remove(t)
+	t.at = t.w.expireAt(d)
+	t.w.add(t)
+	return active
+}
+
+// d 之后对应的刻度，向上取整，至少是下一个刻度
+func (tw *TickWheel) expireAt(d time.Duration) int64 {
+	at := int64((tw.clock.Now().Sub(tw.start) + d + tw.tick - 1) / tw.tick)
+	if at <= tw.now {
+		at = tw.now + 1
+	}
+	return at
+}
+
+// 按剩余刻度放入能容纳它的最底层轮盘
+func (tw *TickWheel) add(t *Timer) {
+	delta := t.at - tw.now
+	l := tw.overflow
+	for _, level := range tw.levels {
+		if delta < level.cycle() {
+			i := t.at / level.span % int64(len(level.slots))
+			if level.slots[i] == nil {
+				level.slots[i] = list.New()
+			}
+			l = level.slots[i]
+			break
+		}
+	}
+	t.slot = l
+	t.elem = l.PushBack(t)
+}
+
+func (tw *TickWheel) remove(t *Timer) bool {
+	if t.slot == nil {
+		return false
+	}
+	t.slot.Remove(t.elem)
+	t.slot, t.elem = nil, nil
+	return true
+}
+
+// 指针走到第 to 个刻度，返回到期的定时器
+func (tw *TickWheel) advance(to int64) (expired []*Timer) {
+	for tw.now < to {
+		tw.now++
+		// 下层转完一圈就把上层当前槽中的定时器分配到下层
+		for _, level := range tw.levels[1:] {
+			if tw.now%level.span != 0 {
+				break
+			}
+			i := tw.now / level.span % int64(len(level.slots))
+			tasks := level.slots[i]
+			level.slots[i] = nil
+			tw.reassign(tasks)
+		}
+		if top := tw.levels[len(tw.levels)-1]; tw.now%top.cycle() == 0 {
+			overflow := tw.overflow
+			tw.overflow = list.New()
+			tw.reassign(overflow)
+		}
+		bottom := tw.levels[0]
+		i := tw.now % int64(len(bottom.slots))
+		if tasks := bottom.slots[i]; tasks != nil {
+			for e := tasks.Front(); e != nil; e = e.Next() {
+				t := e.Value.(*Timer)
+				t.slot, t.elem = nil, nil
+				expired = append(expired, t)
+			}
+			bottom.slots[i] = nil
+		}
+	}
+	return
+}
+
+func (tw *TickWheel) reassign(tasks *list.List) {
+	if tasks == nil {
+		return
+	}
+	for e := tasks.Front(); e != nil; e = e.Next() {
+		tw.add(e.Value.(*Timer))
+	}
+}
@@ -0,0 +1,65 @@
+package timeWheel
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 每个定时器都在到期的刻度被取出，包括需要多次下放的和放在 overflow 中的
+func TestTickWheelAdvance(t *testing.T) {
+	tw := NewTickWheel(&TickWheelConfig{Slots: []int64{4, 4}})
+	tw.now = 3
+	var timers []*Timer
+	for at := int64(4); at < 60; at++ {
+		timer := &Timer{w: tw, at: at}
+		tw.add(timer)
+		timers = append(timers, timer)
+	}
+	stopped := timers[10]
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("Stop 返回值错误")
+	}
+	for tw.now < 59 {
+		expired := tw.advance(tw.now + 1)
+		if tw.now == stopped.at {
+			if len(expired) != 0 {
+				t.Fatalf("已取消的定时器在 %d 到期", tw.now)
+			}
+			continue
+		}
+		if len(expired) != 1 || expired[0].at != tw.now {
+			t.Fatalf("刻度 %d 到期了 %d 个定时器", tw.now, len(expired))
+		}
+	}
+	if n := tw.Len(); n != 0 {
+		t.Fatalf("还剩 %d 个定时器", n)
+	}
+}
+
+func TestTickWheelAfterFunc(t *testing.T) {
+	tw := NewTickWheel(&TickWheelConfig{})
+	go tw.Start()
+	defer tw.Stop()
+	var fired int32
+	done := make(chan time.Time, 1)
+	start := time.Now()
+	tw.AfterFunc(20*time.Millisecond, func() { done <- time.Now() })
+	stopped := tw.AfterFunc(10*time.Millisecond, func() { atomic.AddInt32(&fired, 1) })
+	stopped.Stop()
+	reset := tw.AfterFunc(time.Hour, func() { atomic.AddInt32(&fired, 1) })
+	if !reset.Reset(time.Millisecond) {
+		t.Fatal("Reset 前定时器应该还未到期")
+	}
+	select {
+	case at := <-done:
+		if at.Sub(start) < 20*time.Millisecond {
+			t.Fatalf("提前 %v 执行", 20*time.Millisecond-at.Sub(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("定时器没有执行")
+	}
+	if n := atomic.LoadInt32(&fired); n != 1 {
+		t.Fatalf("执行了 %d 个定时器", n)
+	}
+}
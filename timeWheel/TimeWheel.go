@@ -2,15 +2,17 @@ package timeWheel
 
 import (
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/deckarep/golang-set"
 	"math/rand"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
-	"unicode"
+
+	"github.com/anacrolix/log"
 )
 
 // TaskData 回调函数参数类型
@@ -29,11 +31,14 @@ type Roulette struct {
 	taskKeyMap     map[int64]int // 任务在第几个槽中保存，只保存存在的，查不到就默认不存在
 	beforeRoulette *Roulette     // 上层的轮盘
 	afterRoulette  *Roulette     // 下层轮盘
+	submit         func(func())  // 执行到期的任务
+	logger         log.Logger
+	pending        int64 // 槽中的任务数量
 }
 
 // Task 延时任务
 type Task struct {
-	delay        int64            // 延迟时间
+	at           time.Time        // 到期时间
 	rouletteSite map[string]int64 // 在每个时间轮的位置
 	key          int64            // 定时器唯一标识, 用于删除定时器
 	Job          func()           //Job 延时任务回调函数
@@ -87,6 +92,9 @@ func (r *Roulette) cycle() bool {
 		分 60个刻度 最小数字 0 最大数字 59
 		秒 60个刻度 最小数字 0 最大数字 59
 	*/
+	if r.name == "year" {
+		return false
+	}
 	if r.name == "month" {
 		return r.currentPos == r.slotNum+1
 	}
@@ -117,79 +125,79 @@ func (r *Roulette) tickHandler() {
 			r.beforeRoulette.tickHandler()
 		}
 	}
-	tasks := r.slots[r.currentPos]
-	if r.isLastRoulette {
-		// 如果是最底层的时间轮的话就执行所有的任务
-		if tasks != nil {
-			r.runTask(*tasks)
-			r.slots[r.currentPos] = list.New()
-		}
-
-	} else {
-		// 不是执行任务的时间轮就向下层分配任务
-		r.afterRoulette.assignTask(tasks)
-	}
-
-}
-
-// 执行所有已到期的任务
-func (r Roulette) runTask(taskList list.List) {
-	for e := taskList.Front(); e != nil; e = e.Next() {
-		task := e.Value.(*Task)
-		fmt.Println("执行回调函数")
-		go task.Job()
-	}
+	r.dispatch()
 }
 
-// 判断任务是否需要立即执行，不需要的话就在下层轮盘中放置任务
-func (r *Roulette) assignTask(tasks *list.List) {
+// 指针指向的槽中的任务：最底层的时间轮就执行，否则向下层分配任务
+func (r *Roulette) dispatch() {
+	index := r.slotIndex(r.currentPos)
+	tasks := r.slots[index]
 	if tasks == nil {
 		return
 	}
+	r.slots[index] = nil
+	r.addPending(-int64(tasks.Len()))
+	for e := tasks.Front(); e != nil; e = e.Next() {
+		delete(r.taskKeyMap, e.Value.(*Task).key)
+	}
 	if r.isLastRoulette {
 		r.runTask(*tasks)
-		r.slots[r.currentPos] = list.New()
 		return
 	}
-	afterName := r.afterRoulette.name
-	runTaskList := list.New()
 	for e := tasks.Front(); e != nil; e = e.Next() {
-		task := e.Value.(*Task)
-		_, ok := task.rouletteSite[afterName]
-		if !ok {
-			//需要立即执行任务
-			runTaskList.PushBack(task)
-		}
-		// 放入下层轮盘中等待执行
-		r.afterRoulette.appendTask(task)
-		delete(r.taskKeyMap, task.key)
+		r.afterRoulette.appendTask(e.Value.(*Task))
+	}
+}
 
+// 执行所有已到期的任务
+func (r Roulette) runTask(taskList list.List) {
+	for e := taskList.Front(); e != nil; e = e.Next() {
+		task := e.Value.(*Task)
+		r.logger.Printf("执行任务 %d", task.key)
+		r.submit(task.Job)
 	}
 }
 
-// 添加上层转交过来的函数
+// 添加上层转交过来的函数，放到任务在本层的位置。上层分配任务时本层指针已经归零，
+// 如果位置就是当前指针，本层接下来处理当前槽时会继续向下分配
 func (r *Roulette) appendTask(task *Task) {
-	index, ok := task.rouletteSite[r.name]
-	if !ok {
-		go task.Job()
+	r.put(task, task.rouletteSite[r.name])
+	r.logger.Printf("%s轮盘落下一个任务", r.name)
+}
+
+// 槽的下标，月和日从1开始，年只保留最近十年所以取余数
+func (r *Roulette) slotIndex(pos int64) int64 {
+	if r.name == "year" {
+		return pos % r.slotNum
 	}
+	return pos
+}
+
+func (r *Roulette) put(task *Task, pos int64) {
+	index := r.slotIndex(pos)
 	if r.slots[index] == nil {
 		r.slots[index] = list.New()
 	}
 	r.slots[index].PushBack(task)
 	r.taskKeyMap[task.key] = int(index)
-	fmt.Printf("%s轮盘落下一个任务\n", r.name)
+	r.addPending(1)
+}
+
+func (r *Roulette) addPending(n int64) {
+	r.pending += n
+	pendingTasks.Add(r.name, n)
 }
 
 // 删除尚未到期的任务
 func (r *Roulette) removeTask(taskKey int64) {
 	taskIndex, ok := r.taskKeyMap[taskKey]
 	if !ok {
-		if r.isLastRoulette {
-			return
+		if !r.isLastRoulette {
+			r.afterRoulette.removeTask(taskKey)
 		}
-		r.afterRoulette.removeTask(taskKey)
+		return
 	}
+	delete(r.taskKeyMap, taskKey)
 	l := r.slots[taskIndex]
 	if l == nil {
 		return
@@ -198,67 +206,81 @@ func (r *Roulette) removeTask(taskKey int64) {
 		task := e.Value.(*Task)
 		if task.key == taskKey {
 			l.Remove(e)
+			r.addPending(-1)
+			break
 		}
 	}
+}
 
+// 当前轮盘指向的时间，比本层刻度小的部分为0
+func (r *Roulette) currentTime() time.Time {
+	pos := map[string]int{"month": 1, "day": 1}
+	for l := r; l != nil; l = l.beforeRoulette {
+		pos[l.name] = int(l.currentPos)
+	}
+	return time.Date(pos["year"], time.Month(pos["month"]), pos["day"], pos["hour"], pos["minute"], pos["second"], 0, time.Local)
+}
+
+// 时间 t 在 name 轮盘上的位置
+func roulettePos(t time.Time, name string) int64 {
+	switch name {
+	case "year":
+		return int64(t.Year())
+	case "month":
+		return int64(t.Month())
+	case "day":
+		return int64(t.Day())
+	case "hour":
+		return int64(t.Hour())
+	case "minute":
+		return int64(t.Minute())
+	case "second":
+		return int64(t.Second())
+	}
+	panic("model类型错误")
 }
 
-//添加task 根据超时时间计算多久后执行任务 最大时间十年，超过十年会触发panic
+//添加task 根据到期时间放到对应的轮盘 最大时间十年，超过十年会触发panic
 func (r *Roulette) addTask(task *Task) {
 	/*
-			year 2021
-			month 8
-			day 27
-			hour 22
-			minute 30
-			second 10
-
-			300000
-
-			300,000 / 60 = 5000 0  位置 10 + 0
-			5000 / 60 = 83 20  位置 30 + 20
-			83 / 24 = 3 11 位置 22 + 11 -> 9 ↓ 1
-			3 / 31 = 0 3 位置 27 + 3 + 1
-
-			year 2021
-			month 8
-			day 31
-			hour 9
-			minute 50
-			second 10
+		从最上层的年开始，找到到期时间和当前时间第一个不同的轮盘，任务放在这个轮盘上到期时间的位置，
+		下层轮盘的位置记在 rouletteSite 中，上层指针走到这个位置时再按 rouletteSite 往下层分配
 
-		余数是在本级中的位置，商是上层需要的计算的数字
+			当前 2021-08-27 22:30:10
+			到期 2021-08-31 09:50:10
+			年月相同，日不同，放在日轮盘 31 的位置，rouletteSite 记下 时 9 分 50 秒 10
 	*/
-	nowRouletteSite := task.delay % r.slotNum // 余数
-	nextCircle := task.delay / r.slotNum      // 商
-	if nowRouletteSite+r.currentPos >= r.slotNum {
-		// 如果超过当前 最大刻度，在上级时间中加一 本级中计算差值
-		nextCircle++
-		nowRouletteSite = nowRouletteSite + r.currentPos - r.slotNum
-	} else {
-		nowRouletteSite += r.currentPos
+	last := r
+	for !last.isLastRoulette {
+		last = last.afterRoulette
+	}
+	root := r
+	for root.beforeRoulette != nil {
+		root = root.beforeRoulette
+	}
+	target := task.at.In(time.Local)
+	if !target.After(last.currentTime()) {
+		// 已经到期的立即调用
+		r.submit(task.Job)
+		return
 	}
-	task.delay = nextCircle
-	task.rouletteSite[r.name] = nowRouletteSite
-	if nextCircle != 0 {
-		if r.name == "year" {
+	for l := root; l != nil; l = l.afterRoulette {
+		pos := roulettePos(target, l.name)
+		if pos == l.currentPos {
+			continue
+		}
+		if l.name == "year" && pos-l.currentPos >= l.slotNum {
 			panic("无法添加超过十年的任务")
 		}
-		r.beforeRoulette.addTask(task)
-		return
-	}
-	fmt.Printf("%s轮盘添加一个任务,在%d时候调用，当前指针在%d\n", r.name, nowRouletteSite, r.currentPos)
-
-	if nowRouletteSite == r.currentPos {
-		// 如果执行时间就是当前时间立即调用
-		go task.Job()
+		for after := l.afterRoulette; after != nil; after = after.afterRoulette {
+			task.rouletteSite[after.name] = roulettePos(target, after.name)
+		}
+		l.put(task, pos)
+		l.logger.Printf("%s轮盘添加一个任务,在%d时候调用，当前指针在%d", l.name, pos, l.currentPos)
 		return
 	}
-	if r.slots[nowRouletteSite] == nil {
-		r.slots[nowRouletteSite] = list.New()
-	}
-	r.slots[nowRouletteSite].PushBack(task)
-	r.taskKeyMap[task.key] = int(nowRouletteSite)
+	// 比最底层的刻度还小，到下一个刻度前不会再有机会执行，立即调用
+	r.submit(task.Job)
 }
 
 func newRoulette(model string, initPointer int64) *Roulette {
@@ -279,14 +301,14 @@ func newRoulette(model string, initPointer int64) *Roulette {
 	} else if model == "second" {
 		slotNum = 60
 		isLastRoulette = true
-	} else if model == "millisecond" {
-		slotNum = 100 // 暂时用不上
 	} else {
+		// 秒以下的刻度用 TickWheel
 		panic("model类型错误")
 	}
 	return &Roulette{
-		name:           model,
-		slots:          make([]*list.List, slotNum),
+		name: model,
+		// 月和日从1开始，多留一个槽
+		slots:          make([]*list.List, slotNum+1),
 		slotNum:        slotNum,
 		currentPos:     initPointer,
 		isLastRoulette: isLastRoulette,
@@ -299,31 +321,66 @@ func newRoulette(model string, initPointer int64) *Roulette {
 // TimeWheel 时间轮
 type TimeWheel struct {
 	interval          time.Duration // 指针每隔多久往前移动一格
-	ticker            *time.Ticker  // 时间间隔
+	clock             Clock         // 时间来源
+	ticker            Ticker        // 时间间隔
 	wheel             *Roulette     // 时间轮
 	rootWheel         *Roulette     // 最上层时间轮
-	taskKeySet        mapset.Set    //taskKey集合
 	addTaskChannel    chan Task     // 新增任务channel
 	removeTaskChannel chan int64    // 删除任务channel
+	syncChannel       chan func()   // 在时间轮的 goroutine 中执行，这之前收到的 tick 都已经处理完
 	stopChannel       chan bool     // 停止定时器channel
 	runing            bool
+	jobs              map[string]TaskFunc // 可持久化的任务
+	journal           Journal             // 持久化任务的记录
+	pool              *workerPool         // 执行任务的 goroutine，为空时每个任务一个 goroutine
+	ctx               context.Context     // 传给任务的 ctx，时间轮停止时取消
+	cancel            context.CancelFunc  // 停止时取消 ctx
+	lease             Lease               // 多个实例之间的租约
+	leaseHolder       string              // 本实例在租约中的名字
+	leaseTTL          time.Duration       // 租约有效期
+	leaseTicker       Ticker              // 续租间隔
+	leaseChecked      chan struct{}       // 第一次获取租约后关闭，不管有没有获得
+	leaseReleased     chan struct{}       // 停止后释放了租约时关闭
+	logger            log.Logger          // 默认级别是 Debug
+
+	mu         sync.Mutex
+	tasks      map[int64]*taskState // 所有任务，包括暂停的
+	history    []RunResult          // 最近的执行结果
+	leaseToken uint64               // 持有租约时的 fencing token
+	leaseUntil time.Time            // 租约到期时间，没有持有时是零值
 }
 
 // 配置信息
 type TimeWheelConfig struct {
 	Model        string
 	TickInterval int64
+	// Deprecated: 从来没有用到过，设置了也不会执行，用 AppendCycleFunc 添加周期任务
 	BeatSchedule []struct {
 		Job     func(interface{})
 		JobData interface{}
 		delay   int
 		crontab *Crontab
 	}
-	isRun bool
+	// 可持久化的任务，按名字注册，AppendOnceJob 和 AppendCycleJob 按名字添加，任务收到的 data 是 []byte
+	Jobs map[string]TaskFunc
+	// 保存持久化任务，Start 时重新加载，错过的任务按各自的 CatchUp 补执行
+	Journal Journal
+	// 时间来源，默认是系统时间
+	Clock Clock
+	// 同时执行任务的 goroutine 数量，忙不过来时到期的任务排队，0 不限制
+	Workers int
+	// 多个实例之间的租约，只有持有租约的实例执行 TaskOptions.Singleton 的任务
+	Lease Lease
+	// 本实例在租约中的名字，默认是主机名和进程号
+	LeaseHolder string
+	// 租约的有效期，默认 30 秒，每过三分之一续租一次
+	LeaseTTL time.Duration
+	// 默认只输出 Info 以上的日志，任务的添加、执行等是 Debug 级别
+	Logger log.Logger
 }
 
 // NewTimeWheel 调用实例，需要全局唯一，
-// model: 模式，就是时间轮层数 年月日时分秒 year, month, day, hour, minute, second
+// model: 模式，就是时间轮层数 年月日时分秒 year, month, day, hour, minute, second，需要毫秒或其他刻度的用 TickWheel
 // tickInterval:每次转动的时间间隔
 // 使用方法
 /*
@@ -338,6 +395,11 @@ type TimeWheelConfig struct {
 		return
 	}
 */
+// 需要重启后继续执行的任务，在 TimeWheelConfig.Jobs 中按名字注册，配置 Journal，用 AppendOnceJob、AppendCycleJob 添加
+// 多个实例中只能有一个执行的任务设置 TaskOptions.Singleton，并配置 TimeWheelConfig.Lease
+// 需要超时或者不能重叠执行的任务用 AppendOnceTask、AppendCycleTask 添加，TimeWheelConfig.Workers 限制同时执行的任务数量
+// 添加后用 Tasks 查询下次执行时间，PauseTask、ResumeTask、RescheduleTask 暂停、恢复和修改执行时间，History 查看最近的执行结果
+// 日志输出到 TimeWheelConfig.Logger，执行次数、失败次数、延迟分布和各轮盘中的任务数量在 expvar 的 timeWheel、timeWheelLateBy、timeWheelPending 中
 // 工作大致说明
 // TimeWheel.Start() 开始入口 ，通过监听*time.Ticker 每秒执行一次 TimeWheel.wheel.tickHandler() 这个方法
 // 该方法每次执行都会在时间上 +1秒 ，每一个时间指针都指向一个list.List 链表，链表内存有 Task 对象，被指针指到的链表，其内部所有的 Task 都到了
@@ -359,11 +421,40 @@ func NewTimeWheel(config *TimeWheelConfig) *TimeWheel {
 		interval:          time.Duration(config.TickInterval),
 		addTaskChannel:    make(chan Task),
 		removeTaskChannel: make(chan int64),
+		syncChannel:       make(chan func()),
 		stopChannel:       make(chan bool),
-		taskKeySet:        mapset.NewSet(),
+		tasks:             map[int64]*taskState{},
+		jobs:              config.Jobs,
+		journal:           config.Journal,
+		clock:             config.Clock,
+	}
+	if tw.clock == nil {
+		tw.clock = realClock{}
+	}
+	tw.logger = config.Logger
+	if tw.logger.LoggerImpl == nil {
+		tw.logger = log.Default.FilterLevel(log.Info)
+	}
+	tw.logger = tw.logger.WithDefaultLevel(log.Debug)
+	tw.ctx, tw.cancel = context.WithCancel(context.Background())
+	if config.Workers > 0 {
+		tw.pool = newWorkerPool(config.Workers)
+	}
+	if config.Lease != nil {
+		tw.lease = config.Lease
+		tw.leaseHolder = config.LeaseHolder
+		if tw.leaseHolder == "" {
+			tw.leaseHolder = defaultLeaseHolder()
+		}
+		tw.leaseChecked = make(chan struct{})
+		tw.leaseReleased = make(chan struct{})
+		tw.leaseTTL = config.LeaseTTL
+		if tw.leaseTTL <= 0 {
+			tw.leaseTTL = defaultLeaseTTL
+		}
 	}
 
-	ti := time.Now()
+	ti := tw.clock.Now()
 	timeMap := map[string]int64{
 		"year":   int64(ti.Year()),
 		"month":  int64(ti.Month()),
@@ -399,130 +490,195 @@ func NewTimeWheel(config *TimeWheelConfig) *TimeWheel {
 	}
 	tw.wheel = snapRoulette
 	tw.rootWheel = rootRoulette
-
-	fmt.Println("启动")
-	tw.ticker = time.NewTicker(tw.interval)
-	if config.isRun {
-		go tw.Start()
+	for r := rootRoulette; r != nil; r = r.afterRoulette {
+		r.submit = tw.submit
+		r.logger = tw.logger
 	}
 
+	tw.ticker = tw.clock.NewTicker(tw.interval)
+	if tw.lease != nil {
+		tw.leaseTicker = tw.clock.NewTicker(tw.leaseTTL / 3)
+	}
 	return tw
 }
 
 // 开始
 func (tw *TimeWheel) Start() {
 	if tw.runing {
-		fmt.Println("已启动，无需再次启动")
+		tw.logger.WithDefaultLevel(log.Warning).Printf("已启动，无需再次启动")
 		return
 	}
 
 	tw.runing = true
+	if tw.lease != nil {
+		go tw.renewLease()
+	}
+	if tw.journal != nil {
+		if tw.lease != nil {
+			// 补执行 Singleton 任务时要知道是否持有租约
+			<-tw.leaseChecked
+		}
+		tw.replayJournal()
+	}
 	for {
 		select {
-		case <-tw.ticker.C:
+		case <-tw.ticker.C():
 			tw.wheel.tickHandler()
 			//println(tw.PrintTime())
 		case task := <-tw.addTaskChannel:
 			tw.wheel.addTask(&task)
 		case key := <-tw.removeTaskChannel:
 			tw.rootWheel.removeTask(key)
+		case f := <-tw.syncChannel:
+			f()
 		case <-tw.stopChannel:
 			tw.ticker.Stop()
+			tw.cancel()
+			for r := tw.rootWheel; r != nil; r = r.afterRoulette {
+				// 不再统计停止的时间轮中的任务
+				r.addPending(-r.pending)
+			}
+			if tw.pool != nil {
+				tw.pool.stop()
+			}
 			return
 		}
 	}
 }
 
-// 停止
+// 停止，正在执行的任务的 ctx 会被取消，排队的任务不再执行。配置了 Lease 时等释放了租约再返回
 func (tw *TimeWheel) Stop() {
 	tw.stopChannel <- true
+	if tw.lease != nil {
+		<-tw.leaseReleased
+	}
+}
+
+// 在任务池中执行
+func (tw *TimeWheel) submit(f func()) {
+	if tw.pool == nil {
+		go f()
+		return
+	}
+	tw.pool.submit(f)
 }
 
 // 添加单次任务
 func (tw *TimeWheel) AppendOnceFunc(job func(interface{}), jobData interface{}, expiredTime interface{}) (taskKey int64, err error) {
-	timeParams, err := tw.expiredTimeParsing(expiredTime)
+	nextRun, err := tw.onceNextRun(expiredTime)
 	if err != nil {
 		return
 	}
-	if timeParams > 10*365*24*60*60 {
-
-		return 0, errors.New("时间最长不能超过十年")
-	}
-	taskKey = tw.randomTaskKey()
-	tw.addTask(job, jobData, timeParams, taskKey, nil)
-	return
+	return tw.appendTask(&taskState{
+		name:    GetFunctionName(job),
+		job:     funcTask(job),
+		jobData: jobData,
+		nextRun: nextRun,
+	})
 }
 
 // 添加重复任务
 func (tw *TimeWheel) AppendCycleFunc(job func(interface{}), jobData interface{}, expiredTime Crontab) (taskKey int64, err error) {
-	timeParams, err := expiredTime.getNextExecTime(tw.getTimeDict())
-	fmt.Printf("重复任务下次执行时间: %d\n", timeParams)
+	nextRun, err := tw.cycleNextRun(&expiredTime, tw.clock.Now())
 	if err != nil {
 		return
 	}
-	if timeParams > 10*365*24*60*60 {
-		return 0, errors.New("时间最长不能超过十年")
+	tw.logger.Printf("重复任务下次执行时间: %s", nextRun.Format("2006-01-02 15:04:05"))
+	return tw.appendTask(&taskState{
+		name:    GetFunctionName(job),
+		job:     funcTask(job),
+		jobData: jobData,
+		crontab: &expiredTime,
+		nextRun: nextRun,
+	})
+}
+
+// AppendOnceTask 添加单次任务，和 AppendOnceFunc 一样，可以设置超时和重叠策略
+func (tw *TimeWheel) AppendOnceTask(job TaskFunc, jobData interface{}, expiredTime interface{}, opts TaskOptions) (taskKey int64, err error) {
+	nextRun, err := tw.onceNextRun(expiredTime)
+	if err != nil {
+		return
 	}
-	taskKey = tw.randomTaskKey()
-	tw.addTask(job, jobData, timeParams, taskKey, &expiredTime)
-	return
+	return tw.appendTask(&taskState{
+		name:    GetFunctionName(job),
+		job:     job,
+		jobData: jobData,
+		opts:    opts,
+		nextRun: nextRun,
+	})
 }
 
-// 统一处理回调函数，如果想在执行回调函数的时候做什么事情，就在这修改
-func (tw *TimeWheel) addTask(job func(interface{}), jobData interface{}, expiredTime int64, taskKey int64, cycle *Crontab) {
-	var taskJob func()
-	if cycle != nil {
-		taskJob = func() {
-			fmt.Println(fmt.Sprintf("%s 执行 %s 函数", time.Now().Format("2006-01-02 15:04:05"), GetFunctionName(job)))
-			if !cycle.isCycle() {
-				// 如果下次调用时间每次都不相等的话，就需要重新获取到期时间
-				fmt.Printf("回调函数获取当前时间%s\n", tw.getTimeDict().PrintTime())
-				expiredTime, _ = cycle.getNextExecTime(tw.getTimeDict())
-				fmt.Printf("重新添加任务,延时 %d 秒调用\n", expiredTime)
-			}
-			tw.addTask(job, jobData, expiredTime, taskKey, cycle)
-			job(jobData)
+// AppendCycleTask 添加重复任务，和 AppendCycleFunc 一样，可以设置超时和重叠策略
+func (tw *TimeWheel) AppendCycleTask(job TaskFunc, jobData interface{}, expiredTime Crontab, opts TaskOptions) (taskKey int64, err error) {
+	nextRun, err := tw.cycleNextRun(&expiredTime, tw.clock.Now())
+	if err != nil {
+		return
+	}
+	return tw.appendTask(&taskState{
+		name:    GetFunctionName(job),
+		job:     job,
+		jobData: jobData,
+		crontab: &expiredTime,
+		opts:    opts,
+		nextRun: nextRun,
+	})
+}
 
-		}
-	} else {
-		taskJob = func() {
-			fmt.Println(fmt.Sprintf("%s执行 %s 函数", time.Now().Format("2006-01-02 15:04:05"), GetFunctionName(job)))
-			tw.taskKeySet.Remove(taskKey)
-			job(jobData)
-		}
+// 任务最长的延时，十年
+const maxDelay = 10 * 365 * 24 * time.Hour
+
+// 单次任务的执行时间
+func (tw *TimeWheel) onceNextRun(expiredTime interface{}) (time.Time, error) {
+	timeParams, err := tw.expiredTimeParsing(expiredTime)
+	if err != nil {
+		return time.Time{}, err
 	}
-	tw.taskKeySet.Add(taskKey)
-	//tw.wheel.addTask(&Task{
-	//	delay:        expiredTime,
-	//	rouletteSite: map[string]int64{},
-	//	key:          taskKey,
-	//	Job:          taskJob,
-	//	crontab:      cycle,
-	//})
-	tw.addTaskChannel <- Task{
-		delay:        expiredTime,
-		rouletteSite: map[string]int64{},
-		key:          taskKey,
-		Job:          taskJob,
-		crontab:      cycle,
+	delay := time.Duration(timeParams) * time.Second
+	if delay > maxDelay {
+		return time.Time{}, errors.New("时间最长不能超过十年")
 	}
+	return tw.clock.Now().Add(delay), nil
+}
+
+// 周期任务 from 之后的下次执行时间
+func (tw *TimeWheel) cycleNextRun(c *Crontab, from time.Time) (time.Time, error) {
+	if err := c.parse(); err != nil {
+		return time.Time{}, err
+	}
+	next := c.Next(from)
+	if next.IsZero() {
+		return next, errors.New("时间表以后不会再执行")
+	}
+	if next.Sub(from) > maxDelay {
+		return time.Time{}, errors.New("时间最长不能超过十年")
+	}
+	return next, nil
 }
 
 // 删除指定的回调任务
 func (tw *TimeWheel) RemoveTask(taskKey int64) {
-	if !tw.taskKeySet.Contains(taskKey) {
+	tw.mu.Lock()
+	s, ok := tw.tasks[taskKey]
+	if !ok {
 		// taskKey 不存在
+		tw.mu.Unlock()
 		return
 	}
-	tw.removeTaskChannel <- taskKey
+	tw.removeLocked(s)
+	tw.mu.Unlock()
+	tw.sendRemove(taskKey)
+}
+
+func init() {
+	// 只设置一次种子，每次都按秒设置的话同一秒内会重复生成已经删除的任务的 key
+	rand.Seed(time.Now().UnixNano())
 }
 
-// 获取随机数字
+// 获取随机数字，需要持有 tw.mu
 func (tw *TimeWheel) randomTaskKey() (key int64) {
-	rand.Seed(time.Now().Unix())
 	for {
 		key = rand.Int63()
-		if !tw.taskKeySet.Contains(key) {
+		if _, ok := tw.tasks[key]; !ok && key != 0 {
 			return key
 		}
 	}
@@ -540,22 +696,11 @@ func (tw *TimeWheel) expiredTimeParsing(timeParams interface{}) (int64, error) {
 		if err != nil {
 			return 0, err
 		}
-		return stamp.Unix(), nil
+		return stamp.Unix() - tw.clock.Now().Unix(), nil
 	}
 	return 0, errors.New("过期时间类型错误,目前只支持int,int64,string类型")
 }
 
-// 获取当前定时器时间 集合
-func (tw *TimeWheel) getTime() (year, month, day, hour, minute, second int64) {
-	year = tw.rootWheel.currentPos
-	month = tw.rootWheel.afterRoulette.currentPos
-	day = tw.rootWheel.afterRoulette.afterRoulette.currentPos
-	hour = tw.rootWheel.afterRoulette.afterRoulette.afterRoulette.currentPos
-	minute = tw.rootWheel.afterRoulette.afterRoulette.afterRoulette.afterRoulette.currentPos
-	second = tw.rootWheel.afterRoulette.afterRoulette.afterRoulette.afterRoulette.afterRoulette.currentPos
-	return
-}
-
 //  获取当前定时器时间 字符串
 func (tw *TimeWheel) PrintTime() string {
 	year := tw.rootWheel.currentPos
@@ -567,501 +712,6 @@ func (tw *TimeWheel) PrintTime() string {
 	return fmt.Sprintf("%d-%02d-%02d %02d:%02d:%02d", year, month, day, hour, minute, second)
 }
 
-// 获取当前定时器时间 timestamp 对象
-func (tw *TimeWheel) getTimeDict() (result timestamp) {
-	result = timestamp{}
-	result.year = int(tw.rootWheel.currentPos)
-	result.month = int(tw.rootWheel.afterRoulette.currentPos)
-	result.day = int(tw.rootWheel.afterRoulette.afterRoulette.currentPos)
-	result.hour = int(tw.rootWheel.afterRoulette.afterRoulette.afterRoulette.currentPos)
-	result.minute = int(tw.rootWheel.afterRoulette.afterRoulette.afterRoulette.afterRoulette.currentPos)
-	result.second = int(tw.rootWheel.afterRoulette.afterRoulette.afterRoulette.afterRoulette.afterRoulette.currentPos)
-	return result
-}
-
-// timestamp 时间对象++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
-type timestamp struct {
-	year   int
-	month  int
-	day    int
-	hour   int
-	minute int
-	second int
-}
-
-// 指定的时间刻度+1
-func (t *timestamp) addUp(timeType string) {
-	switch timeType {
-	case "year":
-		t.year++
-	case "month":
-		t.month++
-		if t.month == 13 {
-			t.month = 1
-			t.year++
-		}
-	case "day":
-		t.day++
-		if t.day == int(getMonthDay(int64(t.year), int64(t.month)))+1 {
-			t.day = 1
-			t.addUp("month")
-		}
-	case "hour":
-		t.hour++
-		if t.hour == 24 {
-			t.hour = 0
-			t.addUp("day")
-		}
-	case "minute":
-		t.minute++
-		if t.minute == 60 {
-			t.minute = 0
-			t.addUp("hour")
-		}
-	case "second":
-		t.second++
-		if t.second == 60 {
-			t.second = 0
-			t.addUp("minute")
-		}
-	default:
-		panic("错误类型")
-	}
-}
-
-// 获取时间差
-func (t timestamp) stamp(datetime timestamp) int64 {
-	// t 目标天数
-	// 当前时间
-	// 计算datetime时间到t 时间相差的秒数
-	// 只能计算t比datetime大的时间
-	days := -1
-	stamp := 0
-	// year ==============================
-	a := datetime.year
-	//if t.year+t.month+t.day < datetime.year+datetime.month+datetime.day {
-	//	a = t.year
-	//	b = datetime.year
-	//}
-	for {
-		if a >= t.year {
-			break
-		}
-		a++
-		if leapYear(int64(a)) {
-			days += 366
-		} else {
-			days += 365
-		}
-	}
-	// t ==================================
-	a = 1
-	tDay := 0
-	for {
-		if a == t.month {
-			tDay += t.day
-			break
-		}
-		tDay += int(getMonthDay(int64(t.year), int64(a)))
-		a++
-	}
-	// datetime ===========================
-	a = 1
-	datetimeDay := 0
-	for {
-		if a == datetime.month {
-			datetimeDay += datetime.day
-			break
-		}
-		datetimeDay += int(getMonthDay(int64(t.year), int64(a)))
-		a++
-	}
-	days += tDay - datetimeDay
-	if leapYear(int64(datetime.year)) {
-		days++
-	}
-	stamp += days * (24 * 60 * 60)
-	a = t.hour*3600 + t.minute*60 + t.second
-	b := datetime.hour*3600 + datetime.minute*60 + datetime.second
-	stamp += a - b
-	x := a - b
-	if a < b {
-		// 如果t的时分秒比datetime的时分秒小，那需要加一天
-		stamp += 86400
-		x += 86400
-	}
-	return int64(stamp)
-}
-
-// 使用时间戳获取时间差
-func (t timestamp) sysStamp(datetime timestamp) int64 {
-	datetimeStamp, _ := time.ParseInLocation("2006-01-02 15:04:05", datetime.PrintTime(), time.Local)
-	selfStamp, _ := time.ParseInLocation("2006-01-02 15:04:05", t.PrintTime(), time.Local)
-
-	return selfStamp.Unix() - datetimeStamp.Unix()
-}
-
-// 格式化时间字符串 2020-01-01 12:00:00
-func (t timestamp) PrintTime() string {
-	return fmt.Sprintf("%d-%02d-%02d %02d:%02d:%02d", t.year, t.month, t.day, t.hour, t.minute, t.second)
-}
-
-// Crontab 时间执行表 +++++++++++++++++++++++++++++++++++++++++++++++++++
-// 字符串 按照给定的数字，当时间到给定的刻度就会执行
-// 比如 Crontab{Minute:10,Second:30} 每个小时的十分三十秒的时候就会执行
-// 支持一次传入多个时间点 Crontab{Minute:"10,11,12",Second:30}每个小时的10：30，11：30，12：30三个时间点执行
-// 连续时间点可以用-表示 Minute:"10-12" 代表 Minute:"10,11,12"
-// 也可以 /5表示当时间点可以被5整除的时候就执行任务 前面可以写自己指定的时间段 默认的是当前时间段的起止 比如 秒 就是0-59
-// 10-20/5 表示当时间点在 10 15 20 这三个时间点执行任务
-// 参照python的celery的crontab实现的
-type Crontab struct {
-	Second        string
-	Minute        string
-	Hour          string
-	Day           string
-	Month         string
-	Year          string
-	second        []int
-	minute        []int
-	hour          []int
-	day           []int
-	month         []int
-	year          []int
-	timeDict      map[string][]int
-	init          bool
-	beforeRunTime timestamp //上次调用时间
-}
-
-// 获取执行延时
-func (c *Crontab) getNextExecTime(TimeDict timestamp) (int64, error) {
-	if !c.init {
-		// 初始化 解析字符串
-		var abc []int
-		c.timeDict = make(map[string][]int)
-		if abc = splitArgs(c.Year, "year"); len(abc) != 0 {
-			c.year = abc
-			c.timeDict["year"] = abc
-		}
-		if abc = splitArgs(c.Month, "month"); len(abc) != 0 {
-			c.month = abc
-			c.timeDict["month"] = abc
-		}
-		if abc = splitArgs(c.Day, "day"); len(abc) != 0 {
-			c.day = abc
-			c.timeDict["day"] = abc
-		}
-		if abc = splitArgs(c.Hour, "hour"); len(abc) != 0 {
-			c.hour = abc
-			c.timeDict["hour"] = abc
-		}
-		if abc = splitArgs(c.Minute, "minute"); len(abc) != 0 {
-			c.minute = abc
-			c.timeDict["minute"] = abc
-		}
-		if abc = splitArgs(c.Second, "second"); len(abc) != 0 {
-			c.second = abc
-			c.timeDict["second"] = abc
-		}
-		c.init = true
-	}
-
-	if len(c.timeDict) == 0 {
-		//默认每分钟执行一次
-		return 60, nil
-	}
-	//TimeDict := timestamp{
-	//	year:   2021,
-	//	month:  9,
-	//	day:    1,
-	//	hour:   15,
-	//	minute: 54,
-	//	second: 21,
-	//}
-	fmt.Printf("上次执行时间: %s 当前时间是: %s ,时间是否相等 %t \n", c.beforeRunTime.PrintTime(), TimeDict.PrintTime(),
-		c.beforeRunTime.PrintTime() == TimeDict.PrintTime())
-	if c.beforeRunTime.PrintTime() == TimeDict.PrintTime() {
-		TimeDict.addUp("second")
-	}
-
-	ti := c.nextTime(TimeDict)
-	c.beforeRunTime = ti
-	fmt.Printf("预计在%s时间点调用\n", ti.PrintTime())
-	return ti.sysStamp(TimeDict), nil
-}
-
-// 按照给定的规则找到与传入时间 最近的执行时间
-// 如果上次执行时间和当前时间相同那就返回的是下次的时间
-// 如何才能返回下一个执行时间点？
-func (c *Crontab) nextTime(TimeDict timestamp) timestamp {
-	ti := timestamp{
-		year:   -1,
-		month:  -1,
-		day:    -1,
-		hour:   -1,
-		minute: -1,
-		second: -1,
-	}
-	// year
-	timeIntList, ok := c.timeDict["year"]
-	year := TimeDict.year
-	if !ok {
-		ti.year = year
-	} else {
-		for _, x := range timeIntList {
-			if year < x {
-				ti.year = x
-				break
-			}
-		}
-		if ti.year == -1 {
-			ti.year = timeIntList[0]
-		}
-	}
-	// month
-	timeIntList, ok = c.timeDict["month"]
-	month := TimeDict.month
-	if !ok {
-		ti.month = month
-	} else {
-		for _, x := range timeIntList {
-			if month < x {
-				ti.month = x
-				break
-			}
-		}
-		if ti.month == -1 {
-			ti.month = timeIntList[0]
-			ti.addUp("year")
-		}
-	}
-	// day
-	timeIntList, ok = c.timeDict["day"]
-	day := TimeDict.day
-	if !ok {
-		ti.day = day
-	} else {
-		for _, x := range timeIntList {
-			if day < x {
-				ti.day = x
-				break
-			}
-		}
-		if ti.day == -1 {
-			ti.day = timeIntList[0]
-			ti.addUp("month")
-		}
-	}
-	// hour
-	timeIntList, ok = c.timeDict["hour"]
-	hour := TimeDict.hour
-	if !ok {
-		ti.hour = hour
-	} else {
-		for _, x := range timeIntList {
-			if hour < x {
-				ti.hour = x
-				break
-			}
-		}
-		if ti.hour == -1 {
-			ti.hour = timeIntList[0]
-			ti.addUp("day")
-		}
-	}
-	// minute
-	timeIntList, ok = c.timeDict["minute"]
-	minute := TimeDict.minute
-	if !ok {
-		ti.minute = minute
-	} else {
-		for _, x := range timeIntList {
-			if minute < x {
-				ti.minute = x
-				break
-			}
-		}
-		if ti.minute == -1 {
-			ti.minute = timeIntList[0]
-			ti.addUp("hour")
-		}
-	}
-	// second
-	timeIntList, ok = c.timeDict["second"]
-	second := TimeDict.second
-	if !ok {
-		ti.second = second
-	} else {
-		for _, x := range timeIntList {
-			if second < x {
-				ti.second = x
-				break
-			}
-		}
-		if ti.second == -1 {
-			ti.second = timeIntList[0]
-			ti.addUp("minute")
-		}
-	}
-
-	return ti
-}
-
-// 每次执行任务的时间差是否相等 相同返回true 不同返回false
-func (c *Crontab) isCycle() bool {
-
-	return false
-}
-
-// 切割字符串，根据输入将执行的时间点以切片的形式返回
-func splitArgs(args, timeType string) []int {
-	/* 1,2,3,4,5
-	/2 == 0
-	0-10/2 == 0
-	0-10 0,1,2,3,4,5,6,7,8,9,10
-	*/
-
-	if args == "" {
-		return []int{}
-	}
-	s := strings.Split(args, ",")
-	var result []int
-	for _, timeStr := range s {
-		isTrue := true
-		xIndex := -1 // /
-		yIndex := -1 // -
-		var cache []int
-		var special []int
-		for _, a := range timeStr {
-			if !unicode.IsDigit(a) {
-				isTrue = false
-				if a == 47 {
-					// /字符
-					if xIndex != -1 {
-						panic(fmt.Sprintf("%s字符格式错误%s", timeType, args))
-					}
-					if len(cache) > 0 {
-						special = append(special, listToInt(cache))
-					}
-					special = append(special, -1)
-					cache = cache[:0]
-					xIndex = len(special) - 1
-				}
-				if a == 45 {
-					// -字符
-					if yIndex != -1 {
-						panic(fmt.Sprintf("%s字符格式错误%s", timeType, args))
-					}
-					special = append(special, listToInt(cache))
-					special = append(special, -2)
-					cache = cache[:0]
-					yIndex = len(special) - 1
-				}
-				continue
-			}
-			cache = append(cache, strToInt(a))
-		}
-
-		if !isTrue {
-			special = append(special, listToInt(cache))
-			if xIndex != -1 {
-				var e, f int
-				if xIndex == 0 {
-					e, f = timeRange(timeType)
-				} else {
-					e, f = special[0], special[2]
-				}
-				base := special[xIndex+1]
-				// 根据起始时间计算可被底数整除的时间点
-				for e <= f {
-					if e%base == 0 {
-						result = append(result, e)
-					}
-					e++
-				}
-			} else {
-				e, f := special[0], special[2]
-				for e <= f {
-					result = append(result, e)
-					e++
-				}
-			}
-		} else {
-			result = append(result, listToInt(cache))
-		}
-	}
-
-	return result
-}
-
-// rune 映射成数字
-func strToInt(a rune) int {
-	switch a {
-	case 48:
-		return 0
-	case 49:
-		return 1
-	case 50:
-		return 2
-	case 51:
-		return 3
-	case 52:
-		return 4
-	case 53:
-		return 5
-	case 54:
-		return 6
-	case 55:
-		return 7
-	case 56:
-		return 8
-	case 57:
-		return 9
-	}
-	panic("")
-}
-
-// 数字切片转整数
-func listToInt(data []int) int {
-	l := len(data) - 1
-	result := 0
-	for index, value := range data {
-		result += pow(10, l-index) * value
-	}
-	return result
-}
-
-// 计算次方
-func pow(x, n int) int {
-	ret := 1 // 结果初始为0次方的值，整数0次方为1。如果是矩阵，则为单元矩阵。
-	for n != 0 {
-		if n%2 != 0 {
-			ret = ret * x
-		}
-		n /= 2
-		x = x * x
-	}
-	return ret
-}
-
-// 每个时间轮盘的起止时间点
-func timeRange(timeType string) (start, end int) {
-	switch timeType {
-	case "year":
-		return 2021, 2031
-	case "month":
-		return 1, 12
-	case "day":
-		return 1, 31 // 2月份的处理放在计算时间间隔的时候
-	case "hour":
-		return 0, 23
-	case "minute":
-		return 0, 59
-	case "second":
-		return 0, 59
-	}
-	panic("错误时间类型")
-}
-
 // 获取函数名
 func GetFunctionName(i interface{}, seps ...rune) string {
 	// 获取函数名称
@@ -1,34 +1,143 @@
 package timeWheel
 
 import (
-	"fmt"
 	"testing"
 	"time"
 )
 
-var callbackIndex int
-
-func TestCrontab(t *testing.T) {
-	callbackIndex++
-	tw := NewTimeWheel(&TimeWheelConfig{})
-	//fmt.Println(tw.PrintTime())
-	printTimeWheelTime := func(data interface{}) { println(tw.PrintTime()) }
-	key, _ := tw.AppendOnceFunc(oneCallback, 1, 10)
-	//_, err := tw.AppendCycleFunc(callbackFunc, 2, Crontab{Second: "/5"})
-	_, err := tw.AppendCycleFunc(printTimeWheelTime, 2, Crontab{Second: "0"})
-	fmt.Println("添加任务完成")
+const timeLayout = "2006-01-02 15:04:05"
+
+func mustLocalTime(t *testing.T, s string) time.Time {
+	ti, err := time.ParseInLocation(timeLayout, s, time.Local)
 	if err != nil {
-		tw.Stop()
-		println(err.Error())
-		return
+		t.Fatal(err)
+	}
+	return ti
+}
+
+// 用 FakeClock 启动时间轮
+func newFakeTimeWheel(t *testing.T, start string) (*TimeWheel, *FakeClock) {
+	clock := NewFakeClock(mustLocalTime(t, start))
+	tw := NewTimeWheel(&TimeWheelConfig{Clock: clock})
+	go tw.Start()
+	t.Cleanup(tw.Stop)
+	return tw, clock
+}
+
+// 等时间轮处理完已经收到的 tick
+func syncTimeWheel(tw *TimeWheel) {
+	done := make(chan struct{})
+	tw.syncChannel <- func() { close(done) }
+	<-done
+}
+
+// 任务在新的 goroutine 中执行，最多等一秒
+func expectFired(t *testing.T, fired chan interface{}, want interface{}) {
+	t.Helper()
+	select {
+	case got := <-fired:
+		if got != want {
+			t.Fatalf("执行了 %v，应该是 %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%v 没有执行", want)
+	}
+}
+
+func expectNotFired(t *testing.T, fired chan interface{}) {
+	t.Helper()
+	select {
+	case got := <-fired:
+		t.Fatalf("不应该执行 %v", got)
+	default:
+	}
+}
+
+func TestTimeWheelRollover(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		start   string
+		advance time.Duration
+	}{
+		{"闰年二月", "2024-02-28 23:59:58", 3 * time.Second},
+		{"平年二月", "2023-02-28 23:59:59", time.Second},
+		{"跨年", "2023-12-31 23:59:59", time.Second},
+		{"三十天的月份", "2023-04-30 23:59:59", time.Second},
+		{"三十一天的月份", "2023-05-30 23:59:59", 24 * time.Hour},
+		{"十一月到十二月", "2023-11-30 23:59:30", time.Minute},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tw, clock := newFakeTimeWheel(t, tc.start)
+			clock.Advance(tc.advance)
+			syncTimeWheel(tw)
+			if got, want := tw.PrintTime(), clock.Now().Format(timeLayout); got != want {
+				t.Errorf("时间轮时间 %s，应该是 %s", got, want)
+			}
+		})
 	}
-	tw.RemoveTask(key)
-	time.Sleep(time.Minute * 10)
 }
-func oneCallback(data interface{}) {
-	println(fmt.Sprintf("单次回调函数执行：执行序号%d", data))
+
+func TestCrontabNext(t *testing.T) {
+	for _, tc := range []struct {
+		crontab Crontab
+		now     string
+		want    int64
+	}{
+		{Crontab{}, "2023-06-01 10:05:30", 60},
+		{Crontab{Second: "/5"}, "2023-06-01 12:00:03", 2},
+		{Crontab{Second: "/5"}, "2023-06-01 12:00:05", 5},
+		{Crontab{Minute: "10", Second: "0"}, "2023-06-01 10:05:30", 270},
+		{Crontab{Minute: "10", Second: "0"}, "2023-06-01 10:10:00", 3600},
+		{Crontab{Hour: "0", Minute: "0", Second: "0"}, "2023-12-31 23:59:59", 1},
+		{Crontab{Day: "31", Hour: "0", Minute: "0", Second: "0"}, "2023-04-15 00:00:00", 46 * 86400},
+		{Crontab{Month: "2", Day: "29", Hour: "0", Minute: "0", Second: "0"}, "2023-03-01 00:00:00", 365 * 86400},
+	} {
+		now := mustLocalTime(t, tc.now)
+		next := tc.crontab.Next(now)
+		if next.IsZero() {
+			t.Errorf("%+v 在 %s 之后不会执行", tc.crontab, tc.now)
+			continue
+		}
+		if got := next.Unix() - now.Unix(); got != tc.want {
+			t.Errorf("%+v 在 %s 之后 %d 秒执行，应该是 %d 秒", tc.crontab, tc.now, got, tc.want)
+		}
+	}
+	c := Crontab{Year: "2020"}
+	if next := c.Next(mustLocalTime(t, "2023-01-01 00:00:00")); !next.IsZero() {
+		t.Errorf("已经过去的时间表在 %s 执行", next)
+	}
 }
-func callbackFunc(data interface{}) {
-	println(fmt.Sprintf("测试回调函数执行：执行序号%d", callbackIndex))
-	callbackIndex++
+
+func TestTimeWheelTasks(t *testing.T) {
+	tw, clock := newFakeTimeWheel(t, "2023-12-31 23:58:30")
+	fired := make(chan interface{}, 10)
+	job := func(data interface{}) { fired <- data }
+	if _, err := tw.AppendOnceFunc(job, "once", 100); err != nil {
+		t.Fatal(err)
+	}
+	removed, err := tw.AppendOnceFunc(job, "removed", 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw.RemoveTask(removed)
+	if _, err := tw.AppendCycleFunc(job, "cycle", Crontab{Second: "0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(30 * time.Second) // 23:59:00
+	expectFired(t, fired, "cycle")
+	clock.Advance(60 * time.Second) // 00:00:00
+	expectFired(t, fired, "cycle")
+	clock.Advance(9 * time.Second)
+	syncTimeWheel(tw)
+	expectNotFired(t, fired)
+	clock.Advance(time.Second) // 00:00:10
+	expectFired(t, fired, "once")
+	clock.Advance(50 * time.Second) // 00:01:00
+	expectFired(t, fired, "cycle")
+	syncTimeWheel(tw)
+	expectNotFired(t, fired)
+	if _, ok := tw.Task(removed); ok {
+		t.Error("删除的任务还在")
+	}
 }
@@ -0,0 +1,126 @@
+package timeWheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 时间轮的时间来源，默认是系统时间，测试中用 FakeClock 手动拨动
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker 同 time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// FakeClock 手动拨动的时钟，只有调用 Advance 时间才会前进
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFakeClock 从 now 开始的时钟
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("ticker 间隔必须大于0")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{
+		c:       make(chan time.Time),
+		d:       d,
+		next:    c.now.Add(d),
+		stopped: make(chan struct{}),
+	}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+// Advance 时间前进 d，途中到期的每一个 tick 都按时间顺序发送，并等到被接收后才继续，
+// 所以返回时除最后一个 tick 外，前面的 tick 都已经处理完
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		var next *fakeTicker
+		for _, t := range c.tickers {
+			if !t.isStopped() && !t.next.After(end) && (next == nil || t.next.Before(next.next)) {
+				next = t
+			}
+		}
+		if next == nil {
+			break
+		}
+		c.now = next.next
+		next.next = next.next.Add(next.d)
+		now := c.now
+		c.mu.Unlock()
+		select {
+		case next.c <- now:
+		case <-next.stopped:
+		}
+		c.mu.Lock()
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+type fakeTicker struct {
+	c        chan time.Time
+	d        time.Duration
+	next     time.Time // 下次 tick 的时间
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stopped)
+	})
+}
+
+func (t *fakeTicker) isStopped() bool {
+	select {
+	case <-t.stopped:
+		return true
+	default:
+		return false
+	}
+}
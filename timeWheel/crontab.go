@@ -0,0 +1,508 @@
+package timeWheel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Crontab 时间执行表 +++++++++++++++++++++++++++++++++++++++++++++++++++
+// 字符串 按照给定的数字，当时间到给定的刻度就会执行
+// 比如 Crontab{Minute:10,Second:30} 每个小时的十分三十秒的时候就会执行
+// 支持一次传入多个时间点 Crontab{Minute:"10,11,12",Second:30}每个小时的10：30，11：30，12：30三个时间点执行
+// 连续时间点可以用-表示 Minute:"10-12" 代表 Minute:"10,11,12"
+// 也可以 /5表示当时间点可以被5整除的时候就执行任务 前面可以写自己指定的时间段 默认的是当前时间段的起止 比如 秒 就是0-59
+// 3-20/5 表示当时间点在 5 10 15 20 这几个时间点执行任务，5/15 从5开始每15个执行一次
+// 设置了 CronSteps 时 a-b/n 和 */n 和 cron 一样从开始值每n个执行一次，3-20/5 是 3 8 13 18，ParseCrontab 会设置
+// 月和星期可以写英文缩写 JAN-DEC SUN-SAT，日和星期支持 L W # 写法，见 ParseCrontab
+// 参照python的celery的crontab实现的
+type Crontab struct {
+	Second   string
+	Minute   string
+	Hour     string
+	Day      string
+	Month    string
+	Year     string
+	Weekday  string // 星期 0-7，0 和 7 都是星期日
+	Timezone string // 按哪个时区计算，比如 Asia/Shanghai，默认是本地时区
+	// a-b/n 和 */n 按 cron 的写法从开始值每n个取一个，不设置时取能被n整除的值
+	CronSteps bool
+
+	second       []int
+	minute       []int
+	hour         []int
+	day          []int
+	dayRules     []dayRule
+	month        []int
+	year         []int
+	weekday      []int
+	weekdayRules []weekdayRule
+	loc          *time.Location
+	init         bool
+	err          error
+}
+
+// 日字段中和月份有关的写法
+type dayRule struct {
+	day     int
+	last    bool // L 最后一天，L-3 倒数第四天
+	offset  int  // L-n 中的 n
+	weekday bool // 15W 离15号最近的工作日，LW 最后一个工作日
+}
+
+// 星期字段中和月份有关的写法
+type weekdayRule struct {
+	weekday int
+	last    bool // 5L 本月最后一个星期五
+	nth     int  // 5#3 本月第三个星期五
+}
+
+// 每个字段的取值范围
+type cronBounds struct {
+	name     string
+	min, max int
+	names    map[string]int
+	// a-b/n 和 */n 从开始值每n个取一个，见 Crontab.CronSteps
+	fromStart bool
+}
+
+var (
+	secondBounds = cronBounds{name: "秒", min: 0, max: 59}
+	minuteBounds = cronBounds{name: "分", min: 0, max: 59}
+	hourBounds   = cronBounds{name: "时", min: 0, max: 23}
+	dayBounds    = cronBounds{name: "日", min: 1, max: 31}
+	yearBounds   = cronBounds{name: "年", min: 1970, max: 2099}
+	monthBounds  = cronBounds{name: "月", min: 1, max: 12, names: map[string]int{
+		"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+		"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+	}}
+	weekdayBounds = cronBounds{name: "星期", min: 0, max: 7, names: map[string]int{
+		"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCrontab 解析 cron 表达式
+// 5 个字段: 分 时 日 月 星期，秒是 0
+// 6 个字段: 秒 分 时 日 月 星期
+// 每个字段可以写 * ? 数字 a-b a-b/n */n 和用逗号分隔的列表，月和星期可以写英文缩写
+// 步长和 cron 一样从开始值算起，3-20/5 是 3 8 13 18，返回的 Crontab 设置了 CronSteps
+// 日字段还支持 L 最后一天，L-3 倒数第四天，15W 离15号最近的工作日，LW 最后一个工作日
+// 星期字段还支持 5L 本月最后一个星期五，5#3 本月第三个星期五
+// 日和星期都不是 * 的时候和 cron 一样满足其中一个就执行
+// 开头可以用 CRON_TZ=Asia/Shanghai 指定时区，也可以用 @daily @hourly 等简写
+//
+//	c, err := ParseCrontab("*/5 * * * MON-FRI")
+//	tw.AppendCycleFunc(callback, nil, c)
+func ParseCrontab(expr string) (Crontab, error) {
+	var c Crontab
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		c.Timezone = fields[0][strings.Index(fields[0], "=")+1:]
+		fields = fields[1:]
+	}
+	if len(fields) == 1 && strings.HasPrefix(fields[0], "@") {
+		d, ok := cronDescriptors[strings.ToLower(fields[0])]
+		if !ok {
+			return Crontab{}, fmt.Errorf("不支持的简写 %s", fields[0])
+		}
+		fields = strings.Fields(d)
+	}
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return Crontab{}, fmt.Errorf("cron 表达式 %q 应该有 5 或 6 个字段", expr)
+	}
+	c.Second, c.Minute, c.Hour, c.Day, c.Month, c.Weekday = fields[0], fields[1], fields[2], fields[3], fields[4], fields[5]
+	c.CronSteps = true
+	if err := c.parse(); err != nil {
+		return Crontab{}, err
+	}
+	return c, nil
+}
+
+// 解析字符串
+func (c *Crontab) parse() error {
+	if c.init {
+		return c.err
+	}
+	c.init = true
+	c.err = c.parseFields()
+	return c.err
+}
+
+func (c *Crontab) parseFields() (err error) {
+	if c.second, err = parseField(c.Second, c.bounds(secondBounds)); err != nil {
+		return
+	}
+	if c.minute, err = parseField(c.Minute, c.bounds(minuteBounds)); err != nil {
+		return
+	}
+	if c.hour, err = parseField(c.Hour, c.bounds(hourBounds)); err != nil {
+		return
+	}
+	if c.day, c.dayRules, err = parseDayField(c.Day, c.bounds(dayBounds)); err != nil {
+		return
+	}
+	if c.month, err = parseField(c.Month, c.bounds(monthBounds)); err != nil {
+		return
+	}
+	if c.year, err = parseField(c.Year, c.bounds(yearBounds)); err != nil {
+		return
+	}
+	if c.weekday, c.weekdayRules, err = parseWeekdayField(c.Weekday, c.bounds(weekdayBounds)); err != nil {
+		return
+	}
+	c.loc = time.Local
+	if c.Timezone != "" {
+		if c.loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return fmt.Errorf("时区 %s: %w", c.Timezone, err)
+		}
+	}
+	return nil
+}
+
+// 按 CronSteps 设置步长的算法
+func (c *Crontab) bounds(b cronBounds) cronBounds {
+	b.fromStart = c.CronSteps
+	return b
+}
+
+// 没有设置任何字段
+func (c *Crontab) isEmpty() bool {
+	return c.Second == "" && c.Minute == "" && c.Hour == "" && c.Day == "" &&
+		c.Month == "" && c.Year == "" && c.Weekday == ""
+}
+
+// Next t 之后下次执行的时间，不包括 t 本身，按 Timezone 计算，返回的时间也在这个时区。
+// 没有设置任何字段时默认每分钟执行一次，时间表有错误或者十年内不会再执行返回零值
+func (c *Crontab) Next(t time.Time) time.Time {
+	if c.parse() != nil {
+		return time.Time{}
+	}
+	if c.isEmpty() {
+		return t.Add(time.Minute)
+	}
+	return c.next(t.In(c.loc))
+}
+
+// 按照给定的规则找到 t 之后最近的执行时间，不包括 t 本身
+/*
+从年开始逐级匹配，某一级不匹配就进到下一个值，并把比它小的刻度归零，再从头检查，
+比如 Minute:"10" Second:"0" 在 10:05:30 时，秒归零进到 10:06:00，分不匹配进到 10:10:00
+十年内都找不到的返回零值
+*/
+func (c *Crontab) next(t time.Time) time.Time {
+	t = t.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(10, 0, 0)
+	loc := t.Location()
+	for t.Before(limit) {
+		if !matchField(c.year, t.Year()) {
+			t = time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !matchField(c.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		// 时和分按实际经过的时间往前走，夏令时结束时同一个钟点出现两次，time.Date 会返回前一次，
+		// 得到比 t 早的时间
+		if !matchField(c.hour, t.Hour()) {
+			t = t.Add(time.Hour - time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+			continue
+		}
+		if !matchField(c.minute, t.Minute()) {
+			t = t.Add(time.Minute - time.Duration(t.Second())*time.Second)
+			continue
+		}
+		if !matchField(c.second, t.Second()) {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// 没有设置的刻度匹配任意值
+func matchField(field []int, v int) bool {
+	if len(field) == 0 {
+		return true
+	}
+	for _, x := range field {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// 日和星期，两个都设置了的话满足一个就行
+func (c *Crontab) matchDay(t time.Time) bool {
+	anyDay := len(c.day) == 0 && len(c.dayRules) == 0
+	anyWeekday := len(c.weekday) == 0 && len(c.weekdayRules) == 0
+	switch {
+	case anyDay && anyWeekday:
+		return true
+	case anyWeekday:
+		return c.matchDayOfMonth(t)
+	case anyDay:
+		return c.matchWeekday(t)
+	}
+	return c.matchDayOfMonth(t) || c.matchWeekday(t)
+}
+
+func (c *Crontab) matchDayOfMonth(t time.Time) bool {
+	for _, d := range c.day {
+		if d == t.Day() {
+			return true
+		}
+	}
+	for _, r := range c.dayRules {
+		if r.resolve(t.Year(), t.Month(), t.Location()) == t.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Crontab) matchWeekday(t time.Time) bool {
+	for _, w := range c.weekday {
+		if w == int(t.Weekday()) {
+			return true
+		}
+	}
+	for _, r := range c.weekdayRules {
+		if r.match(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// 这个月中对应的日期，没有对应的日期返回0
+func (r dayRule) resolve(year int, month time.Month, loc *time.Location) int {
+	last := int(getMonthDay(int64(year), int64(month)))
+	day := r.day
+	if r.last {
+		day = last - r.offset
+	}
+	if day < 1 || day > last {
+		return 0
+	}
+	if r.weekday {
+		// 不会跨到别的月份
+		switch time.Date(year, month, day, 0, 0, 0, 0, loc).Weekday() {
+		case time.Saturday:
+			if day == 1 {
+				day += 2
+			} else {
+				day--
+			}
+		case time.Sunday:
+			if day == last {
+				day -= 2
+			} else {
+				day++
+			}
+		}
+	}
+	return day
+}
+
+func (r weekdayRule) match(t time.Time) bool {
+	if int(t.Weekday()) != r.weekday {
+		return false
+	}
+	if r.last {
+		return t.Day()+7 > int(getMonthDay(int64(t.Year()), int64(t.Month())))
+	}
+	return (t.Day()-1)/7+1 == r.nth
+}
+
+// 切割字符串，根据输入将执行的时间点以切片的形式返回，空字符串、* 和 ? 返回空切片表示任意值
+func parseField(field string, b cronBounds) ([]int, error) {
+	if field == "" || field == "*" || field == "?" {
+		return nil, nil
+	}
+	set := make([]bool, b.max+1)
+	for _, part := range strings.Split(field, ",") {
+		if err := parseRange(part, b, set); err != nil {
+			return nil, err
+		}
+	}
+	return setValues(set, b), nil
+}
+
+func parseDayField(field string, b cronBounds) (days []int, rules []dayRule, err error) {
+	if field == "" || field == "*" || field == "?" {
+		return
+	}
+	set := make([]bool, b.max+1)
+	for _, part := range strings.Split(field, ",") {
+		upper := strings.ToUpper(part)
+		switch {
+		case upper == "L":
+			rules = append(rules, dayRule{last: true})
+		case upper == "LW":
+			rules = append(rules, dayRule{last: true, weekday: true})
+		case strings.HasPrefix(upper, "L-"):
+			offset, err := strconv.Atoi(upper[2:])
+			if err != nil || offset < 0 || offset >= b.max {
+				return nil, nil, fmt.Errorf("日字段 %q 格式错误", part)
+			}
+			rules = append(rules, dayRule{last: true, offset: offset})
+		case strings.HasSuffix(upper, "W"):
+			day, err := b.value(upper[:len(upper)-1])
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, dayRule{day: day, weekday: true})
+		default:
+			if err := parseRange(part, b, set); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return setValues(set, b), rules, nil
+}
+
+func parseWeekdayField(field string, b cronBounds) (weekdays []int, rules []weekdayRule, err error) {
+	if field == "" || field == "*" || field == "?" {
+		return
+	}
+	set := make([]bool, b.max+1)
+	for _, part := range strings.Split(field, ",") {
+		upper := strings.ToUpper(part)
+		if i := strings.Index(upper, "#"); i != -1 {
+			weekday, err := b.value(upper[:i])
+			if err != nil {
+				return nil, nil, err
+			}
+			nth, err := strconv.Atoi(upper[i+1:])
+			if err != nil || nth < 1 || nth > 5 {
+				return nil, nil, fmt.Errorf("星期字段 %q 格式错误，# 后面应该是 1-5", part)
+			}
+			rules = append(rules, weekdayRule{weekday: weekday % 7, nth: nth})
+			continue
+		}
+		if len(upper) > 1 && strings.HasSuffix(upper, "L") {
+			weekday, err := b.value(upper[:len(upper)-1])
+			if err != nil {
+				return nil, nil, err
+			}
+			rules = append(rules, weekdayRule{weekday: weekday % 7, last: true})
+			continue
+		}
+		if err := parseRange(part, b, set); err != nil {
+			return nil, nil, err
+		}
+	}
+	// 7 也是星期日
+	if set[7] {
+		set[0], set[7] = true, false
+	}
+	return setValues(set, b), rules, nil
+}
+
+// 解析 a a-b a-b/n */n a/n /n，把匹配的值记在 set 中
+func parseRange(part string, b cronBounds, set []bool) error {
+	rangePart, step := part, 1
+	hasStep := false
+	if i := strings.Index(part, "/"); i != -1 {
+		var err error
+		rangePart, hasStep = part[:i], true
+		if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+			return fmt.Errorf("%s字段 %q 步长错误", b.name, part)
+		}
+	}
+	// a-b/n 和 */n 没有设置 CronSteps 时取能被n整除的值
+	divisible := hasStep && !b.fromStart
+	var start, end int
+	switch rangePart {
+	case "":
+		if !hasStep {
+			return fmt.Errorf("%s字段有空值", b.name)
+		}
+		// /5 表示能被5整除的时间点
+		start, end = b.min, b.max
+		divisible = true
+	case "*", "?":
+		start, end = b.min, b.max
+	default:
+		var err error
+		if i := strings.Index(rangePart, "-"); i != -1 {
+			if start, err = b.value(rangePart[:i]); err != nil {
+				return err
+			}
+			if end, err = b.value(rangePart[i+1:]); err != nil {
+				return err
+			}
+		} else {
+			if start, err = b.value(rangePart); err != nil {
+				return err
+			}
+			end = start
+			if hasStep {
+				// 5/15 表示从5开始每15个执行一次
+				end, divisible = b.max, false
+			}
+		}
+	}
+	if start > end {
+		return fmt.Errorf("%s字段 %q 开始大于结束", b.name, part)
+	}
+	if divisible {
+		// 根据起始时间计算可被底数整除的时间点
+		for v := start; v <= end; v++ {
+			if v%step == 0 {
+				set[v] = true
+			}
+		}
+		return nil
+	}
+	for v := start; v <= end; v += step {
+		set[v] = true
+	}
+	return nil
+}
+
+// 解析一个数字或英文缩写
+func (b cronBounds) value(s string) (int, error) {
+	if v, ok := b.names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%s字段 %q 不是数字", b.name, s)
+	}
+	if v < b.min || v > b.max {
+		return 0, fmt.Errorf("%s字段 %d 超出范围 %d-%d", b.name, v, b.min, b.max)
+	}
+	return v, nil
+}
+
+func setValues(set []bool, b cronBounds) (values []int) {
+	for v := b.min; v <= b.max; v++ {
+		if set[v] {
+			values = append(values, v)
+		}
+	}
+	return
+}
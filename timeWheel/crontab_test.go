@@ -0,0 +1,158 @@
+package timeWheel
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseCrontabNext(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		from string
+		want string
+	}{
+		{"*/5 * * * MON-FRI", "2023-06-02 23:58:00", "2023-06-05 00:00:00"},
+		{"*/5 * * * MON-FRI", "2023-06-05 00:00:00", "2023-06-05 00:05:00"},
+		{"30 0 0 * * SUN", "2023-06-01 00:00:00", "2023-06-04 00:00:30"},
+		{"0 0 * * 7", "2023-06-01 00:00:00", "2023-06-04 00:00:00"},
+		{"0 0 1 jan,JUL *", "2023-02-01 00:00:00", "2023-07-01 00:00:00"},
+		{"0 0 L * *", "2024-02-10 00:00:00", "2024-02-29 00:00:00"},
+		{"0 0 L * *", "2023-02-10 00:00:00", "2023-02-28 00:00:00"},
+		{"0 0 L-2 * *", "2023-04-01 00:00:00", "2023-04-28 00:00:00"},
+		{"0 0 15W * *", "2023-07-01 00:00:00", "2023-07-14 00:00:00"},
+		{"0 0 1W * *", "2023-07-01 00:00:00", "2023-07-03 00:00:00"},
+		{"0 0 LW * *", "2023-09-01 00:00:00", "2023-09-29 00:00:00"},
+		{"0 9 * * 5L", "2023-06-01 00:00:00", "2023-06-30 09:00:00"},
+		{"0 9 * * MON#2", "2023-06-01 00:00:00", "2023-06-12 09:00:00"},
+		// 日和星期都设置了，满足一个就行
+		{"0 12 13 * FRI", "2023-06-01 00:00:00", "2023-06-02 12:00:00"},
+		{"0 12 13 * FRI", "2023-06-12 00:00:00", "2023-06-13 12:00:00"},
+		{"5/20 * * * *", "2023-06-01 00:06:00", "2023-06-01 00:25:00"},
+		{"@daily", "2023-12-31 12:00:00", "2024-01-01 00:00:00"},
+		{"@hourly", "2023-12-31 12:00:00", "2023-12-31 13:00:00"},
+	} {
+		c, err := ParseCrontab("CRON_TZ=UTC " + tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		from, _ := time.Parse(timeLayout, tc.from)
+		if got := c.Next(from).Format(timeLayout); got != tc.want {
+			t.Errorf("%q 在 %s 之后是 %s，应该是 %s", tc.expr, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestCrontabSteps(t *testing.T) {
+	for _, tc := range []struct {
+		c    Crontab
+		want []int
+	}{
+		// 结构体上的字段取能被5整除的值
+		{Crontab{Minute: "3-20/5"}, []int{5, 10, 15, 20}},
+		{Crontab{Day: "*/5"}, []int{5, 10, 15, 20, 25, 30}},
+		{Crontab{Minute: "/20"}, []int{0, 20, 40}},
+		{Crontab{Minute: "5/20"}, []int{5, 25, 45}},
+		// cron 的写法从开始值算起
+		{Crontab{Minute: "3-20/5", CronSteps: true}, []int{3, 8, 13, 18}},
+		{Crontab{Day: "*/5", CronSteps: true}, []int{1, 6, 11, 16, 21, 26, 31}},
+		{Crontab{Minute: "/20", CronSteps: true}, []int{0, 20, 40}},
+	} {
+		c := tc.c
+		if err := c.parse(); err != nil {
+			t.Fatal(err)
+		}
+		got := c.minute
+		if c.Day != "" {
+			got = c.day
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%+v 是 %v，应该是 %v", tc.c, got, tc.want)
+		}
+	}
+	c, err := ParseCrontab("3-20/5 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.CronSteps || fmt.Sprint(c.minute) != "[3 8 13 18]" {
+		t.Errorf("ParseCrontab 应该按 cron 的步长，分是 %v", c.minute)
+	}
+}
+
+func TestCrontabTimezone(t *testing.T) {
+	c, err := ParseCrontab("CRON_TZ=Asia/Shanghai 0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	want := time.Date(2023, 6, 1, 1, 0, 0, 0, time.UTC)
+	if got := c.Next(from); !got.Equal(want) {
+		t.Errorf("下次执行时间 %v，应该是 %v", got, want)
+	}
+	// 结构体上直接设置的字段也能用星期和时区
+	c = Crontab{Weekday: "SAT", Hour: "10", Minute: "0", Second: "0", Timezone: "UTC"}
+	if got := c.Next(from).Format(timeLayout); got != "2023-06-03 10:00:00" {
+		t.Errorf("下次执行时间 %s", got)
+	}
+}
+
+func TestCrontabDaylightSaving(t *testing.T) {
+	c, err := ParseCrontab("CRON_TZ=America/New_York */5 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 夏令时结束，01:00 到 02:00 出现两次，这是第二次的 01:01
+	from := time.Date(2026, 11, 1, 6, 1, 0, 0, time.UTC)
+	want := time.Date(2026, 11, 1, 6, 5, 0, 0, time.UTC)
+	if got := c.Next(from); !got.Equal(want) {
+		t.Errorf("下次执行时间 %v，应该是 %v", got, want)
+	}
+	// 跨过夏令时的开始和结束，每次都在上一次的五分钟之后
+	for _, start := range []time.Time{
+		time.Date(2026, 3, 8, 5, 0, 0, 0, time.UTC),
+		time.Date(2026, 11, 1, 4, 0, 0, 0, time.UTC),
+	} {
+		for prev, i := start, 0; i < 60; i++ {
+			next := c.Next(prev)
+			if next.Sub(prev) != 5*time.Minute {
+				t.Fatalf("%v 之后是 %v", prev, next)
+			}
+			prev = next
+		}
+	}
+	// 按钟点的时间表在跳过的钟点之后继续
+	c, err = ParseCrontab("CRON_TZ=America/New_York 30 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from = time.Date(2026, 3, 8, 6, 30, 0, 0, time.UTC) // 01:30 EST
+	want = time.Date(2026, 3, 8, 7, 30, 0, 0, time.UTC) // 03:30 EDT
+	if got := c.Next(from); !got.Equal(want) {
+		t.Errorf("下次执行时间 %v，应该是 %v", got, want)
+	}
+}
+
+func TestParseCrontabErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * * *",
+		"61 * * * *",
+		"* * * * MON-XYZ",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"0 0 32W * *",
+		"0 0 * * 1#6",
+		"@often",
+		"CRON_TZ=Nowhere/City * * * * *",
+	} {
+		if _, err := ParseCrontab(expr); err == nil {
+			t.Errorf("%q 应该解析失败", expr)
+		}
+	}
+	c := Crontab{Minute: "1-"}
+	if err := c.parse(); err == nil {
+		t.Error("格式错误的字段应该返回错误")
+	}
+}
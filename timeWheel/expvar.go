@@ -0,0 +1,85 @@
+package timeWheel
+
+import (
+	"expvar"
+	"time"
+)
+
+var (
+	// 轮盘中等待到期的任务数量，按轮盘名字统计
+	pendingTasks = expvar.NewMap("timeWheelPending")
+	// 任务实际执行时间比计划晚了多久，按 lateByBuckets 分组
+	lateBy  = expvar.NewMap("timeWheelLateBy")
+	expvars = expvar.NewMap("timeWheel")
+)
+
+var lateByBuckets = []struct {
+	max  time.Duration
+	name string
+}{
+	{10 * time.Millisecond, "10ms"},
+	{100 * time.Millisecond, "100ms"},
+	{time.Second, "1s"},
+	{10 * time.Second, "10s"},
+	{time.Minute, "1m"},
+}
+
+func recordLateBy(d time.Duration) {
+	expvars.AddFloat("lateBySeconds", d.Seconds())
+	for _, b := range lateByBuckets {
+		if d <= b.max {
+			lateBy.Add(b.name, 1)
+			return
+		}
+	}
+	lateBy.Add("inf", 1)
+}
+
+// LateByBucket 是延迟分布中的一组
+type LateByBucket struct {
+	Max   time.Duration // 延迟的上限，最后一组为 0，表示没有上限
+	Count int64
+}
+
+// Metrics 是所有时间轮统计数据的快照
+type Metrics struct {
+	Pending   map[string]int64 // 各轮盘中等待到期的任务数量
+	Counters  map[string]int64 // fired、runs、failures 等次数
+	LateBy    []LateByBucket   // 延迟分布，不累计
+	LateBySum time.Duration    // 所有延迟的总和
+}
+
+// ReadMetrics 读取 expvar 中的统计数据
+func ReadMetrics() Metrics {
+	m := Metrics{
+		Pending:  make(map[string]int64),
+		Counters: make(map[string]int64),
+	}
+	pendingTasks.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			m.Pending[kv.Key] = v.Value()
+		}
+	})
+	expvars.Do(func(kv expvar.KeyValue) {
+		switch v := kv.Value.(type) {
+		case *expvar.Int:
+			m.Counters[kv.Key] = v.Value()
+		case *expvar.Float:
+			if kv.Key == "lateBySeconds" {
+				m.LateBySum = time.Duration(v.Value() * float64(time.Second))
+			}
+		}
+	})
+	for _, b := range lateByBuckets {
+		m.LateBy = append(m.LateBy, LateByBucket{Max: b.max, Count: expvarInt(lateBy, b.name)})
+	}
+	m.LateBy = append(m.LateBy, LateByBucket{Count: expvarInt(lateBy, "inf")})
+	return m
+}
+
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+package timeWheel
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+func TestMetrics(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		levels = map[log.Level]int{}
+	)
+	clock := NewFakeClock(mustLocalTime(t, "2023-06-01 10:00:00"))
+	tw := NewTimeWheel(&TimeWheelConfig{
+		Clock: clock,
+		Logger: log.Logger{LoggerImpl: log.LoggerFunc(func(m log.Msg) {
+			level, _ := m.GetLevel()
+			mu.Lock()
+			levels[level]++
+			mu.Unlock()
+		})},
+	})
+	go tw.Start()
+	stopped := false
+	defer func() {
+		if !stopped {
+			tw.Stop()
+		}
+	}()
+
+	pending := expvarInt(pendingTasks, "minute")
+	fired := expvarInt(expvars, "fired")
+	failures := expvarInt(expvars, "failures")
+	onTime := expvarInt(lateBy, "10ms")
+	before := ReadMetrics()
+	if _, err := tw.AppendOnceFunc(func(interface{}) { panic("boom") }, nil, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.AppendOnceFunc(func(interface{}) {}, nil, 90); err != nil {
+		t.Fatal(err)
+	}
+	syncTimeWheel(tw)
+	if got := expvarInt(pendingTasks, "minute") - pending; got != 1 {
+		t.Errorf("分钟轮盘中有 %d 个任务", got)
+	}
+
+	clock.Advance(time.Second)
+	waitFor(t, func() bool { return len(tw.History()) == 1 })
+	if got := expvarInt(expvars, "fired") - fired; got != 1 {
+		t.Errorf("到期了 %d 个任务", got)
+	}
+	if got := expvarInt(expvars, "failures") - failures; got != 1 {
+		t.Errorf("失败了 %d 次", got)
+	}
+	if got := expvarInt(lateBy, "10ms") - onTime; got != 1 {
+		t.Errorf("准时执行了 %d 次", got)
+	}
+	after := ReadMetrics()
+	if got := after.Counters["fired"] - before.Counters["fired"]; got != 1 {
+		t.Errorf("快照中到期了 %d 个任务", got)
+	}
+	if got := after.LateBy[0].Count - before.LateBy[0].Count; got != 1 {
+		t.Errorf("快照中准时执行了 %d 次", got)
+	}
+	if got := len(after.LateBy); got != len(lateByBuckets)+1 {
+		t.Errorf("延迟分布有 %d 组", got)
+	}
+	mu.Lock()
+	if levels[log.Debug] == 0 || levels[log.Error] != 1 {
+		t.Errorf("日志级别 %v", levels)
+	}
+	mu.Unlock()
+
+	// 停止后不再统计时间轮中的任务
+	tw.Stop()
+	stopped = true
+	waitFor(t, func() bool { return expvarInt(pendingTasks, "minute") == pending })
+}
@@ -0,0 +1,260 @@
+package timeWheel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/log"
+	"go.etcd.io/bbolt"
+)
+
+// CatchUp 重启后对停机期间错过的任务的处理方式
+type CatchUp int
+
+const (
+	CatchUpOnce CatchUp = iota // 不管错过几次，只补执行一次
+	CatchUpAll                 // 错过几次补执行几次，最多 maxCatchUp 次
+	CatchUpSkip                // 不补执行，单次任务直接删除，周期任务等下次执行时间
+)
+
+// CatchUpAll 最多补执行的次数，避免停机太久后一次执行太多
+const maxCatchUp = 1000
+
+// TaskRecord 持久化任务的记录
+type TaskRecord struct {
+	Key     int64
+	Job     string    // TimeWheelConfig.Jobs 中注册的任务名
+	JobData []byte    // 传给任务的参数
+	NextRun time.Time // 下次执行时间
+	Crontab *Crontab  // 周期任务的时间表，单次任务为空
+	CatchUp CatchUp
+	Options TaskOptions // 补执行和以后的执行都按这些选项
+	Paused  bool        // 暂停的任务重启后仍然是暂停的
+}
+
+// Journal 保存持久化任务，TimeWheel 在任务添加、执行、删除时更新
+type Journal interface {
+	Save(TaskRecord) error
+	Delete(key int64) error
+	Load() ([]TaskRecord, error)
+}
+
+var tasksBucketKey = []byte("tasks")
+
+// BoltJournal 保存在 bbolt 文件中的 Journal
+type BoltJournal struct {
+	db *bbolt.DB
+}
+
+var _ Journal = (*BoltJournal)(nil)
+
+// OpenBoltJournal 打开或创建 bbolt 文件
+func OpenBoltJournal(path string) (*BoltJournal, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tasksBucketKey)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltJournal{db: db}, nil
+}
+
+func taskRecordKey(key int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(key))
+	return b[:]
+}
+
+func (j *BoltJournal) Save(r TaskRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tasksBucketKey).Put(taskRecordKey(r.Key), b)
+	})
+}
+
+func (j *BoltJournal) Delete(key int64) error {
+	return j.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tasksBucketKey).Delete(taskRecordKey(key))
+	})
+}
+
+func (j *BoltJournal) Load() (records []TaskRecord, err error) {
+	err = j.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(tasksBucketKey).ForEach(func(k, v []byte) error {
+			var r TaskRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("任务 %x: %w", k, err)
+			}
+			records = append(records, r)
+			return nil
+		})
+	})
+	return
+}
+
+func (j *BoltJournal) Close() error {
+	return j.db.Close()
+}
+
+// AppendOnceJob 添加单次持久化任务，name 是 TimeWheelConfig.Jobs 中注册的任务名，任务收到的 data 是 jobData
+func (tw *TimeWheel) AppendOnceJob(name string, jobData []byte, expiredTime interface{}, catchUp CatchUp, opts TaskOptions) (taskKey int64, err error) {
+	job, err := tw.persistentJob(name)
+	if err != nil {
+		return
+	}
+	nextRun, err := tw.onceNextRun(expiredTime)
+	if err != nil {
+		return
+	}
+	return tw.appendTask(&taskState{
+		name:    name,
+		job:     job,
+		jobData: jobData,
+		opts:    opts,
+		nextRun: nextRun,
+		record:  &TaskRecord{Job: name, JobData: jobData, CatchUp: catchUp, Options: opts},
+	})
+}
+
+// AppendCycleJob 添加重复持久化任务，name 是 TimeWheelConfig.Jobs 中注册的任务名，任务收到的 data 是 jobData
+func (tw *TimeWheel) AppendCycleJob(name string, jobData []byte, expiredTime Crontab, catchUp CatchUp, opts TaskOptions) (taskKey int64, err error) {
+	job, err := tw.persistentJob(name)
+	if err != nil {
+		return
+	}
+	nextRun, err := tw.cycleNextRun(&expiredTime, tw.clock.Now())
+	if err != nil {
+		return
+	}
+	return tw.appendTask(&taskState{
+		name:    name,
+		job:     job,
+		jobData: jobData,
+		crontab: &expiredTime,
+		opts:    opts,
+		nextRun: nextRun,
+		record:  &TaskRecord{Job: name, JobData: jobData, CatchUp: catchUp, Options: opts},
+	})
+}
+
+// 按名字找到注册的任务
+func (tw *TimeWheel) persistentJob(name string) (TaskFunc, error) {
+	if tw.journal == nil {
+		return nil, errors.New("没有配置 Journal")
+	}
+	job, ok := tw.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("任务 %q 没有注册", name)
+	}
+	return job, nil
+}
+
+func (tw *TimeWheel) saveRecord(r TaskRecord) {
+	if err := tw.journal.Save(r); err != nil {
+		tw.logger.WithDefaultLevel(log.Warning).Printf("保存任务 %d 失败: %v", r.Key, err)
+	}
+}
+
+func (tw *TimeWheel) deleteRecord(key int64) {
+	if err := tw.journal.Delete(key); err != nil {
+		tw.logger.WithDefaultLevel(log.Warning).Printf("删除任务 %d 失败: %v", key, err)
+	}
+}
+
+// 重新加载持久化任务并补执行错过的，在 Start 中获取过一次租约之后、轮盘开始转动之前调用
+func (tw *TimeWheel) replayJournal() {
+	records, err := tw.journal.Load()
+	if err != nil {
+		tw.logger.WithDefaultLevel(log.Error).Printf("加载持久化任务失败: %v", err)
+		return
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	now := tw.clock.Now()
+	for i := range records {
+		r := &records[i]
+		if _, ok := tw.tasks[r.Key]; ok {
+			// Start 之前添加的
+			continue
+		}
+		job, err := tw.persistentJob(r.Job)
+		if err == nil && r.Options.Singleton && tw.lease == nil {
+			err = ErrNoLease
+		}
+		if err != nil {
+			// 保留记录，等注册了这个任务的版本再执行
+			tw.logger.WithDefaultLevel(log.Warning).Printf("跳过任务 %d: %v", r.Key, err)
+			continue
+		}
+		s := &taskState{
+			key:     r.Key,
+			name:    r.Job,
+			job:     job,
+			jobData: r.JobData,
+			opts:    r.Options,
+			crontab: r.Crontab,
+			record:  r,
+			nextRun: r.NextRun,
+			paused:  r.Paused,
+		}
+		if r.Paused {
+			// 恢复时再计算执行时间
+			tw.tasks[r.Key] = s
+			continue
+		}
+		missed := 0
+		if !r.NextRun.After(now) {
+			missed = 1
+			if r.Crontab != nil {
+				// 时间表以后不会再执行时 Next 返回零值
+				missed = 0
+				for !r.NextRun.IsZero() && !r.NextRun.After(now) && missed < maxCatchUp {
+					missed++
+					r.NextRun = r.Crontab.Next(r.NextRun)
+				}
+				for !r.NextRun.IsZero() && !r.NextRun.After(now) {
+					r.NextRun = r.Crontab.Next(r.NextRun)
+				}
+			}
+		}
+		switch r.CatchUp {
+		case CatchUpOnce:
+			if missed > 1 {
+				missed = 1
+			}
+		case CatchUpSkip:
+			missed = 0
+		}
+		if missed != 0 {
+			tw.logger.WithDefaultLevel(log.Info).Printf("补执行任务 %d %d 次", r.Key, missed)
+			n := missed
+			tw.submit(func() {
+				for ; n > 0; n-- {
+					tw.runJob(s)
+				}
+			})
+		}
+		if !r.NextRun.After(now) {
+			tw.deleteRecord(r.Key)
+			continue
+		}
+		s.nextRun = r.NextRun
+		tw.saveRecord(*r)
+		tw.tasks[r.Key] = s
+		tw.wheel.addTask(tw.scheduleLocked(s))
+	}
+}
@@ -0,0 +1,196 @@
+package timeWheel
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJournalReplay(t *testing.T) {
+	j, err := OpenBoltJournal(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	now := time.Now()
+	minute := now.Truncate(time.Minute)
+	records := []TaskRecord{
+		{Key: 1, Job: "count", JobData: []byte("once"), NextRun: now.Add(-time.Hour), CatchUp: CatchUpOnce},
+		{Key: 2, Job: "count", JobData: []byte("skip"), NextRun: now.Add(-time.Hour), CatchUp: CatchUpSkip},
+		{Key: 3, Job: "count", JobData: []byte("all"), NextRun: minute.Add(-10 * time.Minute), Crontab: &Crontab{Second: "0"}, CatchUp: CatchUpAll},
+		{Key: 4, Job: "count", JobData: []byte("cycleOnce"), NextRun: minute.Add(-10 * time.Minute), Crontab: &Crontab{Second: "0"}, CatchUp: CatchUpOnce},
+		{Key: 5, Job: "count", JobData: []byte("later"), NextRun: now.Add(time.Hour)},
+		{Key: 6, Job: "unknown", NextRun: now.Add(-time.Hour)},
+	}
+	for _, r := range records {
+		if err := j.Save(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	counts := map[string]int{}
+	tw := NewTimeWheel(&TimeWheelConfig{
+		Jobs: map[string]TaskFunc{
+			"count": func(_ context.Context, data interface{}) error {
+				mu.Lock()
+				counts[string(data.([]byte))]++
+				mu.Unlock()
+				return nil
+			},
+		},
+		Journal: j,
+	})
+	// 只是创建的时间轮不执行也不加载任务
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if len(counts) != 0 {
+		t.Errorf("Start 之前执行了 %v", counts)
+	}
+	mu.Unlock()
+	if tasks := tw.Tasks(); len(tasks) != 0 {
+		t.Errorf("Start 之前加载了 %d 个任务", len(tasks))
+	}
+	go tw.Start()
+	defer tw.Stop()
+	want := map[string]int{"once": 1, "all": 11, "cycleOnce": 1}
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		done := counts["once"]+counts["all"]+counts["cycleOnce"] == 13
+		mu.Unlock()
+		if done || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	for k, v := range want {
+		if counts[k] != v {
+			t.Errorf("%s 执行了 %d 次，应该是 %d 次", k, counts[k], v)
+		}
+	}
+	if len(counts) != len(want) {
+		t.Errorf("执行了 %v", counts)
+	}
+	mu.Unlock()
+
+	left, err := j.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[int64]TaskRecord{}
+	for _, r := range left {
+		keys[r.Key] = r
+	}
+	for _, k := range []int64{3, 4, 5, 6} {
+		if _, ok := keys[k]; !ok {
+			t.Errorf("任务 %d 的记录被删除了", k)
+		}
+	}
+	if len(keys) != 4 {
+		t.Errorf("剩下 %d 条记录", len(keys))
+	}
+	if next := keys[3].NextRun; !next.After(now) || next.Sub(now) > time.Minute {
+		t.Errorf("下次执行时间 %v", next)
+	}
+	for _, k := range []int64{3, 4, 5} {
+		if _, ok := tw.Task(k); !ok {
+			t.Errorf("任务 %d 没有重新添加", k)
+		}
+	}
+}
+
+func TestJournalAppendRemove(t *testing.T) {
+	j, err := OpenBoltJournal(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	tw := NewTimeWheel(&TimeWheelConfig{
+		Jobs:    map[string]TaskFunc{"noop": noopTask},
+		Journal: j,
+	})
+	go tw.Start()
+	defer tw.Stop()
+	if _, err := tw.AppendOnceJob("missing", nil, 100, CatchUpOnce, TaskOptions{}); err == nil {
+		t.Error("没有注册的任务应该添加失败")
+	}
+	once, err := tw.AppendOnceJob("noop", []byte("a"), 100, CatchUpOnce, TaskOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cycle, err := tw.AppendCycleJob("noop", []byte("b"), Crontab{Minute: "0"}, CatchUpSkip, TaskOptions{Overlap: OverlapSkip, Timeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := j.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("保存了 %d 条记录", len(records))
+	}
+	tw.RemoveTask(once)
+	records, err = j.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Key != cycle || records[0].Crontab.Minute != "0" ||
+		records[0].Options != (TaskOptions{Overlap: OverlapSkip, Timeout: time.Minute}) {
+		t.Fatalf("剩下的记录 %+v", records)
+	}
+
+	// 暂停的任务重启后仍然是暂停的
+	if err := tw.PauseTask(cycle); err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewTimeWheel(&TimeWheelConfig{
+		Jobs:    map[string]TaskFunc{"noop": noopTask},
+		Journal: j,
+	})
+	go restarted.Start()
+	defer restarted.Stop()
+	syncTimeWheel(restarted)
+	if info, ok := restarted.Task(cycle); !ok || !info.Paused || !info.Persistent || info.Name != "noop" {
+		t.Errorf("重启后的任务 %+v", info)
+	}
+}
+
+func noopTask(context.Context, interface{}) error { return nil }
+
+// 补执行的任务也有超时，错误记录在执行结果中
+func TestJournalJobOptions(t *testing.T) {
+	j, err := OpenBoltJournal(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	err = j.Save(TaskRecord{
+		Key:     1,
+		Job:     "wait",
+		NextRun: time.Now().Add(-time.Hour),
+		Options: TaskOptions{Timeout: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := NewTimeWheel(&TimeWheelConfig{
+		Jobs: map[string]TaskFunc{
+			"wait": func(ctx context.Context, _ interface{}) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		},
+		Journal: j,
+	})
+	go tw.Start()
+	defer tw.Stop()
+	waitFor(t, func() bool { return len(tw.History()) != 0 })
+	if r := tw.History()[0]; r.Key != 1 || !errors.Is(r.Err, context.DeadlineExceeded) {
+		t.Errorf("执行结果 %+v", r)
+	}
+}
@@ -0,0 +1,183 @@
+package timeWheel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/anacrolix/log"
+	"go.etcd.io/bbolt"
+)
+
+// 默认的租约有效期
+const defaultLeaseTTL = 30 * time.Second
+
+// Lease 多个实例之间的租约，只有持有租约的实例执行 TaskOptions.Singleton 的任务
+type Lease interface {
+	// Acquire 为 holder 获取或续租到 now+ttl，租约被别的实例持有并且没有过期时返回 false。
+	// 每次换了持有者 token 都会变大，任务把 token 带给外部存储，存储拒绝比见过的 token 小的写入，
+	// 这样租约过期后还没发现的旧实例写不进去
+	Acquire(holder string, now time.Time, ttl time.Duration) (token uint64, ok bool, err error)
+	// Release 释放 holder 持有的租约，其他实例不用等到过期
+	Release(holder string) error
+}
+
+type leaseRecord struct {
+	Holder  string
+	Token   uint64
+	Expires time.Time
+}
+
+var leasesBucketKey = []byte("leases")
+
+// BoltLease 保存在 bbolt 文件中的租约。bbolt 打开文件时会加锁，所以每次操作时才打开文件，
+// 同一台机器或者共享文件系统上的多个进程可以用同一个文件
+type BoltLease struct {
+	path string
+	name []byte // 同一个文件中可以保存多个租约
+}
+
+var _ Lease = (*BoltLease)(nil)
+
+// NewBoltLease 保存在 path 中名字是 name 的租约，文件不存在时自动创建
+func NewBoltLease(path, name string) *BoltLease {
+	return &BoltLease{path: path, name: []byte(name)}
+}
+
+func (l *BoltLease) update(f func(b *bbolt.Bucket) error) error {
+	db, err := bbolt.Open(l.path, 0600, &bbolt.Options{
+		Timeout: time.Second,
+	})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(leasesBucketKey)
+		if err != nil {
+			return err
+		}
+		return f(b)
+	})
+}
+
+func (l *BoltLease) Acquire(holder string, now time.Time, ttl time.Duration) (token uint64, ok bool, err error) {
+	err = l.update(func(b *bbolt.Bucket) error {
+		var r leaseRecord
+		if v := b.Get(l.name); v != nil {
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+		}
+		token = r.Token
+		if r.Holder != holder && now.Before(r.Expires) {
+			return nil
+		}
+		if r.Holder != holder || r.Token == 0 {
+			r.Token++
+			r.Holder = holder
+		}
+		r.Expires = now.Add(ttl)
+		token, ok = r.Token, true
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(l.name, v)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return
+}
+
+func (l *BoltLease) Release(holder string) error {
+	return l.update(func(b *bbolt.Bucket) error {
+		v := b.Get(l.name)
+		if v == nil {
+			return nil
+		}
+		var r leaseRecord
+		if err := json.Unmarshal(v, &r); err != nil {
+			return err
+		}
+		if r.Holder != holder {
+			return nil
+		}
+		// 保留 token，下一个持有者的 token 继续变大
+		r.Expires = time.Time{}
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		return b.Put(l.name, v)
+	})
+}
+
+type fencingTokenKey struct{}
+
+// FencingToken Singleton 任务执行时持有的租约 token
+func FencingToken(ctx context.Context) (uint64, bool) {
+	token, ok := ctx.Value(fencingTokenKey{}).(uint64)
+	return token, ok
+}
+
+// 默认的租约持有者名字
+func defaultLeaseHolder() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Leader 是否持有租约，token 是 fencing token。没有配置 Lease 时返回 false
+func (tw *TimeWheel) Leader() (token uint64, ok bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.lease == nil || !tw.clock.Now().Before(tw.leaseUntil) {
+		return 0, false
+	}
+	return tw.leaseToken, true
+}
+
+// 每过三分之一有效期续租一次，时间轮停止时释放租约
+func (tw *TimeWheel) renewLease() {
+	defer close(tw.leaseReleased)
+	defer tw.leaseTicker.Stop()
+	tw.acquireLease()
+	close(tw.leaseChecked)
+	for {
+		select {
+		case <-tw.leaseTicker.C():
+			tw.acquireLease()
+		case <-tw.ctx.Done():
+			tw.mu.Lock()
+			tw.leaseUntil = time.Time{}
+			tw.mu.Unlock()
+			if err := tw.lease.Release(tw.leaseHolder); err != nil {
+				tw.logger.WithDefaultLevel(log.Warning).Printf("释放租约失败: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func (tw *TimeWheel) acquireLease() {
+	now := tw.clock.Now()
+	token, ok, err := tw.lease.Acquire(tw.leaseHolder, now, tw.leaseTTL)
+	if err != nil {
+		// 保持原来的状态，续不上的话到期后自然失去租约
+		tw.logger.WithDefaultLevel(log.Warning).Printf("续租失败: %v", err)
+		return
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if !ok {
+		tw.leaseUntil = time.Time{}
+		return
+	}
+	if token != tw.leaseToken {
+		tw.logger.WithDefaultLevel(log.Info).Printf("%s 获得租约 token %d", tw.leaseHolder, token)
+	}
+	tw.leaseToken, tw.leaseUntil = token, now.Add(tw.leaseTTL)
+}
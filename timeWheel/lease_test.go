@@ -0,0 +1,171 @@
+package timeWheel
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltLease(t *testing.T) {
+	lease := NewBoltLease(filepath.Join(t.TempDir(), "lease.db"), "spider")
+	now := time.Date(2023, 6, 1, 10, 0, 0, 0, time.UTC)
+	acquire := func(holder string, now time.Time, wantToken uint64, wantOk bool) {
+		t.Helper()
+		token, ok, err := lease.Acquire(holder, now, 3*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != wantToken || ok != wantOk {
+			t.Fatalf("%s 获取租约 %d %t，应该是 %d %t", holder, token, ok, wantToken, wantOk)
+		}
+	}
+	acquire("a", now, 1, true)
+	acquire("b", now.Add(time.Second), 1, false)
+	// 续租不改变 token
+	acquire("a", now.Add(2*time.Second), 1, true)
+	acquire("b", now.Add(4*time.Second), 1, false)
+	// 过期后换持有者，token 变大
+	acquire("b", now.Add(5*time.Second), 2, true)
+	acquire("a", now.Add(6*time.Second), 2, false)
+	if err := lease.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("a", now.Add(6*time.Second), 2, false)
+	if err := lease.Release("b"); err != nil {
+		t.Fatal(err)
+	}
+	acquire("a", now.Add(6*time.Second), 3, true)
+}
+
+func TestSingleton(t *testing.T) {
+	lease := NewBoltLease(filepath.Join(t.TempDir(), "lease.db"), "spider")
+	start := mustLocalTime(t, "2023-06-01 10:00:00")
+	newWheel := func(holder string) (*TimeWheel, *FakeClock, chan uint64) {
+		clock := NewFakeClock(start)
+		tw := NewTimeWheel(&TimeWheelConfig{
+			Clock:       clock,
+			Lease:       lease,
+			LeaseHolder: holder,
+			LeaseTTL:    3 * time.Second,
+		})
+		go tw.Start()
+		ran := make(chan uint64, 100)
+		job := func(ctx context.Context, _ interface{}) error {
+			token, _ := FencingToken(ctx)
+			ran <- token
+			return nil
+		}
+		if _, err := tw.AppendCycleTask(job, nil, Crontab{Second: "*"}, TaskOptions{Singleton: true}); err != nil {
+			t.Fatal(err)
+		}
+		return tw, clock, ran
+	}
+	leader := func(tw *TimeWheel) bool {
+		_, ok := tw.Leader()
+		return ok
+	}
+
+	a, clockA, ranA := newWheel("a")
+	waitFor(t, func() bool { return leader(a) })
+	b, clockB, ranB := newWheel("b")
+	defer b.Stop()
+	clockA.Advance(time.Second)
+	clockB.Advance(time.Second)
+	select {
+	case token := <-ranA:
+		if token != 1 {
+			t.Errorf("token %d", token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("持有租约的实例没有执行")
+	}
+	syncTimeWheel(b)
+	if leader(b) || len(b.History()) != 0 {
+		t.Fatal("两个实例都执行了")
+	}
+
+	// 停止后释放租约，另一个实例接手
+	a.Stop()
+	waitFor(t, func() bool { return !leader(a) })
+	clockB.Advance(4 * time.Second)
+	waitFor(t, func() bool { return leader(b) })
+	clockB.Advance(time.Second)
+	waitFor(t, func() bool { return len(ranB) != 0 })
+	for len(ranB) != 0 {
+		if token := <-ranB; token != 2 {
+			t.Errorf("token %d", token)
+		}
+	}
+	if len(ranA) != 0 {
+		t.Error("停止后还在执行")
+	}
+}
+
+func TestSingletonWithoutLease(t *testing.T) {
+	j, err := OpenBoltJournal(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	tw := NewTimeWheel(&TimeWheelConfig{
+		Jobs:    map[string]TaskFunc{"noop": noopTask},
+		Journal: j,
+	})
+	opts := TaskOptions{Singleton: true}
+	if _, err := tw.AppendOnceTask(noopTask, nil, 10, opts); err != ErrNoLease {
+		t.Errorf("AppendOnceTask: %v", err)
+	}
+	if _, err := tw.AppendCycleTask(noopTask, nil, Crontab{Second: "0"}, opts); err != ErrNoLease {
+		t.Errorf("AppendCycleTask: %v", err)
+	}
+	if _, err := tw.AppendOnceJob("noop", nil, 10, CatchUpOnce, opts); err != ErrNoLease {
+		t.Errorf("AppendOnceJob: %v", err)
+	}
+	if _, err := tw.AppendCycleJob("noop", nil, Crontab{Second: "0"}, CatchUpOnce, opts); err != ErrNoLease {
+		t.Errorf("AppendCycleJob: %v", err)
+	}
+	if records, err := j.Load(); err != nil || len(records) != 0 {
+		t.Errorf("保存了记录 %v: %v", records, err)
+	}
+}
+
+// 持久化的 Singleton 任务在获取租约之后补执行
+func TestSingletonJobCatchUp(t *testing.T) {
+	j, err := OpenBoltJournal(filepath.Join(t.TempDir(), "tasks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	err = j.Save(TaskRecord{
+		Key:     1,
+		Job:     "token",
+		NextRun: time.Now().Add(-time.Hour),
+		Options: TaskOptions{Singleton: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ran := make(chan uint64, 1)
+	tw := NewTimeWheel(&TimeWheelConfig{
+		Jobs: map[string]TaskFunc{
+			"token": func(ctx context.Context, _ interface{}) error {
+				token, _ := FencingToken(ctx)
+				ran <- token
+				return nil
+			},
+		},
+		Journal: j,
+		Lease:   NewBoltLease(filepath.Join(t.TempDir(), "lease.db"), "spider"),
+	})
+	go tw.Start()
+	defer tw.Stop()
+	select {
+	case token := <-ran:
+		if token != 1 {
+			t.Errorf("token %d", token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("没有补执行")
+	}
+}
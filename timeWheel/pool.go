@@ -0,0 +1,58 @@
+package timeWheel
+
+import (
+	"container/list"
+	"sync"
+)
+
+// 固定数量的 goroutine 执行到期的任务，忙不过来时任务排队，不会阻塞时间轮
+type workerPool struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   list.List // 排队的任务 func()
+	stopped bool
+}
+
+func newWorkerPool(workers int) *workerPool {
+	p := &workerPool{}
+	p.cond = sync.NewCond(&p.mu)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) submit(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return
+	}
+	p.queue.PushBack(f)
+	p.cond.Signal()
+}
+
+func (p *workerPool) work() {
+	for {
+		p.mu.Lock()
+		for p.queue.Len() == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.mu.Unlock()
+			return
+		}
+		f := p.queue.Remove(p.queue.Front()).(func())
+		p.mu.Unlock()
+		f()
+	}
+}
+
+// 停止后排队的任务不再执行，正在执行的任务执行完后 goroutine 退出
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.queue.Init()
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
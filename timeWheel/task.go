@@ -0,0 +1,411 @@
+package timeWheel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// 最多保存最近多少次执行结果
+const historyLen = 100
+
+// ErrTaskNotFound 任务不存在或者已经执行完
+var ErrTaskNotFound = errors.New("任务不存在")
+
+// ErrNoLease 没有配置 TimeWheelConfig.Lease 时不能添加 Singleton 任务，否则永远不会执行
+var ErrNoLease = errors.New("Singleton 任务需要配置 Lease")
+
+// TaskFunc 任务回调函数，ctx 在超时或时间轮停止时取消，返回的错误记录在 RunResult 中
+type TaskFunc func(ctx context.Context, data interface{}) error
+
+// 把 AppendOnceFunc 和 AppendCycleFunc 的回调函数包装成 TaskFunc
+func funcTask(job func(interface{})) TaskFunc {
+	return func(_ context.Context, data interface{}) error {
+		job(data)
+		return nil
+	}
+}
+
+// Overlap 任务上一次还没执行完又到期时的处理方式
+type Overlap int
+
+const (
+	OverlapAllow Overlap = iota // 同时执行
+	OverlapSkip                 // 跳过这一次
+	OverlapQueue                // 等上一次执行完再执行
+)
+
+// TaskOptions 任务的执行选项
+type TaskOptions struct {
+	Overlap   Overlap
+	Timeout   time.Duration // 执行超过这个时间后取消 ctx，0 不限制
+	Singleton bool          // 只在持有 TimeWheelConfig.Lease 的实例上执行，ctx 中带有 FencingToken，没有配置 Lease 时添加返回 ErrNoLease
+}
+
+// TaskInfo 任务的状态，由 Tasks 和 Task 返回
+type TaskInfo struct {
+	Key        int64
+	Name       string     // 回调函数名，持久化任务是注册的任务名
+	NextRun    time.Time  // 下次执行时间，暂停的周期任务恢复时会重新计算
+	Crontab    *Crontab   // 周期任务的时间表，单次任务为空
+	Paused     bool       // 是否已暂停
+	Persistent bool       // 是否保存在 Journal 中
+	LastRun    *RunResult // 最近一次执行结果，没有执行过为空
+}
+
+// RunResult 任务的一次执行结果
+type RunResult struct {
+	Key      int64
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Panic    interface{} // 任务 panic 时恢复的值
+	Err      error       // 执行失败的原因
+}
+
+// 任务的状态，除 key、name、job、jobData、opts 外都由 TimeWheel.mu 保护
+type taskState struct {
+	key     int64
+	name    string
+	job     TaskFunc
+	jobData interface{}
+	opts    TaskOptions
+	crontab *Crontab
+	record  *TaskRecord // 持久化任务的记录
+	nextRun time.Time
+	paused  bool
+	gen     int64 // 每次放入时间轮加一，时间轮中之前放入的任务到期后不再执行
+	lastRun *RunResult
+	running int // 正在执行的次数
+	pending int // OverlapQueue 等待执行的次数
+}
+
+func (s *taskState) info() TaskInfo {
+	info := TaskInfo{
+		Key:        s.key,
+		Name:       s.name,
+		NextRun:    s.nextRun,
+		Paused:     s.paused,
+		Persistent: s.record != nil,
+	}
+	if s.crontab != nil {
+		c := *s.crontab
+		info.Crontab = &c
+	}
+	if s.lastRun != nil {
+		r := *s.lastRun
+		info.LastRun = &r
+	}
+	return info
+}
+
+// Tasks 所有任务，包括暂停的，按下次执行时间排序
+func (tw *TimeWheel) Tasks() []TaskInfo {
+	tw.mu.Lock()
+	infos := make([]TaskInfo, 0, len(tw.tasks))
+	for _, s := range tw.tasks {
+		infos = append(infos, s.info())
+	}
+	tw.mu.Unlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].NextRun.Before(infos[j].NextRun)
+	})
+	return infos
+}
+
+// Task 查询任务，单次任务执行后就查不到了
+func (tw *TimeWheel) Task(taskKey int64) (TaskInfo, bool) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	s, ok := tw.tasks[taskKey]
+	if !ok {
+		return TaskInfo{}, false
+	}
+	return s.info(), true
+}
+
+// History 最近的执行结果，最多 100 条，先执行的在前面
+func (tw *TimeWheel) History() []RunResult {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return append([]RunResult(nil), tw.history...)
+}
+
+// PauseTask 暂停任务，恢复前不会执行
+func (tw *TimeWheel) PauseTask(taskKey int64) error {
+	tw.mu.Lock()
+	s, ok := tw.tasks[taskKey]
+	if !ok {
+		tw.mu.Unlock()
+		return ErrTaskNotFound
+	}
+	if s.paused {
+		tw.mu.Unlock()
+		return nil
+	}
+	s.paused = true
+	s.gen++
+	tw.saveState(s)
+	tw.mu.Unlock()
+	tw.sendRemove(taskKey)
+	return nil
+}
+
+// ResumeTask 恢复暂停的任务，周期任务从现在开始计算下次执行时间，已经过了执行时间的单次任务立即执行
+func (tw *TimeWheel) ResumeTask(taskKey int64) error {
+	tw.mu.Lock()
+	s, ok := tw.tasks[taskKey]
+	if !ok {
+		tw.mu.Unlock()
+		return ErrTaskNotFound
+	}
+	if !s.paused {
+		tw.mu.Unlock()
+		return nil
+	}
+	if s.crontab != nil {
+		next, err := tw.cycleNextRun(s.crontab, tw.clock.Now())
+		if err != nil {
+			tw.mu.Unlock()
+			return err
+		}
+		s.nextRun = next
+	}
+	s.paused = false
+	tw.saveState(s)
+	task := tw.scheduleLocked(s)
+	tw.mu.Unlock()
+	tw.sendAdd(task)
+	return nil
+}
+
+// RescheduleTask 修改任务的执行时间，schedule 是 Crontab 时改成周期任务，
+// 否则和 AppendOnceFunc 的 expiredTime 一样，改成单次任务。暂停的任务修改后仍然是暂停的
+func (tw *TimeWheel) RescheduleTask(taskKey int64, schedule interface{}) error {
+	var (
+		crontab *Crontab
+		nextRun time.Time
+		err     error
+	)
+	if c, ok := schedule.(Crontab); ok {
+		crontab = &c
+		nextRun, err = tw.cycleNextRun(crontab, tw.clock.Now())
+	} else {
+		nextRun, err = tw.onceNextRun(schedule)
+	}
+	if err != nil {
+		return err
+	}
+	tw.mu.Lock()
+	s, ok := tw.tasks[taskKey]
+	if !ok {
+		tw.mu.Unlock()
+		return ErrTaskNotFound
+	}
+	s.crontab, s.nextRun = crontab, nextRun
+	tw.saveState(s)
+	if s.paused {
+		tw.mu.Unlock()
+		return nil
+	}
+	task := tw.scheduleLocked(s)
+	tw.mu.Unlock()
+	tw.sendRemove(taskKey)
+	tw.sendAdd(task)
+	return nil
+}
+
+// 登记新任务并放入时间轮，持久化任务先保存记录
+func (tw *TimeWheel) appendTask(s *taskState) (int64, error) {
+	if s.opts.Singleton && tw.lease == nil {
+		return 0, ErrNoLease
+	}
+	tw.mu.Lock()
+	s.key = tw.randomTaskKey()
+	if s.record != nil {
+		s.syncRecord()
+		if err := tw.journal.Save(*s.record); err != nil {
+			tw.mu.Unlock()
+			return 0, err
+		}
+	}
+	tw.tasks[s.key] = s
+	task := tw.scheduleLocked(s)
+	tw.mu.Unlock()
+	tw.sendAdd(task)
+	return s.key, nil
+}
+
+// 创建放入时间轮的任务，之前放入的同一个任务到期后不再执行，需要持有 tw.mu
+func (tw *TimeWheel) scheduleLocked(s *taskState) *Task {
+	s.gen++
+	gen := s.gen
+	return &Task{
+		at:           s.nextRun,
+		rouletteSite: map[string]int64{},
+		key:          s.key,
+		Job:          func() { tw.fire(s, gen) },
+		crontab:      s.crontab,
+	}
+}
+
+// 删除任务，需要持有 tw.mu
+func (tw *TimeWheel) removeLocked(s *taskState) {
+	delete(tw.tasks, s.key)
+	s.gen++
+	if s.record != nil {
+		tw.deleteRecord(s.key)
+	}
+}
+
+func (s *taskState) syncRecord() {
+	s.record.Key = s.key
+	s.record.NextRun = s.nextRun
+	s.record.Crontab = s.crontab
+	s.record.Paused = s.paused
+}
+
+// 更新持久化任务的记录，需要持有 tw.mu
+func (tw *TimeWheel) saveState(s *taskState) {
+	if s.record == nil {
+		return
+	}
+	s.syncRecord()
+	tw.saveRecord(*s.record)
+}
+
+// 任务到期，周期任务先算出下次执行时间重新放入时间轮，再执行
+func (tw *TimeWheel) fire(s *taskState, gen int64) {
+	tw.mu.Lock()
+	if tw.tasks[s.key] != s || s.gen != gen {
+		// 已经删除、暂停或者修改了执行时间
+		tw.mu.Unlock()
+		return
+	}
+	expvars.Add("fired", 1)
+	now := tw.clock.Now()
+	recordLateBy(now.Sub(s.nextRun))
+	var task *Task
+	if s.crontab != nil {
+		// 从这次的执行时间开始算，执行晚了错过的就从现在开始算
+		next, err := tw.cycleNextRun(s.crontab, s.nextRun)
+		if err == nil && next.Before(now) {
+			next, err = tw.cycleNextRun(s.crontab, now)
+		}
+		if err != nil {
+			// 时间表以后不会再执行，这是最后一次
+			tw.logger.WithDefaultLevel(log.Info).Printf("任务 %d 不再重复: %v", s.key, err)
+			tw.removeLocked(s)
+		} else {
+			s.nextRun = next
+			tw.saveState(s)
+			task = tw.scheduleLocked(s)
+		}
+	} else {
+		tw.removeLocked(s)
+	}
+	tw.mu.Unlock()
+	if task != nil {
+		tw.logger.Printf("重新添加任务,在 %s 调用", task.at.Format("2006-01-02 15:04:05"))
+		tw.sendAdd(task)
+	}
+	tw.runJob(s)
+}
+
+// 按任务的重叠策略执行
+func (tw *TimeWheel) runJob(s *taskState) {
+	tw.mu.Lock()
+	if s.running > 0 {
+		switch s.opts.Overlap {
+		case OverlapSkip:
+			tw.mu.Unlock()
+			expvars.Add("overlapSkipped", 1)
+			tw.logger.Printf("任务 %d 上一次还没有执行完，跳过", s.key)
+			return
+		case OverlapQueue:
+			s.pending++
+			tw.mu.Unlock()
+			return
+		}
+	}
+	s.running++
+	tw.mu.Unlock()
+	for {
+		tw.execute(s)
+		tw.mu.Lock()
+		if s.pending > 0 {
+			s.pending--
+			tw.mu.Unlock()
+			continue
+		}
+		s.running--
+		tw.mu.Unlock()
+		return
+	}
+}
+
+// 执行任务，恢复 panic 并记录执行结果
+func (tw *TimeWheel) execute(s *taskState) {
+	ctx := tw.ctx
+	if s.opts.Singleton {
+		token, ok := tw.Leader()
+		if !ok {
+			expvars.Add("notLeaderSkipped", 1)
+			tw.logger.Printf("没有持有租约，跳过任务 %d", s.key)
+			return
+		}
+		ctx = context.WithValue(ctx, fencingTokenKey{}, token)
+	}
+	result := RunResult{
+		Key:   s.key,
+		Name:  s.name,
+		Start: tw.clock.Now(),
+	}
+	expvars.Add("runs", 1)
+	tw.logger.Printf("%s 执行 %s 函数", result.Start.Format("2006-01-02 15:04:05"), s.name)
+	if s.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			result.Panic = r
+			result.Err = fmt.Errorf("panic: %v", r)
+			expvars.Add("panics", 1)
+			tw.logger.WithDefaultLevel(log.Error).Printf("任务 %d panic: %v\n%s", s.key, r, debug.Stack())
+		}
+		if result.Err != nil {
+			expvars.Add("failures", 1)
+		}
+		result.Duration = tw.clock.Now().Sub(result.Start)
+		tw.mu.Lock()
+		s.lastRun = &result
+		if len(tw.history) == historyLen {
+			tw.history = append(tw.history[:0], tw.history[1:]...)
+		}
+		tw.history = append(tw.history, result)
+		tw.mu.Unlock()
+	}()
+	result.Err = s.job(ctx, s.jobData)
+}
+
+// 发给时间轮的 goroutine，时间轮已经停止的话直接丢弃
+func (tw *TimeWheel) sendAdd(task *Task) {
+	select {
+	case tw.addTaskChannel <- *task:
+	case <-tw.ctx.Done():
+	}
+}
+
+func (tw *TimeWheel) sendRemove(taskKey int64) {
+	select {
+	case tw.removeTaskChannel <- taskKey:
+	case <-tw.ctx.Done():
+	}
+}
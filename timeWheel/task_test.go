@@ -0,0 +1,205 @@
+package timeWheel
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTaskLifecycle(t *testing.T) {
+	tw, clock := newFakeTimeWheel(t, "2023-06-01 10:00:00")
+	fired := make(chan interface{}, 10)
+	job := func(data interface{}) { fired <- data }
+	a, err := tw.AppendOnceFunc(job, "a", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tw.AppendCycleFunc(job, "b", Crontab{Second: "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tw.AppendOnceFunc(func(interface{}) { panic("boom") }, nil, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tasks := tw.Tasks()
+	if len(tasks) != 3 || tasks[0].Key != c || tasks[1].Key != a || tasks[2].Key != b {
+		t.Fatalf("任务顺序 %+v", tasks)
+	}
+	if got := tasks[2].NextRun.Format(timeLayout); got != "2023-06-01 10:01:00" || tasks[2].Crontab == nil {
+		t.Errorf("周期任务 %+v", tasks[2])
+	}
+
+	if err := tw.PauseTask(a); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := tw.Task(a); !info.Paused {
+		t.Error("任务没有暂停")
+	}
+
+	// panic 不会让进程退出，记录在执行结果中
+	clock.Advance(10 * time.Second)
+	waitFor(t, func() bool { return len(tw.History()) == 1 })
+	history := tw.History()
+	if len(history) != 1 || history[0].Key != c || history[0].Panic != "boom" || history[0].Err == nil {
+		t.Fatalf("执行结果 %+v", history)
+	}
+	if _, ok := tw.Task(c); ok {
+		t.Error("执行过的单次任务还在")
+	}
+
+	// 暂停的任务到期后不执行
+	clock.Advance(20 * time.Second) // 10:00:30
+	syncTimeWheel(tw)
+	expectNotFired(t, fired)
+
+	if err := tw.RescheduleTask(b, Crontab{Second: "45"}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Second) // 10:00:45
+	expectFired(t, fired, "b")
+	if info, _ := tw.Task(b); info.NextRun.Format(timeLayout) != "2023-06-01 10:01:45" {
+		t.Errorf("下次执行时间 %v", info.NextRun)
+	}
+
+	// 已经过了执行时间的立即执行
+	if err := tw.ResumeTask(a); err != nil {
+		t.Fatal(err)
+	}
+	expectFired(t, fired, "a")
+
+	// 改成单次任务
+	if err := tw.RescheduleTask(b, 5); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(5 * time.Second) // 10:00:50
+	expectFired(t, fired, "b")
+	clock.Advance(time.Minute)
+	syncTimeWheel(tw)
+	expectNotFired(t, fired)
+	if tasks := tw.Tasks(); len(tasks) != 0 {
+		t.Errorf("还有任务 %+v", tasks)
+	}
+	if err := tw.PauseTask(b); err != ErrTaskNotFound {
+		t.Errorf("暂停不存在的任务: %v", err)
+	}
+	if got := len(tw.History()); got != 4 {
+		t.Errorf("执行了 %d 次", got)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	clock := NewFakeClock(mustLocalTime(t, "2023-06-01 10:00:00"))
+	tw := NewTimeWheel(&TimeWheelConfig{Clock: clock, Workers: 2})
+	go tw.Start()
+	defer tw.Stop()
+	var mu sync.Mutex
+	running, most := 0, 0
+	release := make(chan struct{})
+	job := func(ctx context.Context, _ interface{}) error {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := tw.AppendOnceTask(job, nil, 1, TaskOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(time.Second)
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return running == 2
+	})
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	waitFor(t, func() bool { return len(tw.History()) == 5 })
+	mu.Lock()
+	defer mu.Unlock()
+	if most != 2 {
+		t.Errorf("同时执行了 %d 个任务", most)
+	}
+}
+
+func TestOverlap(t *testing.T) {
+	for _, tc := range []struct {
+		overlap Overlap
+		runs    int
+	}{
+		{OverlapAllow, 3},
+		{OverlapSkip, 1},
+		{OverlapQueue, 3},
+	} {
+		tw, clock := newFakeTimeWheel(t, "2023-06-01 10:00:00")
+		started := make(chan struct{}, 10)
+		release := make(chan struct{})
+		job := func(ctx context.Context, _ interface{}) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}
+		if _, err := tw.AppendCycleTask(job, nil, Crontab{Second: "*"}, TaskOptions{Overlap: tc.overlap}); err != nil {
+			t.Fatal(err)
+		}
+		skipped := expvarInt(expvars, "overlapSkipped")
+		clock.Advance(time.Second)
+		<-started
+		// 第一次还没执行完又到期两次，等三次都按重叠策略处理完
+		clock.Advance(time.Second)
+		clock.Advance(time.Second)
+		syncTimeWheel(tw)
+		waitFor(t, func() bool {
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			for _, s := range tw.tasks {
+				return s.running+s.pending+int(expvarInt(expvars, "overlapSkipped")-skipped) == 3
+			}
+			return false
+		})
+		close(release)
+		waitFor(t, func() bool { return len(tw.History()) == tc.runs })
+		time.Sleep(10 * time.Millisecond)
+		if got := len(tw.History()); got != tc.runs {
+			t.Errorf("Overlap %d 执行了 %d 次，应该是 %d 次", tc.overlap, got, tc.runs)
+		}
+	}
+}
+
+func TestTaskTimeout(t *testing.T) {
+	tw, clock := newFakeTimeWheel(t, "2023-06-01 10:00:00")
+	job := func(ctx context.Context, _ interface{}) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	if _, err := tw.AppendOnceTask(job, nil, 1, TaskOptions{Timeout: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	waitFor(t, func() bool { return len(tw.History()) == 1 })
+	if err := tw.History()[0].Err; err != context.DeadlineExceeded {
+		t.Errorf("执行结果 %v", err)
+	}
+}
+
+// 最多等一秒
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
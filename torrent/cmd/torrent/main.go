@@ -181,6 +181,7 @@ type DownloadCmd struct {
 	UploadRate         *tagflag.Bytes `help:"max piece bytes to send per second"`
 	DownloadRate       *tagflag.Bytes `help:"max bytes per second down from peers"`
 	PackedBlocklist    string
+	Blocklist          []string `help:"blocklist files in P2P, CIDR or eMule DAT format, optionally gzipped, reloaded when they change"`
 	PublicIP           net.IP
 	Progress           bool `default:"true"`
 	PieceStates        bool
@@ -306,6 +307,24 @@ func downloadErr() error {
 		defer blocklist.Close()
 		clientConfig.IPBlocklist = blocklist
 	}
+	if len(flags.Blocklist) != 0 {
+		if flags.PackedBlocklist != "" {
+			return xerrors.New("packed blocklist can't be combined with other blocklists")
+		}
+		var sources []iplist.Source
+		for _, path := range flags.Blocklist {
+			sources = append(sources, iplist.Source{Path: path})
+		}
+		blocklist, err := iplist.OpenBlocklist(sources...)
+		if err != nil {
+			return xerrors.Errorf("loading blocklists: %v", err)
+		}
+		if err := blocklist.Watch(); err != nil {
+			return xerrors.Errorf("watching blocklists: %v", err)
+		}
+		defer blocklist.Close()
+		clientConfig.IPBlocklist = blocklist
+	}
 	if flags.Mmap {
 		clientConfig.DefaultStorage = storage.NewMMap("")
 	}
@@ -0,0 +1,315 @@
+//go:build !wasm
+// +build !wasm
+
+package iplist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Source is a blocklist file for a Blocklist.
+type Source struct {
+	Path   string
+	Format Format
+}
+
+// A Blocklist is a Ranger over several blocklist files, in any of the Formats and optionally gzipped.
+// Reload, or Watch, replaces the ranges of sources without disturbing lookups in progress, so a
+// Blocklist can be given to a Client or DHT server once and kept up to date. Lookups count the hits
+// on each range.
+type Blocklist struct {
+	// Where Watch reports reloads and errors. Defaults to log.Default.
+	Logger log.Logger
+
+	sources []Source
+	// A []*sourceRanges, indexed like sources. Replaced whole, so lookups don't lock.
+	lists atomic.Value
+
+	// Serializes loads, and guards the fields below.
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	// Pending reloads by source index.
+	reloads map[int]*time.Timer
+	closed  bool
+}
+
+var _ Ranger = (*Blocklist)(nil)
+
+// How long Watch waits for a file to stop changing before reloading it.
+var blocklistReloadDelay = time.Second
+
+type sourceRanges struct {
+	// In 16-byte form, sorted by First.
+	ranges []Range
+	hits   []int64
+	// The index of the range with the greatest Last in ranges[:i+1]. Ranges can overlap or nest, so
+	// the range starting nearest below an IP doesn't always contain it when an earlier one does.
+	reach []int
+}
+
+func newSourceRanges(ranges []Range) *sourceRanges {
+	sr := &sourceRanges{
+		ranges: ranges,
+		hits:   make([]int64, len(ranges)),
+		reach:  make([]int, len(ranges)),
+	}
+	for i, r := range ranges {
+		if i != 0 && bytes.Compare(r.Last, ranges[sr.reach[i-1]].Last) <= 0 {
+			sr.reach[i] = sr.reach[i-1]
+		} else {
+			sr.reach[i] = i
+		}
+	}
+	return sr
+}
+
+// RangeHits is a range of a Blocklist, and the number of lookups that have matched it.
+type RangeHits struct {
+	Range
+	Source string
+	Hits   int64
+}
+
+// OpenBlocklist loads the sources. It fails if any of them can't be loaded.
+func OpenBlocklist(sources ...Source) (*Blocklist, error) {
+	bl := &Blocklist{
+		sources: sources,
+	}
+	bl.lists.Store(make([]*sourceRanges, len(sources)))
+	if err := bl.Reload(); err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+func readSourceFile(s Source) ([]Range, error) {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRanges(f, s.Format)
+}
+
+// Reload loads every source again. Sources that fail to load keep their previous ranges, and the
+// first error is returned.
+func (bl *Blocklist) Reload() (err error) {
+	for i := range bl.sources {
+		if loadErr := bl.load(i); loadErr != nil && err == nil {
+			err = loadErr
+		}
+	}
+	return
+}
+
+func (bl *Blocklist) load(i int) error {
+	s := bl.sources[i]
+	ranges, err := readSourceFile(s)
+	if err != nil {
+		return fmt.Errorf("loading %q: %w", s.Path, err)
+	}
+	for j := range ranges {
+		ranges[j].First = ranges[j].First.To16()
+		ranges[j].Last = ranges[j].Last.To16()
+	}
+	sort.SliceStable(ranges, func(j, k int) bool {
+		return bytes.Compare(ranges[j].First, ranges[k].First) < 0
+	})
+	sr := newSourceRanges(ranges)
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	old := bl.loaded()
+	// Hits carry over to ranges that are still there.
+	if prev := old[i]; prev != nil {
+		prevHits := make(map[string]int64, len(prev.ranges))
+		for j, r := range prev.ranges {
+			if h := atomic.LoadInt64(&prev.hits[j]); h != 0 {
+				prevHits[r.String()] = h
+			}
+		}
+		for j, r := range sr.ranges {
+			sr.hits[j] = prevHits[r.String()]
+		}
+	}
+	lists := append([]*sourceRanges(nil), old...)
+	lists[i] = sr
+	bl.lists.Store(lists)
+	return nil
+}
+
+func (bl *Blocklist) loaded() []*sourceRanges {
+	return bl.lists.Load().([]*sourceRanges)
+}
+
+// Returns the index of the range containing ip, which is in 16-byte form, or -1.
+func (sr *sourceRanges) search(ip net.IP) int {
+	// The first range that starts after ip.
+	i := sort.Search(len(sr.ranges), func(i int) bool {
+		return bytes.Compare(ip, sr.ranges[i].First) < 0
+	})
+	if i == 0 {
+		return -1
+	}
+	// Prefer the range starting nearest, which is the narrowest if it nests in the others.
+	if bytes.Compare(ip, sr.ranges[i-1].Last) <= 0 {
+		return i - 1
+	}
+	if j := sr.reach[i-1]; bytes.Compare(ip, sr.ranges[j].Last) <= 0 {
+		return j
+	}
+	return -1
+}
+
+// Lookup returns the first range containing ip, trying the sources in order.
+func (bl *Blocklist) Lookup(ip net.IP) (r Range, ok bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return Range{Description: "bad IP"}, true
+	}
+	for _, sr := range bl.loaded() {
+		if sr == nil {
+			continue
+		}
+		if i := sr.search(ip16); i >= 0 {
+			atomic.AddInt64(&sr.hits[i], 1)
+			return sr.ranges[i], true
+		}
+	}
+	return
+}
+
+func (bl *Blocklist) NumRanges() (ret int) {
+	for _, sr := range bl.loaded() {
+		if sr != nil {
+			ret += len(sr.ranges)
+		}
+	}
+	return
+}
+
+// Hits returns the ranges that lookups have matched, most hit first.
+func (bl *Blocklist) Hits() (ret []RangeHits) {
+	for i, sr := range bl.loaded() {
+		if sr == nil {
+			continue
+		}
+		for j, r := range sr.ranges {
+			if h := atomic.LoadInt64(&sr.hits[j]); h != 0 {
+				ret = append(ret, RangeHits{r, bl.sources[i].Path, h})
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Hits > ret[j].Hits
+	})
+	return
+}
+
+// Watch reloads sources when their files change, until Close. The directories of the sources are
+// watched, so files that are replaced, as by downloads, are picked up.
+func (bl *Blocklist) Watch() error {
+	if bl.Logger.LoggerImpl == nil {
+		bl.Logger = log.Default
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for _, s := range bl.sources {
+		dir := filepath.Dir(s.Path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.closed || bl.watcher != nil {
+		w.Close()
+		return errors.New("blocklist closed or already watched")
+	}
+	bl.watcher = w
+	bl.reloads = make(map[int]*time.Timer)
+	go bl.handleEvents(w)
+	go bl.handleErrors(w)
+	return nil
+}
+
+func (bl *Blocklist) handleEvents(w *fsnotify.Watcher) {
+	for e := range w.Events {
+		name := filepath.Clean(e.Name)
+		for i, s := range bl.sources {
+			if filepath.Clean(s.Path) == name {
+				bl.scheduleReload(i)
+			}
+		}
+	}
+}
+
+func (bl *Blocklist) handleErrors(w *fsnotify.Watcher) {
+	for err := range w.Errors {
+		bl.Logger.WithDefaultLevel(log.Warning).Printf("error watching blocklists: %v", err)
+	}
+}
+
+// Reloads the source once its file has stopped changing for a while.
+func (bl *Blocklist) scheduleReload(i int) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.closed {
+		return
+	}
+	if t, ok := bl.reloads[i]; ok {
+		t.Reset(blocklistReloadDelay)
+		return
+	}
+	bl.reloads[i] = time.AfterFunc(blocklistReloadDelay, func() {
+		bl.mu.Lock()
+		delete(bl.reloads, i)
+		closed := bl.closed
+		bl.mu.Unlock()
+		if closed {
+			return
+		}
+		path := bl.sources[i].Path
+		if err := bl.load(i); err != nil {
+			bl.Logger.WithDefaultLevel(log.Warning).Printf("keeping previous ranges: %v", err)
+			return
+		}
+		bl.Logger.WithDefaultLevel(log.Info).Printf("reloaded blocklist %q", path)
+	})
+}
+
+// Close stops watching. The ranges loaded are still used.
+func (bl *Blocklist) Close() error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if bl.closed {
+		return nil
+	}
+	bl.closed = true
+	for _, t := range bl.reloads {
+		t.Stop()
+	}
+	if bl.watcher == nil {
+		return nil
+	}
+	return bl.watcher.Close()
+}
@@ -0,0 +1,149 @@
+package iplist
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadRangesFormats(t *testing.T) {
+	dat := `
+// eMule ipfilter.dat
+001.002.004.000 - 001.002.004.255 , 000 , a
+001.002.005.000 - 001.002.005.255 , 200 , allowed
+`
+	rs, err := ReadRanges(strings.NewReader(dat), FormatAuto)
+	require.NoError(t, err)
+	require.Len(t, rs, 1)
+	assert.EqualValues(t, Range{First: net.IP{1, 2, 4, 0}, Last: net.IP{1, 2, 4, 255}, Description: "a"}, rs[0])
+
+	cidr := "# comment\n1.2.3.0/24\n\n2001:db8::1\n"
+	rs, err = ReadRanges(strings.NewReader(cidr), FormatAuto)
+	require.NoError(t, err)
+	require.Len(t, rs, 2)
+	assert.EqualValues(t, net.IP{1, 2, 3, 255}, rs[0].Last)
+	assert.True(t, rs[1].First.Equal(net.ParseIP("2001:db8::1")))
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte(sample))
+	require.NoError(t, gw.Close())
+	rs, err = ReadRanges(&gz, FormatAuto)
+	require.NoError(t, err)
+	assert.Len(t, rs, 5)
+
+	_, err = ReadRanges(strings.NewReader("1.2.3.0/24\n"), FormatP2P)
+	assert.Error(t, err)
+}
+
+func writeFile(t *testing.T, name, contents string) {
+	// Replace the file, as downloads tend to.
+	tmp := name + ".tmp"
+	require.NoError(t, ioutil.WriteFile(tmp, []byte(contents), 0644))
+	require.NoError(t, os.Rename(tmp, name))
+}
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	p2p := filepath.Join(dir, "level1.txt")
+	cidr := filepath.Join(dir, "cidr.txt")
+	writeFile(t, p2p, sample)
+	writeFile(t, cidr, "1.2.3.0/24\n2001:db8::/32\n")
+	bl, err := OpenBlocklist(Source{Path: p2p}, Source{Path: cidr, Format: FormatCIDR})
+	require.NoError(t, err)
+	defer bl.Close()
+	assert.EqualValues(t, 7, bl.NumRanges())
+
+	lookup := func(ip string) (Range, bool) {
+		return bl.Lookup(net.ParseIP(ip))
+	}
+	r, ok := lookup("1.2.4.1")
+	assert.True(t, ok)
+	assert.Equal(t, "a", r.Description)
+	r, ok = lookup("1.2.3.4")
+	assert.True(t, ok)
+	assert.True(t, r.First.Equal(net.IPv4(1, 2, 3, 0)))
+	_, ok = lookup("2001:db8::1")
+	assert.True(t, ok)
+	_, ok = lookup("1.2.5.1")
+	assert.False(t, ok)
+	lookup("1.2.4.2")
+	hits := bl.Hits()
+	require.Len(t, hits, 3)
+	assert.Equal(t, "a", hits[0].Description)
+	assert.EqualValues(t, 2, hits[0].Hits)
+	assert.Equal(t, p2p, hits[0].Source)
+
+	defer func(d time.Duration) { blocklistReloadDelay = d }(blocklistReloadDelay)
+	blocklistReloadDelay = 10 * time.Millisecond
+	require.NoError(t, bl.Watch())
+	writeFile(t, cidr, "1.2.5.0/24\n")
+	require.Eventually(t, func() bool {
+		_, ok := lookup("1.2.5.1")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok = lookup("1.2.3.4")
+	assert.False(t, ok)
+	// A bad list leaves the previous one in place.
+	writeFile(t, p2p, "junk\n")
+	time.Sleep(100 * time.Millisecond)
+	_, ok = lookup("1.2.4.1")
+	assert.True(t, ok)
+	// Hits for ranges that remain are kept.
+	require.NoError(t, bl.Close())
+	writeFile(t, p2p, sample+"\nz:5.6.7.8-5.6.7.8")
+	require.NoError(t, bl.Reload())
+	_, ok = lookup("5.6.7.8")
+	assert.True(t, ok)
+	hits = bl.Hits()
+	assert.Equal(t, "a", hits[0].Description)
+	assert.EqualValues(t, 3, hits[0].Hits)
+}
+
+func TestBlocklistOverlapping(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "level1.txt")
+	// Nested, and overlapping without nesting.
+	writeFile(t, path, `a:10.0.0.0-10.255.255.255
+b:10.1.0.0-10.1.255.255
+c:10.1.2.0-10.1.2.255
+d:10.3.0.0-10.3.255.255
+e:10.200.0.0-10.250.0.0
+f:10.255.0.0-10.255.255.255
+g:11.0.0.0-11.0.0.255
+h:11.0.0.128-11.0.1.255
+`)
+	bl, err := OpenBlocklist(Source{Path: path})
+	require.NoError(t, err)
+	defer bl.Close()
+	for _, tc := range []struct {
+		ip    string
+		first string
+	}{
+		{"10.2.0.1", "10.0.0.0"},
+		{"10.1.3.0", "10.0.0.0"},
+		{"10.1.2.3", "10.1.2.0"},
+		{"10.3.255.255", "10.3.0.0"},
+		{"10.251.0.0", "10.0.0.0"},
+		{"10.255.255.255", "10.255.0.0"},
+		{"11.0.0.200", "11.0.0.128"},
+		{"11.0.1.0", "11.0.0.128"},
+	} {
+		r, ok := bl.Lookup(net.ParseIP(tc.ip))
+		if assert.True(t, ok, tc.ip) {
+			assert.True(t, r.First.Equal(net.ParseIP(tc.first)), "%v in %v", tc.ip, r)
+		}
+	}
+	for _, ip := range []string{"9.255.255.255", "11.0.2.0"} {
+		_, ok := bl.Lookup(net.ParseIP(ip))
+		assert.False(t, ok, ip)
+	}
+}
@@ -9,20 +9,14 @@ import (
 func ParseCIDRListReader(r io.Reader) (ret []Range, err error) {
 	s := bufio.NewScanner(r)
 	for s.Scan() {
-		err = func() (err error) {
-			_, in, err := net.ParseCIDR(s.Text())
-			if err != nil {
-				return
-			}
-			ret = append(ret, Range{
-				First: in.IP,
-				Last:  IPNetLast(in),
-			})
-			return
-		}()
-		if err != nil {
+		r, ok, lineErr := ParseCIDRLine(s.Bytes())
+		if lineErr != nil {
+			err = lineErr
 			return
 		}
+		if ok {
+			ret = append(ret, r)
+		}
 	}
 	return
 }
@@ -0,0 +1,191 @@
+package iplist
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Format is a text blocklist format.
+type Format int
+
+const (
+	// Detected from the first line that isn't blank or a comment.
+	FormatAuto Format = iota
+	// The P2P plaintext format, as read by NewFromReader.
+	FormatP2P
+	// A CIDR, or a single IP, per line.
+	FormatCIDR
+	// eMule's ipfilter.dat.
+	FormatDAT
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatAuto:
+		return "auto"
+	case FormatP2P:
+		return "p2p"
+	case FormatCIDR:
+		return "cidr"
+	case FormatDAT:
+		return "dat"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+type lineParser func(l []byte) (r Range, ok bool, err error)
+
+func (f Format) lineParser() lineParser {
+	switch f {
+	case FormatP2P:
+		return ParseBlocklistP2PLine
+	case FormatCIDR:
+		return ParseCIDRLine
+	case FormatDAT:
+		return ParseDATLine
+	default:
+		return nil
+	}
+}
+
+// Picks the format that can parse the line, which isn't blank or a comment, trying the most
+// particular first.
+func detectFormat(l []byte) Format {
+	for _, f := range []Format{FormatDAT, FormatCIDR, FormatP2P} {
+		if _, _, err := f.lineParser()(l); err == nil {
+			return f
+		}
+	}
+	return FormatP2P
+}
+
+func isBlankOrComment(l []byte) bool {
+	l = bytes.TrimSpace(l)
+	return len(l) == 0 || l[0] == '#' || bytes.HasPrefix(l, []byte("//"))
+}
+
+// ReadRanges reads the ranges from a blocklist in the given format, decompressing it first if it's
+// gzipped. Ranges are in the order they're read.
+func ReadRanges(r io.Reader, f Format) (ret []Range, err error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		br = bufio.NewReader(gr)
+	}
+	parse := f.lineParser()
+	// There's a lot of similar descriptions, so they're shared.
+	uniqStrs := make(map[string]string)
+	scanner := bufio.NewScanner(br)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		l := scanner.Bytes()
+		if parse == nil {
+			if isBlankOrComment(l) {
+				continue
+			}
+			parse = detectFormat(l).lineParser()
+		}
+		r, ok, lineErr := parse(l)
+		if lineErr != nil {
+			err = fmt.Errorf("error parsing line %d: %s", lineNum, lineErr)
+			return
+		}
+		if !ok {
+			continue
+		}
+		if s, ok := uniqStrs[r.Description]; ok {
+			r.Description = s
+		} else {
+			uniqStrs[r.Description] = r.Description
+		}
+		ret = append(ret, r)
+	}
+	err = scanner.Err()
+	return
+}
+
+// Parses a line of a CIDR list. A lone IP is a range of one. Returns !ok but no error for blank and
+// comment lines.
+func ParseCIDRLine(l []byte) (r Range, ok bool, err error) {
+	if isBlankOrComment(l) {
+		return
+	}
+	s := string(bytes.TrimSpace(l))
+	if bytes.IndexByte(l, '/') == -1 {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			err = errors.New("bad IP")
+			return
+		}
+		minifyIP(&ip)
+		return Range{First: ip, Last: ip}, true, nil
+	}
+	_, in, err := net.ParseCIDR(s)
+	if err != nil {
+		return
+	}
+	return Range{First: in.IP, Last: IPNetLast(in)}, true, nil
+}
+
+// Parses a line of eMule's ipfilter.dat, "first - last , level , description". Ranges with an access
+// level above 127 are allowed by eMule, so they're skipped like blank and comment lines.
+func ParseDATLine(l []byte) (r Range, ok bool, err error) {
+	if isBlankOrComment(l) {
+		return
+	}
+	fields := bytes.SplitN(l, []byte(","), 3)
+	if len(fields) < 2 {
+		err = errors.New("missing access level")
+		return
+	}
+	ips := bytes.SplitN(fields[0], []byte("-"), 2)
+	if len(ips) != 2 {
+		err = errors.New("missing hyphen")
+		return
+	}
+	r.First = parseDATIP(bytes.TrimSpace(ips[0]))
+	r.Last = parseDATIP(bytes.TrimSpace(ips[1]))
+	if r.First == nil || r.Last == nil {
+		err = errors.New("bad IP range")
+		return
+	}
+	level, err := strconv.Atoi(string(bytes.TrimSpace(fields[1])))
+	if err != nil {
+		err = fmt.Errorf("bad access level: %w", err)
+		return
+	}
+	if len(fields) == 3 {
+		r.Description = string(bytes.TrimSpace(fields[2]))
+	}
+	ok = level <= 127
+	return
+}
+
+// DAT files zero pad the octets of IPv4 addresses, which net.ParseIP doesn't allow.
+func parseDATIP(b []byte) net.IP {
+	octets := bytes.Split(b, []byte("."))
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, o := range octets {
+		n, err := strconv.ParseUint(string(o), 10, 8)
+		if err != nil {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
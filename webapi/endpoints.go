@@ -0,0 +1,436 @@
+package webapi
+
+import (
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"testTorrent/crawler"
+	"testTorrent/dht"
+	"testTorrent/dht/krpc"
+	"testTorrent/index"
+	"testTorrent/torrent/metainfo"
+)
+
+type nodeJSON struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+func nodeView(ni krpc.NodeInfo) nodeJSON {
+	return nodeJSON{ID: hex.EncodeToString(ni.ID[:]), Addr: ni.Addr.String()}
+}
+
+type serverJSON struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+func serverView(s *dht.Server) serverJSON {
+	id := s.ID()
+	return serverJSON{ID: hex.EncodeToString(id[:]), Addr: s.Addr().String()}
+}
+
+type serverStatsJSON struct {
+	serverJSON
+	GoodNodes                int   `json:"goodNodes"`
+	Nodes                    int   `json:"nodes"`
+	BadNodes                 uint  `json:"badNodes"`
+	OutstandingTransactions  int   `json:"outstandingTransactions"`
+	OutboundQueriesAttempted int64 `json:"outboundQueriesAttempted"`
+	SuccessfulAnnounces      int64 `json:"successfulAnnounces"`
+}
+
+type crawlerStatsJSON struct {
+	Sightings  int64 `json:"sightings"`
+	Dropped    int64 `json:"dropped"`
+	SinkErrors int64 `json:"sinkErrors"`
+	InfoHashes int   `json:"infoHashes"`
+}
+
+type indexStatsJSON struct {
+	Torrents int64 `json:"torrents"`
+	Resolved int64 `json:"resolved"`
+}
+
+type statsJSON struct {
+	Time    time.Time         `json:"time"`
+	Servers []serverStatsJSON `json:"servers"`
+	Crawler *crawlerStatsJSON `json:"crawler,omitempty"`
+	Index   *indexStatsJSON   `json:"index,omitempty"`
+}
+
+func (h *Handler) stats(*http.Request) (interface{}, error) {
+	ret := statsJSON{Time: time.Now(), Servers: []serverStatsJSON{}}
+	for _, s := range h.config.Servers {
+		st := s.Stats()
+		ret.Servers = append(ret.Servers, serverStatsJSON{
+			serverJSON:               serverView(s),
+			GoodNodes:                st.GoodNodes,
+			Nodes:                    st.Nodes,
+			BadNodes:                 st.BadNodes,
+			OutstandingTransactions:  st.OutstandingTransactions,
+			OutboundQueriesAttempted: st.OutboundQueriesAttempted,
+			SuccessfulAnnounces:      st.SuccessfulOutboundAnnouncePeerQueries,
+		})
+	}
+	if cr := h.config.Crawler; cr != nil {
+		st := cr.Stats()
+		ret.Crawler = &crawlerStatsJSON{
+			Sightings:  st.Sightings,
+			Dropped:    st.Dropped,
+			SinkErrors: st.SinkErrors,
+			InfoHashes: st.InfoHashes,
+		}
+	}
+	if ix := h.config.Index; ix != nil {
+		total, resolved, err := ix.Count()
+		if err != nil {
+			return nil, err
+		}
+		ret.Index = &indexStatsJSON{Torrents: total, Resolved: resolved}
+	}
+	return ret, nil
+}
+
+type bucketJSON struct {
+	Bucket       int `json:"bucket"`
+	Nodes        int `json:"nodes"`
+	Good         int `json:"good"`
+	Questionable int `json:"questionable"`
+	Bad          int `json:"bad"`
+	Secure       int `json:"secure"`
+}
+
+type tableJSON struct {
+	serverJSON
+	// Only buckets with nodes.
+	Buckets []bucketJSON `json:"buckets"`
+}
+
+func (h *Handler) table(*http.Request) (interface{}, error) {
+	ret := []tableJSON{}
+	for _, s := range h.config.Servers {
+		t := tableJSON{serverJSON: serverView(s), Buckets: []bucketJSON{}}
+		for _, ns := range s.NodeStatuses() {
+			if len(t.Buckets) == 0 || t.Buckets[len(t.Buckets)-1].Bucket != ns.Bucket {
+				t.Buckets = append(t.Buckets, bucketJSON{Bucket: ns.Bucket})
+			}
+			b := &t.Buckets[len(t.Buckets)-1]
+			b.Nodes++
+			for _, c := range []struct {
+				flag  bool
+				count *int
+			}{
+				{ns.Good, &b.Good},
+				{ns.Questionable, &b.Questionable},
+				{ns.Bad, &b.Bad},
+				{ns.Secure, &b.Secure},
+			} {
+				if c.flag {
+					*c.count++
+				}
+			}
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+type recordJSON struct {
+	InfoHash     metainfo.Hash `json:"infohash"`
+	FirstSeen    time.Time     `json:"firstSeen"`
+	LastSeen     time.Time     `json:"lastSeen"`
+	GetPeers     int64         `json:"getPeers"`
+	AnnouncePeer int64         `json:"announcePeer"`
+	LastSource   nodeJSON      `json:"lastSource"`
+	LastPort     int           `json:"lastPort,omitempty"`
+}
+
+func recordView(r crawler.Record) recordJSON {
+	return recordJSON{
+		InfoHash:     r.InfoHash,
+		FirstSeen:    r.FirstSeen,
+		LastSeen:     r.LastSeen,
+		GetPeers:     r.GetPeers,
+		AnnouncePeer: r.AnnouncePeer,
+		LastSource:   nodeView(r.LastSource),
+		LastPort:     r.LastPort,
+	}
+}
+
+func (h *Handler) recent(r *http.Request) (interface{}, error) {
+	if h.config.Crawler == nil {
+		return nil, errNoCrawler
+	}
+	n, err := intParam(r, "n", 50)
+	if err != nil {
+		return nil, err
+	}
+	if n > 1000 {
+		n = 1000
+	}
+	ret := []recordJSON{}
+	for _, rec := range h.config.Crawler.Recent(n) {
+		ret = append(ret, recordView(rec))
+	}
+	return ret, nil
+}
+
+type fileJSON struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+type torrentJSON struct {
+	InfoHash  metainfo.Hash `json:"infohash"`
+	Name      string        `json:"name,omitempty"`
+	Length    int64         `json:"length,omitempty"`
+	NumFiles  int           `json:"numFiles,omitempty"`
+	Resolved  *time.Time    `json:"resolved,omitempty"`
+	FirstSeen time.Time     `json:"firstSeen"`
+	LastSeen  time.Time     `json:"lastSeen"`
+	Announces int64         `json:"announces"`
+	Peers     int64         `json:"peers"`
+	Files     []fileJSON    `json:"files,omitempty"`
+}
+
+func torrentView(t index.Torrent) torrentJSON {
+	ret := torrentJSON{
+		InfoHash:  t.InfoHash,
+		Name:      t.Name,
+		Length:    t.Length,
+		NumFiles:  t.NumFiles,
+		FirstSeen: t.FirstSeen,
+		LastSeen:  t.LastSeen,
+		Announces: t.Announces,
+		Peers:     t.Peers,
+	}
+	if !t.Resolved.IsZero() {
+		ret.Resolved = &t.Resolved
+	}
+	for _, f := range t.Files {
+		ret.Files = append(ret.Files, fileJSON{f.Path, f.Length})
+	}
+	return ret
+}
+
+// What's known about an infohash. Either part can be missing.
+type lookupJSON struct {
+	// From the crawler's memory.
+	Record *recordJSON `json:"record,omitempty"`
+	// From the index.
+	Torrent *torrentJSON `json:"torrent,omitempty"`
+}
+
+func (h *Handler) torrent(r *http.Request) (interface{}, error) {
+	s := strings.TrimPrefix(r.URL.Path, "/api/torrent/")
+	var ih metainfo.Hash
+	if err := ih.FromHexString(s); err != nil {
+		return nil, badRequest("bad infohash %q", s)
+	}
+	if h.config.Crawler == nil && h.config.Index == nil {
+		return nil, errNoIndex
+	}
+	var ret lookupJSON
+	if cr := h.config.Crawler; cr != nil {
+		if rec, ok := cr.Record(ih); ok {
+			rv := recordView(rec)
+			ret.Record = &rv
+		}
+	}
+	if ix := h.config.Index; ix != nil {
+		t, ok, err := ix.Get(ih)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			tv := torrentView(t)
+			ret.Torrent = &tv
+		}
+	}
+	if ret.Record == nil && ret.Torrent == nil {
+		return nil, notFound("infohash %v not seen", ih)
+	}
+	return ret, nil
+}
+
+// Searches the index. Parameters are q for words to match, minSize and maxSize in bytes or with
+// units like "700MB", ext for file extensions (repeated or comma separated), after and before as
+// dates or RFC 3339 times, limit (at most 500) and offset.
+func (h *Handler) search(r *http.Request) (interface{}, error) {
+	if h.config.Index == nil {
+		return nil, errNoIndex
+	}
+	vs := r.URL.Query()
+	q := index.Query{Terms: vs["q"]}
+	for _, b := range []struct {
+		name string
+		v    *int64
+	}{
+		{"minSize", &q.MinLength},
+		{"maxSize", &q.MaxLength},
+	} {
+		if s := vs.Get(b.name); s != "" {
+			n, err := humanize.ParseBytes(s)
+			if err != nil {
+				return nil, badRequest("bad %s: %q", b.name, s)
+			}
+			*b.v = int64(n)
+		}
+	}
+	for _, ext := range vs["ext"] {
+		for _, e := range strings.Split(ext, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				q.Extensions = append(q.Extensions, e)
+			}
+		}
+	}
+	var err error
+	if q.SeenAfter, err = timeParam(r, "after"); err != nil {
+		return nil, err
+	}
+	if q.SeenBefore, err = timeParam(r, "before"); err != nil {
+		return nil, err
+	}
+	if q.Limit, err = intParam(r, "limit", 50); err != nil {
+		return nil, err
+	}
+	if q.Limit > 500 {
+		q.Limit = 500
+	}
+	if q.Offset, err = intParam(r, "offset", 0); err != nil {
+		return nil, err
+	}
+	ts, err := h.config.Index.Search(q)
+	if err != nil {
+		return nil, err
+	}
+	ret := []torrentJSON{}
+	for _, t := range ts {
+		ret = append(ret, torrentView(t))
+	}
+	return ret, nil
+}
+
+type countsJSON struct {
+	Sent     uint16 `json:"sent"`
+	Replies  uint16 `json:"replies"`
+	Received uint16 `json:"received"`
+}
+
+type nodeSummaryJSON struct {
+	nodeJSON
+	// Local address of the server that communicated with the node.
+	Server      string     `json:"server"`
+	FirstHour   time.Time  `json:"firstHour"`
+	LastHour    time.Time  `json:"lastHour"`
+	ActiveHours int64      `json:"activeHours"`
+	ReplyRate   float64    `json:"replyRate"`
+	Total       countsJSON `json:"total"`
+}
+
+// Summarizes a node's communication record. ok is false if the record is empty.
+func nodeSummary(s *dht.Server, ni krpc.NodeInfo, cr dht.CommunicationRecord) (ret nodeSummaryJSON, ok bool) {
+	first, last, ok := cr.Span()
+	if !ok {
+		return
+	}
+	t := cr.Total(first, last.Add(time.Hour))
+	return nodeSummaryJSON{
+		nodeJSON:    nodeView(ni),
+		Server:      s.Addr().String(),
+		FirstHour:   first,
+		LastHour:    last,
+		ActiveHours: cr.ActiveHours(),
+		ReplyRate:   cr.ReplyRate(),
+		Total:       countsJSON{t.Sent, t.Replies, t.Received},
+	}, true
+}
+
+func (h *Handler) nodes(r *http.Request) (interface{}, error) {
+	n, err := intParam(r, "n", 100)
+	if err != nil {
+		return nil, err
+	}
+	ret := []nodeSummaryJSON{}
+	for _, s := range h.config.Servers {
+		for _, nc := range s.CommunicationRecords() {
+			if sum, ok := nodeSummary(s, nc.NodeInfo, nc.CommunicationRecord); ok {
+				ret = append(ret, sum)
+			}
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if !ret[i].LastHour.Equal(ret[j].LastHour) {
+			return ret[i].LastHour.After(ret[j].LastHour)
+		}
+		return ret[i].ActiveHours > ret[j].ActiveHours
+	})
+	if len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret, nil
+}
+
+type hourJSON struct {
+	Hour time.Time `json:"hour"`
+	countsJSON
+}
+
+type nodeHistoryJSON struct {
+	nodeSummaryJSON
+	Hours []hourJSON `json:"hours"`
+}
+
+// Returns the hourly history of the node with the given addr and id, over the last hours (default
+// 48, at most a year).
+func (h *Handler) node(r *http.Request) (interface{}, error) {
+	vs := r.URL.Query()
+	var ni krpc.NodeInfo
+	host, portStr, err := net.SplitHostPort(vs.Get("addr"))
+	port, portErr := strconv.ParseUint(portStr, 10, 16)
+	ni.Addr.IP = net.ParseIP(host)
+	if err != nil || portErr != nil || ni.Addr.IP == nil {
+		return nil, badRequest("bad addr %q", vs.Get("addr"))
+	}
+	ni.Addr.Port = int(port)
+	if ip4 := ni.Addr.IP.To4(); ip4 != nil {
+		ni.Addr.IP = ip4
+	}
+	id, err := hex.DecodeString(vs.Get("id"))
+	if err != nil || len(id) != len(ni.ID) {
+		return nil, badRequest("bad id %q", vs.Get("id"))
+	}
+	copy(ni.ID[:], id)
+	hours, err := intParam(r, "hours", 48)
+	if err != nil {
+		return nil, err
+	}
+	if hours > 24*366 {
+		hours = 24 * 366
+	}
+	for _, s := range h.config.Servers {
+		cr, ok := s.NodeCommunicationRecord(ni)
+		if !ok {
+			continue
+		}
+		sum, ok := nodeSummary(s, ni, cr)
+		if !ok {
+			sum = nodeSummaryJSON{nodeJSON: nodeView(ni), Server: s.Addr().String()}
+		}
+		ret := nodeHistoryJSON{nodeSummaryJSON: sum, Hours: []hourJSON{}}
+		now := time.Now()
+		for _, hc := range cr.Hours(now.Add(-time.Duration(hours)*time.Hour), now) {
+			ret.Hours = append(ret.Hours, hourJSON{hc.Hour, countsJSON{hc.Sent, hc.Replies, hc.Received}})
+		}
+		return ret, nil
+	}
+	return nil, notFound("no communication with node")
+}
@@ -0,0 +1,174 @@
+// Package webapi serves a crawl's collected data over HTTP as JSON, along with a small embedded web
+// page for browsing it.
+//
+// Endpoints, all GET:
+//
+//	/                      the web page
+//	/api/stats             counters for the crawler, each DHT server, and the index
+//	/api/table             routing table occupancy per bucket for each DHT server
+//	/api/recent?n=         infohashes most recently seen by the crawler
+//	/api/torrent/<hash>    what's known about an infohash, including its files if resolved
+//	/api/search?q=         search resolved torrents, also filtered by minSize, maxSize, ext, after and before
+//	/api/nodes?n=          communication summaries for nodes seen in the last week, most recently active first
+//	/api/node?addr=&id=    hourly communication history for a node
+//
+// Errors are returned as {"error": "..."} with an appropriate status code.
+package webapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"testTorrent/crawler"
+	"testTorrent/dht"
+	"testTorrent/index"
+	"testTorrent/torrent/metainfo"
+)
+
+//go:embed ui.html
+var uiHTML []byte
+
+// Index is the subset of *index.Index used by the API. It's an interface so the API can be built
+// without cgo.
+type Index interface {
+	Get(metainfo.Hash) (index.Torrent, bool, error)
+	Search(index.Query) ([]index.Torrent, error)
+	Count() (total, resolved int64, err error)
+}
+
+// Config selects what the API serves. Endpoints whose source is missing respond with 404.
+type Config struct {
+	// DHT servers to report on. If there's a Crawler, its servers are used instead.
+	Servers []*dht.Server
+	Crawler *crawler.Crawler
+	Index   Index
+}
+
+// Handler serves the API and web page.
+type Handler struct {
+	config Config
+	mux    *http.ServeMux
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+func New(c Config) *Handler {
+	if c.Crawler != nil {
+		c.Servers = c.Crawler.Servers()
+	}
+	h := &Handler{config: c, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/", serveUI)
+	h.handle("/api/stats", h.stats)
+	h.handle("/api/table", h.table)
+	h.handle("/api/recent", h.recent)
+	h.handle("/api/torrent/", h.torrent)
+	h.handle("/api/search", h.search)
+	h.handle("/api/nodes", h.nodes)
+	h.handle("/api/node", h.node)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func serveUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(uiHTML)
+}
+
+// An error with an HTTP status code.
+type httpError struct {
+	code int
+	err  error
+}
+
+func (me httpError) Error() string {
+	return me.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return httpError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return httpError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
+var (
+	errNoCrawler = notFound("not crawling")
+	errNoIndex   = notFound("no index")
+)
+
+// Registers an endpoint whose result is encoded as JSON.
+func (h *Handler) handle(pattern string, f func(r *http.Request) (interface{}, error)) {
+	h.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeJSON(w, http.StatusMethodNotAllowed, errorBody{"method not allowed"})
+			return
+		}
+		ret, err := f(r)
+		if err != nil {
+			code := http.StatusInternalServerError
+			var he httpError
+			if errors.As(err, &he) {
+				code = he.code
+			}
+			writeJSON(w, code, errorBody{err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, ret)
+	})
+}
+
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Parses an optional non-negative integer query parameter.
+func intParam(r *http.Request, name string, def int) (int, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, badRequest("bad %s: %q", name, s)
+	}
+	return i, nil
+}
+
+// Parses an optional time query parameter, as a date or RFC 3339 time.
+func timeParam(r *http.Request, name string) (time.Time, error) {
+	s := r.URL.Query().Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, badRequest("bad %s: %q", name, s)
+	}
+	return t, nil
+}
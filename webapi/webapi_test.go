@@ -0,0 +1,165 @@
+package webapi
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"testTorrent/crawler"
+	"testTorrent/dht"
+	"testTorrent/dht/int160"
+	"testTorrent/index"
+	"testTorrent/torrent/metainfo"
+)
+
+type testIndex struct {
+	torrents []index.Torrent
+	queries  []index.Query
+}
+
+func (me *testIndex) Get(ih metainfo.Hash) (index.Torrent, bool, error) {
+	for _, t := range me.torrents {
+		if t.InfoHash == ih {
+			return t, true, nil
+		}
+	}
+	return index.Torrent{}, false, nil
+}
+
+func (me *testIndex) Search(q index.Query) ([]index.Torrent, error) {
+	me.queries = append(me.queries, q)
+	return me.torrents, nil
+}
+
+func (me *testIndex) Count() (total, resolved int64, err error) {
+	return int64(len(me.torrents)), int64(len(me.torrents)), nil
+}
+
+func getJSON(t *testing.T, h http.Handler, path string, code int, v interface{}) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	require.Equal(t, code, w.Code, w.Body.String())
+	if v != nil {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	sighted := make(chan struct{}, 1)
+	cr, err := crawler.New(&crawler.Config{
+		Addrs:       []string{"127.0.0.1:0"},
+		NoBootstrap: true,
+		Sinks: []crawler.Sink{crawler.FuncSink(func(crawler.Sighting) error {
+			sighted <- struct{}{}
+			return nil
+		})},
+	})
+	require.NoError(t, err)
+	defer cr.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	client, err := dht.NewServer(&dht.ServerConfig{Conn: pc, NoSecurity: true})
+	require.NoError(t, err)
+	defer client.Close()
+	ih := metainfo.NewHashFromHex("64a980abe6e448226bb930ba061592e44c3781a1")
+	res := client.GetPeers(context.Background(), dht.NewAddr(cr.Servers()[0].Addr()), int160.FromByteArray(ih), false, dht.QueryRateLimiting{})
+	require.NoError(t, res.Err)
+	select {
+	case <-sighted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for sighting")
+	}
+	ix := &testIndex{torrents: []index.Torrent{{
+		InfoHash: ih,
+		Name:     "ubuntu.iso",
+		Length:   3 << 30,
+		NumFiles: 1,
+		Resolved: time.Now(),
+		Files:    []index.File{{Path: "ubuntu.iso", Length: 3 << 30}},
+	}}}
+	h := New(Config{Crawler: cr, Index: ix})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "<html>")
+
+	var stats statsJSON
+	getJSON(t, h, "/api/stats", http.StatusOK, &stats)
+	require.Len(t, stats.Servers, 1)
+	assert.Equal(t, 1, stats.Servers[0].Nodes)
+	assert.EqualValues(t, 1, stats.Crawler.Sightings)
+	assert.EqualValues(t, 1, stats.Index.Resolved)
+
+	var table []tableJSON
+	getJSON(t, h, "/api/table", http.StatusOK, &table)
+	require.Len(t, table, 1)
+	require.Len(t, table[0].Buckets, 1)
+	assert.Equal(t, 1, table[0].Buckets[0].Nodes)
+
+	var recent []recordJSON
+	getJSON(t, h, "/api/recent?n=10", http.StatusOK, &recent)
+	require.Len(t, recent, 1)
+	assert.Equal(t, ih, recent[0].InfoHash)
+	assert.EqualValues(t, 1, recent[0].GetPeers)
+	getJSON(t, h, "/api/recent?n=-1", http.StatusBadRequest, nil)
+
+	var lookup lookupJSON
+	getJSON(t, h, "/api/torrent/"+ih.HexString(), http.StatusOK, &lookup)
+	require.NotNil(t, lookup.Record)
+	require.NotNil(t, lookup.Torrent)
+	assert.Equal(t, "ubuntu.iso", lookup.Torrent.Name)
+	assert.Len(t, lookup.Torrent.Files, 1)
+	getJSON(t, h, "/api/torrent/"+metainfo.Hash{}.HexString(), http.StatusNotFound, nil)
+	getJSON(t, h, "/api/torrent/nope", http.StatusBadRequest, nil)
+
+	var found []torrentJSON
+	getJSON(t, h, "/api/search?q=ubuntu&minSize=1GB&ext=iso,img&ext=mkv&after=2021-09-01", http.StatusOK, &found)
+	assert.Len(t, found, 1)
+	require.Len(t, ix.queries, 1)
+	q := ix.queries[0]
+	assert.Equal(t, []string{"ubuntu"}, q.Terms)
+	assert.EqualValues(t, 1000*1000*1000, q.MinLength)
+	assert.Equal(t, []string{"iso", "img", "mkv"}, q.Extensions)
+	assert.Equal(t, 2021, q.SeenAfter.Year())
+	getJSON(t, h, "/api/search?minSize=lots", http.StatusBadRequest, nil)
+
+	var nodes []nodeSummaryJSON
+	getJSON(t, h, "/api/nodes", http.StatusOK, &nodes)
+	require.Len(t, nodes, 1)
+	clientID := client.ID()
+	assert.Equal(t, hex.EncodeToString(clientID[:]), nodes[0].ID)
+	assert.EqualValues(t, 1, nodes[0].Total.Received)
+
+	var history nodeHistoryJSON
+	getJSON(t, h, "/api/node?"+url.Values{"addr": {nodes[0].Addr}, "id": {nodes[0].ID}}.Encode(), http.StatusOK, &history)
+	require.Len(t, history.Hours, 1)
+	assert.EqualValues(t, 1, history.Hours[0].Received)
+	getJSON(t, h, "/api/node?addr=1.2.3.4:5&id="+nodes[0].ID, http.StatusNotFound, nil)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/stats", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestHandlerWithoutCrawler(t *testing.T) {
+	h := New(Config{})
+	var stats statsJSON
+	getJSON(t, h, "/api/stats", http.StatusOK, &stats)
+	assert.Empty(t, stats.Servers)
+	assert.Nil(t, stats.Crawler)
+	assert.Nil(t, stats.Index)
+	getJSON(t, h, "/api/recent", http.StatusNotFound, nil)
+	getJSON(t, h, "/api/search?q=x", http.StatusNotFound, nil)
+	getJSON(t, h, "/api/torrent/"+metainfo.Hash{}.HexString(), http.StatusNotFound, nil)
+}